@@ -9,6 +9,8 @@ type Config struct {
 	ReadlineBurst       int     `yaml:"readline_burst" json:"readline_burst"`
 	ReadlineRateEnabled bool    `yaml:"readline_rate_enabled,omitempty"  json:"readline_rate_enabled"`
 	ReadlineRateDrop    bool    `yaml:"readline_rate_drop,omitempty"  json:"readline_rate_drop"`
+	// MaxCloudflareConcurrency caps the in-flight Cloudflare API calls across all targets.
+	MaxCloudflareConcurrency int `yaml:"max_cloudflare_concurrency,omitempty" json:"max_cloudflare_concurrency"`
 }
 
 func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
@@ -16,4 +18,5 @@ func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	f.IntVar(&cfg.ReadlineBurst, prefix+"limit.readline-burst", 10000, "promtail readline Burst.")
 	f.BoolVar(&cfg.ReadlineRateEnabled, prefix+"limit.readline-rate-enabled", false, "Set to false to disable readline rate limit.")
 	f.BoolVar(&cfg.ReadlineRateDrop, prefix+"limit.readline-rate-drop", true, "Set to true to drop log when rate limit.")
+	f.IntVar(&cfg.MaxCloudflareConcurrency, prefix+"limit.max-cloudflare-concurrency", 0, "Maximum number of concurrent Cloudflare API calls across all targets, 0 means no limit.")
 }
@@ -75,7 +75,7 @@ func New(cfg config.Config, dryRun bool, opts ...Option) (*Promtail, error) {
 		}
 	}
 
-	tms, err := targets.NewTargetManagers(promtail, promtail.reg, promtail.logger, cfg.PositionsConfig, promtail.client, cfg.ScrapeConfig, &cfg.TargetConfig)
+	tms, err := targets.NewTargetManagers(promtail, promtail.reg, promtail.logger, cfg.PositionsConfig, promtail.client, cfg.ScrapeConfig, &cfg.TargetConfig, &cfg.LimitConfig)
 	if err != nil {
 		return nil, err
 	}
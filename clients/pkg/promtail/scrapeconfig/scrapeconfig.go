@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/grafana/dskit/backoff"
 	"github.com/grafana/dskit/flagext"
 
 	promconfig "github.com/prometheus/common/config"
@@ -321,6 +322,9 @@ type CloudflareConfig struct {
 	Workers int `yaml:"workers"`
 	// The timerange to fetch for each pull request that will be spread across workers. Default 1m.
 	PullRange model.Duration `yaml:"pull_range"`
+	// MaxPullRange caps PullRange, larger values are clamped to it. Default 1h, as the Logpull API serves
+	// at most one hour of logs per request. It can't exceed the 7 days logs retention.
+	MaxPullRange model.Duration `yaml:"max_pull_range"`
 	// Fields to fetch from cloudflare logs.
 	// Default to default fields.
 	// Available fields type:
@@ -329,6 +333,76 @@ type CloudflareConfig struct {
 	// - extended
 	// - all
 	FieldsType string `yaml:"fields_type"`
+	// FieldsTypeLabel optionally is the name of a label holding the FieldsType of each entry.
+	// Default to empty, which doesn't add any label.
+	FieldsTypeLabel string `yaml:"fields_type_label"`
+	// BackoffConfig configures the retries of each pull request.
+	// Unset fields default to a min period of 1s, a max period of 10s and 5 retries.
+	BackoffConfig backoff.Config `yaml:"backoff_config"`
+	// StartAt is where to start pulling logs from when no position is saved for the zone.
+	// Either a RFC3339 timestamp or a duration before now. Default to now.
+	StartAt *TimeOrDuration `yaml:"start_at"`
+	// API is the Cloudflare API to pull logs from, either logpull or graphql. Default to logpull.
+	// With graphql, a fixed set of fields is fetched and FieldsType is ignored.
+	API string `yaml:"api"`
+	// APIBaseURL is the base URL of the Cloudflare API, e.g. to use a mock server in tests.
+	// Default to https://api.cloudflare.com/client/v4.
+	APIBaseURL string `yaml:"api_base_url"`
+	// DropInvalidTimestamps drops the lines without a valid timestamp,
+	// instead of sending them with the current time. Default to false.
+	DropInvalidTimestamps bool `yaml:"drop_invalid_timestamps"`
+	// SendTimeout fails the pull, which is then retried, when an entry can't be sent to the pipeline
+	// within it. Default to 0, which waits for the pipeline indefinitely.
+	SendTimeout model.Duration `yaml:"send_timeout"`
+	// TimestampField is the fetched field holding the timestamp of the entries, either as nanoseconds
+	// since the epoch or as a RFC3339 string. Default to EdgeStartTimestamp.
+	TimestampField string `yaml:"timestamp_field"`
+}
+
+// TimeOrDuration is either a RFC3339 timestamp or a duration before now, such as "24h".
+type TimeOrDuration struct {
+	Time *time.Time
+	Dur  *model.Duration
+}
+
+// At returns the time represented relatively to now.
+func (t TimeOrDuration) At(now time.Time) time.Time {
+	switch {
+	case t.Time != nil:
+		return *t.Time
+	case t.Dur != nil:
+		return now.Add(-time.Duration(*t.Dur))
+	}
+	return now
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (t *TimeOrDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if ts, err := time.Parse(time.RFC3339, s); err == nil {
+		t.Time = &ts
+		return nil
+	}
+	dur, err := model.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is neither a RFC3339 timestamp nor a duration", s)
+	}
+	t.Dur = &dur
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (t TimeOrDuration) MarshalYAML() (interface{}, error) {
+	switch {
+	case t.Time != nil:
+		return t.Time.Format(time.RFC3339), nil
+	case t.Dur != nil:
+		return t.Dur.String(), nil
+	}
+	return nil, nil
 }
 
 // GcplogTargetConfig describes a scrape config to pull logs from any pubsub topic.
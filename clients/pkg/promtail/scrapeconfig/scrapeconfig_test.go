@@ -2,6 +2,7 @@ package scrapeconfig
 
 import (
 	"testing"
+	"time"
 
 	promConfig "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
@@ -141,3 +142,25 @@ func TestLoadConfig(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestCloudflareStartAt(t *testing.T) {
+	now := time.Date(2021, 11, 10, 12, 0, 0, 0, time.UTC)
+
+	var config CloudflareConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`start_at: 24h`), &config))
+	require.Equal(t, now.Add(-24*time.Hour), config.StartAt.At(now))
+
+	config = CloudflareConfig{}
+	require.NoError(t, yaml.Unmarshal([]byte(`start_at: 2021-11-09T10:00:00Z`), &config))
+	require.Equal(t, time.Date(2021, 11, 9, 10, 0, 0, 0, time.UTC), config.StartAt.At(now))
+
+	out, err := yaml.Marshal(config)
+	require.NoError(t, err)
+	require.Contains(t, string(out), "start_at: \"2021-11-09T10:00:00Z\"")
+
+	config = CloudflareConfig{}
+	require.NoError(t, yaml.Unmarshal([]byte(`zone_id: foo`), &config))
+	require.Nil(t, config.StartAt)
+
+	require.Error(t, yaml.Unmarshal([]byte(`start_at: yesterday`), &config))
+}
@@ -24,8 +24,11 @@ func (w *wrappedClient) LogpullReceived(ctx context.Context, start, end time.Tim
 	})
 }
 
-var getClient = func(apiKey, zoneID string, fields []string) (Client, error) {
-	c, err := cloudflare.NewWithAPIToken(apiKey)
+// getClient creates the logpull clients, it is overridden in tests.
+var getClient = newClient
+
+func newClient(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+	c, err := cloudflare.NewWithAPIToken(apiKey, cloudflare.BaseURL(baseURL))
 	if err != nil {
 		return nil, err
 	}
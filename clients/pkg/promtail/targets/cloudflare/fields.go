@@ -34,6 +34,12 @@ var (
 	}...)
 )
 
+// graphqlFields are the fields of the entries pulled with the GraphQL API, whatever the fields type.
+var graphqlFields = []string{
+	"EdgeStartTimestamp", "RayID", "ClientIP", "ClientCountry", "ClientRequestHost", "ClientRequestMethod", "ClientRequestPath",
+	"ClientRequestURI", "ClientRequestUserAgent", "EdgeColoCode", "CacheCacheStatus", "EdgeResponseBytes", "EdgeResponseStatus",
+}
+
 func Fields(t FieldsType) ([]string, error) {
 	switch t {
 	case FieldsTypeDefault:
@@ -48,3 +54,12 @@ func Fields(t FieldsType) ([]string, error) {
 		return nil, fmt.Errorf("unknown fields type: %s", t)
 	}
 }
+
+func hasField(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+const (
+	graphqlPageSize = 1000
+	graphqlTimeout  = 30 * time.Second
+)
+
+// errGraphQLPagingStalled is returned when a page doesn't start after the previous one, paging would never end.
+var errGraphQLPagingStalled = errors.New("cloudflare graphql page doesn't start after the previous one")
+
+// graphqlQuery fetches a page of requests of a zone, ordered by time then ray.
+// The GraphQL API has no cursor, pages start after the time and ray of the last request of the previous page,
+// as the times have a second precision.
+const graphqlQuery = `query ($zoneTag: string, $filter: ZoneHttpRequestsAdaptiveFilter_InputObject, $limit: uint64!) {
+  viewer {
+    zones(filter: {zoneTag: $zoneTag}) {
+      httpRequestsAdaptive(filter: $filter, limit: $limit, orderBy: [datetime_ASC, rayName_ASC]) {
+        datetime
+        rayName
+        clientIP
+        clientCountryName
+        clientRequestHTTPHost
+        clientRequestHTTPMethodName
+        clientRequestPath
+        clientRequestQuery
+        userAgent
+        coloCode
+        cacheStatus
+        edgeResponseBytes
+        edgeResponseStatus
+      }
+    }
+  }
+}`
+
+// graphqlClient pulls logs from the Cloudflare GraphQL Analytics API, for accounts which can't use the logpull API.
+type graphqlClient struct {
+	client   *http.Client
+	endpoint string
+	token    string
+	zoneID   string
+	pageSize int
+}
+
+func newGraphQLClient(baseURL, apiToken, zoneID string) *graphqlClient {
+	return &graphqlClient{
+		client:   &http.Client{Timeout: graphqlTimeout},
+		endpoint: strings.TrimSuffix(baseURL, "/") + "/graphql",
+		token:    apiToken,
+		zoneID:   zoneID,
+		pageSize: graphqlPageSize,
+	}
+}
+
+// LogpullReceived returns an iterator over the requests between start and end.
+// The first page is fetched right away so that API errors are returned here.
+func (c *graphqlClient) LogpullReceived(ctx context.Context, start, end time.Time) (cloudflare.LogpullReceivedIterator, error) {
+	it := &graphqlIterator{
+		ctx:    ctx,
+		client: c,
+		start:  start,
+		end:    end,
+	}
+	if err := it.fetch(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+type graphqlRequest struct {
+	Datetime                    time.Time `json:"datetime"`
+	RayName                     string    `json:"rayName"`
+	ClientIP                    string    `json:"clientIP"`
+	ClientCountryName           string    `json:"clientCountryName"`
+	ClientRequestHTTPHost       string    `json:"clientRequestHTTPHost"`
+	ClientRequestHTTPMethodName string    `json:"clientRequestHTTPMethodName"`
+	ClientRequestPath           string    `json:"clientRequestPath"`
+	ClientRequestQuery          string    `json:"clientRequestQuery"`
+	UserAgent                   string    `json:"userAgent"`
+	ColoCode                    string    `json:"coloCode"`
+	CacheStatus                 string    `json:"cacheStatus"`
+	EdgeResponseBytes           int64     `json:"edgeResponseBytes"`
+	EdgeResponseStatus          int       `json:"edgeResponseStatus"`
+}
+
+// logpullLine is a GraphQL request using the logpull field names, so entries have the same shape with both APIs.
+type logpullLine struct {
+	EdgeStartTimestamp     int64  `json:"EdgeStartTimestamp"`
+	RayID                  string `json:"RayID"`
+	ClientIP               string `json:"ClientIP"`
+	ClientCountry          string `json:"ClientCountry"`
+	ClientRequestHost      string `json:"ClientRequestHost"`
+	ClientRequestMethod    string `json:"ClientRequestMethod"`
+	ClientRequestPath      string `json:"ClientRequestPath"`
+	ClientRequestURI       string `json:"ClientRequestURI"`
+	ClientRequestUserAgent string `json:"ClientRequestUserAgent"`
+	EdgeColoCode           string `json:"EdgeColoCode"`
+	CacheCacheStatus       string `json:"CacheCacheStatus"`
+	EdgeResponseBytes      int64  `json:"EdgeResponseBytes"`
+	EdgeResponseStatus     int    `json:"EdgeResponseStatus"`
+}
+
+func (r graphqlRequest) line() ([]byte, error) {
+	return json.Marshal(logpullLine{
+		EdgeStartTimestamp:     r.Datetime.UnixNano(),
+		RayID:                  r.RayName,
+		ClientIP:               r.ClientIP,
+		ClientCountry:          strings.ToLower(r.ClientCountryName),
+		ClientRequestHost:      r.ClientRequestHTTPHost,
+		ClientRequestMethod:    r.ClientRequestHTTPMethodName,
+		ClientRequestPath:      r.ClientRequestPath,
+		ClientRequestURI:       r.ClientRequestPath + r.ClientRequestQuery,
+		ClientRequestUserAgent: r.UserAgent,
+		EdgeColoCode:           r.ColoCode,
+		CacheCacheStatus:       r.CacheStatus,
+		EdgeResponseBytes:      r.EdgeResponseBytes,
+		EdgeResponseStatus:     r.EdgeResponseStatus,
+	})
+}
+
+type graphqlResponse struct {
+	Data struct {
+		Viewer struct {
+			Zones []struct {
+				Requests []graphqlRequest `json:"httpRequestsAdaptive"`
+			} `json:"zones"`
+		} `json:"viewer"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// page fetches up to pageSize requests matching the filter.
+func (c *graphqlClient) page(ctx context.Context, filter map[string]interface{}) ([]graphqlRequest, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": graphqlQuery,
+		"variables": map[string]interface{}{
+			"zoneTag": c.zoneID,
+			"limit":   c.pageSize,
+			"filter":  filter,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &cloudflare.APIRequestError{
+			StatusCode: resp.StatusCode,
+			Errors:     []cloudflare.ResponseInfo{{Message: string(respBody)}},
+		}
+	}
+
+	var res graphqlResponse
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Errors) > 0 {
+		messages := make([]string, 0, len(res.Errors))
+		for _, e := range res.Errors {
+			messages = append(messages, e.Message)
+		}
+		return nil, fmt.Errorf("cloudflare graphql query failed: %s", strings.Join(messages, ", "))
+	}
+	if len(res.Data.Viewer.Zones) == 0 {
+		return nil, nil
+	}
+	return res.Data.Viewer.Zones[0].Requests, nil
+}
+
+// graphqlIterator pages through the requests of a time range.
+type graphqlIterator struct {
+	ctx        context.Context
+	client     *graphqlClient
+	start, end time.Time
+
+	// previous is the last request returned, the next page starts after it.
+	previous *graphqlRequest
+	last     bool
+
+	page    []graphqlRequest
+	current []byte
+	err     error
+}
+
+// filter returns the filter of the next page: the requests of the time range after the previous one.
+func (it *graphqlIterator) filter() map[string]interface{} {
+	end := it.end.UTC().Format(time.RFC3339)
+	if it.previous == nil {
+		return map[string]interface{}{
+			"datetime_geq": it.start.UTC().Format(time.RFC3339),
+			"datetime_lt":  end,
+		}
+	}
+	datetime := it.previous.Datetime.UTC().Format(time.RFC3339)
+	return map[string]interface{}{
+		"datetime_lt": end,
+		"OR": []map[string]interface{}{
+			{"datetime_gt": datetime},
+			{"datetime": datetime, "rayName_gt": it.previous.RayName},
+		},
+	}
+}
+
+func (it *graphqlIterator) fetch() error {
+	page, err := it.client.page(it.ctx, it.filter())
+	if err != nil {
+		return err
+	}
+	it.last = len(page) < it.client.pageSize
+
+	for i := range page {
+		if it.previous != nil && !page[i].after(*it.previous) {
+			return errGraphQLPagingStalled
+		}
+		it.previous = &page[i]
+	}
+	it.page = page
+	return nil
+}
+
+// after tells if r is after other in the order of the pages.
+func (r graphqlRequest) after(other graphqlRequest) bool {
+	if !r.Datetime.Equal(other.Datetime) {
+		return r.Datetime.After(other.Datetime)
+	}
+	return r.RayName > other.RayName
+}
+
+func (it *graphqlIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.last || it.err != nil {
+			return false
+		}
+		if it.err = it.fetch(); it.err != nil {
+			return false
+		}
+	}
+	it.current, it.err = it.page[0].line()
+	it.page = it.page[1:]
+	return it.err == nil
+}
+
+func (it *graphqlIterator) Err() error   { return it.err }
+func (it *graphqlIterator) Line() []byte { return it.current }
+func (it *graphqlIterator) Close() error { return nil }
+
+func (it *graphqlIterator) Fields() (map[string]string, error) {
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(it.current))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(fields))
+	for k, v := range fields {
+		res[k] = fmt.Sprint(v)
+	}
+	return res, nil
+}
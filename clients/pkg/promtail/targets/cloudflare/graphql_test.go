@@ -0,0 +1,233 @@
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// fakeGraphQLTransport serves the requests sorted by time and ray, honouring the filter and limit of the query.
+func fakeGraphQLTransport(requests []graphqlRequest, filters *[]map[string]interface{}) http.RoundTripper {
+	return roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		var body struct {
+			Variables struct {
+				ZoneTag string                 `json:"zoneTag"`
+				Limit   int                    `json:"limit"`
+				Filter  map[string]interface{} `json:"filter"`
+			} `json:"variables"`
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			return nil, fmt.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if body.Variables.ZoneTag != "zone" {
+			return nil, fmt.Errorf("unexpected zone %q", body.Variables.ZoneTag)
+		}
+		if filters != nil {
+			*filters = append(*filters, body.Variables.Filter)
+		}
+
+		var page []graphqlRequest
+		for _, req := range requests {
+			matches, err := matchesGraphQLFilter(req, body.Variables.Filter)
+			if err != nil {
+				return nil, err
+			}
+			if matches && len(page) < body.Variables.Limit {
+				page = append(page, req)
+			}
+		}
+		var res graphqlResponse
+		res.Data.Viewer.Zones = append(res.Data.Viewer.Zones, struct {
+			Requests []graphqlRequest `json:"httpRequestsAdaptive"`
+		}{Requests: page})
+		resBody, err := json.Marshal(res)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(string(resBody)))}, nil
+	})
+}
+
+// matchesGraphQLFilter evaluates the operators of the filters of the pages.
+func matchesGraphQLFilter(req graphqlRequest, filter map[string]interface{}) (bool, error) {
+	for key, value := range filter {
+		if key == "OR" {
+			matches := false
+			for _, f := range value.([]interface{}) {
+				m, err := matchesGraphQLFilter(req, f.(map[string]interface{}))
+				if err != nil {
+					return false, err
+				}
+				matches = matches || m
+			}
+			if !matches {
+				return false, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "rayName") {
+			if key != "rayName_gt" {
+				return false, fmt.Errorf("unexpected filter %q", key)
+			}
+			if req.RayName <= value.(string) {
+				return false, nil
+			}
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, value.(string))
+		if err != nil {
+			return false, err
+		}
+		var matches bool
+		switch key {
+		case "datetime":
+			matches = req.Datetime.Equal(ts)
+		case "datetime_gt":
+			matches = req.Datetime.After(ts)
+		case "datetime_geq":
+			matches = !req.Datetime.Before(ts)
+		case "datetime_lt":
+			matches = req.Datetime.Before(ts)
+		default:
+			return false, fmt.Errorf("unexpected filter %q", key)
+		}
+		if !matches {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func Test_graphqlClient_Pages(t *testing.T) {
+	var (
+		start    = time.Unix(100, 0)
+		end      = time.Unix(200, 0)
+		requests []graphqlRequest
+		filters  []map[string]interface{}
+	)
+	// 3 requests per second, so pages end in the middle of a second.
+	for i := 0; i < 12; i++ {
+		requests = append(requests, graphqlRequest{
+			Datetime:           time.Unix(int64(100+i/3), 0).UTC(),
+			RayName:            fmt.Sprintf("ray-%02d", i),
+			ClientRequestPath:  "/foo",
+			ClientRequestQuery: "?bar=1",
+			ClientCountryName:  "FR",
+			EdgeResponseStatus: 200,
+		})
+	}
+	c := &graphqlClient{
+		client:   &http.Client{Transport: fakeGraphQLTransport(requests, &filters)},
+		endpoint: "http://cloudflare/graphql",
+		token:    "token",
+		zoneID:   "zone",
+		pageSize: 5,
+	}
+
+	it, err := c.LogpullReceived(context.Background(), start, end)
+	require.NoError(t, err)
+	var lines []logpullLine
+	for it.Next() {
+		var line logpullLine
+		require.NoError(t, json.Unmarshal(it.Line(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+
+	require.Len(t, lines, len(requests))
+	for i, line := range lines {
+		require.Equal(t, requests[i].RayName, line.RayID)
+		require.Equal(t, requests[i].Datetime.UnixNano(), line.EdgeStartTimestamp)
+		require.Equal(t, "/foo?bar=1", line.ClientRequestURI)
+		require.Equal(t, "fr", line.ClientCountry)
+		require.Equal(t, 200, line.EdgeResponseStatus)
+	}
+
+	// each page starts after the time and ray of the last request of the previous one.
+	require.Len(t, filters, 3)
+	require.Equal(t, map[string]interface{}{
+		"datetime_geq": "1970-01-01T00:01:40Z",
+		"datetime_lt":  "1970-01-01T00:03:20Z",
+	}, filters[0])
+	require.Equal(t, map[string]interface{}{
+		"datetime_lt": "1970-01-01T00:03:20Z",
+		"OR": []interface{}{
+			map[string]interface{}{"datetime_gt": "1970-01-01T00:01:41Z"},
+			map[string]interface{}{"datetime": "1970-01-01T00:01:41Z", "rayName_gt": "ray-04"},
+		},
+	}, filters[1])
+}
+
+func Test_graphqlClient_PagingStalled(t *testing.T) {
+	var requests []graphqlRequest
+	for i := 0; i < 5; i++ {
+		requests = append(requests, graphqlRequest{Datetime: time.Unix(100, 0).UTC(), RayName: fmt.Sprintf("ray-%d", i)})
+	}
+	// the filters are ignored, every page is the first one.
+	c := &graphqlClient{
+		client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			var res graphqlResponse
+			res.Data.Viewer.Zones = append(res.Data.Viewer.Zones, struct {
+				Requests []graphqlRequest `json:"httpRequestsAdaptive"`
+			}{Requests: requests})
+			resBody, err := json.Marshal(res)
+			if err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(string(resBody)))}, nil
+		})},
+		endpoint: "http://cloudflare/graphql",
+		token:    "token",
+		zoneID:   "zone",
+		pageSize: 5,
+	}
+
+	it, err := c.LogpullReceived(context.Background(), time.Unix(100, 0), time.Unix(200, 0))
+	require.NoError(t, err)
+	lines := 0
+	for it.Next() {
+		lines++
+	}
+	require.Equal(t, 5, lines)
+	require.ErrorIs(t, it.Err(), errGraphQLPagingStalled)
+	require.True(t, isPermanentError(it.Err()))
+}
+
+func Test_graphqlClient_Errors(t *testing.T) {
+	c := &graphqlClient{
+		client: &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusForbidden, Body: ioutil.NopCloser(strings.NewReader("forbidden"))}, nil
+		})},
+		endpoint: "http://cloudflare/graphql",
+		token:    "token",
+		zoneID:   "zone",
+		pageSize: 5,
+	}
+	_, err := c.LogpullReceived(context.Background(), time.Unix(100, 0), time.Unix(200, 0))
+	var apiErr *cloudflare.APIRequestError
+	require.ErrorAs(t, err, &apiErr)
+	require.True(t, isPermanentError(err))
+
+	c.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(`{"data":null,"errors":[{"message":"quota exceeded"}]}`))}, nil
+	})}
+	_, err = c.LogpullReceived(context.Background(), time.Unix(100, 0), time.Unix(200, 0))
+	require.EqualError(t, err, "cloudflare graphql query failed: quota exceeded")
+	require.False(t, isPermanentError(err))
+}
@@ -0,0 +1,39 @@
+package cloudflare
+
+import "context"
+
+// Limiter bounds the number of concurrent Cloudflare API calls.
+// It is shared across all targets so that the account-wide rate limit is not exceeded.
+// A nil Limiter doesn't limit anything.
+type Limiter struct {
+	sem chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing up to max concurrent calls, or nil if max is not positive.
+func NewLimiter(max int) *Limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &Limiter{sem: make(chan struct{}, max)}
+}
+
+// Acquire blocks until a call can be made or the context is done.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot previously taken by Acquire.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
@@ -6,8 +6,11 @@ import "github.com/prometheus/client_golang/prometheus"
 type Metrics struct {
 	reg prometheus.Registerer
 
-	Entries prometheus.Counter
-	LastEnd prometheus.Gauge
+	Entries         prometheus.Counter
+	TransformErrors prometheus.Counter
+	ParseErrors     prometheus.Counter
+	SendTimeouts    prometheus.Counter
+	LastEnd         prometheus.Gauge
 }
 
 // NewMetrics creates a new set of cloudflare metrics. If reg is non-nil, the
@@ -21,6 +24,21 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 		Name:      "cloudflare_target_entries_total",
 		Help:      "Total number of successful entries sent via the cloudflare target",
 	})
+	m.TransformErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "promtail",
+		Name:      "cloudflare_target_transform_errors_total",
+		Help:      "Total number of entries dropped because they failed to be transformed",
+	})
+	m.ParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "promtail",
+		Name:      "cloudflare_target_parse_errors_total",
+		Help:      "Total number of entries without a valid timestamp",
+	})
+	m.SendTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "promtail",
+		Name:      "cloudflare_target_send_timeout_total",
+		Help:      "Total number of pulls failed because an entry couldn't be sent to the pipeline within the send timeout",
+	})
 	m.LastEnd = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "promtail",
 		Name:      "cloudflare_target_last_requested_end_timestamp",
@@ -30,6 +48,9 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 	if reg != nil {
 		reg.MustRegister(
 			m.Entries,
+			m.TransformErrors,
+			m.ParseErrors,
+			m.SendTimeouts,
 			m.LastEnd,
 		)
 	}
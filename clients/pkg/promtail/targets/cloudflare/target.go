@@ -3,6 +3,9 @@ package cloudflare
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -25,8 +28,20 @@ import (
 	"github.com/grafana/loki/pkg/logproto"
 )
 
-// The minimun window size is 1 minute.
-const minDelay = time.Minute
+const (
+	// The minimun window size is 1 minute.
+	minDelay = time.Minute
+	// Cloudflare retains logs for 7 days.
+	maxRetention = 7 * 24 * time.Hour
+	// The Logpull API serves at most one hour of logs per request.
+	defaultMaxPullRange = time.Hour
+	// The field holding the timestamp of the entries unless configured otherwise.
+	defaultTimestampField = "EdgeStartTimestamp"
+	// The base URL of the public Cloudflare API.
+	defaultAPIBaseURL = "https://api.cloudflare.com/client/v4"
+	// The number of entries pulled before they are sent to the handler.
+	sendBatchSize = 100
+)
 
 var defaultBackoff = backoff.Config{
 	MinBackoff: 1 * time.Second,
@@ -34,12 +49,28 @@ var defaultBackoff = backoff.Config{
 	MaxRetries: 5,
 }
 
+// The Cloudflare APIs logs can be pulled from.
+const (
+	APILogpull = "logpull"
+	APIGraphQL = "graphql"
+)
+
+// Transformer transforms a raw Cloudflare log line before it is sent, e.g. to redact fields.
+// Lines for which an error is returned are dropped.
+type Transformer func(line []byte) ([]byte, error)
+
+func identity(line []byte) ([]byte, error) { return line, nil }
+
 type Target struct {
-	logger    log.Logger
-	handler   api.EntryHandler
-	positions positions.Positions
-	config    *scrapeconfig.CloudflareConfig
-	metrics   *Metrics
+	logger      log.Logger
+	handler     api.EntryHandler
+	positions   positions.Positions
+	positionKey string
+	config      *scrapeconfig.CloudflareConfig
+	labels      model.LabelSet // the labels of each entry
+	metrics     *Metrics
+	transform   Transformer
+	limiter     *Limiter
 
 	client  Client
 	ctx     context.Context
@@ -47,7 +78,7 @@ type Target struct {
 	wg      sync.WaitGroup
 	to      time.Time // the end of the next pull interval
 	running *atomic.Bool
-	err     error
+	err     *atomic.Error // the error of the last pull, nil once a pull succeeds
 }
 
 func NewTarget(
@@ -56,39 +87,69 @@ func NewTarget(
 	handler api.EntryHandler,
 	position positions.Positions,
 	config *scrapeconfig.CloudflareConfig,
+	transform Transformer,
+	limiter *Limiter,
 ) (*Target, error) {
-	if err := validateConfig(config); err != nil {
+	if err := validateConfig(config, logger); err != nil {
 		return nil, err
 	}
 	fields, err := Fields(FieldsType(config.FieldsType))
 	if err != nil {
 		return nil, err
 	}
-	client, err := getClient(config.APIToken, config.ZoneID, fields)
-	if err != nil {
-		return nil, err
+	var client Client
+	switch config.API {
+	case APIGraphQL:
+		client = newGraphQLClient(config.APIBaseURL, config.APIToken, config.ZoneID)
+	default:
+		client, err = getClient(config.APIBaseURL, config.APIToken, config.ZoneID, fields)
+		if err != nil {
+			return nil, err
+		}
 	}
-	pos, err := position.Get(positions.CursorKey(config.ZoneID))
+	positionKey := positionKey(config)
+	pos, err := position.Get(positionKey)
 	if err != nil {
 		return nil, err
 	}
+	if pos == 0 {
+		// Resume from the position saved by the previous versions keying it by zone only.
+		pos, err = position.Get(positions.CursorKey(config.ZoneID))
+		if err != nil {
+			return nil, err
+		}
+	}
 	to := time.Now()
 	if pos != 0 {
 		to = time.Unix(0, pos)
+	} else if config.StartAt != nil {
+		to = config.StartAt.At(to)
+	}
+	if transform == nil {
+		transform = identity
+	}
+	labels := config.Labels.Clone()
+	if config.FieldsTypeLabel != "" {
+		labels[model.LabelName(config.FieldsTypeLabel)] = model.LabelValue(config.FieldsType)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	t := &Target{
-		logger:    logger,
-		handler:   handler,
-		positions: position,
-		config:    config,
-		metrics:   metrics,
+		logger:      logger,
+		handler:     handler,
+		positions:   position,
+		positionKey: positionKey,
+		config:      config,
+		labels:      labels,
+		metrics:     metrics,
+		transform:   transform,
+		limiter:     limiter,
 
 		ctx:     ctx,
 		cancel:  cancel,
 		client:  client,
 		to:      to,
 		running: atomic.NewBool(false),
+		err:     atomic.NewError(nil),
 	}
 	t.start()
 	return t, nil
@@ -102,6 +163,11 @@ func (t *Target) start() {
 			t.wg.Done()
 			t.running.Store(false)
 		}()
+		// retries pauses the pulls after transient errors, it never gives up.
+		retries := backoff.New(t.ctx, backoff.Config{
+			MinBackoff: t.config.BackoffConfig.MinBackoff,
+			MaxBackoff: t.config.BackoffConfig.MaxBackoff,
+		})
 		for t.ctx.Err() == nil {
 			end := t.to
 			maxEnd := time.Now().Add(-minDelay)
@@ -116,15 +182,23 @@ func (t *Target) start() {
 				request := job.(pullRequest)
 				return t.pull(ctx, request.start, request.end)
 			}); err != nil {
-				level.Error(t.logger).Log("msg", "failed to pull logs", "err", err, "start", start, "end", end)
-				t.err = err
-				return
+				t.err.Store(err)
+				if isPermanentError(err) {
+					level.Error(t.logger).Log("msg", "failed to pull logs, stopping target", "err", err, "start", start, "end", end)
+					return
+				}
+				// The same interval is pulled again, entries sent by the workers that succeeded may be duplicated.
+				level.Warn(t.logger).Log("msg", "failed to pull logs, retrying", "err", err, "start", start, "end", end)
+				retries.Wait()
+				continue
 			}
+			retries.Reset()
+			t.err.Store(nil)
 
 			// Sets current timestamp metrics, move to the next interval and saves the position.
 			t.metrics.LastEnd.Set(float64(end.UnixNano()) / 1e9)
 			t.to = end.Add(time.Duration(t.config.PullRange))
-			t.positions.Put(positions.CursorKey(t.config.ZoneID), t.to.UnixNano())
+			t.positions.Put(t.positionKey, t.to.UnixNano())
 
 			// If the next window can be fetched do it, if not sleep for a while.
 			// This is because Cloudflare logs should never be pulled between now-1m and now.
@@ -140,46 +214,160 @@ func (t *Target) start() {
 }
 
 // pull pulls logs from cloudflare for a given time range.
-// It will retry on errors.
+// It will retry on errors, each attempt waits for the shared limiter.
 func (t *Target) pull(ctx context.Context, start, end time.Time) error {
 	var (
-		backoff = backoff.New(ctx, defaultBackoff)
+		backoff = backoff.New(ctx, t.config.BackoffConfig)
 		errs    = multierror.New()
 		it      cloudflare.LogpullReceivedIterator
 		err     error
 	)
 
 	for backoff.Ongoing() {
+		// the pulls aren't canceled half way through, but the target stops without waiting for a slot.
+		if err := t.limiter.Acquire(t.ctx); err != nil {
+			return err
+		}
 		it, err = t.client.LogpullReceived(ctx, start, end)
 		if err != nil {
+			t.limiter.Release()
+			if isPermanentError(err) {
+				return err
+			}
 			errs.Add(err)
 			backoff.Wait()
 			continue
 		}
+		defer t.limiter.Release()
 		defer it.Close()
+		batch := make([]api.Entry, 0, sendBatchSize)
 		for it.Next() {
 			if it.Err() != nil {
-				return it.Err()
+				break
 			}
 			line := it.Line()
-			ts, err := jsonparser.GetInt(line, "EdgeStartTimestamp")
+			ts, err := parseTimestamp(line, t.config.TimestampField)
 			if err != nil {
+				t.metrics.ParseErrors.Inc()
+				if t.config.DropInvalidTimestamps {
+					level.Debug(t.logger).Log("msg", "failed to parse timestamp, dropping line", "err", err)
+					continue
+				}
 				ts = time.Now().UnixNano()
 			}
-			t.handler.Chan() <- api.Entry{
-				Labels: t.config.Labels.Clone(),
+			line, err = t.transform(line)
+			if err != nil {
+				level.Warn(t.logger).Log("msg", "failed to transform line, dropping it", "err", err)
+				t.metrics.TransformErrors.Inc()
+				continue
+			}
+			batch = append(batch, api.Entry{
+				Labels: t.labels.Clone(),
 				Entry: logproto.Entry{
 					Timestamp: time.Unix(0, ts),
 					Line:      string(line),
 				},
+			})
+			if len(batch) == sendBatchSize {
+				if err := t.sendBatch(batch); err != nil {
+					return err
+				}
+				batch = make([]api.Entry, 0, sendBatchSize)
 			}
-			t.metrics.Entries.Inc()
 		}
-		return nil
+		// entries read before a failure are still sent, the retried pull resends them anyway.
+		if err := t.sendBatch(batch); err != nil {
+			return err
+		}
+		return it.Err()
 	}
 	return errs.Err()
 }
 
+// parseTimestamp returns the timestamp held by field of line, either as nanoseconds since the epoch or as
+// an RFC3339 string.
+func parseTimestamp(line []byte, field string) (int64, error) {
+	value, dataType, _, err := jsonparser.Get(line, field)
+	if err != nil {
+		return 0, err
+	}
+	switch dataType {
+	case jsonparser.Number:
+		return jsonparser.ParseInt(value)
+	case jsonparser.String:
+		ts, err := time.Parse(time.RFC3339Nano, string(value))
+		if err != nil {
+			return 0, err
+		}
+		return ts.UnixNano(), nil
+	default:
+		return 0, fmt.Errorf("unsupported %s timestamp value of type %s", field, dataType)
+	}
+}
+
+// sendBatch sends the entries of batch to the handler one by one. Each send fails once the send timeout elapses or the target is stopped so that a backed up
+// handler fails the pull instead of blocking it forever. sendBatch takes ownership of batch.
+func (t *Target) sendBatch(batch []api.Entry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var (
+		d       = time.Duration(t.config.SendTimeout)
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	if d > 0 {
+		timer = time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	entries := t.handler.Chan()
+	for i, entry := range batch {
+		// the timer is reused across entries rather than allocated for each of them.
+		if timer != nil && i > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(d)
+		}
+		select {
+		case entries <- entry:
+		case <-t.ctx.Done():
+			t.metrics.Entries.Add(float64(i))
+			return t.ctx.Err()
+		case <-timeout:
+			t.metrics.Entries.Add(float64(i))
+			return t.sendTimedOut()
+		}
+	}
+	t.metrics.Entries.Add(float64(len(batch)))
+	return nil
+}
+
+func (t *Target) sendTimedOut() error {
+	t.metrics.SendTimeouts.Inc()
+	level.Warn(t.logger).Log("msg", "timed out sending entries, the pipeline is backed up", "send_timeout", t.config.SendTimeout)
+	return fmt.Errorf("timed out after %s sending entries", t.config.SendTimeout)
+}
+
+// isPermanentError tells if err can't be recovered from by retrying, which is the case
+// for authentication and authorization errors such as a bad token or a revoked zone access, and for the GraphQL
+// pages which don't advance.
+func isPermanentError(err error) bool {
+	if errors.Is(err, errGraphQLPagingStalled) {
+		return true
+	}
+	var apiErr *cloudflare.APIRequestError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
 func (t *Target) Stop() {
 	t.cancel()
 	t.wg.Wait()
@@ -195,7 +383,7 @@ func (t *Target) DiscoveredLabels() model.LabelSet {
 }
 
 func (t *Target) Labels() model.LabelSet {
-	return t.config.Labels
+	return t.labels
 }
 
 func (t *Target) Ready() bool {
@@ -204,15 +392,25 @@ func (t *Target) Ready() bool {
 
 func (t *Target) Details() interface{} {
 	fields, _ := Fields(FieldsType(t.config.FieldsType))
+	var errMsg string
+	if err := t.err.Load(); err != nil {
+		errMsg = err.Error()
+	}
 	return map[string]string{
 		"zone_id":        t.config.ZoneID,
-		"error":          t.err.Error(),
-		"position":       t.positions.GetString(positions.CursorKey(t.config.ZoneID)),
+		"error":          errMsg,
+		"position":       t.positions.GetString(t.positionKey),
 		"last_timestamp": t.to.String(),
 		"fields":         strings.Join(fields, ","),
 	}
 }
 
+// positionKey returns the key of the position of the target, distinct for each API and fields type of a
+// zone so that targets pulling different fields of the same zone don't overwrite each other's position.
+func positionKey(cfg *scrapeconfig.CloudflareConfig) string {
+	return positions.CursorKey(fmt.Sprintf("%s/%s/%s", cfg.ZoneID, cfg.API, cfg.FieldsType))
+}
+
 type pullRequest struct {
 	start time.Time
 	end   time.Time
@@ -235,10 +433,41 @@ func splitRequests(start, end time.Time, workers int) []interface{} {
 	return requests
 }
 
-func validateConfig(cfg *scrapeconfig.CloudflareConfig) error {
+func validateConfig(cfg *scrapeconfig.CloudflareConfig, logger log.Logger) error {
 	if cfg.FieldsType == "" {
 		cfg.FieldsType = string(FieldsTypeDefault)
 	}
+	switch cfg.API {
+	case "":
+		cfg.API = APILogpull
+	case APILogpull, APIGraphQL:
+	default:
+		return fmt.Errorf("unsupported cloudflare api %q, supported values are %q and %q", cfg.API, APILogpull, APIGraphQL)
+	}
+	if cfg.APIBaseURL == "" {
+		cfg.APIBaseURL = defaultAPIBaseURL
+	}
+	if u, err := url.Parse(cfg.APIBaseURL); err != nil {
+		return fmt.Errorf("invalid cloudflare api_base_url %q: %w", cfg.APIBaseURL, err)
+	} else if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid cloudflare api_base_url %q: must be an absolute URL", cfg.APIBaseURL)
+	}
+	if cfg.TimestampField == "" {
+		cfg.TimestampField = defaultTimestampField
+	}
+	fields := graphqlFields
+	if cfg.API == APILogpull {
+		var err error
+		if fields, err = Fields(FieldsType(cfg.FieldsType)); err != nil {
+			return err
+		}
+	}
+	if !hasField(fields, cfg.TimestampField) {
+		return fmt.Errorf("cloudflare timestamp field %q is not one of the fetched fields", cfg.TimestampField)
+	}
+	if cfg.FieldsTypeLabel != "" && !model.LabelName(cfg.FieldsTypeLabel).IsValid() {
+		return fmt.Errorf("invalid cloudflare fields type label name %q", cfg.FieldsTypeLabel)
+	}
 	if cfg.APIToken == "" {
 		return errors.New("cloudflare api token is required")
 	}
@@ -248,8 +477,33 @@ func validateConfig(cfg *scrapeconfig.CloudflareConfig) error {
 	if cfg.PullRange == 0 {
 		cfg.PullRange = model.Duration(time.Minute)
 	}
+	if cfg.MaxPullRange == 0 {
+		cfg.MaxPullRange = model.Duration(defaultMaxPullRange)
+	}
+	if time.Duration(cfg.MaxPullRange) > maxRetention {
+		return fmt.Errorf("cloudflare max_pull_range %s is beyond the logs retention of %s", cfg.MaxPullRange, maxRetention)
+	}
+	if time.Duration(cfg.PullRange) > maxRetention {
+		return fmt.Errorf("cloudflare pull_range %s is beyond the logs retention of %s", cfg.PullRange, maxRetention)
+	}
+	if cfg.PullRange > cfg.MaxPullRange {
+		level.Warn(logger).Log("msg", "cloudflare pull_range exceeds max_pull_range, clamping it", "pull_range", cfg.PullRange, "max_pull_range", cfg.MaxPullRange)
+		cfg.PullRange = cfg.MaxPullRange
+	}
 	if cfg.Workers == 0 {
 		cfg.Workers = 3
 	}
+	if cfg.StartAt != nil && time.Since(cfg.StartAt.At(time.Now())) > maxRetention {
+		return fmt.Errorf("cloudflare start_at %s is beyond the logs retention of %s", cfg.StartAt.At(time.Now()), maxRetention)
+	}
+	if cfg.BackoffConfig.MinBackoff == 0 {
+		cfg.BackoffConfig.MinBackoff = defaultBackoff.MinBackoff
+	}
+	if cfg.BackoffConfig.MaxBackoff == 0 {
+		cfg.BackoffConfig.MaxBackoff = defaultBackoff.MaxBackoff
+	}
+	if cfg.BackoffConfig.MaxRetries == 0 {
+		cfg.BackoffConfig.MaxRetries = defaultBackoff.MaxRetries
+	}
 	return nil
 }
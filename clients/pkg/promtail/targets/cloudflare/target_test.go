@@ -1,21 +1,34 @@
 package cloudflare
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/buger/jsonparser"
+	"github.com/cloudflare/cloudflare-go"
 	"github.com/go-kit/log"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/loki/clients/pkg/promtail/api"
 	"github.com/grafana/loki/clients/pkg/promtail/client/fake"
 	"github.com/grafana/loki/clients/pkg/promtail/positions"
 	"github.com/grafana/loki/clients/pkg/promtail/scrapeconfig"
+	"github.com/grafana/loki/pkg/logproto"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 )
 
 func Test_CloudflareTarget(t *testing.T) {
@@ -63,11 +76,11 @@ func Test_CloudflareTarget(t *testing.T) {
 		logs: []string{},
 	}, nil)
 	// replace the client.
-	getClient = func(apiKey, zoneID string, fields []string) (Client, error) {
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
 		return cfClient, nil
 	}
 
-	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg)
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
 	require.NoError(t, err)
 	require.True(t, ta.Ready())
 
@@ -95,10 +108,223 @@ func Test_CloudflareTarget(t *testing.T) {
 	ta.Stop()
 	ps.Stop()
 	// Make sure we save the last position.
-	newPos, _ := ps.Get(positions.CursorKey(cfg.ZoneID))
+	newPos, _ := ps.Get(positionKey(cfg))
 	require.Greater(t, newPos, end.UnixNano())
 }
 
+func Test_CloudflareTargetTransform(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		cfg    = &scrapeconfig.CloudflareConfig{
+			APIToken:  "foo",
+			ZoneID:    "bar",
+			Labels:    model.LabelSet{"job": "cloudflare"},
+			PullRange: model.Duration(time.Minute),
+			Workers:   1,
+		}
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		start    = time.Unix(0, time.Hour.Nanoseconds()-int64(cfg.PullRange))
+		client   = fake.New(func() {})
+		cfClient = newFakeCloudflareClient()
+		metrics  = NewMetrics(prometheus.NewRegistry())
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+	cfClient.On("LogpullReceived", mock.Anything, start, end).Return(&fakeLogIterator{
+		logs: []string{
+			`{"EdgeStartTimestamp":1,"ClientIP":"10.0.0.1"}`,
+			`{"EdgeStartTimestamp":2}`,
+		},
+	}, nil)
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{},
+	}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	// redacts the client IP, lines without it are rejected.
+	redact := func(line []byte) ([]byte, error) {
+		if _, _, _, err := jsonparser.Get(line, "ClientIP"); err != nil {
+			return nil, err
+		}
+		return jsonparser.Set(line, []byte(`"redacted"`), "ClientIP")
+	}
+
+	ta, err := NewTarget(metrics, logger, client, ps, cfg, redact, nil)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == 1 && testutil.ToFloat64(metrics.TransformErrors) == 1
+	}, 5*time.Second, 100*time.Millisecond)
+
+	received := client.Received()
+	require.Equal(t, `{"EdgeStartTimestamp":1,"ClientIP":"redacted"}`, received[0].Line)
+	require.Equal(t, time.Unix(0, 1), received[0].Timestamp)
+	require.True(t, ta.Ready())
+	ta.Stop()
+	ps.Stop()
+}
+
+func Test_CloudflareTargetParseErrors(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drop=%t", drop), func(t *testing.T) {
+			var (
+				w      = log.NewSyncWriter(os.Stderr)
+				logger = log.NewLogfmtLogger(w)
+				cfg    = &scrapeconfig.CloudflareConfig{
+					APIToken:              "foo",
+					ZoneID:                "bar",
+					Labels:                model.LabelSet{"job": "cloudflare"},
+					PullRange:             model.Duration(time.Minute),
+					Workers:               1,
+					DropInvalidTimestamps: drop,
+				}
+				end      = time.Unix(0, time.Hour.Nanoseconds())
+				start    = time.Unix(0, time.Hour.Nanoseconds()-int64(cfg.PullRange))
+				client   = fake.New(func() {})
+				cfClient = newFakeCloudflareClient()
+				metrics  = NewMetrics(prometheus.NewRegistry())
+			)
+			ps, err := positions.New(logger, positions.Config{
+				SyncPeriod:    10 * time.Second,
+				PositionsFile: t.TempDir() + "/positions.yml",
+			})
+			require.NoError(t, err)
+			ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+			cfClient.On("LogpullReceived", mock.Anything, start, end).Return(&fakeLogIterator{
+				logs: []string{
+					`{"EdgeStartTimestamp":1}`,
+					`{"EdgeStartTimestamp":"yesterday"}`,
+					`{"EdgeRequestHost":"foo.com"}`,
+				},
+			}, nil)
+			cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+				logs: []string{},
+			}, nil)
+			getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+				return cfClient, nil
+			}
+
+			ta, err := NewTarget(metrics, logger, client, ps, cfg, nil, nil)
+			require.NoError(t, err)
+
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(metrics.ParseErrors) == 2
+			}, 5*time.Second, 10*time.Millisecond)
+			ta.Stop()
+			ps.Stop()
+
+			if drop {
+				require.Len(t, client.Received(), 1)
+				require.Equal(t, float64(1), testutil.ToFloat64(metrics.Entries))
+			} else {
+				require.Len(t, client.Received(), 3)
+				require.Equal(t, float64(3), testutil.ToFloat64(metrics.Entries))
+			}
+		})
+	}
+}
+
+func Test_CloudflareTargetFieldsTypeLabel(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		cfg    = &scrapeconfig.CloudflareConfig{
+			APIToken:        "foo",
+			ZoneID:          "bar",
+			Labels:          model.LabelSet{"job": "cloudflare"},
+			PullRange:       model.Duration(time.Minute),
+			Workers:         1,
+			FieldsType:      string(FieldsTypeMinimal),
+			FieldsTypeLabel: "dataset",
+		}
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		start    = time.Unix(0, time.Hour.Nanoseconds()-int64(cfg.PullRange))
+		client   = fake.New(func() {})
+		cfClient = newFakeCloudflareClient()
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+	cfClient.On("LogpullReceived", mock.Anything, start, end).Return(&fakeLogIterator{
+		logs: []string{`{"EdgeStartTimestamp":1}`},
+	}, nil)
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{},
+	}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+
+	expected := model.LabelSet{"job": "cloudflare", "dataset": "minimal"}
+	require.Equal(t, expected, client.Received()[0].Labels)
+	require.Equal(t, expected, ta.Labels())
+	// the configured labels are left untouched.
+	require.Equal(t, model.LabelSet{"job": "cloudflare"}, cfg.Labels)
+}
+
+func Test_CloudflareTargetStartAt(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		cfg    = &scrapeconfig.CloudflareConfig{
+			APIToken:  "foo",
+			ZoneID:    "bar",
+			Labels:    model.LabelSet{"job": "cloudflare"},
+			PullRange: model.Duration(time.Minute),
+			Workers:   1,
+			StartAt:   &scrapeconfig.TimeOrDuration{Dur: durationPtr(24 * time.Hour)},
+		}
+		client   = fake.New(func() {})
+		cfClient = newFakeCloudflareClient()
+	)
+	// no position is saved for the zone.
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{},
+	}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return cfClient.CallCount() > 0
+	}, 5*time.Second, 100*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+
+	// the first pull ends 24h ago.
+	firstEnd := cfClient.Calls[0].Arguments.Get(2).(time.Time)
+	require.WithinDuration(t, time.Now().Add(-24*time.Hour), firstEnd, time.Minute)
+}
+
 func Test_CloudflareTargetError(t *testing.T) {
 	var (
 		w      = log.NewSyncWriter(os.Stderr)
@@ -125,14 +351,14 @@ func Test_CloudflareTargetError(t *testing.T) {
 	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
 	require.NoError(t, err)
 
-	// setup errors for all retries
-	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(nil, errors.New("no logs"))
+	// setup an authorization error, which is not retried.
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(nil, &cloudflare.APIRequestError{StatusCode: http.StatusForbidden})
 	// replace the client.
-	getClient = func(apiKey, zoneID string, fields []string) (Client, error) {
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
 		return cfClient, nil
 	}
 
-	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg)
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
 	require.NoError(t, err)
 	require.True(t, ta.Ready())
 
@@ -142,7 +368,9 @@ func Test_CloudflareTargetError(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 
 	require.Len(t, client.Received(), 0)
-	require.GreaterOrEqual(t, cfClient.CallCount(), 5)
+	// authorization errors are not retried, so each worker makes at most one call.
+	require.GreaterOrEqual(t, cfClient.CallCount(), 1)
+	require.LessOrEqual(t, cfClient.CallCount(), cfg.Workers)
 	require.NotEmpty(t, ta.Details().(map[string]string)["error"])
 	ta.Stop()
 	ps.Stop()
@@ -152,6 +380,519 @@ func Test_CloudflareTargetError(t *testing.T) {
 	require.Equal(t, newEnd, end.UnixNano())
 }
 
+func Test_CloudflareTargetTransientError(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		cfg    = &scrapeconfig.CloudflareConfig{
+			APIToken:  "foo",
+			ZoneID:    "bar",
+			Labels:    model.LabelSet{"job": "cloudflare"},
+			PullRange: model.Duration(time.Minute),
+			Workers:   1,
+			BackoffConfig: backoff.Config{
+				MinBackoff: time.Millisecond,
+				MaxBackoff: time.Millisecond,
+				MaxRetries: 2,
+			},
+		}
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		client   = fake.New(func() {})
+		cfClient = newFakeCloudflareClient()
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+	// rate limited for more than the retries of a single pull.
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(nil, &cloudflare.APIRequestError{StatusCode: http.StatusTooManyRequests}).Times(5)
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{`{"EdgeStartTimestamp":1, "EdgeRequestHost":"foo.com"}`},
+	}, nil).Once()
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{},
+	}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
+	require.NoError(t, err)
+
+	// the target keeps running and eventually pulls the logs.
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.True(t, ta.Ready())
+	// the error is cleared once the pulls recover.
+	require.Eventually(t, func() bool {
+		return ta.err.Load() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+	require.Empty(t, ta.Details().(map[string]string)["error"])
+}
+
+func Test_CloudflareTargetBlockedHandler(t *testing.T) {
+	for _, sendTimeout := range []time.Duration{0, 50 * time.Millisecond} {
+		t.Run(sendTimeout.String(), func(t *testing.T) {
+			var (
+				w      = log.NewSyncWriter(os.Stderr)
+				logger = log.NewLogfmtLogger(w)
+				cfg    = &scrapeconfig.CloudflareConfig{
+					APIToken:    "foo",
+					ZoneID:      "bar",
+					Labels:      model.LabelSet{"job": "cloudflare"},
+					PullRange:   model.Duration(time.Minute),
+					Workers:     1,
+					SendTimeout: model.Duration(sendTimeout),
+				}
+				end      = time.Unix(0, time.Hour.Nanoseconds())
+				cfClient = newFakeCloudflareClient()
+				metrics  = NewMetrics(prometheus.NewRegistry())
+				// nothing ever reads the entries sent to the handler.
+				handler = api.NewEntryHandler(make(chan api.Entry), func() {})
+			)
+			ps, err := positions.New(logger, positions.Config{
+				SyncPeriod:    10 * time.Second,
+				PositionsFile: t.TempDir() + "/positions.yml",
+			})
+			require.NoError(t, err)
+			ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+			cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+				logs: []string{`{"EdgeStartTimestamp":1, "EdgeRequestHost":"foo.com"}`},
+			}, nil).Once()
+			cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+				logs: []string{},
+			}, nil)
+			getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+				return cfClient, nil
+			}
+
+			ta, err := NewTarget(metrics, logger, handler, ps, cfg, nil, nil)
+			require.NoError(t, err)
+
+			if sendTimeout > 0 {
+				// the pull fails and is retried, the target keeps running.
+				require.Eventually(t, func() bool {
+					return testutil.ToFloat64(metrics.SendTimeouts) == 1
+				}, 5*time.Second, 10*time.Millisecond)
+				require.True(t, ta.Ready())
+			} else {
+				time.Sleep(100 * time.Millisecond)
+				require.Zero(t, testutil.ToFloat64(metrics.SendTimeouts))
+			}
+			require.Zero(t, testutil.ToFloat64(metrics.Entries))
+
+			// stopping the target unblocks the send.
+			stopped := make(chan struct{})
+			go func() {
+				ta.Stop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the target didn't stop")
+			}
+			ps.Stop()
+		})
+	}
+}
+
+func newSendTarget(handler api.EntryHandler, sendTimeout time.Duration) *Target {
+	return &Target{
+		logger:  log.NewNopLogger(),
+		handler: handler,
+		config:  &scrapeconfig.CloudflareConfig{SendTimeout: model.Duration(sendTimeout)},
+		metrics: NewMetrics(prometheus.NewRegistry()),
+		ctx:     context.Background(),
+	}
+}
+
+func testBatch(size int) []api.Entry {
+	batch := make([]api.Entry, 0, size)
+	for i := 0; i < size; i++ {
+		batch = append(batch, api.Entry{
+			Labels: model.LabelSet{"job": "cloudflare"},
+			Entry:  logproto.Entry{Timestamp: time.Unix(0, int64(i)), Line: fmt.Sprintf(`{"EdgeStartTimestamp":%d}`, i)},
+		})
+	}
+	return batch
+}
+
+func Test_Target_sendBatch(t *testing.T) {
+	batch := testBatch(10)
+
+	t.Run("entry handler", func(t *testing.T) {
+		entries := make(chan api.Entry, len(batch))
+		ta := newSendTarget(api.NewEntryHandler(entries, func() {}), time.Second)
+		require.NoError(t, ta.sendBatch(batch))
+		close(entries)
+		var received []api.Entry
+		for e := range entries {
+			received = append(received, e)
+		}
+		require.Equal(t, batch, received)
+		require.Equal(t, float64(len(batch)), testutil.ToFloat64(ta.metrics.Entries))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		// the handler accepts only the first half of the batch.
+		ta := newSendTarget(api.NewEntryHandler(make(chan api.Entry, len(batch)/2), func() {}), 10*time.Millisecond)
+		require.Error(t, ta.sendBatch(batch))
+		require.Equal(t, float64(len(batch)/2), testutil.ToFloat64(ta.metrics.Entries))
+		require.Equal(t, float64(1), testutil.ToFloat64(ta.metrics.SendTimeouts))
+	})
+}
+
+// BenchmarkTarget_sendBatch compares sending the entries of a pull one by one to sending them in batches,
+// to a handler draining its channel.
+func BenchmarkTarget_sendBatch(b *testing.B) {
+	const entries = 10000
+	batch := testBatch(entries)
+	for _, bc := range []struct {
+		name string
+		size int
+	}{
+		{"per entry", 1},
+		{"batched", sendBatchSize},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ch := make(chan api.Entry)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for range ch {
+				}
+			}()
+			ta := newSendTarget(api.NewEntryHandler(ch, func() {}), time.Second)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for i := 0; i < entries; i += bc.size {
+					if err := ta.sendBatch(batch[i : i+bc.size]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+			b.StopTimer()
+			close(ch)
+			<-done
+		})
+	}
+}
+
+func Test_CloudflareTargetAPIBaseURL(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		end    = time.Unix(0, time.Hour.Nanoseconds())
+		client = fake.New(func() {})
+		pulls  atomic.Int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/client/v4/zones/bar/logs/received", r.URL.Path)
+		require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+		if pulls.Inc() == 1 {
+			_, _ = w.Write([]byte(`{"EdgeStartTimestamp":1, "EdgeRequestHost":"foo.com"}` + "\n"))
+		}
+	}))
+	defer server.Close()
+	getClient = newClient
+
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey("bar"), end.UnixNano())
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, &scrapeconfig.CloudflareConfig{
+		APIToken:   "foo",
+		ZoneID:     "bar",
+		APIBaseURL: server.URL + "/client/v4",
+		Labels:     model.LabelSet{"job": "cloudflare"},
+		PullRange:  model.Duration(time.Minute),
+		Workers:    1,
+	}, nil, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+
+	received := client.Received()
+	require.Equal(t, time.Unix(0, 1), received[0].Timestamp)
+	require.Equal(t, `{"EdgeStartTimestamp":1, "EdgeRequestHost":"foo.com"}`, received[0].Line)
+}
+
+func Test_CloudflareTargetGraphQLPagesWithinASecond(t *testing.T) {
+	var (
+		w        = log.NewSyncWriter(os.Stderr)
+		logger   = log.NewLogfmtLogger(w)
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		client   = fake.New(func() {})
+		requests []graphqlRequest
+	)
+	// more requests within a second than fit in a page.
+	for i := 0; i < 2*graphqlPageSize+500; i++ {
+		requests = append(requests, graphqlRequest{
+			Datetime: end.Add(-30 * time.Second).UTC(),
+			RayName:  fmt.Sprintf("ray-%05d", i),
+		})
+	}
+	transport := fakeGraphQLTransport(requests, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/client/v4/graphql" {
+			http.Error(w, "unexpected path "+r.URL.Path, http.StatusNotFound)
+			return
+		}
+		resp, err := transport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, _ = io.Copy(w, resp.Body)
+	}))
+	defer server.Close()
+
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey("zone"), end.UnixNano())
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, &scrapeconfig.CloudflareConfig{
+		APIToken:   "token",
+		ZoneID:     "zone",
+		API:        APIGraphQL,
+		APIBaseURL: server.URL + "/client/v4",
+		Labels:     model.LabelSet{"job": "cloudflare"},
+		PullRange:  model.Duration(time.Minute),
+		Workers:    1,
+	}, nil, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == len(requests)
+	}, 5*time.Second, 10*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+	require.NoError(t, ta.err.Load())
+
+	rays := map[string]struct{}{}
+	for _, e := range client.Received() {
+		ray, err := jsonparser.GetString([]byte(e.Line), "RayID")
+		require.NoError(t, err)
+		rays[ray] = struct{}{}
+	}
+	require.Len(t, rays, len(requests))
+}
+
+func Test_parseTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		line    string
+		field   string
+		want    int64
+		wantErr bool
+	}{
+		{"epoch", `{"EdgeStartTimestamp":1637336610517000000}`, "EdgeStartTimestamp", 1637336610517000000, false},
+		{"rfc3339", `{"EdgeEndTimestamp":"2021-11-19T15:43:30.517Z"}`, "EdgeEndTimestamp", 1637336610517000000, false},
+		{"rfc3339 with offset", `{"EdgeEndTimestamp":"2021-11-19T16:43:30+01:00"}`, "EdgeEndTimestamp", 1637336610000000000, false},
+		{"missing", `{"EdgeStartTimestamp":1}`, "EdgeEndTimestamp", 0, true},
+		{"invalid string", `{"EdgeEndTimestamp":"yesterday"}`, "EdgeEndTimestamp", 0, true},
+		{"invalid type", `{"EdgeEndTimestamp":true}`, "EdgeEndTimestamp", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseTimestamp([]byte(tc.line), tc.field)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_CloudflareTargetTimestampField(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		cfg    = &scrapeconfig.CloudflareConfig{
+			APIToken:       "foo",
+			ZoneID:         "bar",
+			Labels:         model.LabelSet{"job": "cloudflare"},
+			PullRange:      model.Duration(time.Minute),
+			Workers:        1,
+			TimestampField: "EdgeEndTimestamp",
+		}
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		client   = fake.New(func() {})
+		cfClient = newFakeCloudflareClient()
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{
+			`{"EdgeStartTimestamp":1, "EdgeEndTimestamp":2}`,
+			`{"EdgeStartTimestamp":1, "EdgeEndTimestamp":"1970-01-01T00:00:00.000000003Z"}`,
+		},
+	}, nil).Once()
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Return(&fakeLogIterator{
+		logs: []string{},
+	}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, client, ps, cfg, nil, nil)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(client.Received()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	ta.Stop()
+	ps.Stop()
+
+	received := client.Received()
+	require.Equal(t, time.Unix(0, 2), received[0].Timestamp)
+	require.Equal(t, time.Unix(0, 3), received[1].Timestamp)
+}
+
+func Test_isPermanentError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		permanent bool
+	}{
+		{&cloudflare.APIRequestError{StatusCode: http.StatusUnauthorized}, true},
+		{&cloudflare.APIRequestError{StatusCode: http.StatusForbidden}, true},
+		{&cloudflare.APIRequestError{StatusCode: http.StatusTooManyRequests}, false},
+		{&cloudflare.APIRequestError{StatusCode: http.StatusBadGateway}, false},
+		{errors.New("connection reset by peer"), false},
+	} {
+		require.Equal(t, tc.permanent, isPermanentError(tc.err), tc.err.Error())
+	}
+}
+
+func Test_CloudflareTargetsSharedLimiter(t *testing.T) {
+	var (
+		w        = log.NewSyncWriter(os.Stderr)
+		logger   = log.NewLogfmtLogger(w)
+		end      = time.Unix(0, time.Hour.Nanoseconds())
+		limiter  = NewLimiter(1)
+		inflight = atomic.NewInt32(0)
+		maxSeen  = atomic.NewInt32(0)
+		calls    = atomic.NewInt32(0)
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+
+	cfClient := newFakeCloudflareClient()
+	cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		n := inflight.Inc()
+		for {
+			max := maxSeen.Load()
+			if n <= max || maxSeen.CAS(max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		inflight.Dec()
+		calls.Inc()
+	}).Return(&fakeLogIterator{logs: []string{}}, nil)
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+
+	var targets []*Target
+	for _, zone := range []string{"foo", "bar"} {
+		cfg := &scrapeconfig.CloudflareConfig{
+			APIToken:  "foo",
+			ZoneID:    zone,
+			Labels:    model.LabelSet{"job": "cloudflare"},
+			PullRange: model.Duration(time.Minute),
+			Workers:   3,
+		}
+		ps.Put(positions.CursorKey(zone), end.UnixNano())
+		ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, fake.New(func() {}), ps, cfg, nil, limiter)
+		require.NoError(t, err)
+		targets = append(targets, ta)
+	}
+
+	require.Eventually(t, func() bool {
+		return calls.Load() >= 12
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, ta := range targets {
+		ta.Stop()
+	}
+	ps.Stop()
+
+	require.Equal(t, int32(1), maxSeen.Load())
+}
+
+func Test_CloudflareTargetStopWithSaturatedLimiter(t *testing.T) {
+	var (
+		w       = log.NewSyncWriter(os.Stderr)
+		logger  = log.NewLogfmtLogger(w)
+		end     = time.Unix(0, time.Hour.Nanoseconds())
+		limiter = NewLimiter(1)
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+	defer ps.Stop()
+
+	// the only slot of the shared limiter is held by another target.
+	require.NoError(t, limiter.Acquire(context.Background()))
+	defer limiter.Release()
+
+	cfClient := newFakeCloudflareClient()
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return cfClient, nil
+	}
+	cfg := &scrapeconfig.CloudflareConfig{
+		APIToken:  "foo",
+		ZoneID:    "foo",
+		Labels:    model.LabelSet{"job": "cloudflare"},
+		PullRange: model.Duration(time.Minute),
+		Workers:   3,
+	}
+	ps.Put(positions.CursorKey(cfg.ZoneID), end.UnixNano())
+	ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, fake.New(func() {}), ps, cfg, nil, limiter)
+	require.NoError(t, err)
+	// let the workers wait for the limiter.
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		ta.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the target didn't stop while waiting for the limiter")
+	}
+	require.Zero(t, cfClient.CallCount())
+}
+
 func Test_validateConfig(t *testing.T) {
 	tests := []struct {
 		in      *scrapeconfig.CloudflareConfig
@@ -163,15 +904,233 @@ func Test_validateConfig(t *testing.T) {
 				APIToken: "foo",
 				ZoneID:   "bar",
 			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(time.Minute),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:  "foo",
+				ZoneID:    "bar",
+				PullRange: model.Duration(30 * time.Minute),
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(30 * time.Minute),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			// clamped to the max pull range.
+			&scrapeconfig.CloudflareConfig{
+				APIToken:  "foo",
+				ZoneID:    "bar",
+				PullRange: model.Duration(24 * time.Hour),
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(defaultMaxPullRange),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:     "foo",
+				ZoneID:       "bar",
+				PullRange:    model.Duration(24 * time.Hour),
+				MaxPullRange: model.Duration(3 * time.Hour),
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(3 * time.Hour),
+				MaxPullRange:   model.Duration(3 * time.Hour),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:  "foo",
+				ZoneID:    "bar",
+				PullRange: model.Duration(8 * 24 * time.Hour),
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				TimestampField: "EdgeEndTimestamp",
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(time.Minute),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: "EdgeEndTimestamp",
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			// not part of the default fields.
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				TimestampField: "Datetime",
+			},
+			nil,
+			true,
+		},
+		{
 			&scrapeconfig.CloudflareConfig{
 				APIToken:   "foo",
 				ZoneID:     "bar",
-				Workers:    3,
-				PullRange:  model.Duration(time.Minute),
-				FieldsType: string(FieldsTypeDefault),
+				APIBaseURL: "http://localhost:8080/client/v4",
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(time.Minute),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     "http://localhost:8080/client/v4",
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig:  defaultBackoff,
+			},
+			false,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:   "foo",
+				ZoneID:     "bar",
+				APIBaseURL: "api.cloudflare.com/client/v4",
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:   "foo",
+				ZoneID:     "bar",
+				APIBaseURL: "http://local host",
+			},
+			nil,
+			true,
+		},
+		{
+			// not part of the fields of the GraphQL API.
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				API:            APIGraphQL,
+				TimestampField: "EdgeEndTimestamp",
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:     "foo",
+				ZoneID:       "bar",
+				MaxPullRange: model.Duration(8 * 24 * time.Hour),
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken: "foo",
+				ZoneID:   "bar",
+				BackoffConfig: backoff.Config{
+					MaxBackoff: time.Minute,
+					MaxRetries: 20,
+				},
+			},
+			&scrapeconfig.CloudflareConfig{
+				APIToken:       "foo",
+				ZoneID:         "bar",
+				Workers:        3,
+				PullRange:      model.Duration(time.Minute),
+				MaxPullRange:   model.Duration(defaultMaxPullRange),
+				TimestampField: defaultTimestampField,
+				APIBaseURL:     defaultAPIBaseURL,
+				FieldsType:     string(FieldsTypeDefault),
+				API:            APILogpull,
+				BackoffConfig: backoff.Config{
+					MinBackoff: defaultBackoff.MinBackoff,
+					MaxBackoff: time.Minute,
+					MaxRetries: 20,
+				},
 			},
 			false,
 		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken: "foo",
+				ZoneID:   "bar",
+				StartAt:  &scrapeconfig.TimeOrDuration{Dur: durationPtr(8 * 24 * time.Hour)},
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken: "foo",
+				ZoneID:   "bar",
+				API:      "logpush",
+			},
+			nil,
+			true,
+		},
+		{
+			&scrapeconfig.CloudflareConfig{
+				APIToken:        "foo",
+				ZoneID:          "bar",
+				FieldsTypeLabel: "fields-type",
+			},
+			nil,
+			true,
+		},
 		{
 			&scrapeconfig.CloudflareConfig{
 				APIToken: "foo",
@@ -189,7 +1148,7 @@ func Test_validateConfig(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run("", func(t *testing.T) {
-			err := validateConfig(tt.in)
+			err := validateConfig(tt.in, log.NewNopLogger())
 			if tt.wantErr {
 				require.Error(t, err)
 				return
@@ -242,3 +1201,87 @@ func Test_splitRequests(t *testing.T) {
 		})
 	}
 }
+
+func durationPtr(d time.Duration) *model.Duration {
+	md := model.Duration(d)
+	return &md
+}
+
+func Test_CloudflareTargetsPositionPerFieldsType(t *testing.T) {
+	var (
+		w      = log.NewSyncWriter(os.Stderr)
+		logger = log.NewLogfmtLogger(w)
+		end    = time.Unix(0, time.Hour.Nanoseconds())
+	)
+	ps, err := positions.New(logger, positions.Config{
+		SyncPeriod:    10 * time.Second,
+		PositionsFile: t.TempDir() + "/positions.yml",
+	})
+	require.NoError(t, err)
+
+	cfgs := map[FieldsType]*scrapeconfig.CloudflareConfig{}
+	clients := map[string]*fakeCloudflareClient{}
+	calls := map[string]*atomic.Int32{}
+	for _, fieldsType := range []FieldsType{FieldsTypeDefault, FieldsTypeMinimal} {
+		cfgs[fieldsType] = &scrapeconfig.CloudflareConfig{
+			APIToken:   "foo",
+			ZoneID:     "bar",
+			Labels:     model.LabelSet{"job": "cloudflare"},
+			PullRange:  model.Duration(time.Minute),
+			Workers:    1,
+			FieldsType: string(fieldsType),
+			API:        APILogpull,
+		}
+		fields, err := Fields(fieldsType)
+		require.NoError(t, err)
+		key := strings.Join(fields, ",")
+		calls[key] = atomic.NewInt32(0)
+		cfClient := newFakeCloudflareClient()
+		cfClient.On("LogpullReceived", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			calls[key].Inc()
+		}).Return(&fakeLogIterator{logs: []string{}}, nil)
+		clients[key] = cfClient
+	}
+	getClient = func(baseURL, apiKey, zoneID string, fields []string) (Client, error) {
+		return clients[strings.Join(fields, ",")], nil
+	}
+	// the default fields target resumes from the legacy zone position,
+	// the minimal fields one from its own position.
+	ps.Put(positions.CursorKey("bar"), end.UnixNano())
+	ps.Put(positionKey(cfgs[FieldsTypeMinimal]), end.Add(time.Hour).UnixNano())
+
+	var targets []*Target
+	for _, cfg := range cfgs {
+		ta, err := NewTarget(NewMetrics(prometheus.NewRegistry()), logger, fake.New(func() {}), ps, cfg, nil, nil)
+		require.NoError(t, err)
+		targets = append(targets, ta)
+	}
+	require.Eventually(t, func() bool {
+		for _, c := range calls {
+			if c.Load() < 3 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, ta := range targets {
+		ta.Stop()
+	}
+	ps.Stop()
+
+	firstStart := func(fieldsType FieldsType) time.Time {
+		fields, err := Fields(fieldsType)
+		require.NoError(t, err)
+		return clients[strings.Join(fields, ",")].Calls[0].Arguments.Get(1).(time.Time)
+	}
+	require.Equal(t, end.Add(-time.Minute), firstStart(FieldsTypeDefault))
+	require.Equal(t, end.Add(time.Hour-time.Minute), firstStart(FieldsTypeMinimal))
+
+	defaultPos, err := ps.Get(positionKey(cfgs[FieldsTypeDefault]))
+	require.NoError(t, err)
+	minimalPos, err := ps.Get(positionKey(cfgs[FieldsTypeMinimal]))
+	require.NoError(t, err)
+	require.Greater(t, defaultPos, end.UnixNano())
+	require.Greater(t, minimalPos, end.Add(time.Hour).UnixNano())
+	require.NotEqual(t, defaultPos, minimalPos)
+}
@@ -17,12 +17,14 @@ type TargetManager struct {
 }
 
 // NewTargetManager creates a new cloudflare target managers.
+// All targets share the given limiter for their API calls.
 func NewTargetManager(
 	metrics *Metrics,
 	logger log.Logger,
 	positions positions.Positions,
 	pushClient api.EntryHandler,
 	scrapeConfigs []scrapeconfig.Config,
+	limiter *Limiter,
 ) (*TargetManager, error) {
 	tm := &TargetManager{
 		logger:  logger,
@@ -36,7 +38,7 @@ func NewTargetManager(
 		if err != nil {
 			return nil, err
 		}
-		t, err := NewTarget(metrics, log.With(logger, "target", "cloudflare"), pipeline.Wrap(pushClient), positions, cfg.CloudflareConfig)
+		t, err := NewTarget(metrics, log.With(logger, "target", "cloudflare"), pipeline.Wrap(pushClient), positions, cfg.CloudflareConfig, nil, limiter)
 		if err != nil {
 			return nil, err
 		}
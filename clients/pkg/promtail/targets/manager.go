@@ -10,6 +10,7 @@ import (
 
 	"github.com/grafana/loki/clients/pkg/promtail/api"
 	"github.com/grafana/loki/clients/pkg/promtail/client"
+	"github.com/grafana/loki/clients/pkg/promtail/limit"
 	"github.com/grafana/loki/clients/pkg/promtail/positions"
 	"github.com/grafana/loki/clients/pkg/promtail/scrapeconfig"
 	"github.com/grafana/loki/clients/pkg/promtail/targets/cloudflare"
@@ -59,6 +60,7 @@ func NewTargetManagers(
 	client api.EntryHandler,
 	scrapeConfigs []scrapeconfig.Config,
 	targetConfig *file.Config,
+	limitConfig *limit.Config,
 	clientConfigs ...client.Config,
 ) (*TargetManagers, error) {
 	var targetManagers []targetManager
@@ -227,7 +229,7 @@ func NewTargetManagers(
 			if err != nil {
 				return nil, err
 			}
-			cfTargetManager, err := cloudflare.NewTargetManager(cloudflareMetrics, logger, pos, client, scrapeConfigs)
+			cfTargetManager, err := cloudflare.NewTargetManager(cloudflareMetrics, logger, pos, client, scrapeConfigs, cloudflare.NewLimiter(limitConfig.MaxCloudflareConcurrency))
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to make cloudflare target manager")
 			}
@@ -14,8 +14,10 @@ import (
 
 	"github.com/grafana/loki/pkg/loki"
 	logutil "github.com/grafana/loki/pkg/util"
+	"github.com/grafana/loki/pkg/util/ballast"
 	_ "github.com/grafana/loki/pkg/util/build"
 	"github.com/grafana/loki/pkg/util/cfg"
+	"github.com/grafana/loki/pkg/util/gctuning"
 	"github.com/grafana/loki/pkg/validation"
 
 	util_log "github.com/cortexproject/cortex/pkg/util/log"
@@ -91,8 +93,13 @@ func main() {
 	// Allocate a block of memory to reduce the frequency of garbage collection.
 	// The larger the ballast, the lower the garbage collection frequency.
 	// https://github.com/grafana/loki/issues/781
-	ballast := make([]byte, config.BallastBytes)
-	runtime.KeepAlive(ballast)
+	b, err := ballast.New(config.BallastBytes, config.BallastMode, util_log.Logger)
+	util_log.CheckFatal("allocating ballast", err)
+	runtime.KeepAlive(b)
+
+	// Explicit GC settings, an alternative to the ballast.
+	err = gctuning.Apply(config.GCPercent, config.MemoryLimitBytes)
+	util_log.CheckFatal("applying the GC settings", err)
 
 	// Start Loki
 	t, err := loki.New(config.Config)
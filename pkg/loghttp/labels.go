@@ -18,6 +18,18 @@ type LabelResponse struct {
 	Data   []string `json:"data,omitempty"`
 }
 
+// LabelValueCount is a label value and the number of series it is set on.
+type LabelValueCount struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// LabelCountsResponse represents the http json response to a label values query with counts
+type LabelCountsResponse struct {
+	Status string            `json:"status"`
+	Data   []LabelValueCount `json:"data,omitempty"`
+}
+
 // LabelSet is a key/value pair mapping of labels
 type LabelSet map[string]string
 
@@ -84,3 +96,8 @@ func ParseLabelQuery(r *http.Request) (*logproto.LabelRequest, error) {
 	req.End = &end
 	return req, nil
 }
+
+// ParseLabelWithCounts parses whether a label values request asks for the number of series of each value.
+func ParseLabelWithCounts(r *http.Request) (bool, error) {
+	return boolParam(r, "with_counts")
+}
@@ -46,6 +46,42 @@ func shards(r *http.Request) []string {
 	return r.Form["shards"]
 }
 
+func statsOnly(r *http.Request) (bool, error) {
+	return boolParam(r, "stats_only")
+}
+
+func explain(r *http.Request) (bool, error) {
+	return boolParam(r, "explain")
+}
+
+func boolParam(r *http.Request, name string) (bool, error) {
+	value := r.Form.Get(name)
+	if value == "" {
+		return false, nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.Errorf("invalid %s parameter %q, it must be a boolean", name, value)
+	}
+	return v, nil
+}
+
+func maxBytes(r *http.Request) (int, error) {
+	v, err := parseInt(r.Form.Get("max_bytes"), 0)
+	if err != nil || v < 0 {
+		return 0, errors.Errorf("invalid max_bytes parameter %q, it must be a non-negative integer", r.Form.Get("max_bytes"))
+	}
+	return v, nil
+}
+
+func maxPoints(r *http.Request) (int, error) {
+	v, err := parseInt(r.Form.Get("max_points"), 0)
+	if err != nil || v < 0 || v == 1 {
+		return 0, errors.Errorf("invalid max_points parameter %q, it must be 0 or an integer of at least 2", r.Form.Get("max_points"))
+	}
+	return v, nil
+}
+
 func bounds(r *http.Request) (time.Time, time.Time, error) {
 	now := time.Now()
 	start, err := parseTimestamp(r.Form.Get("start"), now.Add(-defaultSince))
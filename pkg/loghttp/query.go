@@ -15,6 +15,10 @@ import (
 	"github.com/grafana/loki/pkg/logqlmodel/stats"
 )
 
+// MaxPointsPerSeries is the maximum number of points per series a range query can return.
+// This is sufficient for 60s resolution for a week or 1h resolution for a year.
+const MaxPointsPerSeries = 11000
+
 var (
 	errEndBeforeStart   = errors.New("end timestamp must not be before or equal to start time")
 	errNegativeStep     = errors.New("zero or negative query resolution step widths are not accepted. Try a positive integer")
@@ -33,8 +37,9 @@ const (
 
 // QueryResponse represents the http json response to a Loki range and instant query
 type QueryResponse struct {
-	Status string            `json:"status"`
-	Data   QueryResponseData `json:"data"`
+	Status   string            `json:"status"`
+	Data     QueryResponseData `json:"data"`
+	Warnings []string          `json:"warnings,omitempty"`
 }
 
 func (q *QueryResponse) UnmarshalJSON(data []byte) error {
@@ -48,6 +53,26 @@ func (q *QueryResponse) UnmarshalJSON(data []byte) error {
 				return err
 			}
 			q.Data = responseData
+		case "warnings":
+			var warnings []string
+			var parseErr error
+			if _, err := jsonparser.ArrayEach(value, func(value []byte, dataType jsonparser.ValueType, _ int, _ error) {
+				if dataType != jsonparser.String {
+					return
+				}
+				warning, err := jsonparser.ParseString(value)
+				if err != nil {
+					parseErr = err
+					return
+				}
+				warnings = append(warnings, warning)
+			}); err != nil {
+				return err
+			}
+			if parseErr != nil {
+				return parseErr
+			}
+			q.Warnings = warnings
 		}
 		return nil
 	})
@@ -118,6 +143,7 @@ func (s Streams) ToProto() []logproto.Stream {
 	}
 	result := make([]logproto.Stream, 0, len(s))
 	for _, s := range s {
+		// Entry and logproto.Entry have the same layout, any field added to one must be added to the other.
 		entries := *(*[]logproto.Entry)(unsafe.Pointer(&s.Entries))
 		result = append(result, logproto.Stream{Labels: s.Labels.String(), Entries: entries})
 	}
@@ -245,6 +271,8 @@ type InstantQuery struct {
 	Limit     uint32
 	Direction logproto.Direction
 	Shards    []string
+	// StatsOnly requests only the statistics of the query, without its result.
+	StatsOnly bool
 }
 
 // ParseInstantQuery parses an InstantQuery request from an http request.
@@ -269,6 +297,11 @@ func ParseInstantQuery(r *http.Request) (*InstantQuery, error) {
 		return nil, err
 	}
 
+	request.StatsOnly, err = statsOnly(r)
+	if err != nil {
+		return nil, err
+	}
+
 	return request, nil
 }
 
@@ -282,58 +315,108 @@ type RangeQuery struct {
 	Direction logproto.Direction
 	Limit     uint32
 	Shards    []string
+	// StatsOnly requests only the statistics of the query, without its result.
+	StatsOnly bool
+	// MaxBytes caps the estimated serialized size of the entries of log queries, 0 for no cap.
+	MaxBytes int
+	// MaxPoints downsamples the series of metric queries to at most this many points, 0 to keep them all.
+	MaxPoints int
+	// Explain requests the plan of the query, how it is split and sharded, instead of its result.
+	Explain bool
 }
 
 // ParseRangeQuery parses a RangeQuery request from an http request.
 func ParseRangeQuery(r *http.Request) (*RangeQuery, error) {
+	result, _, err := parseRangeQuery(r, false)
+	return result, err
+}
+
+// ParseRangeQueryWithAutoStep parses a RangeQuery request from an http request like ParseRangeQuery, except
+// that the step of queries exceeding MaxPointsPerSeries is increased to AutoStep instead of rejecting them.
+// It returns whether the step was increased.
+func ParseRangeQueryWithAutoStep(r *http.Request) (*RangeQuery, bool, error) {
+	return parseRangeQuery(r, true)
+}
+
+// AutoStep returns the smallest step, in whole milliseconds, keeping a query over the given range
+// within MaxPointsPerSeries points per series.
+func AutoStep(rng time.Duration) time.Duration {
+	step := rng/(MaxPointsPerSeries+1) + 1
+	return (step + time.Millisecond - 1) / time.Millisecond * time.Millisecond
+}
+
+func parseRangeQuery(r *http.Request, autoStep bool) (*RangeQuery, bool, error) {
 	var result RangeQuery
 	var err error
 
 	result.Query = query(r)
 	result.Start, result.End, err = bounds(r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if result.End.Before(result.Start) {
-		return nil, errEndBeforeStart
+		return nil, false, errEndBeforeStart
 	}
 
 	result.Limit, err = limit(r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	result.Direction, err = direction(r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	result.Step, err = step(r, result.Start, result.End)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if result.Step <= 0 {
-		return nil, errNegativeStep
+		return nil, false, errNegativeStep
 	}
 
 	result.Shards = shards(r)
 
 	// For safety, limit the number of returned points per timeseries.
-	// This is sufficient for 60s resolution for a week or 1h resolution for a year.
-	if (result.End.Sub(result.Start) / result.Step) > 11000 {
-		return nil, errStepTooSmall
+	adjusted := false
+	if (result.End.Sub(result.Start) / result.Step) > MaxPointsPerSeries {
+		if !autoStep {
+			return nil, false, errStepTooSmall
+		}
+		result.Step, adjusted = AutoStep(result.End.Sub(result.Start)), true
 	}
 
 	result.Interval, err = interval(r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if result.Interval < 0 {
-		return nil, errNegativeInterval
+		return nil, false, errNegativeInterval
+	}
+
+	result.StatsOnly, err = statsOnly(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result.MaxBytes, err = maxBytes(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result.MaxPoints, err = maxPoints(r)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result.Explain, err = explain(r)
+	if err != nil {
+		return nil, false, err
 	}
 
-	return &result, nil
+	return &result, adjusted, nil
 }
@@ -70,6 +70,86 @@ func TestParseRangeQuery(t *testing.T) {
 				Limit:     1000,
 			}, false,
 		},
+		{
+			"bad stats only",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&stats_only=maybe`),
+			}, nil, true,
+		},
+		{
+			"stats only",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&stats_only=true`),
+			}, &RangeQuery{
+				Step:      time.Hour,
+				Query:     `{foo="bar"}`,
+				Direction: logproto.BACKWARD,
+				Start:     time.Date(2017, 06, 10, 21, 42, 24, 760738998, time.UTC),
+				End:       time.Date(2017, 07, 10, 21, 42, 24, 760738998, time.UTC),
+				Limit:     1000,
+				StatsOnly: true,
+			}, false,
+		},
+		{
+			"bad explain",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&explain=maybe`),
+			}, nil, true,
+		},
+		{
+			"explain",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&explain=true`),
+			}, &RangeQuery{
+				Step:      time.Hour,
+				Query:     `{foo="bar"}`,
+				Direction: logproto.BACKWARD,
+				Start:     time.Date(2017, 06, 10, 21, 42, 24, 760738998, time.UTC),
+				End:       time.Date(2017, 07, 10, 21, 42, 24, 760738998, time.UTC),
+				Limit:     1000,
+				Explain:   true,
+			}, false,
+		},
+		{
+			"bad max bytes",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&max_bytes=-1`),
+			}, nil, true,
+		},
+		{
+			"max bytes",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&max_bytes=1048576`),
+			}, &RangeQuery{
+				Step:      time.Hour,
+				Query:     `{foo="bar"}`,
+				Direction: logproto.BACKWARD,
+				Start:     time.Date(2017, 06, 10, 21, 42, 24, 760738998, time.UTC),
+				End:       time.Date(2017, 07, 10, 21, 42, 24, 760738998, time.UTC),
+				Limit:     1000,
+				MaxBytes:  1 << 20,
+			}, false,
+		},
+		{
+			"bad max points",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&max_points=1`),
+			}, nil, true,
+		},
+		{
+			"max points",
+			&http.Request{
+				URL: mustParseURL(`?query={foo="bar"}&start=2017-06-10T21:42:24.760738998Z&end=2017-07-10T21:42:24.760738998Z&limit=1000&direction=BACKWARD&step=3600&max_points=500`),
+			}, &RangeQuery{
+				Step:      time.Hour,
+				Query:     `{foo="bar"}`,
+				Direction: logproto.BACKWARD,
+				Start:     time.Date(2017, 06, 10, 21, 42, 24, 760738998, time.UTC),
+				End:       time.Date(2017, 07, 10, 21, 42, 24, 760738998, time.UTC),
+				Limit:     1000,
+				MaxPoints: 500,
+			}, false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -88,6 +168,41 @@ func TestParseRangeQuery(t *testing.T) {
 	}
 }
 
+func TestParseRangeQueryWithAutoStep(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		rng      time.Duration
+		step     string
+		want     time.Duration
+		adjusted bool
+	}{
+		{11000 * time.Second, "1", time.Second, false},
+		{11001 * time.Second, "1", 1001 * time.Millisecond, true},
+		{12 * time.Hour, "0.001", 3927 * time.Millisecond, true},
+		{7 * 24 * time.Hour, "50", 54977 * time.Millisecond, true},
+		{7 * 24 * time.Hour, "60", time.Minute, false},
+		{30 * 24 * time.Hour, "1", 235615 * time.Millisecond, true},
+	} {
+		start := time.Date(2017, 06, 10, 21, 42, 24, 0, time.UTC)
+		r := &http.Request{URL: mustParseURL(`?query={foo="bar"}&start=` + start.Format(time.RFC3339Nano) + `&end=` + start.Add(tc.rng).Format(time.RFC3339Nano) + `&step=` + tc.step)}
+		require.NoError(t, r.ParseForm())
+
+		got, adjusted, err := ParseRangeQueryWithAutoStep(r)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, got.Step, tc.rng)
+		require.Equal(t, tc.adjusted, adjusted, tc.rng)
+		require.LessOrEqual(t, int64(tc.rng/got.Step), int64(MaxPointsPerSeries))
+		if adjusted {
+			// the step is the smallest within the limit.
+			require.Greater(t, int64(tc.rng/(got.Step-time.Millisecond)), int64(MaxPointsPerSeries))
+		}
+
+		_, err = ParseRangeQuery(r)
+		require.Equal(t, tc.adjusted, err != nil)
+	}
+}
+
 func TestParseInstantQuery(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -268,3 +383,16 @@ func Test_QueryResponseUnmarshal(t *testing.T) {
 		})
 	}
 }
+
+// Streams.ToProto converts the entries of each stream without copying them, it relies on
+// loghttp.Entry and logproto.Entry having the same memory layout.
+func TestEntryLayout(t *testing.T) {
+	a, b := reflect.TypeOf(Entry{}), reflect.TypeOf(logproto.Entry{})
+	require.Equal(t, b.Size(), a.Size())
+	require.Equal(t, b.NumField(), a.NumField())
+	for i := 0; i < a.NumField(); i++ {
+		require.Equal(t, b.Field(i).Name, a.Field(i).Name)
+		require.Equal(t, b.Field(i).Type, a.Field(i).Type)
+		require.Equal(t, b.Field(i).Offset, a.Field(i).Offset)
+	}
+}
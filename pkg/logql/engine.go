@@ -124,6 +124,9 @@ func (q *query) Exec(ctx context.Context) (logqlmodel.Result, error) {
 	queueTime, _ := ctx.Value(httpreq.QueryQueueTimeHTTPHeader).(time.Duration)
 
 	statResult := statsCtx.Result(time.Since(start), queueTime)
+	if streams, ok := data.(logqlmodel.Streams); ok {
+		statResult.Summary.TotalStreamsReturned = int64(len(streams))
+	}
 	statResult.Log(level.Debug(log))
 
 	status := "200"
@@ -89,6 +89,9 @@ func RecordMetrics(ctx context.Context, p Params, status string, stats logql_sta
 	}
 
 	queryTags, _ := ctx.Value(httpreq.QueryTagsHTTPHeader).(string) // it's ok to be empty.
+	if queryTags == "" {
+		queryTags = stats.Summary.QueryTags
+	}
 
 	logValues := make([]interface{}, 0, 20)
 
@@ -106,6 +109,7 @@ func RecordMetrics(ctx context.Context, p Params, status string, stats logql_sta
 		"throughput", strings.Replace(humanize.Bytes(uint64(stats.Summary.BytesProcessedPerSecond)), " ", "", 1),
 		"total_bytes", strings.Replace(humanize.Bytes(uint64(stats.Summary.TotalBytesProcessed)), " ", "", 1),
 		"queue_time", logql_stats.ConvertSecondsToNanoseconds(stats.Summary.QueueTime),
+		"response_bytes", strings.Replace(humanize.Bytes(uint64(stats.Summary.ResponseBytes)), " ", "", 1),
 	}...)
 
 	logValues = append(logValues, tagsToKeyValues(queryTags)...)
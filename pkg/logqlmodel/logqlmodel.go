@@ -17,6 +17,7 @@ const PackedEntryKey = "_entry"
 type Result struct {
 	Data       parser.Value
 	Statistics stats.Result
+	Warnings   []string
 }
 
 // Streams is promql.Value
@@ -173,6 +173,15 @@ func (r *Result) Merge(m Result) {
 	r.Ingester.Merge(m.Ingester)
 	r.ComputeSummary(ConvertSecondsToNanoseconds(r.Summary.ExecTime+m.Summary.ExecTime),
 		ConvertSecondsToNanoseconds(r.Summary.QueueTime+m.Summary.QueueTime))
+	r.Summary.ResponseBytes += m.Summary.ResponseBytes
+	r.Summary.TotalSplits += m.Summary.TotalSplits
+	r.Summary.CachedSplits += m.Summary.CachedSplits
+	// all the parts of a query are submitted with the same tags.
+	if r.Summary.QueryTags == "" {
+		r.Summary.QueryTags = m.Summary.QueryTags
+	}
+	// the streams returned by the parts of a query may overlap, so TotalStreamsReturned is
+	// counted on their merged result instead.
 }
 
 // ConvertSecondsToNanoseconds converts time.Duration representation of seconds (float64)
@@ -292,5 +301,10 @@ func (s Summary) Log(log log.Logger) {
 		"Summary.TotalLinesProcessed", s.TotalLinesProcessed,
 		"Summary.ExecTime", ConvertSecondsToNanoseconds(s.ExecTime),
 		"Summary.QueueTime", ConvertSecondsToNanoseconds(s.QueueTime),
+		"Summary.ResponseBytes", humanize.Bytes(uint64(s.ResponseBytes)),
+		"Summary.QueryTags", s.QueryTags,
+		"Summary.TotalStreamsReturned", s.TotalStreamsReturned,
+		"Summary.TotalSplits", s.TotalSplits,
+		"Summary.CachedSplits", s.CachedSplits,
 	)
 }
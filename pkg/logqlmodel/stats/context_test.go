@@ -184,6 +184,7 @@ func TestResult_Merge(t *testing.T) {
 			LinesProcessedPerSecond: int64(50),
 			TotalBytesProcessed:     int64(84),
 			TotalLinesProcessed:     int64(100),
+			ResponseBytes:           int64(1024),
 		},
 	}
 
@@ -231,6 +232,7 @@ func TestResult_Merge(t *testing.T) {
 			LinesProcessedPerSecond: int64(50),
 			TotalBytesProcessed:     2 * int64(84),
 			TotalLinesProcessed:     2 * int64(100),
+			ResponseBytes:           2 * int64(1024),
 		},
 	}, res)
 }
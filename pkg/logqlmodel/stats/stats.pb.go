@@ -104,6 +104,16 @@ type Summary struct {
 	// In addition to internal calculations this is also returned by the HTTP API.
 	// Grafana expects time values to be returned in seconds as float.
 	QueueTime float64 `protobuf:"fixed64,6,opt,name=queueTime,proto3" json:"queueTime"`
+	// Size in bytes of the serialized query response.
+	ResponseBytes int64 `protobuf:"varint,7,opt,name=responseBytes,proto3" json:"responseBytes,omitempty"`
+	// Query tags the query was submitted with, from the X-Query-Tags header.
+	QueryTags string `protobuf:"bytes,8,opt,name=queryTags,proto3" json:"queryTags,omitempty"`
+	// Total number of unique streams returned by a log query.
+	TotalStreamsReturned int64 `protobuf:"varint,9,opt,name=totalStreamsReturned,proto3" json:"totalStreamsReturned,omitempty"`
+	// Number of splits of a query going through the results cache.
+	TotalSplits int64 `protobuf:"varint,10,opt,name=totalSplits,proto3" json:"totalSplits,omitempty"`
+	// Number of splits of a query entirely served from the results cache.
+	CachedSplits int64 `protobuf:"varint,11,opt,name=cachedSplits,proto3" json:"cachedSplits,omitempty"`
 }
 
 func (m *Summary) Reset()      { *m = Summary{} }
@@ -180,6 +190,41 @@ func (m *Summary) GetQueueTime() float64 {
 	return 0
 }
 
+func (m *Summary) GetResponseBytes() int64 {
+	if m != nil {
+		return m.ResponseBytes
+	}
+	return 0
+}
+
+func (m *Summary) GetQueryTags() string {
+	if m != nil {
+		return m.QueryTags
+	}
+	return ""
+}
+
+func (m *Summary) GetTotalStreamsReturned() int64 {
+	if m != nil {
+		return m.TotalStreamsReturned
+	}
+	return 0
+}
+
+func (m *Summary) GetTotalSplits() int64 {
+	if m != nil {
+		return m.TotalSplits
+	}
+	return 0
+}
+
+func (m *Summary) GetCachedSplits() int64 {
+	if m != nil {
+		return m.CachedSplits
+	}
+	return 0
+}
+
 type Querier struct {
 	Store Store `protobuf:"bytes,1,opt,name=store,proto3" json:"store"`
 }
@@ -473,52 +518,60 @@ func init() {
 func init() { proto.RegisterFile("pkg/logqlmodel/stats/stats.proto", fileDescriptor_6cdfe5d2aea33ebb) }
 
 var fileDescriptor_6cdfe5d2aea33ebb = []byte{
-	// 714 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x55, 0x3d, 0x6f, 0xd3, 0x5c,
-	0x14, 0x8e, 0x93, 0xd7, 0x49, 0x7a, 0xdf, 0x7e, 0x71, 0xab, 0xd2, 0x00, 0x92, 0x5d, 0x65, 0xaa,
-	0x04, 0x34, 0xe2, 0x63, 0x01, 0xd1, 0xc5, 0xad, 0x90, 0x2a, 0x81, 0x28, 0xa7, 0xb0, 0xb0, 0x39,
-	0xce, 0x6d, 0x62, 0xd5, 0xf1, 0x4d, 0xfd, 0x21, 0xe8, 0xc6, 0xc6, 0x08, 0x3f, 0x82, 0x81, 0x85,
-	0x9f, 0xc0, 0xde, 0xb1, 0x63, 0x27, 0x8b, 0xba, 0x0b, 0xf2, 0xd4, 0x9f, 0x80, 0x7c, 0xae, 0x63,
-	0xd7, 0x37, 0x8e, 0xc4, 0x92, 0x9c, 0xf3, 0x3c, 0xe7, 0x39, 0xe7, 0xfa, 0x3c, 0xd7, 0x32, 0xd9,
-	0x9c, 0x1c, 0x0f, 0x7b, 0x0e, 0x1f, 0x9e, 0x38, 0x63, 0x3e, 0x60, 0x4e, 0xcf, 0x0f, 0xcc, 0xc0,
-	0x17, 0xbf, 0xdb, 0x13, 0x8f, 0x07, 0x9c, 0xaa, 0x98, 0xdc, 0x7d, 0x38, 0xb4, 0x83, 0x51, 0xd8,
-	0xdf, 0xb6, 0xf8, 0xb8, 0x37, 0xe4, 0x43, 0xde, 0x43, 0xb6, 0x1f, 0x1e, 0x61, 0x86, 0x09, 0x46,
-	0x42, 0xd5, 0xfd, 0xa5, 0x90, 0x26, 0x30, 0x3f, 0x74, 0x02, 0xfa, 0x8c, 0xb4, 0xfc, 0x70, 0x3c,
-	0x36, 0xbd, 0xd3, 0x8e, 0xb2, 0xa9, 0x6c, 0xfd, 0xff, 0x78, 0x79, 0x5b, 0xf4, 0x3f, 0x14, 0xa8,
-	0xb1, 0x72, 0x16, 0xe9, 0xb5, 0x24, 0xd2, 0xa7, 0x65, 0x30, 0x0d, 0x52, 0xe9, 0x49, 0xc8, 0x3c,
-	0x9b, 0x79, 0x9d, 0x7a, 0x49, 0xfa, 0x56, 0xa0, 0x85, 0x34, 0x2b, 0x83, 0x69, 0x40, 0x77, 0x48,
-	0xdb, 0x76, 0x87, 0xcc, 0x0f, 0x98, 0xd7, 0x69, 0xa0, 0x76, 0x25, 0xd3, 0xee, 0x67, 0xb0, 0xb1,
-	0x9a, 0x89, 0xf3, 0x42, 0xc8, 0xa3, 0xee, 0xf7, 0x06, 0x69, 0x65, 0xe7, 0xa3, 0xef, 0xc9, 0x46,
-	0xff, 0x34, 0x60, 0xfe, 0x81, 0xc7, 0x2d, 0xe6, 0xfb, 0x6c, 0x70, 0xc0, 0xbc, 0x43, 0x66, 0x71,
-	0x77, 0x80, 0x0f, 0xd4, 0x30, 0xee, 0x25, 0x91, 0x3e, 0xaf, 0x04, 0xe6, 0x11, 0x69, 0x5b, 0xc7,
-	0x76, 0x2b, 0xdb, 0xd6, 0x8b, 0xb6, 0x73, 0x4a, 0x60, 0x1e, 0x41, 0xf7, 0xc9, 0x5a, 0xc0, 0x03,
-	0xd3, 0x31, 0x4a, 0x63, 0x71, 0x07, 0x0d, 0x63, 0x23, 0x89, 0xf4, 0x2a, 0x1a, 0xaa, 0xc0, 0xbc,
-	0xd5, 0xab, 0xd2, 0xa8, 0xce, 0x7f, 0x52, 0xab, 0x32, 0x0d, 0x55, 0x20, 0xdd, 0x22, 0x6d, 0xf6,
-	0x89, 0x59, 0xef, 0xec, 0x31, 0xeb, 0xa8, 0x9b, 0xca, 0x96, 0x62, 0x2c, 0xa6, 0x9b, 0x9f, 0x62,
-	0x90, 0x47, 0xf4, 0x3e, 0x59, 0x38, 0x09, 0x59, 0xc8, 0xb0, 0xb4, 0x89, 0xa5, 0x4b, 0x49, 0xa4,
-	0x17, 0x20, 0x14, 0x61, 0xf7, 0x05, 0x69, 0x65, 0x57, 0x81, 0x3e, 0x22, 0xaa, 0x1f, 0x70, 0x8f,
-	0x65, 0x97, 0x6c, 0x71, 0x7a, 0xc9, 0x52, 0xcc, 0x58, 0xca, 0xac, 0x16, 0x25, 0x20, 0xfe, 0xba,
-	0x3f, 0xeb, 0xa4, 0x3d, 0xbd, 0x0d, 0xf4, 0x29, 0x59, 0xc4, 0x83, 0x03, 0x33, 0xad, 0x11, 0x13,
-	0xd6, 0xaa, 0xc6, 0x6a, 0x12, 0xe9, 0x25, 0x1c, 0x4a, 0x19, 0x7d, 0x49, 0x28, 0xe6, 0xbb, 0xa3,
-	0xd0, 0x3d, 0xf6, 0x5f, 0x9b, 0x01, 0x6a, 0x85, 0x7f, 0xb7, 0x93, 0x48, 0xaf, 0x60, 0xa1, 0x02,
-	0xcb, 0xa7, 0x1b, 0x98, 0xfb, 0x99, 0x5d, 0xc5, 0xf4, 0x0c, 0x87, 0x52, 0x46, 0x9f, 0x93, 0xe5,
-	0x62, 0xd9, 0x87, 0xcc, 0x0d, 0x32, 0x6f, 0x68, 0x12, 0xe9, 0x12, 0x03, 0x52, 0x5e, 0xec, 0x4b,
-	0xfd, 0xe7, 0x7d, 0x7d, 0xad, 0x13, 0x15, 0xf9, 0x7c, 0xb0, 0x78, 0x08, 0x60, 0x47, 0xd9, 0x9b,
-	0x50, 0x0c, 0xce, 0x19, 0x90, 0x72, 0xfa, 0x86, 0xac, 0xdf, 0x40, 0xf6, 0xf8, 0x47, 0xd7, 0xe1,
-	0xe6, 0x20, 0xdf, 0xda, 0x9d, 0x24, 0xd2, 0xab, 0x0b, 0xa0, 0x1a, 0x4e, 0x3d, 0xb0, 0x4a, 0x18,
-	0x5e, 0x9d, 0x46, 0xe1, 0xc1, 0x2c, 0x0b, 0x15, 0x58, 0xba, 0x11, 0x44, 0x71, 0x89, 0xc5, 0x46,
-	0x70, 0x5e, 0xb1, 0x11, 0x2c, 0x01, 0xf1, 0xd7, 0xfd, 0xd2, 0x20, 0x2a, 0xf2, 0xe9, 0x46, 0x46,
-	0xcc, 0x1c, 0x88, 0xe2, 0xf4, 0x35, 0xba, 0x69, 0x45, 0x99, 0x01, 0x29, 0x2f, 0x69, 0xd1, 0x20,
-	0xf4, 0x44, 0xd6, 0x22, 0x03, 0x52, 0x4e, 0x77, 0xc9, 0xad, 0x01, 0xb3, 0xf8, 0x78, 0xe2, 0xe1,
-	0x8b, 0x26, 0x46, 0x37, 0x51, 0xbe, 0x9e, 0x44, 0xfa, 0x2c, 0x09, 0xb3, 0x90, 0xdc, 0x44, 0x9c,
-	0xa1, 0x55, 0xdd, 0x44, 0x1c, 0x63, 0x16, 0xa2, 0x3b, 0x64, 0x45, 0x3e, 0x47, 0x1b, 0x5b, 0xac,
-	0x25, 0x91, 0x2e, 0x53, 0x20, 0x03, 0xa9, 0x1c, 0xed, 0xdd, 0x0b, 0x27, 0x8e, 0x6d, 0x99, 0xa9,
-	0x7c, 0xa1, 0x90, 0x4b, 0x14, 0xc8, 0x80, 0xd1, 0x3f, 0xbf, 0xd4, 0x6a, 0x17, 0x97, 0x5a, 0xed,
-	0xfa, 0x52, 0x53, 0x3e, 0xc7, 0x9a, 0xf2, 0x23, 0xd6, 0x94, 0xb3, 0x58, 0x53, 0xce, 0x63, 0x4d,
-	0xf9, 0x1d, 0x6b, 0xca, 0x9f, 0x58, 0xab, 0x5d, 0xc7, 0x9a, 0xf2, 0xed, 0x4a, 0xab, 0x9d, 0x5f,
-	0x69, 0xb5, 0x8b, 0x2b, 0xad, 0xf6, 0xe1, 0xc1, 0xcd, 0xaf, 0x9a, 0x67, 0x1e, 0x99, 0xae, 0xd9,
-	0x73, 0xf8, 0xb1, 0xdd, 0xab, 0xfa, 0x2c, 0xf6, 0x9b, 0xf8, 0x6d, 0x7b, 0xf2, 0x37, 0x00, 0x00,
-	0xff, 0xff, 0xf4, 0x8b, 0xe3, 0xd1, 0x35, 0x07, 0x00, 0x00,
+	// 834 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x56, 0xcd, 0x6f, 0xe3, 0x44,
+	0x14, 0x8f, 0x93, 0x75, 0x3e, 0xa6, 0xe9, 0x76, 0x99, 0xa5, 0xbb, 0x66, 0x91, 0xec, 0x28, 0xa7,
+	0x48, 0x2c, 0x8d, 0xf8, 0x3a, 0xf0, 0xb1, 0x48, 0x78, 0x57, 0x48, 0x2b, 0x81, 0x28, 0x93, 0xc2,
+	0x81, 0x9b, 0x63, 0x4f, 0x13, 0xab, 0xb6, 0x27, 0xf5, 0x8c, 0x05, 0xb9, 0x71, 0xe3, 0x08, 0x7f,
+	0x06, 0x17, 0xfe, 0x04, 0xee, 0x3d, 0xf6, 0xd8, 0x93, 0x45, 0xd3, 0x0b, 0xf2, 0xa9, 0x12, 0xff,
+	0x00, 0xf2, 0x1b, 0xc7, 0x5f, 0x71, 0xa4, 0xbd, 0x34, 0xf3, 0x7e, 0x1f, 0xef, 0xcd, 0xbc, 0x99,
+	0x57, 0x19, 0x8d, 0x56, 0x17, 0x8b, 0xa9, 0xc7, 0x16, 0x97, 0x9e, 0xcf, 0x1c, 0xea, 0x4d, 0xb9,
+	0xb0, 0x04, 0x97, 0x7f, 0x4f, 0x56, 0x21, 0x13, 0x0c, 0xab, 0x10, 0x3c, 0x7b, 0x7f, 0xe1, 0x8a,
+	0x65, 0x34, 0x3f, 0xb1, 0x99, 0x3f, 0x5d, 0xb0, 0x05, 0x9b, 0x02, 0x3b, 0x8f, 0xce, 0x21, 0x82,
+	0x00, 0x56, 0xd2, 0x35, 0xfe, 0x5b, 0x41, 0x5d, 0x42, 0x79, 0xe4, 0x09, 0xfc, 0x29, 0xea, 0xf1,
+	0xc8, 0xf7, 0xad, 0x70, 0xad, 0x29, 0x23, 0x65, 0x72, 0xf0, 0xe1, 0xc3, 0x13, 0x99, 0x7f, 0x26,
+	0x51, 0xf3, 0xe8, 0x2a, 0x36, 0x5a, 0x49, 0x6c, 0x6c, 0x65, 0x64, 0xbb, 0x48, 0xad, 0x97, 0x11,
+	0x0d, 0x5d, 0x1a, 0x6a, 0xed, 0x8a, 0xf5, 0x7b, 0x89, 0x16, 0xd6, 0x4c, 0x46, 0xb6, 0x0b, 0xfc,
+	0x02, 0xf5, 0xdd, 0x60, 0x41, 0xb9, 0xa0, 0xa1, 0xd6, 0x01, 0xef, 0x51, 0xe6, 0x7d, 0x9d, 0xc1,
+	0xe6, 0xa3, 0xcc, 0x9c, 0x0b, 0x49, 0xbe, 0x1a, 0xff, 0xa7, 0xa2, 0x5e, 0xb6, 0x3f, 0xfc, 0x03,
+	0x7a, 0x3a, 0x5f, 0x0b, 0xca, 0x4f, 0x43, 0x66, 0x53, 0xce, 0xa9, 0x73, 0x4a, 0xc3, 0x19, 0xb5,
+	0x59, 0xe0, 0xc0, 0x81, 0x3a, 0xe6, 0xbb, 0x49, 0x6c, 0xec, 0x93, 0x90, 0x7d, 0x44, 0x9a, 0xd6,
+	0x73, 0x83, 0xc6, 0xb4, 0xed, 0x22, 0xed, 0x1e, 0x09, 0xd9, 0x47, 0xe0, 0xd7, 0xe8, 0xb1, 0x60,
+	0xc2, 0xf2, 0xcc, 0x4a, 0x59, 0xe8, 0x41, 0xc7, 0x7c, 0x9a, 0xc4, 0x46, 0x13, 0x4d, 0x9a, 0xc0,
+	0x3c, 0xd5, 0x37, 0x95, 0x52, 0xda, 0x83, 0x5a, 0xaa, 0x2a, 0x4d, 0x9a, 0x40, 0x3c, 0x41, 0x7d,
+	0xfa, 0x0b, 0xb5, 0xcf, 0x5c, 0x9f, 0x6a, 0xea, 0x48, 0x99, 0x28, 0xe6, 0x30, 0xed, 0xfc, 0x16,
+	0x23, 0xf9, 0x0a, 0xbf, 0x87, 0x06, 0x97, 0x11, 0x8d, 0x28, 0x48, 0xbb, 0x20, 0x3d, 0x4c, 0x62,
+	0xa3, 0x00, 0x49, 0xb1, 0xc4, 0x5f, 0xa1, 0xc3, 0x90, 0xf2, 0x15, 0x0b, 0x38, 0x85, 0xbd, 0x6b,
+	0xbd, 0xa2, 0x73, 0x15, 0xe2, 0x39, 0xf3, 0x5d, 0x41, 0xfd, 0x95, 0x58, 0x93, 0xaa, 0x03, 0x7f,
+	0x02, 0xf5, 0xc2, 0xf5, 0x99, 0xb5, 0xe0, 0x5a, 0x7f, 0xa4, 0x4c, 0x06, 0xf2, 0x68, 0x39, 0x58,
+	0xb2, 0x16, 0x4a, 0xfc, 0x23, 0x7a, 0x1b, 0xce, 0x39, 0x13, 0x21, 0xb5, 0x7c, 0x4e, 0xa8, 0x88,
+	0xc2, 0x80, 0x3a, 0xda, 0x00, 0x36, 0x30, 0x4e, 0x62, 0x43, 0x6f, 0xe2, 0x4b, 0xc9, 0x1a, 0xfd,
+	0xf8, 0x73, 0x74, 0x20, 0xf1, 0x95, 0xe7, 0x0a, 0xae, 0x21, 0x48, 0xf7, 0x4e, 0x12, 0x1b, 0xc7,
+	0x25, 0xb8, 0x94, 0xa5, 0xac, 0xc6, 0x5f, 0xa2, 0xa1, 0x6d, 0xd9, 0x4b, 0xea, 0x64, 0xee, 0x03,
+	0x70, 0x3f, 0x4b, 0x62, 0xe3, 0x49, 0x19, 0x2f, 0xd9, 0x2b, 0xfa, 0xf1, 0x17, 0xa8, 0x97, 0x4d,
+	0x16, 0xfe, 0x00, 0xa9, 0x5c, 0xb0, 0x90, 0x66, 0x33, 0x3b, 0xdc, 0xce, 0x6c, 0x8a, 0x99, 0x87,
+	0xd9, 0xe4, 0x48, 0x09, 0x91, 0x3f, 0xe3, 0xbf, 0xda, 0xa8, 0xbf, 0x1d, 0x2e, 0xfc, 0x31, 0x1a,
+	0xc2, 0xce, 0x08, 0x85, 0x02, 0x90, 0x46, 0x35, 0x1f, 0x25, 0xb1, 0x51, 0xc1, 0x49, 0x25, 0xc2,
+	0x5f, 0x23, 0x0c, 0xf1, 0xcb, 0x65, 0x14, 0x5c, 0xf0, 0x6f, 0x2d, 0x01, 0x5e, 0x39, 0x0e, 0x4f,
+	0x92, 0xd8, 0x68, 0x60, 0x49, 0x03, 0x96, 0x57, 0x37, 0x21, 0xe6, 0xd9, 0xeb, 0x2f, 0xaa, 0x67,
+	0x38, 0xa9, 0x44, 0xf8, 0x33, 0xf4, 0xb0, 0x78, 0xbb, 0x33, 0x1a, 0x88, 0xec, 0xa9, 0xe3, 0x24,
+	0x36, 0x6a, 0x0c, 0xa9, 0xc5, 0x45, 0xbf, 0xd4, 0x37, 0xee, 0xd7, 0xef, 0x6d, 0xa4, 0x02, 0x9f,
+	0x17, 0x96, 0x87, 0x20, 0xf4, 0x5c, 0x53, 0x6a, 0x85, 0x73, 0x86, 0xd4, 0x62, 0xfc, 0x1d, 0x3a,
+	0x2e, 0x21, 0xaf, 0xd8, 0xcf, 0x81, 0xc7, 0x2c, 0x27, 0xef, 0x5a, 0xf1, 0x74, 0xea, 0x02, 0xd2,
+	0x0c, 0xa7, 0x77, 0x60, 0x57, 0x30, 0x98, 0xc4, 0x4e, 0x71, 0x07, 0xbb, 0x2c, 0x69, 0xc0, 0xd2,
+	0x8e, 0x00, 0xaa, 0x3d, 0xa8, 0x74, 0x04, 0xea, 0x15, 0x1d, 0x01, 0x09, 0x91, 0x3f, 0xe3, 0xdf,
+	0x3a, 0x48, 0x05, 0x3e, 0xed, 0xc8, 0x92, 0x5a, 0x8e, 0x14, 0xc3, 0x64, 0x97, 0xae, 0xa2, 0xca,
+	0x90, 0x5a, 0x5c, 0xf1, 0xc2, 0x05, 0x69, 0x6a, 0x83, 0x17, 0x18, 0x52, 0x8b, 0xf1, 0x4b, 0xf4,
+	0x96, 0x43, 0x6d, 0xe6, 0xaf, 0x42, 0xf8, 0xbf, 0x25, 0x4b, 0x77, 0xc1, 0x7e, 0x9c, 0xc4, 0xc6,
+	0x2e, 0x49, 0x76, 0xa1, 0x7a, 0x12, 0xb9, 0x87, 0x5e, 0x73, 0x12, 0xb9, 0x8d, 0x5d, 0x08, 0xbf,
+	0x40, 0x47, 0xf5, 0x7d, 0xf4, 0x21, 0xc5, 0xe3, 0x24, 0x36, 0xea, 0x14, 0xa9, 0x03, 0xa9, 0x1d,
+	0xae, 0xf7, 0x55, 0xb4, 0xf2, 0x5c, 0xdb, 0x4a, 0xed, 0x83, 0xc2, 0x5e, 0xa3, 0x48, 0x1d, 0x30,
+	0xe7, 0xd7, 0xb7, 0x7a, 0xeb, 0xe6, 0x56, 0x6f, 0xdd, 0xdf, 0xea, 0xca, 0xaf, 0x1b, 0x5d, 0xf9,
+	0x73, 0xa3, 0x2b, 0x57, 0x1b, 0x5d, 0xb9, 0xde, 0xe8, 0xca, 0x3f, 0x1b, 0x5d, 0xf9, 0x77, 0xa3,
+	0xb7, 0xee, 0x37, 0xba, 0xf2, 0xc7, 0x9d, 0xde, 0xba, 0xbe, 0xd3, 0x5b, 0x37, 0x77, 0x7a, 0xeb,
+	0xa7, 0xe7, 0xe5, 0x8f, 0x84, 0xd0, 0x3a, 0xb7, 0x02, 0x6b, 0xea, 0xb1, 0x0b, 0x77, 0xda, 0xf4,
+	0x95, 0x31, 0xef, 0xc2, 0xa7, 0xc2, 0x47, 0xff, 0x0f, 0x00, 0x43, 0x0a, 0x7c, 0xbe, 0x84, 0x08,
+	0x00, 0x00,
 }
 
 func (this *Result) Equal(that interface{}) bool {
@@ -588,6 +641,21 @@ func (this *Summary) Equal(that interface{}) bool {
 	if this.QueueTime != that1.QueueTime {
 		return false
 	}
+	if this.ResponseBytes != that1.ResponseBytes {
+		return false
+	}
+	if this.QueryTags != that1.QueryTags {
+		return false
+	}
+	if this.TotalStreamsReturned != that1.TotalStreamsReturned {
+		return false
+	}
+	if this.TotalSplits != that1.TotalSplits {
+		return false
+	}
+	if this.CachedSplits != that1.CachedSplits {
+		return false
+	}
 	return true
 }
 func (this *Querier) Equal(that interface{}) bool {
@@ -738,7 +806,7 @@ func (this *Summary) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 10)
+	s := make([]string, 0, 15)
 	s = append(s, "&stats.Summary{")
 	s = append(s, "BytesProcessedPerSecond: "+fmt.Sprintf("%#v", this.BytesProcessedPerSecond)+",\n")
 	s = append(s, "LinesProcessedPerSecond: "+fmt.Sprintf("%#v", this.LinesProcessedPerSecond)+",\n")
@@ -746,6 +814,11 @@ func (this *Summary) GoString() string {
 	s = append(s, "TotalLinesProcessed: "+fmt.Sprintf("%#v", this.TotalLinesProcessed)+",\n")
 	s = append(s, "ExecTime: "+fmt.Sprintf("%#v", this.ExecTime)+",\n")
 	s = append(s, "QueueTime: "+fmt.Sprintf("%#v", this.QueueTime)+",\n")
+	s = append(s, "ResponseBytes: "+fmt.Sprintf("%#v", this.ResponseBytes)+",\n")
+	s = append(s, "QueryTags: "+fmt.Sprintf("%#v", this.QueryTags)+",\n")
+	s = append(s, "TotalStreamsReturned: "+fmt.Sprintf("%#v", this.TotalStreamsReturned)+",\n")
+	s = append(s, "TotalSplits: "+fmt.Sprintf("%#v", this.TotalSplits)+",\n")
+	s = append(s, "CachedSplits: "+fmt.Sprintf("%#v", this.CachedSplits)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -882,6 +955,33 @@ func (m *Summary) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.CachedSplits != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.CachedSplits))
+		i--
+		dAtA[i] = 0x58
+	}
+	if m.TotalSplits != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.TotalSplits))
+		i--
+		dAtA[i] = 0x50
+	}
+	if m.TotalStreamsReturned != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.TotalStreamsReturned))
+		i--
+		dAtA[i] = 0x48
+	}
+	if len(m.QueryTags) > 0 {
+		i -= len(m.QueryTags)
+		copy(dAtA[i:], m.QueryTags)
+		i = encodeVarintStats(dAtA, i, uint64(len(m.QueryTags)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if m.ResponseBytes != 0 {
+		i = encodeVarintStats(dAtA, i, uint64(m.ResponseBytes))
+		i--
+		dAtA[i] = 0x38
+	}
 	if m.QueueTime != 0 {
 		i -= 8
 		encoding_binary.LittleEndian.PutUint64(dAtA[i:], uint64(math.Float64bits(float64(m.QueueTime))))
@@ -1154,6 +1254,22 @@ func (m *Summary) Size() (n int) {
 	if m.QueueTime != 0 {
 		n += 9
 	}
+	if m.ResponseBytes != 0 {
+		n += 1 + sovStats(uint64(m.ResponseBytes))
+	}
+	l = len(m.QueryTags)
+	if l > 0 {
+		n += 1 + l + sovStats(uint64(l))
+	}
+	if m.TotalStreamsReturned != 0 {
+		n += 1 + sovStats(uint64(m.TotalStreamsReturned))
+	}
+	if m.TotalSplits != 0 {
+		n += 1 + sovStats(uint64(m.TotalSplits))
+	}
+	if m.CachedSplits != 0 {
+		n += 1 + sovStats(uint64(m.CachedSplits))
+	}
 	return n
 }
 
@@ -1267,6 +1383,11 @@ func (this *Summary) String() string {
 		`TotalLinesProcessed:` + fmt.Sprintf("%v", this.TotalLinesProcessed) + `,`,
 		`ExecTime:` + fmt.Sprintf("%v", this.ExecTime) + `,`,
 		`QueueTime:` + fmt.Sprintf("%v", this.QueueTime) + `,`,
+		`ResponseBytes:` + fmt.Sprintf("%v", this.ResponseBytes) + `,`,
+		`QueryTags:` + fmt.Sprintf("%v", this.QueryTags) + `,`,
+		`TotalStreamsReturned:` + fmt.Sprintf("%v", this.TotalStreamsReturned) + `,`,
+		`TotalSplits:` + fmt.Sprintf("%v", this.TotalSplits) + `,`,
+		`CachedSplits:` + fmt.Sprintf("%v", this.CachedSplits) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -1610,6 +1731,114 @@ func (m *Summary) Unmarshal(dAtA []byte) error {
 			v = uint64(encoding_binary.LittleEndian.Uint64(dAtA[iNdEx:]))
 			iNdEx += 8
 			m.QueueTime = float64(math.Float64frombits(v))
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponseBytes", wireType)
+			}
+			m.ResponseBytes = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ResponseBytes |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field QueryTags", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStats
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStats
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.QueryTags = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TotalStreamsReturned", wireType)
+			}
+			m.TotalStreamsReturned = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TotalStreamsReturned |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field TotalSplits", wireType)
+			}
+			m.TotalSplits = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.TotalSplits |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CachedSplits", wireType)
+			}
+			m.CachedSplits = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStats
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.CachedSplits |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStats(dAtA[iNdEx:])
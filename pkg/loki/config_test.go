@@ -17,7 +17,7 @@ func TestCrossComponentValidation(t *testing.T) {
 	for _, tc := range []struct {
 		desc string
 		base *Config
-		err  bool
+		err  string
 	}{
 		{
 			desc: "correct shards",
@@ -47,7 +47,6 @@ func TestCrossComponentValidation(t *testing.T) {
 					},
 				},
 			},
-			err: false,
 		},
 		{
 			desc: "correct shards",
@@ -62,27 +61,28 @@ func TestCrossComponentValidation(t *testing.T) {
 								RowShards: 16,
 								Schema:    "v11",
 								From: chunk.DayTime{
-									Time: model.Now().Add(-48 * time.Hour),
+									Time: model.TimeFromUnix(time.Date(2022, 1, 8, 0, 0, 0, 0, time.UTC).Unix()),
 								},
 							},
 							{
 								RowShards: 17,
 								Schema:    "v11",
 								From: chunk.DayTime{
-									Time: model.Now(),
+									Time: model.TimeFromUnix(time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC).Unix()),
 								},
 							},
 						},
 					},
 				},
 			},
-			err: true,
+			err: "for period config at index (1) with from (2022-01-10) and schema (v11)",
 		},
 	} {
 		tc.base.RegisterFlags(flag.NewFlagSet(tc.desc, 0))
 		err := tc.base.Validate()
-		if tc.err {
-			require.NotNil(t, err)
+		if tc.err != "" {
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.err)
 		} else {
 			require.Nil(t, err)
 		}
@@ -5,9 +5,14 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"os"
 	rt "runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	cortex_tripper "github.com/cortexproject/cortex/pkg/querier/queryrange"
 	cortex_ruler "github.com/cortexproject/cortex/pkg/ruler"
@@ -16,6 +21,7 @@ import (
 	"github.com/fatih/color"
 	"github.com/felixge/fgprof"
 	"github.com/go-kit/log/level"
+	"github.com/gorilla/mux"
 	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/grpcutil"
 	"github.com/grafana/dskit/kv/memberlist"
@@ -46,7 +52,10 @@ import (
 	"github.com/grafana/loki/pkg/storage/chunk"
 	"github.com/grafana/loki/pkg/storage/stores/shipper/compactor"
 	"github.com/grafana/loki/pkg/tracing"
+	"github.com/grafana/loki/pkg/util/ballast"
 	"github.com/grafana/loki/pkg/util/fakeauth"
+	"github.com/grafana/loki/pkg/util/gctuning"
+	"github.com/grafana/loki/pkg/util/jwtauth"
 	serverutil "github.com/grafana/loki/pkg/util/server"
 	"github.com/grafana/loki/pkg/validation"
 )
@@ -57,6 +66,15 @@ type Config struct {
 	AuthEnabled  bool                   `yaml:"auth_enabled,omitempty"`
 	HTTPPrefix   string                 `yaml:"http_prefix"`
 	BallastBytes int                    `yaml:"ballast_bytes"`
+	BallastMode  string                 `yaml:"ballast_mode"`
+
+	GCPercent        int   `yaml:"gc_percent"`
+	MemoryLimitBytes int64 `yaml:"memory_limit_bytes"`
+
+	ProfilingEnabled bool          `yaml:"profiling_enabled"`
+	StartupTimeout   time.Duration `yaml:"startup_timeout"`
+	StartupJitter    time.Duration `yaml:"startup_jitter"`
+	ReadinessDelay   time.Duration `yaml:"readiness_delay"`
 
 	Common           common.Config            `yaml:"common,omitempty"`
 	Server           server.Config            `yaml:"server,omitempty"`
@@ -76,6 +94,7 @@ type Config struct {
 	RuntimeConfig    runtimeconfig.Config     `yaml:"runtime_config,omitempty"`
 	MemberlistKV     memberlist.KVConfig      `yaml:"memberlist"`
 	Tracing          tracing.Config           `yaml:"tracing"`
+	JWTAuth          jwtauth.Config           `yaml:"jwt_auth,omitempty"`
 	CompactorConfig  compactor.Config         `yaml:"compactor,omitempty"`
 	QueryScheduler   scheduler.Config         `yaml:"query_scheduler"`
 }
@@ -93,6 +112,14 @@ func (c *Config) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&c.AuthEnabled, "auth.enabled", true, "Set to false to disable auth.")
 	f.IntVar(&c.BallastBytes, "config.ballast-bytes", 0, "The amount of virtual memory to reserve as a ballast in order to optimise "+
 		"garbage collection. Larger ballasts result in fewer garbage collection passes, reducing compute overhead at the cost of memory usage.")
+	f.StringVar(&c.BallastMode, "config.ballast-mode", ballast.ModeHeap, "How the ballast is allocated. Supported values are: "+strings.Join(ballast.Modes, ", ")+". "+
+		"The mmap mode reserves the ballast outside of the Go heap, where the garbage collector doesn't account for it: it doesn't reduce the garbage collection frequency, and falls back to the heap with a warning when the memory mapping can't be created.")
+	f.IntVar(&c.GCPercent, "config.gc-percent", 0, "Garbage collection target percentage of the Go runtime, like GOGC: a collection is triggered when the heap grows by this percentage over the live heap. -1 disables the garbage collection until the memory limit is reached. 0 to leave the default.")
+	f.Int64Var(&c.MemoryLimitBytes, "config.memory-limit-bytes", 0, "Soft memory limit of the Go runtime, like GOMEMLIMIT: the garbage collection runs more often as the memory used approaches it. An alternative to the ballast, requiring Go 1.19. 0 to leave the default.")
+	f.BoolVar(&c.ProfilingEnabled, "profiling.enabled", true, "Expose the /debug/pprof and /debug/fgprof profiling endpoints and the /loki/api/v1/status/tripperware debug endpoint. Set to false to disable them.")
+	f.DurationVar(&c.StartupTimeout, "config.startup-timeout", 0, "Maximum time to wait for all the modules to start. When exceeded, Loki logs the modules still starting and exits with an error. 0 to wait indefinitely.")
+	f.DurationVar(&c.StartupJitter, "config.startup-jitter", 0, "Maximum random delay before initializing the modules, spreading the load on the KV and object stores when many processes start at once. 0 to start immediately.")
+	f.DurationVar(&c.ReadinessDelay, "config.readiness-delay", 0, "How long the process must have been ready before /ready reports it, giving its connections and caches time to warm up before load balancers send it traffic. 0 to report ready immediately.")
 
 	c.registerServerFlagsWithChangedDefaultValues(f)
 	c.Common.RegisterFlags(f)
@@ -112,6 +139,7 @@ func (c *Config) RegisterFlags(f *flag.FlagSet) {
 	c.RuntimeConfig.RegisterFlags(f)
 	c.MemberlistKV.RegisterFlags(f)
 	c.Tracing.RegisterFlags(f)
+	c.JWTAuth.RegisterFlags(f)
 	c.CompactorConfig.RegisterFlags(f)
 	c.QueryScheduler.RegisterFlags(f)
 }
@@ -170,6 +198,12 @@ func (c *Config) Clone() flagext.Registerer {
 // Validate the config and returns an error if the validation
 // doesn't pass
 func (c *Config) Validate() error {
+	if c.BallastMode != "" && !util.StringsContain(ballast.Modes, c.BallastMode) {
+		return fmt.Errorf("invalid ballast mode: %s, supported values are: %s", c.BallastMode, strings.Join(ballast.Modes, ", "))
+	}
+	if err := gctuning.Validate(c.GCPercent, c.MemoryLimitBytes); err != nil {
+		return errors.Wrap(err, "invalid GC settings")
+	}
 	if err := c.SchemaConfig.Validate(); err != nil {
 		return errors.Wrap(err, "invalid schema config")
 	}
@@ -179,6 +213,9 @@ func (c *Config) Validate() error {
 	if err := c.QueryRange.Validate(); err != nil {
 		return errors.Wrap(err, "invalid queryrange config")
 	}
+	if err := c.Frontend.Validate(); err != nil {
+		return errors.Wrap(err, "invalid frontend config")
+	}
 	if err := c.TableManager.Validate(); err != nil {
 		return errors.Wrap(err, "invalid tablemanager config")
 	}
@@ -200,6 +237,13 @@ func (c *Config) Validate() error {
 	if err := c.CompactorConfig.Validate(); err != nil {
 		return errors.Wrap(err, "invalid compactor config")
 	}
+	if err := c.JWTAuth.Validate(); err != nil {
+		return errors.Wrap(err, "invalid jwt auth config")
+	}
+	// the gRPC requests between the modules carry the org ID the JWT middleware injects, they must not be faked.
+	if c.JWTAuth.Enabled && !c.AuthEnabled {
+		return errors.New("jwt auth requires auth to be enabled")
+	}
 	if err := c.ChunkStoreConfig.Validate(util_log.Logger); err != nil {
 		return errors.Wrap(err, "invalid chunk store config")
 	}
@@ -211,10 +255,12 @@ func (c *Config) Validate() error {
 	for i, sc := range c.SchemaConfig.Configs {
 		if sc.RowShards > 0 && c.Ingester.IndexShards%int(sc.RowShards) > 0 {
 			return fmt.Errorf(
-				"incompatible ingester index shards (%d) and period config row shard factor (%d) for period config at index (%d). The ingester factor must be evenly divisible by all period config factors",
+				"incompatible ingester index shards (%d) and period config row shard factor (%d) for period config at index (%d) with from (%s) and schema (%s). The ingester factor must be evenly divisible by all period config factors",
 				c.Ingester.IndexShards,
 				sc.RowShards,
 				i,
+				sc.From.String(),
+				sc.Schema,
 			)
 		}
 	}
@@ -258,6 +304,7 @@ type Loki struct {
 	runtimeConfig            *runtimeconfig.Manager
 	MemberlistKV             *memberlist.KVInitService
 	compactor                *compactor.Compactor
+	compactorDeletion        *compactor.Compactor
 	QueryFrontEndTripperware cortex_tripper.Tripperware
 	queryScheduler           *scheduler.Scheduler
 
@@ -294,6 +341,9 @@ func (t *Loki) setupAuthMiddleware() {
 			"/schedulerpb.SchedulerForQuerier/QuerierLoop",
 			"/schedulerpb.SchedulerForQuerier/NotifyQuerierShutdown",
 		})
+	if t.Cfg.JWTAuth.Enabled {
+		t.HTTPAuthMiddleware = jwtauth.NewMiddleware(t.Cfg.JWTAuth, t.HTTPAuthMiddleware)
+	}
 }
 
 func (t *Loki) setupGRPCRecoveryMiddleware() {
@@ -313,6 +363,11 @@ type RunOpts struct {
 	// CustomConfigEndpointHandlerFn is the handlerFunc to be used by the /config endpoint.
 	// If empty, default handlerFunc will be used.
 	CustomConfigEndpointHandlerFn func(http.ResponseWriter, *http.Request)
+
+	// ExtraRoutes is called with the HTTP router once all the built-in routes are registered,
+	// allowing to expose additional handlers on the same server.
+	// Routes are matched in registration order, so a route colliding with a built-in one is never matched.
+	ExtraRoutes func(*mux.Router)
 }
 
 func (t *Loki) bindConfigEndpoint(opts RunOpts) {
@@ -343,6 +398,11 @@ func (t *Loki) ListTargets() {
 
 // Run starts Loki running, and blocks until a Loki stops.
 func (t *Loki) Run(opts RunOpts) error {
+	if delay := startupDelay(t.Cfg.StartupJitter, rand.New(rand.NewSource(time.Now().UnixNano()))); delay > 0 {
+		level.Info(util_log.Logger).Log("msg", "delaying startup", "delay", delay)
+		time.Sleep(delay)
+	}
+
 	serviceMap, err := t.ModuleManager.InitModuleServices(t.Cfg.Target...)
 	if err != nil {
 		return err
@@ -350,6 +410,7 @@ func (t *Loki) Run(opts RunOpts) error {
 
 	t.serviceMap = serviceMap
 	t.Server.HTTP.Path("/services").Methods("GET").Handler(http.HandlerFunc(t.servicesHandler))
+	t.Server.HTTP.Path("/loki/api/v1/status/services").Methods("GET").Handler(http.HandlerFunc(t.servicesStatusHandler))
 	t.Server.HTTP.NotFoundHandler = http.HandlerFunc(serverutil.NotFoundHandler)
 
 	// get all services, create service manager and tell it to start
@@ -364,7 +425,7 @@ func (t *Loki) Run(opts RunOpts) error {
 	}
 
 	// before starting servers, register /ready handler. It should reflect entire Loki.
-	t.Server.HTTP.Path("/ready").Methods("GET").Handler(t.readyHandler(sm))
+	t.Server.HTTP.Path("/ready").Methods("GET").Handler(t.readyHandler(sm, newReadinessGate(t.Cfg.ReadinessDelay, time.Now)))
 
 	grpc_health_v1.RegisterHealthServer(t.Server.GRPC, grpcutil.NewHealthCheck(sm))
 
@@ -374,7 +435,13 @@ func (t *Loki) Run(opts RunOpts) error {
 	// Each component serves its version.
 	t.Server.HTTP.Path("/loki/api/v1/status/buildinfo").Methods("GET").HandlerFunc(versionHandler())
 
-	t.Server.HTTP.Path("/debug/fgprof").Methods("GET", "POST").Handler(fgprof.Handler())
+	if t.Cfg.ProfilingEnabled {
+		t.Server.HTTP.Path("/debug/fgprof").Methods("GET", "POST").Handler(fgprof.Handler())
+	}
+
+	if opts.ExtraRoutes != nil {
+		opts.ExtraRoutes(t.Server.HTTP)
+	}
 
 	// Let's listen for events from this manager, and log them.
 	healthy := func() { level.Info(util_log.Logger).Log("msg", "Loki started") }
@@ -410,6 +477,9 @@ func (t *Loki) Run(opts RunOpts) error {
 	// Start all services. This can really only fail if some service is already
 	// in other state than New, which should not be the case.
 	err = sm.StartAsync(context.Background())
+	if err == nil && t.Cfg.StartupTimeout > 0 {
+		err = awaitStarted(sm, serviceMap, t.Cfg.StartupTimeout)
+	}
 	if err == nil {
 		// Wait until service manager stops. It can stop in two ways:
 		// 1) Signal is received and manager is stopped.
@@ -433,9 +503,78 @@ func (t *Loki) Run(opts RunOpts) error {
 	return err
 }
 
-func (t *Loki) readyHandler(sm *services.Manager) http.HandlerFunc {
+// startupDelay returns a random delay in [0, jitter), or 0 when jitter isn't positive.
+func startupDelay(jitter time.Duration, rnd *rand.Rand) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(jitter)))
+}
+
+// awaitStarted waits for the services of the manager to be running. If they are not within the timeout,
+// the manager is stopped and an error listing the modules still starting is returned.
+// Services failing to start are not reported here, they are handled by the manager listener.
+func awaitStarted(sm *services.Manager, serviceMap map[string]services.Service, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := sm.AwaitHealthy(ctx); err == nil || ctx.Err() == nil {
+		return nil
+	}
+
+	var starting []string
+	for m, s := range serviceMap {
+		if state := s.State(); state == services.New || state == services.Starting {
+			starting = append(starting, m)
+		}
+	}
+	sort.Strings(starting)
+
+	level.Error(util_log.Logger).Log("msg", "modules did not start in time", "timeout", timeout, "modules", strings.Join(starting, ","))
+	sm.StopAsync()
+	return fmt.Errorf("modules did not start within %s: %s", timeout, strings.Join(starting, ", "))
+}
+
+// readinessGate delays reporting ready until the readiness checks have passed continuously for delay.
+type readinessGate struct {
+	delay time.Duration
+	now   func() time.Time
+
+	mtx sync.Mutex
+	// since is when the checks started passing, zero while they fail.
+	since time.Time
+}
+
+func newReadinessGate(delay time.Duration, now func() time.Time) *readinessGate {
+	return &readinessGate{delay: delay, now: now}
+}
+
+// notReady records that a readiness check failed.
+func (g *readinessGate) notReady() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.since = time.Time{}
+}
+
+// remaining records that the readiness checks passed, it returns how long they must keep passing before
+// reporting ready.
+func (g *readinessGate) remaining() time.Duration {
+	if g.delay <= 0 {
+		return 0
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	now := g.now()
+	if g.since.IsZero() {
+		g.since = now
+	}
+	return g.delay - now.Sub(g.since)
+}
+
+func (t *Loki) readyHandler(sm *services.Manager, gate *readinessGate) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !sm.IsHealthy() {
+			gate.notReady()
 			msg := bytes.Buffer{}
 			msg.WriteString("Some services are not Running:\n")
 
@@ -452,6 +591,7 @@ func (t *Loki) readyHandler(sm *services.Manager) http.HandlerFunc {
 		// and that all other ring entries are OK too.
 		if t.Ingester != nil {
 			if err := t.Ingester.CheckReady(r.Context()); err != nil {
+				gate.notReady()
 				http.Error(w, "Ingester not ready: "+err.Error(), http.StatusServiceUnavailable)
 				return
 			}
@@ -461,11 +601,17 @@ func (t *Loki) readyHandler(sm *services.Manager) http.HandlerFunc {
 		// itself as ready
 		if t.frontend != nil {
 			if err := t.frontend.CheckReady(r.Context()); err != nil {
+				gate.notReady()
 				http.Error(w, "Query Frontend not ready: "+err.Error(), http.StatusServiceUnavailable)
 				return
 			}
 		}
 
+		if remaining := gate.remaining(); remaining > 0 {
+			http.Error(w, fmt.Sprintf("Ready, waiting %s for the readiness delay", remaining), http.StatusServiceUnavailable)
+			return
+		}
+
 		http.Error(w, "ready", http.StatusOK)
 	}
 }
@@ -491,6 +637,7 @@ func (t *Loki) setupModuleManager() error {
 	mm.RegisterModule(Ruler, t.initRuler)
 	mm.RegisterModule(TableManager, t.initTableManager)
 	mm.RegisterModule(Compactor, t.initCompactor)
+	mm.RegisterModule(CompactorDeletion, t.initCompactorDeletion)
 	mm.RegisterModule(IndexGateway, t.initIndexGateway)
 	mm.RegisterModule(QueryScheduler, t.initQueryScheduler)
 
@@ -514,6 +661,7 @@ func (t *Loki) setupModuleManager() error {
 		Ruler:                    {Ring, Server, Store, RulerStorage, IngesterQuerier, Overrides, TenantConfigs},
 		TableManager:             {Server},
 		Compactor:                {Server, Overrides, MemberlistKV},
+		CompactorDeletion:        {Server, Overrides, MemberlistKV},
 		IndexGateway:             {Server},
 		IngesterQuerier:          {Ring},
 		All:                      {QueryScheduler, QueryFrontend, Querier, Ingester, Distributor, Ruler, Compactor},
@@ -521,6 +669,12 @@ func (t *Loki) setupModuleManager() error {
 		Write:                    {Ingester, Distributor},
 	}
 
+	// When the deletions run separately, the all and read targets run them next to the compactor.
+	if t.Cfg.CompactorConfig.SeparateDeletion {
+		deps[All] = append(deps[All], CompactorDeletion)
+		deps[Read] = append(deps[Read], CompactorDeletion)
+	}
+
 	// Add IngesterQuerier as a dependency for store when target is either querier, ruler, or read.
 	if t.Cfg.isModuleEnabled(Querier) || t.Cfg.isModuleEnabled(Ruler) || t.Cfg.isModuleEnabled(Read) {
 		deps[Store] = append(deps[Store], IngesterQuerier)
@@ -2,17 +2,22 @@ package loki
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -177,9 +182,21 @@ schema_config:
 		require.NoError(t, err)
 	}
 
+	extraRoutes := func(r *mux.Router) {
+		r.Path("/custom").Methods("GET").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, err := w.Write([]byte("custom"))
+			require.NoError(t, err)
+		})
+		// built-in routes take precedence.
+		r.Path("/config").Methods("GET").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, err := w.Write([]byte("shadowed"))
+			require.NoError(t, err)
+		})
+	}
+
 	// Run Loki querier in a different go routine and with custom /config handler.
 	go func() {
-		err := loki.Run(RunOpts{CustomConfigEndpointHandlerFn: customHandler})
+		err := loki.Run(RunOpts{CustomConfigEndpointHandlerFn: customHandler, ExtraRoutes: extraRoutes})
 		require.NoError(t, err)
 	}()
 
@@ -195,4 +212,104 @@ schema_config:
 	require.NoError(t, err)
 	require.Equal(t, string(bBytes), "abc")
 	assert.True(t, customHandlerInvoked)
+
+	resp, err = http.DefaultClient.Get(fmt.Sprintf("http://localhost:%d/custom", httpPort))
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	bBytes, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "custom", string(bBytes))
+}
+
+func TestLoki_awaitStarted(t *testing.T) {
+	blocking := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	newServiceMap := func(starting services.StartingFn) map[string]services.Service {
+		return map[string]services.Service{
+			Server:   services.NewIdleService(nil, nil),
+			Ingester: services.NewIdleService(starting, nil),
+		}
+	}
+	newManager := func(serviceMap map[string]services.Service) *services.Manager {
+		var servs []services.Service
+		for _, s := range serviceMap {
+			servs = append(servs, s)
+		}
+		sm, err := services.NewManager(servs...)
+		require.NoError(t, err)
+		require.NoError(t, sm.StartAsync(context.Background()))
+		return sm
+	}
+
+	t.Run("started in time", func(t *testing.T) {
+		serviceMap := newServiceMap(nil)
+		sm := newManager(serviceMap)
+		require.NoError(t, awaitStarted(sm, serviceMap, time.Second))
+		sm.StopAsync()
+		require.NoError(t, sm.AwaitStopped(context.Background()))
+	})
+
+	t.Run("stuck module", func(t *testing.T) {
+		serviceMap := newServiceMap(blocking)
+		sm := newManager(serviceMap)
+		err := awaitStarted(sm, serviceMap, 50*time.Millisecond)
+		require.EqualError(t, err, "modules did not start within 50ms: ingester")
+		// the manager is stopped, cancelling the starting modules.
+		require.NoError(t, sm.AwaitStopped(context.Background()))
+	})
+}
+
+func TestLoki_startupDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	require.Zero(t, startupDelay(0, rnd))
+	require.Zero(t, startupDelay(-time.Second, rnd))
+	for i := 0; i < 100; i++ {
+		delay := startupDelay(time.Second, rnd)
+		require.GreaterOrEqual(t, delay, time.Duration(0))
+		require.Less(t, delay, time.Second)
+	}
+}
+
+func TestLoki_readyHandler_ReadinessDelay(t *testing.T) {
+	sm, err := services.NewManager(services.NewIdleService(nil, nil))
+	require.NoError(t, err)
+	require.NoError(t, sm.StartAsync(context.Background()))
+	require.NoError(t, sm.AwaitHealthy(context.Background()))
+	defer func() {
+		sm.StopAsync()
+		require.NoError(t, sm.AwaitStopped(context.Background()))
+	}()
+
+	now := time.Unix(0, 0)
+	gate := newReadinessGate(10*time.Second, func() time.Time { return now })
+	handler := (&Loki{}).readyHandler(sm, gate)
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return rec.Code
+	}
+
+	// not ready during the readiness delay.
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+	now = now.Add(9 * time.Second)
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+
+	// ready once the delay has elapsed.
+	now = now.Add(time.Second)
+	require.Equal(t, http.StatusOK, ready())
+
+	// the delay starts over once a check fails.
+	gate.notReady()
+	require.Equal(t, http.StatusServiceUnavailable, ready())
+	now = now.Add(10 * time.Second)
+	require.Equal(t, http.StatusOK, ready())
+
+	// without a delay, ready immediately.
+	rec := httptest.NewRecorder()
+	(&Loki{}).readyHandler(sm, newReadinessGate(0, time.Now)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
 }
@@ -8,6 +8,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
@@ -78,6 +79,7 @@ const (
 	TableManager             string = "table-manager"
 	MemberlistKV             string = "memberlist-kv"
 	Compactor                string = "compactor"
+	CompactorDeletion        string = "compactor-deletion"
 	IndexGateway             string = "index-gateway"
 	QueryScheduler           string = "query-scheduler"
 	All                      string = "all"
@@ -95,6 +97,8 @@ func (t *Loki) initServer() (services.Service, error) {
 		return nil, err
 	}
 
+	// the response writers of the default middlewares of the server don't flush the streamed responses.
+	serv.HTTPServer.Handler = serverutil.NewFlusherMiddleware().Wrap(serv.HTTPServer.Handler)
 	t.Server = serv
 
 	servicesToWaitFor := func() []services.Service {
@@ -122,9 +126,25 @@ func (t *Loki) initServer() (services.Service, error) {
 		})
 	}(t.Server.HTTPServer.Handler)
 
+	if !t.Cfg.ProfilingEnabled {
+		// pprof handlers are registered by the server along with the other instrumentation handlers.
+		t.Server.HTTPServer.Handler = blockPathPrefix(strings.TrimSuffix(t.Cfg.Server.PathPrefix, "/")+"/debug/pprof", t.Server.HTTPServer.Handler)
+	}
+
 	return s, nil
 }
 
+// blockPathPrefix responds with a 404 to requests for paths under the given prefix.
+func blockPathPrefix(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (t *Loki) initRing() (_ services.Service, err error) {
 	t.Cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.Multi.ConfigProvider = multiClientRuntimeConfigChannel(t.runtimeConfig)
 	t.Cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.MemberlistKV = t.MemberlistKV.GetMemberlistKV
@@ -233,6 +253,8 @@ func (t *Loki) initQuerier() (services.Service, error) {
 		QueryFrontendEnabled:  t.Cfg.isModuleEnabled(QueryFrontend),
 		QuerySchedulerEnabled: t.Cfg.isModuleEnabled(QueryScheduler),
 		SchedulerRing:         scheduler.SafeReadRing(t.queryScheduler),
+
+		SchedulerFallbackEnabled: t.Cfg.Frontend.SchedulerFallbackEnabled,
 	}
 
 	httpMiddleware := middleware.Merge(
@@ -380,6 +402,12 @@ func (t *Loki) initStore() (_ services.Service, err error) {
 		}
 	}
 
+	if t.Cfg.StorageConfig.StartupProbe {
+		if err := loki_storage.ProbeObjectStores(context.Background(), t.Cfg.StorageConfig, t.Cfg.SchemaConfig, storage.NewObjectClient); err != nil {
+			return nil, err
+		}
+	}
+
 	chunkStore, err := chunk_storage.NewStore(t.Cfg.StorageConfig.Config, t.Cfg.ChunkStoreConfig.StoreConfig, t.Cfg.SchemaConfig.SchemaConfig, t.overrides, prometheus.DefaultRegisterer, nil, util_log.Logger)
 	if err != nil {
 		return
@@ -457,6 +485,10 @@ func (t *Loki) initQueryFrontendTripperware() (_ services.Service, err error) {
 	t.stopper = stopper
 	t.QueryFrontEndTripperware = tripperware
 
+	if t.Cfg.ProfilingEnabled {
+		t.Server.HTTP.Path("/loki/api/v1/status/tripperware").Methods("GET").Handler(queryrange.TripperwareStatusHandler(t.Cfg.QueryRange))
+	}
+
 	return services.NewIdleService(nil, nil), nil
 }
 
@@ -468,6 +500,8 @@ func (t *Loki) initQueryFrontend() (_ services.Service, err error) {
 		FrontendV1:    t.Cfg.Frontend.FrontendV1,
 		FrontendV2:    t.Cfg.Frontend.FrontendV2,
 		DownstreamURL: t.Cfg.Frontend.DownstreamURL,
+
+		SchedulerFallbackEnabled: t.Cfg.Frontend.SchedulerFallbackEnabled,
 	}
 	roundTripper, frontendV1, frontendV2, err := frontend.InitFrontend(
 		combinedCfg,
@@ -480,7 +514,13 @@ func (t *Loki) initQueryFrontend() (_ services.Service, err error) {
 		return nil, err
 	}
 
-	if frontendV1 != nil {
+	if frontendV1 != nil && frontendV2 != nil {
+		// The v1 frontend is the fallback of the v2 frontend, which manages its lifecycle.
+		frontendv1pb.RegisterFrontendServer(t.Server.GRPC, frontendV1)
+		frontendv2pb.RegisterFrontendForQuerierServer(t.Server.GRPC, frontendV2)
+		t.frontend = frontendV2
+		level.Debug(util_log.Logger).Log("msg", "using query frontend", "version", "v2", "fallback", "v1")
+	} else if frontendV1 != nil {
 		frontendv1pb.RegisterFrontendServer(t.Server.GRPC, frontendV1)
 		t.frontend = frontendV1
 		level.Debug(util_log.Logger).Log("msg", "using query frontend", "version", "v1")
@@ -496,7 +536,11 @@ func (t *Loki) initQueryFrontend() (_ services.Service, err error) {
 
 	frontendHandler := transport.NewHandler(t.Cfg.Frontend.Handler, roundTripper, util_log.Logger, prometheus.DefaultRegisterer)
 	if t.Cfg.Frontend.CompressResponses {
-		frontendHandler = gziphandler.GzipHandler(frontendHandler)
+		gzipHandler, err := gziphandler.NewGzipLevelHandler(t.Cfg.Frontend.CompressionLevel)
+		if err != nil {
+			return nil, err
+		}
+		frontendHandler = gzipHandler(frontendHandler)
 	}
 
 	frontendHandler = middleware.Merge(
@@ -706,15 +750,47 @@ func (t *Loki) initCompactor() (services.Service, error) {
 	}
 
 	t.Server.HTTP.Path("/compactor/ring").Methods("GET", "POST").Handler(t.compactor)
-	if t.Cfg.CompactorConfig.RetentionEnabled {
-		t.Server.HTTP.Path("/loki/api/admin/delete").Methods("PUT", "POST").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(t.compactor.DeleteRequestsHandler.AddDeleteRequestHandler)))
-		t.Server.HTTP.Path("/loki/api/admin/delete").Methods("GET").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(t.compactor.DeleteRequestsHandler.GetAllDeleteRequestsHandler)))
-		t.Server.HTTP.Path("/loki/api/admin/cancel_delete_request").Methods("PUT", "POST").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(t.compactor.DeleteRequestsHandler.CancelDeleteRequestHandler)))
+	if t.Cfg.CompactorConfig.RetentionEnabled && !t.Cfg.CompactorConfig.SeparateDeletion {
+		t.registerDeleteRequestsRoutes(t.compactor)
 	}
 
 	return t.compactor, nil
 }
 
+func (t *Loki) initCompactorDeletion() (services.Service, error) {
+	// Set some config sections from other config sections in the config struct
+	t.Cfg.CompactorConfig.CompactorRing.ListenPort = t.Cfg.Server.GRPCListenPort
+	t.Cfg.CompactorConfig.CompactorRing.KVStore.MemberlistKV = t.MemberlistKV.GetMemberlistKV
+
+	if !loki_storage.UsingBoltdbShipper(t.Cfg.SchemaConfig.Configs) {
+		level.Info(util_log.Logger).Log("msg", "Not using boltdb-shipper index, not starting compactor deletion")
+		return nil, nil
+	}
+
+	err := t.Cfg.SchemaConfig.Load()
+	if err != nil {
+		return nil, err
+	}
+	// the compactor and the compactor deletion register the same metrics when they run in the same process.
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"target": CompactorDeletion}, prometheus.DefaultRegisterer)
+	t.compactorDeletion, err = compactor.NewDeletionCompactor(t.Cfg.CompactorConfig, t.Cfg.StorageConfig.Config, t.Cfg.SchemaConfig, t.overrides, reg)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Server.HTTP.Path("/compactor/deletion/ring").Methods("GET", "POST").Handler(t.compactorDeletion)
+	t.registerDeleteRequestsRoutes(t.compactorDeletion)
+
+	return t.compactorDeletion, nil
+}
+
+// registerDeleteRequestsRoutes registers the delete requests API of c, which must apply retention.
+func (t *Loki) registerDeleteRequestsRoutes(c *compactor.Compactor) {
+	t.Server.HTTP.Path("/loki/api/admin/delete").Methods("PUT", "POST").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(c.DeleteRequestsHandler.AddDeleteRequestHandler)))
+	t.Server.HTTP.Path("/loki/api/admin/delete").Methods("GET").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(c.DeleteRequestsHandler.GetAllDeleteRequestsHandler)))
+	t.Server.HTTP.Path("/loki/api/admin/cancel_delete_request").Methods("PUT", "POST").Handler(t.HTTPAuthMiddleware.Wrap(http.HandlerFunc(c.DeleteRequestsHandler.CancelDeleteRequestHandler)))
+}
+
 func (t *Loki) initIndexGateway() (services.Service, error) {
 	t.Cfg.StorageConfig.BoltDBShipperConfig.Mode = shipper.ModeReadOnly
 	objectClient, err := storage.NewObjectClient(t.Cfg.StorageConfig.BoltDBShipperConfig.SharedStoreType, t.Cfg.StorageConfig.Config)
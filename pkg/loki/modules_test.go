@@ -1,9 +1,13 @@
 package loki
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
+
 	"github.com/grafana/loki/pkg/storage/chunk"
 )
 
@@ -81,3 +85,22 @@ func Test_calculateMaxLookBack(t *testing.T) {
 		})
 	}
 }
+
+func Test_blockPathPrefix(t *testing.T) {
+	h := blockPathPrefix("/debug/pprof", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for path, want := range map[string]int{
+		"/debug/pprof":             http.StatusNotFound,
+		"/debug/pprof/":            http.StatusNotFound,
+		"/debug/pprof/heap":        http.StatusNotFound,
+		"/debug/pprofiles":         http.StatusOK,
+		"/metrics":                 http.StatusOK,
+		"/loki/api/v1/query_range": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, want, rec.Code, path)
+	}
+}
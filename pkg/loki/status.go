@@ -1,8 +1,12 @@
 package loki
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+
+	"github.com/grafana/dskit/services"
 )
 
 func (t *Loki) servicesHandler(w http.ResponseWriter, r *http.Request) {
@@ -16,3 +20,61 @@ func (t *Loki) servicesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// servicesStatus is the machine readable status of the modules.
+type servicesStatus struct {
+	// Ready is true when all the modules are running and the special checks pass, same as /ready.
+	Ready    bool            `json:"ready"`
+	Services []serviceStatus `json:"services"`
+	// IngesterReady and FrontendReady are the results of the ingester and query frontend
+	// special readiness checks, only set when those modules are running in this process.
+	IngesterReady *bool `json:"ingesterReady,omitempty"`
+	FrontendReady *bool `json:"frontendReady,omitempty"`
+}
+
+type serviceStatus struct {
+	Name    string `json:"name"`
+	State   string `json:"state"`
+	Failure string `json:"failure,omitempty"`
+}
+
+// servicesStatusHandler reports the state of every module as JSON.
+func (t *Loki) servicesStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := servicesStatus{
+		Ready:    true,
+		Services: make([]serviceStatus, 0, len(t.serviceMap)),
+	}
+	for mod, s := range t.serviceMap {
+		if s == nil {
+			continue
+		}
+		st := serviceStatus{
+			Name:  mod,
+			State: s.State().String(),
+		}
+		if err := s.FailureCase(); err != nil {
+			st.Failure = err.Error()
+		}
+		if s.State() != services.Running {
+			status.Ready = false
+		}
+		status.Services = append(status.Services, st)
+	}
+	sort.Slice(status.Services, func(i, j int) bool { return status.Services[i].Name < status.Services[j].Name })
+
+	if t.Ingester != nil {
+		ready := t.Ingester.CheckReady(r.Context()) == nil
+		status.IngesterReady = &ready
+		status.Ready = status.Ready && ready
+	}
+	if t.frontend != nil {
+		ready := t.frontend.CheckReady(r.Context()) == nil
+		status.FrontendReady = &ready
+		status.Ready = status.Ready && ready
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	// We ignore errors here, because we cannot do anything about them.
+	_ = json.NewEncoder(w).Encode(status)
+}
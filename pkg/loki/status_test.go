@@ -0,0 +1,74 @@
+package loki
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeFrontend struct {
+	services.Service
+	err error
+}
+
+func (f fakeFrontend) CheckReady(context.Context) error { return f.err }
+
+func TestServicesStatusHandler(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	failed := services.NewIdleService(func(context.Context) error { return errors.New("boom") }, nil)
+	require.Error(t, services.StartAndAwaitRunning(context.Background(), failed))
+
+	for _, tc := range []struct {
+		name     string
+		loki     *Loki
+		expected string
+	}{
+		{
+			name: "ready",
+			loki: &Loki{serviceMap: map[string]services.Service{Server: running, Querier: running}},
+			expected: `{
+				"ready": true,
+				"services": [{"name": "querier", "state": "Running"}, {"name": "server", "state": "Running"}]
+			}`,
+		},
+		{
+			name: "failed module",
+			loki: &Loki{serviceMap: map[string]services.Service{Server: running, Ruler: failed}},
+			expected: `{
+				"ready": false,
+				"services": [{"name": "ruler", "state": "Failed", "failure": "boom"}, {"name": "server", "state": "Running"}]
+			}`,
+		},
+		{
+			name: "frontend not ready",
+			loki: &Loki{
+				serviceMap: map[string]services.Service{QueryFrontend: running},
+				frontend:   fakeFrontend{err: errors.New("no queriers connected")},
+			},
+			expected: `{
+				"ready": false,
+				"services": [{"name": "query-frontend", "state": "Running"}],
+				"frontendReady": false
+			}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tc.loki.servicesStatusHandler(w, httptest.NewRequest(http.MethodGet, "/loki/api/v1/status/services", nil))
+
+			resp := w.Result()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(body))
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package lokifrontend
 
 import (
+	"compress/gzip"
 	"flag"
+	"fmt"
 
 	"github.com/grafana/loki/pkg/lokifrontend/frontend/transport"
 	v1 "github.com/grafana/loki/pkg/lokifrontend/frontend/v1"
@@ -14,9 +16,12 @@ type Config struct {
 	FrontendV2 v2.Config               `yaml:",inline"`
 
 	CompressResponses bool   `yaml:"compress_responses"`
+	CompressionLevel  int    `yaml:"compression_level"`
 	DownstreamURL     string `yaml:"downstream_url"`
 
 	TailProxyURL string `yaml:"tail_proxy_url"`
+
+	SchedulerFallbackEnabled bool `yaml:"scheduler_fallback_enabled"`
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet.
@@ -26,7 +31,18 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.FrontendV2.RegisterFlags(f)
 
 	f.BoolVar(&cfg.CompressResponses, "querier.compress-http-responses", false, "Compress HTTP responses.")
+	f.IntVar(&cfg.CompressionLevel, "querier.compress-http-responses-level", gzip.DefaultCompression, "Gzip level of the compressed HTTP responses, from 1 (best speed) to 9 (best compression), or -1 for the default level.")
 	f.StringVar(&cfg.DownstreamURL, "frontend.downstream-url", "", "URL of downstream Prometheus.")
 
 	f.StringVar(&cfg.TailProxyURL, "frontend.tail-proxy-url", "", "URL of querier for tail proxy.")
+
+	f.BoolVar(&cfg.SchedulerFallbackEnabled, "frontend.scheduler-fallback-enabled", false, "Hand queries to queriers connected directly to the query-frontend, as if there was no query-scheduler, while the query-frontend is not connected to any query-scheduler, instead of queuing them until one is reachable. Queriers only connect directly to a query-frontend running in the same process.")
+}
+
+// Validate validates the config.
+func (cfg *Config) Validate() error {
+	if cfg.CompressionLevel != gzip.DefaultCompression && (cfg.CompressionLevel < gzip.BestSpeed || cfg.CompressionLevel > gzip.BestCompression) {
+		return fmt.Errorf("invalid compression level %d, must be between %d and %d or %d for the default level", cfg.CompressionLevel, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression)
+	}
+	return nil
 }
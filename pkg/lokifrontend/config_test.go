@@ -0,0 +1,34 @@
+package lokifrontend
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Validate_CompressionLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level int
+		err   bool
+	}{
+		{level: -1},
+		{level: 1},
+		{level: 6},
+		{level: 9},
+		{level: -2, err: true},
+		{level: 0, err: true},
+		{level: 10, err: true},
+	} {
+		var cfg Config
+		cfg.RegisterFlags(flag.NewFlagSet("", flag.PanicOnError))
+		cfg.CompressionLevel = tc.level
+
+		err := cfg.Validate()
+		if tc.err {
+			require.Error(t, err, tc.level)
+			continue
+		}
+		require.NoError(t, err, tc.level)
+	}
+}
@@ -22,6 +22,8 @@ type CombinedFrontendConfig struct {
 	FrontendV2 v2.Config               `yaml:",inline"`
 
 	DownstreamURL string `yaml:"downstream_url"`
+
+	SchedulerFallbackEnabled bool `yaml:"scheduler_fallback_enabled"`
 }
 
 func (cfg *CombinedFrontendConfig) RegisterFlags(f *flag.FlagSet) {
@@ -30,10 +32,12 @@ func (cfg *CombinedFrontendConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.FrontendV2.RegisterFlags(f)
 
 	f.StringVar(&cfg.DownstreamURL, "frontend.downstream-url", "", "URL of downstream Prometheus.")
+	f.BoolVar(&cfg.SchedulerFallbackEnabled, "frontend.scheduler-fallback-enabled", false, "Hand queries to queriers connected directly to the query-frontend, as if there was no query-scheduler, while the query-frontend is not connected to any query-scheduler, instead of queuing them until one is reachable. Queriers only connect directly to a query-frontend running in the same process.")
 }
 
 // InitFrontend initializes frontend (either V1 -- without scheduler, or V2 -- with scheduler) or no frontend at
-// all if downstream Prometheus URL is used instead.
+// all if downstream Prometheus URL is used instead. With the scheduler fallback enabled, both are returned: V1
+// handles the queries of V2 while it is not connected to any scheduler, and is started and stopped by V2.
 //
 // Returned RoundTripper can be wrapped in more round-tripper middlewares, and then eventually registered
 // into HTTP server using the Handler from this package. Returned RoundTripper is always non-nil
@@ -59,8 +63,17 @@ func InitFrontend(cfg CombinedFrontendConfig, ring ring.ReadRing, limits v1.Limi
 			cfg.FrontendV2.Port = grpcListenPort
 		}
 
-		fr, err := v2.NewFrontend(cfg.FrontendV2, ring, log, reg)
-		return transport.AdaptGrpcRoundTripperToHTTPRoundTripper(fr), nil, fr, err
+		if !cfg.SchedulerFallbackEnabled {
+			fr, err := v2.NewFrontend(cfg.FrontendV2, ring, log, reg)
+			return transport.AdaptGrpcRoundTripperToHTTPRoundTripper(fr), nil, fr, err
+		}
+
+		fallback, err := v1.New(cfg.FrontendV1, limits, log, reg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fr, err := v2.NewFrontendWithFallback(cfg.FrontendV2, ring, fallback, log, reg)
+		return transport.AdaptGrpcRoundTripperToHTTPRoundTripper(fr), fallback, fr, err
 
 	default:
 		// No scheduler = use original frontend.
@@ -132,13 +132,27 @@ func (f *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		hs[h] = vs
 	}
 
+	// the events and lines are streamed while they are produced, the timing is known once they are all sent.
+	streamed := isStreamed(resp)
 	if f.cfg.QueryStatsEnabled {
-		writeServiceTimingHeader(queryResponseTime, hs, stats)
+		if streamed {
+			hs.Add("Trailer", ServiceTimingHeaderName)
+		} else {
+			writeServiceTimingHeader(queryResponseTime, hs, stats)
+		}
 	}
 
 	w.WriteHeader(resp.StatusCode)
 	// we don't check for copy error as there is no much we can do at this point
-	_, _ = io.Copy(w, resp.Body)
+	if streamed {
+		_, _ = io.Copy(flushWriter{w: w, req: r}, resp.Body)
+		queryResponseTime = time.Since(startTime)
+		if f.cfg.QueryStatsEnabled {
+			writeServiceTimingHeader(queryResponseTime, hs, stats)
+		}
+	} else {
+		_, _ = io.Copy(w, resp.Body)
+	}
 
 	// Check whether we should parse the query string.
 	shouldReportSlowQuery := f.cfg.LogQueriesLongerThan > 0 && queryResponseTime > f.cfg.LogQueriesLongerThan
@@ -154,6 +168,25 @@ func (f *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// isStreamed tells if resp streams server-sent events or newline delimited JSON.
+func isStreamed(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// flushWriter flushes the streamed responses as they are written, so that the client gets them while they are
+// produced rather than once the buffers of the server, e.g. the compression ones, are full.
+type flushWriter struct {
+	w   http.ResponseWriter
+	req *http.Request
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	serverutil.Flush(f.w, f.req)
+	return n, err
+}
+
 // reportSlowQuery reports slow queries.
 func (f *Handler) reportSlowQuery(r *http.Request, queryString url.Values, queryResponseTime time.Duration) {
 	logMessage := append([]interface{}{
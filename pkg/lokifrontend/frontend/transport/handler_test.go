@@ -1,14 +1,29 @@
 package transport
 
 import (
+	"bufio"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/logging"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+
+	"github.com/grafana/loki/pkg/querier/queryrange"
+	serverutil "github.com/grafana/loki/pkg/util/server"
 )
 
 func TestWriteError(t *testing.T) {
@@ -28,3 +43,157 @@ func TestWriteError(t *testing.T) {
 		})
 	}
 }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// newTestServer serves the handler of the round tripper through the middlewares of the server, as in production.
+func newTestServer(t *testing.T, roundTripper http.RoundTripper) (*httptest.Server, func()) {
+	// the middlewares register their metrics in the default registerer.
+	reg := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = prometheus.NewRegistry()
+	defer func() { prometheus.DefaultRegisterer = reg }()
+	serv, err := server.New(server.Config{
+		HTTPListenAddress: "localhost",
+		GRPCListenAddress: "localhost",
+		Log:               logging.GoKit(log.NewNopLogger()),
+	})
+	require.NoError(t, err)
+	handler := NewHandler(HandlerConfig{QueryStatsEnabled: true}, roundTripper, log.NewNopLogger(), prometheus.NewRegistry())
+	serv.HTTP.Path("/loki/api/v1/query_range").Handler(middleware.Merge(
+		serverutil.RecoveryHTTPMiddleware,
+		queryrange.StatsHTTPMiddleware,
+	).Wrap(handler))
+	s := httptest.NewServer(serverutil.NewFlusherMiddleware().Wrap(serv.HTTPServer.Handler))
+	return s, func() {
+		s.Close()
+		serv.Shutdown()
+	}
+}
+
+func TestHandler_EventStream(t *testing.T) {
+	// the round tripper streams a progress event, then the result event once the client got the first one.
+	received := make(chan struct{})
+	roundTripper := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = pw.Write([]byte("event: progress\ndata: {}\n\n"))
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+			}
+			time.Sleep(50 * time.Millisecond)
+			_, _ = pw.Write([]byte("event: result\ndata: {}\n\n"))
+			_ = pw.Close()
+		}()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+			Body:       pr,
+		}, nil
+	})
+
+	s, stop := newTestServer(t, roundTripper)
+	defer stop()
+
+	start := time.Now()
+	var (
+		resp   *http.Response
+		reader *bufio.Reader
+		first  = make(chan error, 1)
+	)
+	go func() {
+		var err error
+		resp, err = http.Get(s.URL + "/loki/api/v1/query_range")
+		if err != nil {
+			first <- err
+			return
+		}
+		reader = bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		if err == nil && line != "event: progress\n" {
+			err = fmt.Errorf("unexpected first line %q", line)
+		}
+		first <- err
+	}()
+	select {
+	case err := <-first:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the first event wasn't flushed")
+	}
+	close(received)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	rest, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "data: {}\n\nevent: result\ndata: {}\n\n", string(rest))
+
+	// the response time accounts for the whole stream.
+	timing := resp.Trailer.Get(ServiceTimingHeaderName)
+	require.Contains(t, timing, "response_time;dur=")
+	ms, err := strconv.ParseFloat(timing[strings.Index(timing, "response_time;dur=")+len("response_time;dur="):], 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, ms, float64(50))
+	require.LessOrEqual(t, time.Duration(ms*float64(time.Millisecond)), time.Since(start))
+}
+
+func TestHandler_NDJSON(t *testing.T) {
+	// the round tripper streams a first line, then the last one once the client got the first one.
+	received := make(chan struct{})
+	roundTripper := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			_, _ = pw.Write([]byte("{\"line\":\"a\"}\n"))
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+			}
+			_, _ = pw.Write([]byte("{\"line\":\"b\"}\n"))
+			_ = pw.Close()
+		}()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/x-ndjson"}},
+			Body:       pr,
+		}, nil
+	})
+	s, stop := newTestServer(t, roundTripper)
+	defer stop()
+
+	var (
+		resp   *http.Response
+		reader *bufio.Reader
+		first  = make(chan error, 1)
+	)
+	go func() {
+		var err error
+		resp, err = http.Get(s.URL + "/loki/api/v1/query_range")
+		if err != nil {
+			first <- err
+			return
+		}
+		reader = bufio.NewReader(resp.Body)
+		line, err := reader.ReadString('\n')
+		if err == nil && line != "{\"line\":\"a\"}\n" {
+			err = fmt.Errorf("unexpected first line %q", line)
+		}
+		first <- err
+	}()
+	select {
+	case err := <-first:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the first line wasn't flushed")
+	}
+	close(received)
+	defer resp.Body.Close()
+
+	rest, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, "{\"line\":\"b\"}\n", string(rest))
+}
@@ -71,6 +71,18 @@ type Frontend struct {
 
 	schedulerWorkers *frontendSchedulerWorkers
 	requests         *requestsInProgress
+
+	// fallback handles the queries while the frontend is not connected to any scheduler, if set.
+	fallback        Fallback
+	fallbackQueries prometheus.Counter
+}
+
+// Fallback handles the queries of the frontend while it is not connected to any scheduler, e.g. a
+// frontend without scheduler which queriers connect to directly.
+type Fallback interface {
+	services.Service
+	RoundTripGRPC(ctx context.Context, req *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error)
+	CheckReady(ctx context.Context) error
 }
 
 type frontendRequest struct {
@@ -103,6 +115,12 @@ type enqueueResult struct {
 
 // NewFrontend creates a new frontend.
 func NewFrontend(cfg Config, ring ring.ReadRing, log log.Logger, reg prometheus.Registerer) (*Frontend, error) {
+	return NewFrontendWithFallback(cfg, ring, nil, log, reg)
+}
+
+// NewFrontendWithFallback creates a new frontend handing the queries to fallback while it is not connected
+// to any scheduler, instead of waiting for one. The fallback is started and stopped with the frontend.
+func NewFrontendWithFallback(cfg Config, ring ring.ReadRing, fallback Fallback, log log.Logger, reg prometheus.Registerer) (*Frontend, error) {
 	requestsCh := make(chan *frontendRequest)
 
 	schedulerWorkers, err := newFrontendSchedulerWorkers(cfg, fmt.Sprintf("%s:%d", cfg.Addr, cfg.Port), ring, requestsCh, log)
@@ -116,6 +134,7 @@ func NewFrontend(cfg Config, ring ring.ReadRing, log log.Logger, reg prometheus.
 		requestsCh:       requestsCh,
 		schedulerWorkers: schedulerWorkers,
 		requests:         newRequestsInProgress(),
+		fallback:         fallback,
 	}
 	// Randomize to avoid getting responses from queries sent before restart, which could lead to mixing results
 	// between different queries. Note that frontend verifies the user, so it cannot leak results between tenants.
@@ -136,16 +155,34 @@ func NewFrontend(cfg Config, ring ring.ReadRing, log log.Logger, reg prometheus.
 		return float64(f.schedulerWorkers.getWorkersCount())
 	})
 
+	if fallback != nil {
+		f.fallbackQueries = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "cortex_query_frontend_scheduler_fallback_queries_total",
+			Help: "Total number of queries handled by the fallback while this frontend was not connected to any scheduler.",
+		})
+	}
+
 	f.Service = services.NewIdleService(f.starting, f.stopping)
 	return f, nil
 }
 
 func (f *Frontend) starting(ctx context.Context) error {
+	if f.fallback != nil {
+		if err := services.StartAndAwaitRunning(ctx, f.fallback); err != nil {
+			return errors.Wrap(err, "failed to start frontend fallback")
+		}
+	}
 	return errors.Wrap(services.StartAndAwaitRunning(ctx, f.schedulerWorkers), "failed to start frontend scheduler workers")
 }
 
 func (f *Frontend) stopping(_ error) error {
-	return errors.Wrap(services.StopAndAwaitTerminated(context.Background(), f.schedulerWorkers), "failed to stop frontend scheduler workers")
+	err := services.StopAndAwaitTerminated(context.Background(), f.schedulerWorkers)
+	if f.fallback != nil {
+		if fallbackErr := services.StopAndAwaitTerminated(context.Background(), f.fallback); fallbackErr != nil {
+			level.Warn(f.log).Log("msg", "failed to stop frontend fallback", "err", fallbackErr)
+		}
+	}
+	return errors.Wrap(err, "failed to stop frontend scheduler workers")
 }
 
 // RoundTripGRPC round trips a proto (instead of a HTTP request).
@@ -160,6 +197,12 @@ func (f *Frontend) RoundTripGRPC(ctx context.Context, req *httpgrpc.HTTPRequest)
 	}
 	userID := tenant.JoinTenantIDs(tenantIDs)
 
+	// Without any scheduler to enqueue the request to, it would wait until the request context is done.
+	if f.fallback != nil && f.schedulerWorkers.getConnectedCount() == 0 {
+		f.fallbackQueries.Inc()
+		return f.fallback.RoundTripGRPC(ctx, req)
+	}
+
 	// Propagate trace context in gRPC too - this will be ignored if using HTTP.
 	tracer, span := opentracing.GlobalTracer(), opentracing.SpanFromContext(ctx)
 	if tracer != nil && span != nil {
@@ -267,15 +310,23 @@ func (f *Frontend) QueryResult(ctx context.Context, qrReq *frontendv2pb.QueryRes
 
 // CheckReady determines if the query frontend is ready.  Function parameters/return
 // chosen to match the same method in the ingester
-func (f *Frontend) CheckReady(_ context.Context) error {
-	workers := f.schedulerWorkers.getWorkersCount()
+func (f *Frontend) CheckReady(ctx context.Context) error {
+	connected := f.schedulerWorkers.getConnectedCount()
 
 	// If frontend is connected to at least one scheduler, we are ready.
-	if workers > 0 {
+	if connected > 0 {
+		return nil
+	}
+
+	// Otherwise queries are handled by the fallback, if any.
+	if f.fallback != nil {
+		if err := f.fallback.CheckReady(ctx); err != nil {
+			return errors.Wrap(err, "not connected to any scheduler and fallback not ready")
+		}
 		return nil
 	}
 
-	msg := fmt.Sprintf("not ready: number of schedulers this worker is connected to is %d", workers)
+	msg := fmt.Sprintf("not ready: number of schedulers this worker is connected to is %d", connected)
 	level.Info(f.log).Log("msg", msg)
 	return errors.New(msg)
 }
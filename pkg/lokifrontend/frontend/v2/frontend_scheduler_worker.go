@@ -14,6 +14,7 @@ import (
 	"github.com/grafana/dskit/services"
 	"github.com/pkg/errors"
 	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
 	"google.golang.org/grpc"
 
 	"github.com/grafana/loki/pkg/lokifrontend/frontend/v2/frontendv2pb"
@@ -146,6 +147,21 @@ func (f *frontendSchedulerWorkers) getWorkersCount() int {
 	return len(f.workers)
 }
 
+// Get number of workers with at least one stream to their scheduler established. Unlike
+// getWorkersCount, it doesn't count the schedulers which are resolved but unreachable.
+func (f *frontendSchedulerWorkers) getConnectedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	connected := 0
+	for _, w := range f.workers {
+		if w.streams.Load() > 0 {
+			connected++
+		}
+	}
+	return connected
+}
+
 func (f *frontendSchedulerWorkers) connectToScheduler(ctx context.Context, address string) (*grpc.ClientConn, error) {
 	// Because we only use single long-running method, it doesn't make sense to inject user ID, send over tracing or add metrics.
 	opts, err := f.cfg.GRPCClientConfig.DialOption(nil, nil)
@@ -181,6 +197,9 @@ type frontendSchedulerWorker struct {
 	// Cancellation requests for this scheduler are received via this channel. It is passed to frontend after
 	// query has been enqueued to scheduler.
 	cancelCh chan uint64
+
+	// Number of streams to the scheduler which have been initialized and are still open.
+	streams atomic.Int64
 }
 
 func newFrontendSchedulerWorker(conn *grpc.ClientConn, schedulerAddr string, frontendAddr string, requestCh <-chan *frontendRequest, concurrency int, log log.Logger) *frontendSchedulerWorker {
@@ -262,6 +281,9 @@ func (w *frontendSchedulerWorker) schedulerLoop(loop schedulerpb.SchedulerForFro
 		return errors.Errorf("unexpected status received for init: %v", resp.Status)
 	}
 
+	w.streams.Inc()
+	defer w.streams.Dec()
+
 	ctx := loop.Context()
 
 	for {
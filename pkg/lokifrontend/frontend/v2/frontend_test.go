@@ -2,7 +2,9 @@ package v2
 
 import (
 	"context"
+	"errors"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,6 +29,10 @@ import (
 const testFrontendWorkerConcurrency = 5
 
 func setupFrontend(t *testing.T, schedulerReplyFunc func(f *Frontend, msg *schedulerpb.FrontendToScheduler) *schedulerpb.SchedulerToFrontend) (*Frontend, *mockScheduler) {
+	return setupFrontendWithFallback(t, nil, schedulerReplyFunc)
+}
+
+func setupFrontendWithFallback(t *testing.T, fallback Fallback, schedulerReplyFunc func(f *Frontend, msg *schedulerpb.FrontendToScheduler) *schedulerpb.SchedulerToFrontend) (*Frontend, *mockScheduler) {
 	l, err := net.Listen("tcp", "")
 	require.NoError(t, err)
 
@@ -47,7 +53,7 @@ func setupFrontend(t *testing.T, schedulerReplyFunc func(f *Frontend, msg *sched
 
 	// logger := log.NewLogfmtLogger(os.Stdout)
 	logger := log.NewNopLogger()
-	f, err := NewFrontend(cfg, nil, logger, nil)
+	f, err := NewFrontendWithFallback(cfg, nil, fallback, logger, nil)
 	require.NoError(t, err)
 
 	frontendv2pb.RegisterFrontendForQuerierServer(server, f)
@@ -214,6 +220,92 @@ func TestFrontendFailedCancellation(t *testing.T) {
 	})
 }
 
+func TestFrontendSchedulerFallback(t *testing.T) {
+	const userID = "test"
+
+	fallback := newMockFallback(nil)
+	f, _ := setupFrontendWithFallback(t, fallback, func(f *Frontend, msg *schedulerpb.FrontendToScheduler) *schedulerpb.SchedulerToFrontend {
+		go sendResponseWithDelay(f, 100*time.Millisecond, userID, msg.QueryID, &httpgrpc.HTTPResponse{Code: 200})
+		return &schedulerpb.SchedulerToFrontend{Status: schedulerpb.OK}
+	})
+	require.Equal(t, services.Running, fallback.State())
+
+	// Connected to the scheduler, the fallback is not used.
+	test.Poll(t, time.Second, 1, func() interface{} {
+		return f.schedulerWorkers.getConnectedCount()
+	})
+	require.NoError(t, f.CheckReady(context.Background()))
+	resp, err := f.RoundTripGRPC(user.InjectOrgID(context.Background(), userID), &httpgrpc.HTTPRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int32(200), resp.Code)
+	require.Equal(t, int64(0), fallback.queries.Load())
+
+	// Once disconnected, queries are handed to the fallback instead of waiting for a scheduler.
+	var addrs []string
+	f.schedulerWorkers.mu.Lock()
+	for addr := range f.schedulerWorkers.workers {
+		addrs = append(addrs, addr)
+	}
+	f.schedulerWorkers.mu.Unlock()
+	for _, addr := range addrs {
+		f.schedulerWorkers.AddressRemoved(addr)
+	}
+	require.NoError(t, f.CheckReady(context.Background()))
+	resp, err = f.RoundTripGRPC(user.InjectOrgID(context.Background(), userID), &httpgrpc.HTTPRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int32(http.StatusAccepted), resp.Code)
+	require.Equal(t, int64(1), fallback.queries.Load())
+
+	fallback.err = errors.New("no querier connected")
+	require.Error(t, f.CheckReady(context.Background()))
+
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), f))
+	require.Equal(t, services.Terminated, fallback.State())
+}
+
+func TestFrontendCheckReady_UnreachableScheduler(t *testing.T) {
+	l, err := net.Listen("tcp", "")
+	require.NoError(t, err)
+	// Nothing serves the scheduler address.
+	require.NoError(t, l.Close())
+
+	cfg := Config{}
+	flagext.DefaultValues(&cfg)
+	cfg.SchedulerAddress = l.Addr().String()
+	f, err := NewFrontend(cfg, nil, log.NewNopLogger(), nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), f))
+	t.Cleanup(func() {
+		_ = services.StopAndAwaitTerminated(context.Background(), f)
+	})
+
+	// The scheduler is resolved, but not connected to.
+	test.Poll(t, time.Second, 1, func() interface{} {
+		return f.schedulerWorkers.getWorkersCount()
+	})
+	require.Error(t, f.CheckReady(context.Background()))
+}
+
+type mockFallback struct {
+	services.Service
+
+	err     error
+	queries atomic.Int64
+}
+
+func newMockFallback(err error) *mockFallback {
+	return &mockFallback{Service: services.NewIdleService(nil, nil), err: err}
+}
+
+func (m *mockFallback) RoundTripGRPC(_ context.Context, _ *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error) {
+	m.queries.Inc()
+	return &httpgrpc.HTTPResponse{Code: http.StatusAccepted}, nil
+}
+
+func (m *mockFallback) CheckReady(_ context.Context) error {
+	return m.err
+}
+
 type mockScheduler struct {
 	t *testing.T
 	f *Frontend
@@ -9,6 +9,7 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/weaveworks/common/httpgrpc"
 
@@ -65,6 +66,9 @@ func (q *Querier) RangeQueryHandler(w http.ResponseWriter, r *http.Request) {
 		serverutil.WriteError(err, w)
 		return
 	}
+	if request.StatsOnly {
+		result.Data = withoutData(result.Data)
+	}
 	if err := marshal.WriteQueryResponseJSON(result, w); err != nil {
 		serverutil.WriteError(err, w)
 		return
@@ -105,12 +109,29 @@ func (q *Querier) InstantQueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.StatsOnly {
+		result.Data = withoutData(result.Data)
+	}
 	if err := marshal.WriteQueryResponseJSON(result, w); err != nil {
 		serverutil.WriteError(err, w)
 		return
 	}
 }
 
+// withoutData empties the data of the results of stats only queries, keeping its type.
+func withoutData(data parser.Value) parser.Value {
+	switch data.(type) {
+	case logqlmodel.Streams:
+		return logqlmodel.Streams{}
+	case promql.Matrix:
+		return promql.Matrix{}
+	case promql.Vector:
+		return promql.Vector{}
+	default:
+		return data
+	}
+}
+
 // LogQueryHandler is a http.HandlerFunc for log only queries.
 func (q *Querier) LogQueryHandler(w http.ResponseWriter, r *http.Request) {
 	// Enforce the query timeout while querying backends
@@ -163,6 +184,9 @@ func (q *Querier) LogQueryHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.StatsOnly {
+		result.Data = withoutData(result.Data)
+	}
 	if err := marshal_legacy.WriteQueryResponseJSON(result, w); err != nil {
 		serverutil.WriteError(err, w)
 		return
@@ -177,6 +201,23 @@ func (q *Querier) LabelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	withCounts, err := loghttp.ParseLabelWithCounts(r)
+	if err != nil {
+		serverutil.WriteError(httpgrpc.Errorf(http.StatusBadRequest, err.Error()), w)
+		return
+	}
+	if withCounts && req.Values {
+		counts, err := q.LabelCounts(r.Context(), req)
+		if err != nil {
+			serverutil.WriteError(err, w)
+			return
+		}
+		if err := marshal.WriteLabelCountsResponseJSON(counts, w); err != nil {
+			serverutil.WriteError(err, w)
+		}
+		return
+	}
+
 	resp, err := q.Label(r.Context(), req)
 	if err != nil {
 		serverutil.WriteError(err, w)
@@ -3,7 +3,9 @@ package querier
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/prometheus/common/model"
@@ -297,6 +299,34 @@ func (q *Querier) Label(ctx context.Context, req *logproto.LabelRequest) (*logpr
 	}, nil
 }
 
+// LabelCounts returns the values of the label of a label values request with the number of series
+// each of them is set on, sorted by value.
+func (q *Querier) LabelCounts(ctx context.Context, req *logproto.LabelRequest) ([]loghttp.LabelValueCount, error) {
+	if !model.LabelName(req.Name).IsValid() {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, "invalid label name %q", req.Name)
+	}
+
+	resp, err := q.Series(ctx, &logproto.SeriesRequest{
+		Start:  *req.Start,
+		End:    *req.End,
+		Groups: []string{fmt.Sprintf(`{%s=~".+"}`, req.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint64)
+	for _, series := range resp.Series {
+		counts[series.Labels[req.Name]]++
+	}
+	result := make([]loghttp.LabelValueCount, 0, len(counts))
+	for value, count := range counts {
+		result = append(result, loghttp.LabelValueCount{Value: value, Count: count})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Value < result[j].Value })
+	return result, nil
+}
+
 // Check implements the grpc healthcheck
 func (*Querier) Check(_ context.Context, _ *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
 	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
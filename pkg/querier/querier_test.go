@@ -19,6 +19,7 @@ import (
 	"github.com/weaveworks/common/user"
 
 	"github.com/grafana/loki/pkg/ingester/client"
+	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/grafana/loki/pkg/logql"
 	"github.com/grafana/loki/pkg/storage"
@@ -358,6 +359,41 @@ func TestQuerier_SeriesAPI(t *testing.T) {
 	}
 }
 
+func TestQuerier_LabelCounts(t *testing.T) {
+	store := newStoreMock()
+	ingesterClient := newQuerierClientMock()
+	ingesterClient.On("Series", mock.Anything, mock.Anything, mock.Anything).Return(&logproto.SeriesResponse{
+		Series: []logproto.SeriesIdentifier{
+			{Labels: map[string]string{"app": "foo", "pod": "1"}},
+			{Labels: map[string]string{"app": "foo", "pod": "2"}},
+		},
+	}, nil)
+	store.On("GetSeries", mock.Anything, mock.Anything).Return([]logproto.SeriesIdentifier{
+		{Labels: map[string]string{"app": "foo", "pod": "2"}},
+		{Labels: map[string]string{"app": "bar", "pod": "3"}},
+	}, nil)
+
+	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
+	require.NoError(t, err)
+	q, err := newQuerier(
+		mockQuerierConfig(),
+		mockIngesterClientConfig(),
+		newIngesterClientMockFactory(ingesterClient),
+		mockReadRingWithOneActiveIngester(),
+		store, limits)
+	require.NoError(t, err)
+
+	ctx := user.InjectOrgID(context.Background(), "test")
+	start, end := time.Unix(0, 0), time.Unix(10, 0)
+	counts, err := q.LabelCounts(ctx, &logproto.LabelRequest{Name: "app", Values: true, Start: &start, End: &end})
+	require.NoError(t, err)
+	// the series in both the ingesters and the store are counted once.
+	require.Equal(t, []loghttp.LabelValueCount{{Value: "bar", Count: 1}, {Value: "foo", Count: 2}}, counts)
+
+	_, err = q.LabelCounts(ctx, &logproto.LabelRequest{Name: "not-a-label", Values: true, Start: &start, End: &end})
+	require.Error(t, err)
+}
+
 func TestQuerier_IngesterMaxQueryLookback(t *testing.T) {
 	limits, err := validation.NewOverrides(defaultLimitsTestConfig(), nil)
 	require.NoError(t, err)
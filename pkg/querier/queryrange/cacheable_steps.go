@@ -0,0 +1,65 @@
+package queryrange
+
+import (
+	"strings"
+	"time"
+)
+
+// DurationsCSV is a slice of durations that is parsed from a comma-separated string.
+// It implements flag.Value and yaml Marshalers.
+type DurationsCSV []time.Duration
+
+// String implements flag.Value
+func (v DurationsCSV) String() string {
+	durations := make([]string, 0, len(v))
+	for _, d := range v {
+		durations = append(durations, d.String())
+	}
+	return strings.Join(durations, ",")
+}
+
+// Set implements flag.Value
+func (v *DurationsCSV) Set(s string) error {
+	var durations DurationsCSV
+	for _, str := range strings.Split(s, ",") {
+		if str = strings.TrimSpace(str); str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		durations = append(durations, d)
+	}
+	*v = durations
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (v *DurationsCSV) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return v.Set(s)
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (v DurationsCSV) MarshalYAML() (interface{}, error) {
+	return v.String(), nil
+}
+
+// cacheableStep tells if the results of metric range queries with the given step may be cached. Steps
+// computed from the dashboard width, such as Grafana's $__auto, are unlikely to be queried again and
+// would only pollute the cache. Any step is cacheable when no cacheable steps are configured.
+func (c Codec) cacheableStep(step time.Duration) bool {
+	if len(c.cacheableSteps) == 0 {
+		return true
+	}
+	for _, s := range c.cacheableSteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
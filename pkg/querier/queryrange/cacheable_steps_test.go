@@ -0,0 +1,35 @@
+package queryrange
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestDurationsCSV(t *testing.T) {
+	var v DurationsCSV
+	require.NoError(t, v.Set("15s, 1m,5m"))
+	require.Equal(t, DurationsCSV{15 * time.Second, time.Minute, 5 * time.Minute}, v)
+	require.Equal(t, "15s,1m0s,5m0s", v.String())
+	require.Error(t, v.Set("1m,auto"))
+
+	var cfg struct {
+		Steps DurationsCSV `yaml:"steps"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte(`steps: 1m,1h`), &cfg))
+	require.Equal(t, DurationsCSV{time.Minute, time.Hour}, cfg.Steps)
+	out, err := yaml.Marshal(cfg)
+	require.NoError(t, err)
+	require.Equal(t, "steps: 1m0s,1h0m0s\n", string(out))
+}
+
+func Test_codec_cacheableStep(t *testing.T) {
+	require.True(t, (&Codec{}).cacheableStep(37*time.Second))
+
+	c := &Codec{cacheableSteps: []time.Duration{time.Minute, 5 * time.Minute}}
+	require.True(t, c.cacheableStep(time.Minute))
+	require.True(t, c.cacheableStep(5*time.Minute))
+	require.False(t, c.cacheableStep(37*time.Second))
+}
@@ -6,7 +6,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"sort"
@@ -15,6 +18,8 @@ import (
 
 	"github.com/cortexproject/cortex/pkg/cortexpb"
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/cortexproject/cortex/pkg/util/validation"
 	json "github.com/json-iterator/go"
 	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
@@ -26,6 +31,7 @@ import (
 	"github.com/grafana/loki/pkg/logql"
 	"github.com/grafana/loki/pkg/logqlmodel"
 	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/tenant"
 	"github.com/grafana/loki/pkg/util/httpreq"
 	"github.com/grafana/loki/pkg/util/marshal"
 	marshal_legacy "github.com/grafana/loki/pkg/util/marshal/legacy"
@@ -33,7 +39,101 @@ import (
 
 var LokiCodec = &Codec{}
 
-type Codec struct{}
+const (
+	// versionMediaTypeParam is the Accept media type parameter allowing clients to choose the
+	// response format regardless of the request path, e.g. `Accept: application/json; loki-version=legacy`.
+	versionMediaTypeParam  = "loki-version"
+	versionMediaTypeV1     = "v1"
+	versionMediaTypeLegacy = "legacy"
+
+	versionCtxKey ctxKeyType = "version"
+
+	// seriesFormatParam is the series request parameter choosing between the full label sets of the
+	// matching series, the default, and only their number with seriesFormatCount.
+	seriesFormatParam = "format"
+	seriesFormatFull  = "full"
+	seriesFormatCount = "count"
+
+	seriesFormatCtxKey ctxKeyType = "seriesFormat"
+
+	// ndjsonMediaType is the Accept media type streaming the entries of log queries as newline delimited JSON.
+	ndjsonMediaType = "application/x-ndjson"
+
+	ndjsonCtxKey ctxKeyType = "ndjson"
+
+	// statsOnlyCtxKey is set for queries requesting only their statistics, e.g. to estimate their cost.
+	statsOnlyCtxKey ctxKeyType = "statsOnly"
+
+	// maxBytesCtxKey holds the budget of the estimated serialized size of the entries of log queries.
+	maxBytesCtxKey ctxKeyType = "maxBytes"
+
+	maxBytesWarningTmpl = "the result was truncated to %d of %d entries to fit within max_bytes (%d bytes)"
+
+	// maxPointsCtxKey holds the maximum number of points of each series of the matrix results of metric queries.
+	maxPointsCtxKey ctxKeyType = "maxPoints"
+
+	autoStepCtxKey     ctxKeyType = "autoStep"
+	stepAdjustedCtxKey ctxKeyType = "stepAdjusted"
+
+	stepAdjustedWarningTmpl = "step adjusted to %s to stay within the maximum of %d points per series"
+
+	errEmptyQuery = "query cannot be empty"
+
+	errDuplicateParamTmpl = "parameter %q must be set at most once"
+
+	// cacheControlHeader of requests with one of noCacheDirectives bypasses the results cache.
+	cacheControlHeader = "Cache-Control"
+)
+
+var noCacheDirectives = []string{"no-store", "no-cache"}
+
+// singleValuedParams are the request parameters which can't be repeated, only one of their values would be used.
+var singleValuedParams = []string{"query", "limit", "step", "direction", "time", "start", "end"}
+
+type Codec struct {
+	// alignStartEndToStep snaps the start and end of metric range queries to their step when decoding.
+	alignStartEndToStep bool
+	// maxURLLength is the URL length above which encoded requests are sent as POST, 0 to always use GET.
+	maxURLLength int
+	// allowedHeaders, when not empty, are the only headers set on encoded requests and deniedHeaders are never
+	// set on them, whatever the request context holds. Both are canonical header keys.
+	allowedHeaders map[string]struct{}
+	deniedHeaders  map[string]struct{}
+	// cacheableSteps, when not empty, are the only steps of the metric range queries whose results are cached.
+	cacheableSteps []time.Duration
+	// sortMergedEntries sorts the entries of the merged log streams rather than trusting sub-queries to return
+	// them in order.
+	sortMergedEntries bool
+}
+
+// canonicalHeaders returns the set of the canonical keys of headers, nil when empty.
+func canonicalHeaders(headers []string) map[string]struct{} {
+	if len(headers) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(headers))
+	for _, h := range headers {
+		set[http.CanonicalHeaderKey(strings.TrimSpace(h))] = struct{}{}
+	}
+	return set
+}
+
+// filterHeaders removes the headers which aren't allowed downstream from header. The Content-Type is
+// kept as POST requests can't be decoded without it.
+func (c Codec) filterHeaders(header http.Header) {
+	for key := range header {
+		if key == "Content-Type" {
+			continue
+		}
+		if _, ok := c.deniedHeaders[key]; ok {
+			delete(header, key)
+			continue
+		}
+		if _, ok := c.allowedHeaders[key]; len(c.allowedHeaders) > 0 && !ok {
+			delete(header, key)
+		}
+	}
+}
 
 func (r *LokiRequest) GetEnd() int64 {
 	return r.EndTs.UnixNano() / (int64(time.Millisecond) / int64(time.Nanosecond))
@@ -71,11 +171,10 @@ func (r *LokiRequest) LogToSpan(sp opentracing.Span) {
 		otlog.Int64("limit", int64(r.GetLimit())),
 		otlog.String("direction", r.GetDirection().String()),
 		otlog.String("shards", strings.Join(r.GetShards(), ",")),
+		otlog.String("query_hash", spanQueryHash(sp, r)),
 	)
 }
 
-func (*LokiRequest) GetCachingOptions() (res queryrange.CachingOptions) { return }
-
 func (r *LokiInstantRequest) GetStep() int64 {
 	return 0
 }
@@ -113,6 +212,7 @@ func (r *LokiInstantRequest) LogToSpan(sp opentracing.Span) {
 		otlog.Int64("limit", int64(r.GetLimit())),
 		otlog.String("direction", r.GetDirection().String()),
 		otlog.String("shards", strings.Join(r.GetShards(), ",")),
+		otlog.String("query_hash", spanQueryHash(sp, r)),
 	)
 }
 
@@ -152,6 +252,7 @@ func (r *LokiSeriesRequest) LogToSpan(sp opentracing.Span) {
 		otlog.String("start", timestamp.Time(r.GetStart()).String()),
 		otlog.String("end", timestamp.Time(r.GetEnd()).String()),
 		otlog.String("shards", strings.Join(r.GetShards(), ",")),
+		otlog.String("query_hash", spanQueryHash(sp, r)),
 	)
 }
 
@@ -189,38 +290,68 @@ func (r *LokiLabelNamesRequest) LogToSpan(sp opentracing.Span) {
 	sp.LogFields(
 		otlog.String("start", timestamp.Time(r.GetStart()).String()),
 		otlog.String("end", timestamp.Time(r.GetEnd()).String()),
+		otlog.String("query_hash", spanQueryHash(sp, r)),
 	)
 }
 
 func (*LokiLabelNamesRequest) GetCachingOptions() (res queryrange.CachingOptions) { return }
 
-func (Codec) DecodeRequest(_ context.Context, r *http.Request, forwardHeaders []string) (queryrange.Request, error) {
+// labelName returns the name of the label of a label values request, or an empty string for a label names request.
+func (r *LokiLabelNamesRequest) labelName() string {
+	if getOperation(r.Path) != LabelValuesOp {
+		return ""
+	}
+	return labelValuesName(r.Path)
+}
+
+func (c Codec) DecodeRequest(ctx context.Context, r *http.Request, forwardHeaders []string) (queryrange.Request, error) {
 	if err := r.ParseForm(); err != nil {
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
+	if err := validateSingleValuedParams(r.Form); err != nil {
+		return nil, err
+	}
 
 	switch op := getOperation(r.URL.Path); op {
 	case QueryRangeOp:
-		req, err := loghttp.ParseRangeQuery(r)
+		req, _, err := parseRangeQuery(r)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
-		return &LokiRequest{
+		if strings.TrimSpace(req.Query) == "" {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, errEmptyQuery)
+		}
+		lokiReq := &LokiRequest{
 			Query:     req.Query,
 			Limit:     req.Limit,
 			Direction: req.Direction,
 			StartTs:   req.Start.UTC(),
 			EndTs:     req.End.UTC(),
 			// GetStep must return milliseconds
-			Step:   int64(req.Step) / 1e6,
+			Step:   stepMillis(req.Step),
 			Path:   r.URL.Path,
 			Shards: req.Shards,
-		}, nil
+		}
+		// parsing errors are reported by the downstream handlers.
+		class, _ := classifyRequest(ctx, lokiReq)
+		if c.alignStartEndToStep && class.Metric {
+			start, end := alignToStep(req.Start, req.End, req.Step)
+			lokiReq.StartTs, lokiReq.EndTs = start.UTC(), end.UTC()
+		}
+		lokiReq.IsMetricQuery = class.Metric
+		lokiReq.CachingOptions = cachingOptions(r)
+		if class.Metric && !c.cacheableStep(req.Step) {
+			lokiReq.CachingOptions.Disabled = true
+		}
+		return lokiReq, nil
 	case InstantQueryOp:
 		req, err := loghttp.ParseInstantQuery(r)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
+		if strings.TrimSpace(req.Query) == "" {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, errEmptyQuery)
+		}
 		return &LokiInstantRequest{
 			Query:     req.Query,
 			Limit:     req.Limit,
@@ -241,22 +372,105 @@ func (Codec) DecodeRequest(_ context.Context, r *http.Request, forwardHeaders []
 			Path:    r.URL.Path,
 			Shards:  req.Shards,
 		}, nil
-	case LabelNamesOp:
+	case LabelNamesOp, LabelValuesOp:
 		req, err := loghttp.ParseLabelQuery(r)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
+		var withCounts bool
+		if op == LabelValuesOp {
+			if withCounts, err = loghttp.ParseLabelWithCounts(r); err != nil {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+		}
 		return &LokiLabelNamesRequest{
-			StartTs: *req.Start,
-			EndTs:   *req.End,
-			Path:    r.URL.Path,
+			StartTs:    *req.Start,
+			EndTs:      *req.End,
+			Path:       r.URL.Path,
+			WithCounts: withCounts,
 		}, nil
 	default:
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, fmt.Sprintf("unknown request path: %s", r.URL.Path))
 	}
 }
 
-func (Codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.Request, error) {
+// stepMillis converts a step to milliseconds. Steps below a millisecond are rounded up to one,
+// a zero step would make the sub-queries fall back to the default step when encoded.
+func stepMillis(step time.Duration) int64 {
+	ms := int64(step / time.Millisecond)
+	if ms == 0 && step > 0 {
+		return 1
+	}
+	return ms
+}
+
+// alignToStep snaps start down and end up to the closest step boundaries, so that requests
+// sent with slightly different time ranges result in the same query and cache keys.
+func alignToStep(start, end time.Time, step time.Duration) (time.Time, time.Time) {
+	if step <= 0 {
+		return start, end
+	}
+	s, e := start.UnixNano(), end.UnixNano()
+	s -= s % int64(step)
+	if r := e % int64(step); r != 0 {
+		e += int64(step) - r
+	}
+	return time.Unix(0, s), time.Unix(0, e)
+}
+
+// ValidateRequest decodes the request and validates it against the tenant limits without executing it.
+// It runs the same checks as the frontend tripperware: query parsing, resolution, max query lookback,
+// max query length and max entries limit. Returned errors are httpgrpc errors with a 400 status code.
+func (c Codec) ValidateRequest(ctx context.Context, r *http.Request, limits Limits) error {
+	req, err := c.DecodeRequest(ctx, r, nil)
+	if err != nil {
+		return err
+	}
+
+	var limit uint32
+	switch req := req.(type) {
+	case *LokiRequest:
+		if _, err := parsedExpr(ctx, req); err != nil {
+			return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+		limit = req.Limit
+	case *LokiInstantRequest:
+		if _, err := parsedExpr(ctx, req); err != nil {
+			return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+		limit = req.Limit
+	}
+
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	start := req.GetStart()
+	if maxQueryLookback := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, limits.MaxQueryLookback); maxQueryLookback > 0 {
+		minStartTime := util.TimeToMillis(time.Now().Add(-maxQueryLookback))
+		if req.GetEnd() < minStartTime {
+			return httpgrpc.Errorf(http.StatusBadRequest, errQueryOutsideLookbackTmpl, maxQueryLookback)
+		}
+		if start < minStartTime {
+			start = minStartTime
+		}
+	}
+
+	if maxQueryLength := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, limits.MaxQueryLength); maxQueryLength > 0 {
+		queryLen := timestamp.Time(req.GetEnd()).Sub(timestamp.Time(start))
+		if queryLen > maxQueryLength {
+			return httpgrpc.Errorf(http.StatusBadRequest, validation.ErrQueryTooLong, queryLen, maxQueryLength)
+		}
+	}
+
+	if maxEntriesLimit := validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, limits.MaxEntriesLimitPerQuery); maxEntriesLimit > 0 && int(limit) > maxEntriesLimit {
+		return httpgrpc.Errorf(http.StatusBadRequest, maxEntriesLimitErrTmpl, limit, maxEntriesLimit)
+	}
+	return nil
+}
+
+func (c Codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.Request, error) {
 	header := make(http.Header)
 	queryTags := getQueryTags(ctx)
 	if queryTags != "" {
@@ -278,20 +492,8 @@ func (Codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.Req
 		if request.Step != 0 {
 			params["step"] = []string{fmt.Sprintf("%f", float64(request.Step)/float64(1e3))}
 		}
-		u := &url.URL{
-			// the request could come /api/prom/query but we want to only use the new api.
-			Path:     "/loki/api/v1/query_range",
-			RawQuery: params.Encode(),
-		}
-		req := &http.Request{
-			Method:     "GET",
-			RequestURI: u.String(), // This is what the httpgrpc code looks at.
-			URL:        u,
-			Body:       http.NoBody,
-			Header:     header,
-		}
-
-		return req.WithContext(ctx), nil
+		// the request could come /api/prom/query but we want to only use the new api.
+		return c.newRequest(ctx, "/loki/api/v1/query_range", params, header), nil
 	case *LokiSeriesRequest:
 		params := url.Values{
 			"start":   []string{fmt.Sprintf("%d", request.StartTs.UnixNano())},
@@ -301,36 +503,20 @@ func (Codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.Req
 		if len(request.Shards) > 0 {
 			params["shards"] = request.Shards
 		}
-		u := &url.URL{
-			Path:     "/loki/api/v1/series",
-			RawQuery: params.Encode(),
-		}
-		req := &http.Request{
-			Method:     "GET",
-			RequestURI: u.String(), // This is what the httpgrpc code looks at.
-			URL:        u,
-			Body:       http.NoBody,
-			Header:     header,
-		}
-		return req.WithContext(ctx), nil
+		return c.newRequest(ctx, "/loki/api/v1/series", params, header), nil
 	case *LokiLabelNamesRequest:
 		params := url.Values{
 			"start": []string{fmt.Sprintf("%d", request.StartTs.UnixNano())},
 			"end":   []string{fmt.Sprintf("%d", request.EndTs.UnixNano())},
 		}
-
-		u := &url.URL{
-			Path:     "/loki/api/v1/labels",
-			RawQuery: params.Encode(),
-		}
-		req := &http.Request{
-			Method:     "GET",
-			RequestURI: u.String(), // This is what the httpgrpc code looks at.
-			URL:        u,
-			Body:       http.NoBody,
-			Header:     header,
+		if name := request.labelName(); name != "" {
+			if request.WithCounts {
+				params["with_counts"] = []string{"true"}
+			}
+			return c.newRequest(ctx, fmt.Sprintf("/loki/api/v1/label/%s/values", name), params, header), nil
 		}
-		return req.WithContext(ctx), nil
+
+		return c.newRequest(ctx, "/loki/api/v1/labels", params, header), nil
 	case *LokiInstantRequest:
 		params := url.Values{
 			"query":     []string{request.Query},
@@ -341,25 +527,40 @@ func (Codec) EncodeRequest(ctx context.Context, r queryrange.Request) (*http.Req
 		if len(request.Shards) > 0 {
 			params["shards"] = request.Shards
 		}
-		u := &url.URL{
-			// the request could come /api/prom/query but we want to only use the new api.
-			Path:     "/loki/api/v1/query",
-			RawQuery: params.Encode(),
-		}
-		req := &http.Request{
-			Method:     "GET",
-			RequestURI: u.String(), // This is what the httpgrpc code looks at.
-			URL:        u,
-			Body:       http.NoBody,
-			Header:     header,
-		}
-
-		return req.WithContext(ctx), nil
+		// the request could come /api/prom/query but we want to only use the new api.
+		return c.newRequest(ctx, "/loki/api/v1/query", params, header), nil
 	default:
 		return nil, httpgrpc.Errorf(http.StatusInternalServerError, "invalid request format")
 	}
 }
 
+// newRequest builds the downstream request for the given path and parameters. Requests whose URL would exceed
+// maxURLLength are sent as a POST with a form encoded body instead, so that long queries don't hit URL length limits.
+func (c Codec) newRequest(ctx context.Context, path string, params url.Values, header http.Header) *http.Request {
+	encoded := params.Encode()
+	u := &url.URL{
+		Path:     path,
+		RawQuery: encoded,
+	}
+	req := &http.Request{
+		Method:     "GET",
+		RequestURI: u.String(), // This is what the httpgrpc code looks at.
+		URL:        u,
+		Body:       http.NoBody,
+		Header:     header,
+	}
+	if c.maxURLLength > 0 && len(req.RequestURI) > c.maxURLLength {
+		u.RawQuery = ""
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Method = "POST"
+		req.RequestURI = u.String()
+		req.Body = ioutil.NopCloser(strings.NewReader(encoded))
+		req.ContentLength = int64(len(encoded))
+	}
+	c.filterHeaders(header)
+	return req.WithContext(ctx)
+}
+
 type Buffer interface {
 	Bytes() []byte
 }
@@ -403,6 +604,24 @@ func (Codec) DecodeResponse(ctx context.Context, r *http.Response, req queryrang
 			Headers: httpResponseHeadersToPromResponseHeaders(r.Header),
 		}, nil
 	case *LokiLabelNamesRequest:
+		if req.WithCounts {
+			var resp loghttp.LabelCountsResponse
+			if err := json.Unmarshal(buf, &resp); err != nil {
+				return nil, httpgrpc.Errorf(http.StatusInternalServerError, "error decoding response: %v", err)
+			}
+			values, counts := make([]string, 0, len(resp.Data)), make([]uint64, 0, len(resp.Data))
+			for _, v := range resp.Data {
+				values = append(values, v.Value)
+				counts = append(counts, v.Count)
+			}
+			return &LokiLabelNamesResponse{
+				Status:  resp.Status,
+				Version: uint32(loghttp.GetVersion(req.Path)),
+				Data:    values,
+				Counts:  counts,
+				Headers: httpResponseHeadersToPromResponseHeaders(r.Header),
+			}, nil
+		}
 		var resp loghttp.LabelResponse
 		if err := json.Unmarshal(buf, &resp); err != nil {
 			return nil, httpgrpc.Errorf(http.StatusInternalServerError, "error decoding response: %v", err)
@@ -418,6 +637,10 @@ func (Codec) DecodeResponse(ctx context.Context, r *http.Response, req queryrang
 		if err := resp.UnmarshalJSON(buf); err != nil {
 			return nil, httpgrpc.Errorf(http.StatusInternalServerError, "error decoding response: %v", err)
 		}
+		// carry the query tags in the stats so they survive merging and reach the per-query log line.
+		if resp.Data.Statistics.Summary.QueryTags == "" {
+			resp.Data.Statistics.Summary.QueryTags = getQueryTags(ctx)
+		}
 		switch string(resp.Data.ResultType) {
 		case loghttp.ResultTypeMatrix:
 			return &LokiPromResponse{
@@ -430,6 +653,7 @@ func (Codec) DecodeResponse(ctx context.Context, r *http.Response, req queryrang
 					Headers: convertPrometheusResponseHeadersToPointers(httpResponseHeadersToPromResponseHeaders(r.Header)),
 				},
 				Statistics: resp.Data.Statistics,
+				Warnings:   resp.Warnings,
 			}, nil
 		case loghttp.ResultTypeStream:
 			// This is the same as in querysharding.go
@@ -457,7 +681,8 @@ func (Codec) DecodeResponse(ctx context.Context, r *http.Response, req queryrang
 					ResultType: loghttp.ResultTypeStream,
 					Result:     resp.Data.Result.(loghttp.Streams).ToProto(),
 				},
-				Headers: httpResponseHeadersToPromResponseHeaders(r.Header),
+				Headers:  httpResponseHeadersToPromResponseHeaders(r.Header),
+				Warnings: resp.Warnings,
 			}, nil
 		case loghttp.ResultTypeVector:
 			return &LokiPromResponse{
@@ -470,6 +695,7 @@ func (Codec) DecodeResponse(ctx context.Context, r *http.Response, req queryrang
 					Headers: convertPrometheusResponseHeadersToPointers(httpResponseHeadersToPromResponseHeaders(r.Header)),
 				},
 				Statistics: resp.Data.Statistics,
+				Warnings:   resp.Warnings,
 			}, nil
 		default:
 			return nil, httpgrpc.Errorf(http.StatusInternalServerError, "unsupported response type, got (%s)", string(resp.Data.ResultType))
@@ -484,8 +710,31 @@ func (Codec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http
 
 	switch response := res.(type) {
 	case *LokiPromResponse:
-		return response.encode(ctx)
+		if step, ok := ctx.Value(stepAdjustedCtxKey).(time.Duration); ok {
+			response.Warnings = append(response.Warnings, fmt.Sprintf(stepAdjustedWarningTmpl, step, loghttp.MaxPointsPerSeries))
+		}
+		if statsOnly(ctx) {
+			response.Response.Data.Result = []queryrange.SampleStream{}
+		} else if n := maxPoints(ctx); n > 0 && response.Response.Data.ResultType == loghttp.ResultTypeMatrix {
+			response.Response.Data.Result = downsampleSeries(response.Response.Data.Result, n)
+		}
+		resp, err := response.encode(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return markLimitsHeaders(markPartialResults(resp, res), res), nil
 	case *LokiResponse:
+		if budget := maxBytes(ctx); budget > 0 {
+			if result, kept, total := limitStreamsBytes(response.Data.Result, budget, response.Direction); kept < total {
+				response.Data.Result = result
+				response.Warnings = append(response.Warnings, fmt.Sprintf(maxBytesWarningTmpl, kept, total, budget))
+			}
+		}
+		if statsOnly(ctx) {
+			response.Data.Result = nil
+		} else if ndjson, _ := ctx.Value(ndjsonCtxKey).(bool); ndjson {
+			return markLimitsHeaders(markPartialResults(encodeNDJSON(response), res), res), nil
+		}
 		streams := make([]logproto.Stream, len(response.Data.Result))
 
 		for i, stream := range response.Data.Result {
@@ -497,8 +746,9 @@ func (Codec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http
 		result := logqlmodel.Result{
 			Data:       logqlmodel.Streams(streams),
 			Statistics: response.Statistics,
+			Warnings:   response.Warnings,
 		}
-		if loghttp.Version(response.Version) == loghttp.VersionLegacy {
+		if responseVersion(ctx, response.Version) == loghttp.VersionLegacy {
 			if err := marshal_legacy.WriteQueryResponseJSON(result, &buf); err != nil {
 				return nil, err
 			}
@@ -507,8 +757,20 @@ func (Codec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http
 				return nil, err
 			}
 		}
+		// recorded once serialized for the query stats, so it can't be part of the response itself.
+		response.Statistics.Summary.ResponseBytes = int64(buf.Len())
 
+	case *ExplainResponse:
+		if err := json.NewEncoder(&buf).Encode(response.Plan); err != nil {
+			return nil, err
+		}
 	case *LokiSeriesResponse:
+		if format, _ := ctx.Value(seriesFormatCtxKey).(string); format == seriesFormatCount {
+			if err := marshal.WriteSeriesCountResponseJSON(len(response.Data), &buf); err != nil {
+				return nil, err
+			}
+			break
+		}
 		result := logproto.SeriesResponse{
 			Series: response.Data,
 		}
@@ -516,7 +778,15 @@ func (Codec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http
 			return nil, err
 		}
 	case *LokiLabelNamesResponse:
-		if loghttp.Version(response.Version) == loghttp.VersionLegacy {
+		if len(response.Counts) > 0 {
+			counts := make([]loghttp.LabelValueCount, 0, len(response.Data))
+			for i, value := range response.Data {
+				counts = append(counts, loghttp.LabelValueCount{Value: value, Count: response.Counts[i]})
+			}
+			if err := marshal.WriteLabelCountsResponseJSON(counts, &buf); err != nil {
+				return nil, err
+			}
+		} else if responseVersion(ctx, response.Version) == loghttp.VersionLegacy {
 			if err := marshal_legacy.WriteLabelResponseJSON(logproto.LabelResponse{Values: response.Data}, &buf); err != nil {
 				return nil, err
 			}
@@ -538,45 +808,343 @@ func (Codec) EncodeResponse(ctx context.Context, res queryrange.Response) (*http
 		Body:       ioutil.NopCloser(&buf),
 		StatusCode: http.StatusOK,
 	}
-	return &resp, nil
+	return markLimitsHeaders(markPartialResults(&resp, res), res), nil
+}
+
+// acceptedVersion returns the response version explicitly requested via the
+// versionMediaTypeParam of the Accept header, if any.
+func acceptedVersion(h http.Header) (loghttp.Version, bool) {
+	for _, accept := range h.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			_, params, err := mime.ParseMediaType(mediaType)
+			if err != nil {
+				continue
+			}
+			switch params[versionMediaTypeParam] {
+			case versionMediaTypeV1:
+				return loghttp.VersionV1, true
+			case versionMediaTypeLegacy:
+				return loghttp.VersionLegacy, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// withAcceptedVersion injects the response version requested via the Accept header in the request context.
+func withAcceptedVersion(req *http.Request) *http.Request {
+	v, ok := acceptedVersion(req.Header)
+	if !ok {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), versionCtxKey, v))
+}
+
+// cachingOptions disables the results caching of requests with a no-store or no-cache Cache-Control header.
+func cachingOptions(r *http.Request) queryrange.CachingOptions {
+	for _, value := range r.Header.Values(cacheControlHeader) {
+		for _, directive := range strings.Split(value, ",") {
+			for _, noCache := range noCacheDirectives {
+				if strings.EqualFold(strings.TrimSpace(directive), noCache) {
+					return queryrange.CachingOptions{Disabled: true}
+				}
+			}
+		}
+	}
+	return queryrange.CachingOptions{}
+}
+
+// validateSingleValuedParams rejects the requests repeating a single valued parameter, rather than
+// arbitrarily using one of its values.
+func validateSingleValuedParams(form url.Values) error {
+	for _, param := range singleValuedParams {
+		if len(form[param]) > 1 {
+			return httpgrpc.Errorf(http.StatusBadRequest, errDuplicateParamTmpl, param)
+		}
+	}
+	return nil
+}
+
+// parseRangeQuery parses the range query of r, increasing its step instead of rejecting it when it exceeds
+// the maximum number of points per series if the auto step is enabled in the request context.
+func parseRangeQuery(r *http.Request) (*loghttp.RangeQuery, bool, error) {
+	if autoStep, _ := r.Context().Value(autoStepCtxKey).(bool); autoStep {
+		return loghttp.ParseRangeQueryWithAutoStep(r)
+	}
+	req, err := loghttp.ParseRangeQuery(r)
+	return req, false, err
+}
+
+// withAutoStep enables the auto step in the request context when the tenant enables it.
+func withAutoStep(req *http.Request, limits Limits) (*http.Request, error) {
+	userID, err := tenant.TenantID(req.Context())
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if !limits.AutoStep(userID) {
+		return req, nil
+	}
+	return req.WithContext(context.WithValue(req.Context(), autoStepCtxKey, true)), nil
+}
+
+// encodeNDJSON encodes the entries of a log response as newline delimited JSON in its direction.
+// The body is written while it is read, the caller must close it.
+func encodeNDJSON(res *LokiResponse) *http.Response {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(marshal.WriteStreamsNDJSON(res.Data.Result, res.Direction, pw))
+	}()
+	return &http.Response{
+		Header: http.Header{
+			"Content-Type": []string{ndjsonMediaType},
+		},
+		Body:       pr,
+		StatusCode: http.StatusOK,
+	}
+}
+
+// acceptsNDJSON tells if the Accept header asks for newline delimited JSON.
+func acceptsNDJSON(h http.Header) bool {
+	for _, accept := range h.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if mt, _, err := mime.ParseMediaType(mediaType); err == nil && mt == ndjsonMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withAcceptedNDJSON injects in the request context whether log responses should be streamed as
+// newline delimited JSON, as requested via the Accept header.
+func withAcceptedNDJSON(req *http.Request) *http.Request {
+	if !acceptsNDJSON(req.Header) {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), ndjsonCtxKey, true))
+}
+
+// withStatsOnly injects in the request context that only the statistics of the query should be returned.
+func withStatsOnly(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), statsOnlyCtxKey, true))
+}
+
+func statsOnly(ctx context.Context) bool {
+	statsOnly, _ := ctx.Value(statsOnlyCtxKey).(bool)
+	return statsOnly
+}
+
+// withMaxBytes injects in the request context the budget of the estimated serialized size of the entries
+// of the log query.
+func withMaxBytes(req *http.Request, maxBytes int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), maxBytesCtxKey, maxBytes))
+}
+
+func maxBytes(ctx context.Context) int {
+	maxBytes, _ := ctx.Value(maxBytesCtxKey).(int)
+	return maxBytes
+}
+
+// withMaxPoints injects in the request context the maximum number of points each series of the metric query
+// is downsampled to.
+func withMaxPoints(req *http.Request, maxPoints int) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), maxPointsCtxKey, maxPoints))
+}
+
+func maxPoints(ctx context.Context) int {
+	maxPoints, _ := ctx.Value(maxPointsCtxKey).(int)
+	return maxPoints
+}
+
+// withSeriesFormat injects the series response format requested via the seriesFormatParam of a parsed
+// series request in its context.
+func withSeriesFormat(req *http.Request) (*http.Request, error) {
+	switch format := req.Form.Get(seriesFormatParam); format {
+	case "", seriesFormatFull:
+		return req, nil
+	case seriesFormatCount:
+		return req.WithContext(context.WithValue(req.Context(), seriesFormatCtxKey, format)), nil
+	default:
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, "invalid series format %q, supported values are %q and %q", format, seriesFormatFull, seriesFormatCount)
+	}
+}
+
+// responseVersion returns the version to encode a response with. The version requested via the Accept header
+// takes precedence over the one detected from the request path, as proxies may rewrite paths.
+func responseVersion(ctx context.Context, version uint32) loghttp.Version {
+	if v, ok := ctx.Value(versionCtxKey).(loghttp.Version); ok {
+		return v
+	}
+	return loghttp.Version(version)
+}
+
+// sortedWarnings returns the unique warnings sorted, or nil if there are none.
+func sortedWarnings(warnings map[string]struct{}) []string {
+	if len(warnings) == 0 {
+		return nil
+	}
+	res := make([]string, 0, len(warnings))
+	for w := range warnings {
+		res = append(res, w)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// preferNonNaNBoundarySamples drops the NaN sample ending a series of a response when the following response
+// starts that series with a real value at the same timestamp. When two splits overlap on a sample, the Prometheus
+// codec keeps the one from the earliest response, which would otherwise leave a gap at split boundaries.
+// Responses are copied before being trimmed so that the inputs, which may come from the results cache, are left untouched.
+func preferNonNaNBoundarySamples(responses []*queryrange.PrometheusResponse) []queryrange.Response {
+	sorted := make([]*queryrange.PrometheusResponse, 0, len(responses))
+	for _, res := range responses {
+		copied := *res
+		copied.Data.Result = append([]queryrange.SampleStream(nil), res.Data.Result...)
+		sorted = append(sorted, &copied)
+	}
+	// same ordering as the Prometheus codec uses for merging.
+	firstTime := func(res *queryrange.PrometheusResponse) int64 {
+		if len(res.Data.Result) == 0 || len(res.Data.Result[0].Samples) == 0 {
+			return -1
+		}
+		return res.Data.Result[0].Samples[0].TimestampMs
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return firstTime(sorted[i]) < firstTime(sorted[j]) })
+
+	last := make(map[string]*queryrange.SampleStream)
+	result := make([]queryrange.Response, 0, len(sorted))
+	for _, res := range sorted {
+		for i := range res.Data.Result {
+			stream := &res.Data.Result[i]
+			if len(stream.Samples) == 0 {
+				continue
+			}
+			metric := cortexpb.FromLabelAdaptersToLabels(stream.Labels).String()
+			if prev, ok := last[metric]; ok {
+				prevLast := prev.Samples[len(prev.Samples)-1]
+				first := stream.Samples[0]
+				if prevLast.TimestampMs == first.TimestampMs && math.IsNaN(prevLast.Value) && !math.IsNaN(first.Value) {
+					prev.Samples = prev.Samples[:len(prev.Samples)-1]
+				}
+			}
+			last[metric] = stream
+		}
+		result = append(result, res)
+	}
+	return result
 }
 
 // NOTE: When we would start caching response from non-metric queries we would have to consider cache gen headers as well in
 // MergeResponse implementation for Loki codecs same as it is done in Cortex at https://github.com/cortexproject/cortex/blob/21bad57b346c730d684d6d0205efef133422ab28/pkg/querier/queryrange/query_range.go#L170
-func (Codec) MergeResponse(responses ...queryrange.Response) (queryrange.Response, error) {
+func (c Codec) MergeResponse(responses ...queryrange.Response) (queryrange.Response, error) {
+	return c.mergeResponse(nil, responses...)
+}
+
+// MergeRequestResponses merges the responses of the sub-queries of r. Log responses are
+// merged using the direction of r instead of the direction of the first response.
+func (c Codec) MergeRequestResponses(r queryrange.Request, responses ...queryrange.Response) (queryrange.Response, error) {
+	if req, ok := r.(*LokiRequest); ok {
+		direction := req.Direction
+		return c.mergeResponse(&direction, responses...)
+	}
+	return c.mergeResponse(nil, responses...)
+}
+
+// MergeSeriesResponses merges series responses like MergeResponse, failing with the series limit error
+// as soon as they hold more than maxSeries unique series rather than after merging all of them.
+// 0 disables the limit.
+func (Codec) MergeSeriesResponses(maxSeries int, responses ...queryrange.Response) (queryrange.Response, error) {
+	if len(responses) == 0 {
+		return nil, errors.New("merging responses requires at least one response")
+	}
+	return mergeSeriesResponses(maxSeries, responses)
+}
+
+func mergeSeriesResponses(maxSeries int, responses []queryrange.Response) (queryrange.Response, error) {
+	lokiSeriesRes, ok := responses[0].(*LokiSeriesResponse)
+	if !ok {
+		return nil, errors.New("unknown response in merging responses")
+	}
+
+	var lokiSeriesData []logproto.SeriesIdentifier
+	uniqueSeries := make(map[string]struct{})
+
+	// only unique series should be merged
+	for _, res := range responses {
+		lokiResult := res.(*LokiSeriesResponse)
+		for _, series := range lokiResult.Data {
+			if _, ok := uniqueSeries[series.String()]; !ok {
+				if maxSeries > 0 && len(uniqueSeries) == maxSeries {
+					return nil, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, maxSeries)
+				}
+				lokiSeriesData = append(lokiSeriesData, series)
+				uniqueSeries[series.String()] = struct{}{}
+			}
+		}
+	}
+
+	return &LokiSeriesResponse{
+		Status:  lokiSeriesRes.Status,
+		Version: lokiSeriesRes.Version,
+		Data:    lokiSeriesData,
+	}, nil
+}
+
+func (c Codec) mergeResponse(direction *logproto.Direction, responses ...queryrange.Response) (queryrange.Response, error) {
 	if len(responses) == 0 {
 		return nil, errors.New("merging responses requires at least one response")
 	}
-	var mergedStats stats.Result
+	var (
+		mergedStats stats.Result
+		warnings    = make(map[string]struct{})
+	)
 	switch responses[0].(type) {
 	case *LokiPromResponse:
-
-		promResponses := make([]queryrange.Response, 0, len(responses))
+		promResponses := make([]*queryrange.PrometheusResponse, 0, len(responses))
 		for _, res := range responses {
 			mergedStats.Merge(res.(*LokiPromResponse).Statistics)
 			promResponses = append(promResponses, res.(*LokiPromResponse).Response)
+			for _, w := range res.(*LokiPromResponse).Warnings {
+				warnings[w] = struct{}{}
+			}
 		}
-		promRes, err := queryrange.PrometheusCodec.MergeResponse(promResponses...)
+		promRes, err := queryrange.PrometheusCodec.MergeResponse(preferNonNaNBoundarySamples(promResponses)...)
 		if err != nil {
 			return nil, err
 		}
 		return &LokiPromResponse{
 			Response:   promRes.(*queryrange.PrometheusResponse),
 			Statistics: mergedStats,
+			Warnings:   sortedWarnings(warnings),
 		}, nil
 	case *LokiResponse:
 		lokiRes := responses[0].(*LokiResponse)
+		dir := lokiRes.Direction
+		if direction != nil {
+			dir = *direction
+		}
 
 		lokiResponses := make([]*LokiResponse, 0, len(responses))
 		for _, res := range responses {
 			lokiResult := res.(*LokiResponse)
+			// all sub-responses must be ordered the same way, otherwise the merge would
+			// silently return mis-ordered entries.
+			if lokiResult.Direction != dir {
+				return nil, fmt.Errorf("cannot merge responses with direction %s into direction %s", lokiResult.Direction, dir)
+			}
 			mergedStats.Merge(lokiResult.Statistics)
 			lokiResponses = append(lokiResponses, lokiResult)
+			for _, w := range lokiResult.Warnings {
+				warnings[w] = struct{}{}
+			}
 		}
 
+		result := mergeOrderedNonOverlappingStreams(lokiResponses, lokiRes.Limit, dir, c.sortMergedEntries)
+		mergedStats.Summary.TotalStreamsReturned = int64(len(result))
+
 		return &LokiResponse{
 			Status:     loghttp.QueryStatusSuccess,
-			Direction:  lokiRes.Direction,
+			Direction:  dir,
 			Limit:      lokiRes.Limit,
 			Version:    lokiRes.Version,
 			ErrorType:  lokiRes.ErrorType,
@@ -584,33 +1152,19 @@ func (Codec) MergeResponse(responses ...queryrange.Response) (queryrange.Respons
 			Statistics: mergedStats,
 			Data: LokiData{
 				ResultType: loghttp.ResultTypeStream,
-				Result:     mergeOrderedNonOverlappingStreams(lokiResponses, lokiRes.Limit, lokiRes.Direction),
+				Result:     result,
 			},
+			Warnings: sortedWarnings(warnings),
 		}, nil
 	case *LokiSeriesResponse:
-		lokiSeriesRes := responses[0].(*LokiSeriesResponse)
-
-		var lokiSeriesData []logproto.SeriesIdentifier
-		uniqueSeries := make(map[string]struct{})
-
-		// only unique series should be merged
+		return mergeSeriesResponses(0, responses)
+	case *LokiLabelNamesResponse:
+		labelNameRes := responses[0].(*LokiLabelNamesResponse)
 		for _, res := range responses {
-			lokiResult := res.(*LokiSeriesResponse)
-			for _, series := range lokiResult.Data {
-				if _, ok := uniqueSeries[series.String()]; !ok {
-					lokiSeriesData = append(lokiSeriesData, series)
-					uniqueSeries[series.String()] = struct{}{}
-				}
+			if len(res.(*LokiLabelNamesResponse).Counts) > 0 {
+				return mergeLabelCountsResponses(labelNameRes, responses), nil
 			}
 		}
-
-		return &LokiSeriesResponse{
-			Status:  lokiSeriesRes.Status,
-			Version: lokiSeriesRes.Version,
-			Data:    lokiSeriesData,
-		}, nil
-	case *LokiLabelNamesResponse:
-		labelNameRes := responses[0].(*LokiLabelNamesResponse)
 		uniqueNames := make(map[string]struct{})
 		names := []string{}
 
@@ -624,6 +1178,8 @@ func (Codec) MergeResponse(responses ...queryrange.Response) (queryrange.Respons
 				}
 			}
 		}
+		// sub-responses are merged in arrival order, sort the names so the result is deterministic.
+		sort.Strings(names)
 
 		return &LokiLabelNamesResponse{
 			Status:  labelNameRes.Status,
@@ -635,8 +1191,40 @@ func (Codec) MergeResponse(responses ...queryrange.Response) (queryrange.Respons
 	}
 }
 
-// mergeOrderedNonOverlappingStreams merges a set of ordered, nonoverlapping responses by concatenating matching streams then running them through a heap to pull out limit values
-func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, direction logproto.Direction) []logproto.Stream {
+// mergeLabelCountsResponses merges the label values responses with counts, summing the counts of each value
+// across the responses: the series of a value are counted by each of the sub-queries they have entries in.
+func mergeLabelCountsResponses(first *LokiLabelNamesResponse, responses []queryrange.Response) *LokiLabelNamesResponse {
+	counts := make(map[string]uint64)
+	for _, res := range responses {
+		lokiResult := res.(*LokiLabelNamesResponse)
+		for i, value := range lokiResult.Data {
+			if i < len(lokiResult.Counts) {
+				counts[value] += lokiResult.Counts[i]
+			}
+		}
+	}
+	values := make([]string, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	merged := make([]uint64, 0, len(values))
+	for _, value := range values {
+		merged = append(merged, counts[value])
+	}
+
+	return &LokiLabelNamesResponse{
+		Status:  first.Status,
+		Version: first.Version,
+		Data:    values,
+		Counts:  merged,
+	}
+}
+
+// mergeOrderedNonOverlappingStreams merges a set of ordered, nonoverlapping responses by concatenating matching streams then running them through a heap to pull out limit values.
+// Regardless of whether the limit is hit, the returned streams are ordered by their labels: ascending for FORWARD queries and descending for BACKWARD queries.
+// When unordered, the entries of each stream are sorted instead of trusting the responses to be ordered and non overlapping.
+func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, direction logproto.Direction, unordered bool) []logproto.Stream {
 	var total int
 
 	// turn resps -> map[labels] []entries
@@ -648,6 +1236,7 @@ func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, dire
 				s = &byDir{
 					direction: direction,
 					labels:    stream.Labels,
+					unordered: unordered,
 				}
 				groups[stream.Labels] = s
 			}
@@ -656,21 +1245,14 @@ func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, dire
 			total += len(stream.Entries)
 		}
 
-		// optimization: since limit has been reached, no need to append entries from subsequent responses
-		if total >= int(limit) {
+		// optimization: since limit has been reached, no need to append entries from subsequent responses.
+		// Unordered responses must all be read as any of them may hold the first entries.
+		if !unordered && total >= int(limit) {
 			break
 		}
 	}
 
-	keys := make([]string, 0, len(groups))
-	for key := range groups {
-		keys = append(keys, key)
-	}
-	if direction == logproto.BACKWARD {
-		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
-	} else {
-		sort.Strings(keys)
-	}
+	keys := sortedStreamLabels(groups, direction)
 
 	// escape hatch, can just return all the streams
 	if total <= int(limit) {
@@ -719,6 +1301,7 @@ func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, dire
 		s.Entries = append(s.Entries, next.Entries...)
 	}
 
+	// streams which did not make the cut are skipped, the remaining ones keep the same order as the escape hatch.
 	results := make([]logproto.Stream, 0, len(resultDict))
 	for _, key := range keys {
 		stream, ok := resultDict[key]
@@ -730,6 +1313,67 @@ func mergeOrderedNonOverlappingStreams(resps []*LokiResponse, limit uint32, dire
 	return results
 }
 
+// entryOverheadBytes estimates the serialized size of an entry besides its line: its nanosecond timestamp,
+// quotes, brackets and separators.
+const entryOverheadBytes = 26
+
+// limitStreamsBytes keeps the entries of streams, in the order of the query direction across streams, until
+// their estimated serialized size reaches maxBytes. It returns the streams with the kept entries, in the
+// same order as streams, along with the number of kept entries and the total number of entries.
+func limitStreamsBytes(streams []logproto.Stream, maxBytes int, direction logproto.Direction) ([]logproto.Stream, int, int) {
+	var total, size int
+	pq := &priorityqueue{direction: direction}
+	for i := range streams {
+		total += len(streams[i].Entries)
+		for _, e := range streams[i].Entries {
+			size += len(e.Line) + entryOverheadBytes
+		}
+		if len(streams[i].Entries) > 0 {
+			// the queue reslices the entries of the streams it holds, copy them.
+			stream := streams[i]
+			pq.streams = append(pq.streams, &stream)
+		}
+	}
+	if size <= maxBytes {
+		return streams, total, total
+	}
+
+	heap.Init(pq)
+	kept := make(map[string][]logproto.Entry, len(streams))
+	size = 0
+	n := 0
+	for pq.Len() > 0 {
+		next := heap.Pop(pq).(*logproto.Stream)
+		if size += len(next.Entries[0].Line) + entryOverheadBytes; size > maxBytes {
+			break
+		}
+		kept[next.Labels] = append(kept[next.Labels], next.Entries[0])
+		n++
+	}
+
+	results := make([]logproto.Stream, 0, len(kept))
+	for _, stream := range streams {
+		if entries, ok := kept[stream.Labels]; ok {
+			results = append(results, logproto.Stream{Labels: stream.Labels, Entries: entries})
+		}
+	}
+	return results, n, total
+}
+
+// sortedStreamLabels returns the labels of the given groups sorted according to the query direction.
+func sortedStreamLabels(groups map[string]*byDir, direction logproto.Direction) []string {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	if direction == logproto.BACKWARD {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	} else {
+		sort.Strings(keys)
+	}
+	return keys
+}
+
 func toProtoMatrix(m loghttp.Matrix) []queryrange.SampleStream {
 	res := make([]queryrange.SampleStream, 0, len(m))
 
@@ -779,6 +1423,11 @@ func (res LokiResponse) Count() int64 {
 	return result
 }
 
+// StreamCount returns the number of unique streams of the response.
+func (res LokiResponse) StreamCount() int64 {
+	return int64(len(res.Data.Result))
+}
+
 func paramsFromRequest(req queryrange.Request) (logql.Params, error) {
 	switch r := req.(type) {
 	case *LokiRequest:
@@ -864,7 +1513,8 @@ func getQueryTags(ctx context.Context) string {
 	return v
 }
 
-func NewEmptyResponse(r queryrange.Request) (queryrange.Response, error) {
+// NewEmptyResponse returns the empty response of r, reusing the query parsed within the request of ctx.
+func NewEmptyResponse(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
 	switch req := r.(type) {
 	case *LokiSeriesRequest:
 		return &LokiSeriesResponse{
@@ -877,22 +1527,42 @@ func NewEmptyResponse(r queryrange.Request) (queryrange.Response, error) {
 			Version: uint32(loghttp.GetVersion(req.Path)),
 		}, nil
 	case *LokiInstantRequest:
-		// instant queries in the frontend are always metrics queries.
-		return &LokiPromResponse{
-			Response: &queryrange.PrometheusResponse{
-				Status: loghttp.QueryStatusSuccess,
-				Data: queryrange.PrometheusData{
-					ResultType: loghttp.ResultTypeVector,
+		// instant query can either be metrics or logs.
+		class, err := classifyRequest(ctx, req)
+		if err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+		if class.Metric {
+			return &LokiPromResponse{
+				Response: &queryrange.PrometheusResponse{
+					Status: loghttp.QueryStatusSuccess,
+					Data: queryrange.PrometheusData{
+						ResultType: loghttp.ResultTypeVector,
+					},
 				},
+			}, nil
+		}
+		return &LokiResponse{
+			Status:    loghttp.QueryStatusSuccess,
+			Direction: req.Direction,
+			Limit:     req.Limit,
+			Version:   uint32(loghttp.GetVersion(req.Path)),
+			Data: LokiData{
+				ResultType: loghttp.ResultTypeStream,
 			},
 		}, nil
 	case *LokiRequest:
-		// range query can either be metrics or logs
-		expr, err := logql.ParseExpr(req.Query)
-		if err != nil {
-			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		// range query can either be metrics or logs.
+		// IsMetricQuery is only set by DecodeRequest, requests built elsewhere are parsed instead.
+		isMetricQuery := req.IsMetricQuery
+		if !isMetricQuery {
+			class, err := classifyRequest(ctx, req)
+			if err != nil {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+			isMetricQuery = class.Metric
 		}
-		if _, ok := expr.(logql.SampleExpr); ok {
+		if isMetricQuery {
 			return &LokiPromResponse{
 				Response: queryrange.NewEmptyPrometheusResponse(),
 			}, nil
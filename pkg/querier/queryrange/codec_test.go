@@ -3,11 +3,16 @@ package queryrange
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"sort"
 	strings "strings"
 	"testing"
 	"time"
@@ -15,10 +20,13 @@ import (
 	"github.com/cortexproject/cortex/pkg/cortexpb"
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
 
 	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/util/httpreq"
 )
 
 func init() {
@@ -62,6 +70,19 @@ func Test_codec_DecodeRequest(t *testing.T) {
 			StartTs:   start,
 			EndTs:     end,
 		}, false},
+		{"metric", func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet,
+				fmt.Sprintf(`/query_range?start=%d&end=%d&query=rate({foo="bar"}[1m])&step=60&limit=200&direction=FORWARD`, start.UnixNano(), end.UnixNano()), nil)
+		}, &LokiRequest{
+			Query:         `rate({foo="bar"}[1m])`,
+			Limit:         200,
+			Step:          60000, // step is expected in ms.
+			Direction:     logproto.FORWARD,
+			Path:          "/query_range",
+			StartTs:       start,
+			EndTs:         end,
+			IsMetricQuery: true,
+		}, false},
 		{"series", func() (*http.Request, error) {
 			return http.NewRequest(http.MethodGet,
 				fmt.Sprintf(`/series?start=%d&end=%d&match={foo="bar"}`, start.UnixNano(), end.UnixNano()), nil)
@@ -96,6 +117,139 @@ func Test_codec_DecodeRequest(t *testing.T) {
 	}
 }
 
+func Test_codec_ValidateRequest(t *testing.T) {
+	now := time.Now()
+	rangeQuery := func(query string, start, end time.Time, step string, limit int) string {
+		return fmt.Sprintf(`/loki/api/v1/query_range?start=%d&end=%d&query=%s&step=%s&limit=%d`,
+			start.UnixNano(), end.UnixNano(), url.QueryEscape(query), step, limit)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		url     string
+		limits  fakeLimits
+		wantErr string
+	}{
+		{
+			name: "valid",
+			url:  rangeQuery(`sum(rate({foo="bar"}[1m]))`, now.Add(-time.Hour), now, "60", 100),
+		},
+		{
+			name:    "bad request",
+			url:     "/loki/api/v1/query_range?step=bad",
+			wantErr: "cannot parse",
+		},
+		{
+			name:    "parse error",
+			url:     rangeQuery(`{foo="bar"`, now.Add(-time.Hour), now, "60", 100),
+			wantErr: "parse error",
+		},
+		{
+			name:    "resolution",
+			url:     rangeQuery(`{foo="bar"}`, now.Add(-time.Hour), now, "0.1", 100),
+			wantErr: "exceeded maximum resolution",
+		},
+		{
+			name:    "max query lookback",
+			url:     rangeQuery(`{foo="bar"}`, now.Add(-3*time.Hour), now.Add(-2*time.Hour), "60", 100),
+			limits:  fakeLimits{maxQueryLookback: time.Hour},
+			wantErr: "the query time range is entirely before the max query lookback (1h0m0s)",
+		},
+		{
+			name:    "max query length",
+			url:     rangeQuery(`{foo="bar"}`, now.Add(-2*time.Hour), now, "60", 100),
+			limits:  fakeLimits{maxQueryLength: time.Hour},
+			wantErr: "the query time range exceeds the limit",
+		},
+		{
+			name:    "max entries limit",
+			url:     rangeQuery(`{foo="bar"}`, now.Add(-time.Hour), now, "60", 200),
+			limits:  fakeLimits{maxEntriesLimitPerQuery: 100},
+			wantErr: "max entries limit per query exceeded, limit > max_entries_limit (200 > 100)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+
+			err = LokiCodec.ValidateRequest(user.InjectOrgID(context.Background(), "1"), req, tc.limits)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			resp, ok := httpgrpc.HTTPResponseFromError(err)
+			require.True(t, ok)
+			require.Equal(t, int32(http.StatusBadRequest), resp.Code)
+			require.Contains(t, string(resp.Body), tc.wantErr)
+		})
+	}
+}
+
+func Test_NewEmptyResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		req  queryrange.Request
+		want queryrange.Response
+	}{
+		{
+			"metric flag",
+			// the query is not parsed when the flag is set.
+			&LokiRequest{Query: `not a query`, IsMetricQuery: true},
+			&LokiPromResponse{Response: queryrange.NewEmptyPrometheusResponse()},
+		},
+		{
+			"metric without flag",
+			&LokiRequest{Query: `rate({foo="bar"}[1m])`},
+			&LokiPromResponse{Response: queryrange.NewEmptyPrometheusResponse()},
+		},
+		{
+			"logs",
+			&LokiRequest{Query: `{foo="bar"}`, Limit: 100, Direction: logproto.BACKWARD, Path: "/loki/api/v1/query_range"},
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.BACKWARD,
+				Limit:     100,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+				},
+			},
+		},
+		{
+			"instant metric",
+			&LokiInstantRequest{Query: `count_over_time({foo="bar"}[1m])`, Path: "/loki/api/v1/query"},
+			&LokiPromResponse{
+				Response: &queryrange.PrometheusResponse{
+					Status: loghttp.QueryStatusSuccess,
+					Data: queryrange.PrometheusData{
+						ResultType: loghttp.ResultTypeVector,
+					},
+				},
+			},
+		},
+		{
+			"instant logs",
+			&LokiInstantRequest{Query: `{foo="bar"}`, Limit: 10, Direction: logproto.FORWARD, Path: "/loki/api/v1/query"},
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.FORWARD,
+				Limit:     10,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewEmptyResponse(context.Background(), tc.req)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
 func Test_codec_DecodeResponse(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -182,6 +336,21 @@ func Test_codec_DecodeResponse(t *testing.T) {
 				Statistics: statsResult,
 			}, false,
 		},
+		{
+			"instant streams", &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(streamsString))},
+			&LokiInstantRequest{Direction: logproto.BACKWARD, Limit: 100, Path: "/loki/api/v1/query"},
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.BACKWARD,
+				Limit:     100,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+					Result:     logStreams,
+				},
+				Statistics: statsResult,
+			}, false,
+		},
 		{
 			"series", &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(seriesString))},
 			&LokiSeriesRequest{Path: "/loki/api/v1/series"},
@@ -303,6 +472,28 @@ func Test_codec_labels_EncodeRequest(t *testing.T) {
 	require.Equal(t, "/loki/api/v1/labels", req.(*LokiLabelNamesRequest).Path)
 }
 
+func Test_codec_label_values_EncodeRequest(t *testing.T) {
+	ctx := context.Background()
+	toEncode := &LokiLabelNamesRequest{
+		Path:       "/api/prom/label/app/values",
+		StartTs:    start,
+		EndTs:      end,
+		WithCounts: true,
+	}
+	got, err := LokiCodec.EncodeRequest(ctx, toEncode)
+	require.NoError(t, err)
+	require.Equal(t, "/loki/api/v1/label/app/values", got.URL.Path)
+	require.Equal(t, "true", got.URL.Query().Get("with_counts"))
+
+	// testing a full roundtrip
+	req, err := LokiCodec.DecodeRequest(context.TODO(), got, nil)
+	require.NoError(t, err)
+	require.Equal(t, toEncode.StartTs, req.(*LokiLabelNamesRequest).StartTs)
+	require.Equal(t, toEncode.EndTs, req.(*LokiLabelNamesRequest).EndTs)
+	require.Equal(t, "/loki/api/v1/label/app/values", req.(*LokiLabelNamesRequest).Path)
+	require.True(t, req.(*LokiLabelNamesRequest).WithCounts)
+}
+
 func Test_codec_EncodeResponse(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -481,10 +672,11 @@ func Test_codec_MergeResponse(t *testing.T) {
 				},
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.BACKWARD,
-				Limit:     100,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.BACKWARD,
+				Limit:      100,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 2}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -568,10 +760,11 @@ func Test_codec_MergeResponse(t *testing.T) {
 				},
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.BACKWARD,
-				Limit:     6,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.BACKWARD,
+				Limit:      6,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 2}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -652,10 +845,11 @@ func Test_codec_MergeResponse(t *testing.T) {
 				},
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.FORWARD,
-				Limit:     100,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.FORWARD,
+				Limit:      100,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 2}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -740,10 +934,11 @@ func Test_codec_MergeResponse(t *testing.T) {
 				},
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.FORWARD,
-				Limit:     5,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.FORWARD,
+				Limit:      5,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 2}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -835,7 +1030,35 @@ func Test_codec_MergeResponse(t *testing.T) {
 			&LokiLabelNamesResponse{
 				Status:  "success",
 				Version: 1,
-				Data:    []string{"foo", "bar", "buzz", "blip", "blop"},
+				Data:    []string{"bar", "blip", "blop", "buzz", "foo"},
+			},
+			false,
+		},
+		{
+			"loki label values with counts",
+			[]queryrange.Response{
+				&LokiLabelNamesResponse{
+					Status:  "success",
+					Version: 1,
+					Data:    []string{"bar", "foo"},
+					Counts:  []uint64{2, 3},
+				},
+				&LokiLabelNamesResponse{
+					Status:  "success",
+					Version: 1,
+				},
+				&LokiLabelNamesResponse{
+					Status:  "success",
+					Version: 1,
+					Data:    []string{"buzz", "foo"},
+					Counts:  []uint64{1, 120},
+				},
+			},
+			&LokiLabelNamesResponse{
+				Status:  "success",
+				Version: 1,
+				Data:    []string{"bar", "buzz", "foo"},
+				Counts:  []uint64{2, 1, 123},
 			},
 			false,
 		},
@@ -1101,6 +1324,12 @@ func BenchmarkResponseMerge(b *testing.B) {
 		logsPerStream = 1000
 	)
 
+	ordered := func(resps []*LokiResponse, limit uint32, direction logproto.Direction) []logproto.Stream {
+		return mergeOrderedNonOverlappingStreams(resps, limit, direction, false)
+	}
+	unordered := func(resps []*LokiResponse, limit uint32, direction logproto.Direction) []logproto.Stream {
+		return mergeOrderedNonOverlappingStreams(resps, limit, direction, true)
+	}
 	for _, tc := range []struct {
 		desc  string
 		limit uint32
@@ -1114,7 +1343,12 @@ func BenchmarkResponseMerge(b *testing.B) {
 		{
 			"mergeOrderedNonOverlappingStreams unlimited",
 			uint32(streams * logsPerStream),
-			mergeOrderedNonOverlappingStreams,
+			ordered,
+		},
+		{
+			"mergeOrderedNonOverlappingStreams unordered unlimited",
+			uint32(streams * logsPerStream),
+			unordered,
 		},
 		{
 			"mergeStreams limited",
@@ -1124,7 +1358,12 @@ func BenchmarkResponseMerge(b *testing.B) {
 		{
 			"mergeOrderedNonOverlappingStreams limited",
 			uint32(streams*logsPerStream - 1),
-			mergeOrderedNonOverlappingStreams,
+			ordered,
+		},
+		{
+			"mergeOrderedNonOverlappingStreams unordered limited",
+			uint32(streams*logsPerStream - 1),
+			unordered,
 		},
 	} {
 		input := mkResps(resps, streams, logsPerStream, logproto.FORWARD)
@@ -1273,3 +1512,1184 @@ func generateStream() (res []logproto.Stream) {
 	}
 	return res
 }
+
+func Test_codec_EncodeResponse_AcceptVersion(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		accept string
+		res    queryrange.Response
+		body   string
+	}{
+		{
+			"legacy path, v1 accepted",
+			"application/json; loki-version=v1",
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.FORWARD,
+				Limit:     100,
+				Version:   uint32(loghttp.VersionLegacy),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+					Result:     logStreams,
+				},
+				Statistics: statsResult,
+			}, streamsString,
+		},
+		{
+			"v1 path, legacy accepted",
+			"text/plain, application/json; loki-version=legacy",
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.FORWARD,
+				Limit:     100,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+					Result:     logStreams,
+				},
+				Statistics: statsResult,
+			}, streamsStringLegacy,
+		},
+		{
+			"labels v1 path, legacy accepted",
+			"application/json; loki-version=legacy",
+			&LokiLabelNamesResponse{
+				Status:  "success",
+				Version: uint32(loghttp.VersionV1),
+				Data:    labelsData,
+			}, labelsLegacyString,
+		},
+		{
+			"labels legacy path, no preference",
+			"application/json",
+			&LokiLabelNamesResponse{
+				Status:  "success",
+				Version: uint32(loghttp.VersionLegacy),
+				Data:    labelsData,
+			}, labelsLegacyString,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", tc.accept)
+
+			got, err := LokiCodec.EncodeResponse(withAcceptedVersion(req).Context(), tc.res)
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(got.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.body, string(body))
+		})
+	}
+}
+
+func Test_codec_EncodeResponse_NDJSON(t *testing.T) {
+	streams := []logproto.Stream{
+		{
+			Labels: `{foo="bar"}`,
+			Entries: []logproto.Entry{
+				{Timestamp: time.Unix(0, 1), Line: "1"},
+				{Timestamp: time.Unix(0, 3), Line: "3"},
+			},
+		},
+		{
+			Labels: `{foo="buzz"}`,
+			Entries: []logproto.Entry{
+				{Timestamp: time.Unix(0, 2), Line: "2"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		direction logproto.Direction
+		lines     []string
+	}{
+		{logproto.BACKWARD, []string{"3", "2", "1"}},
+		{logproto.FORWARD, []string{"1", "2", "3"}},
+	} {
+		t.Run(tc.direction.String(), func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", "application/x-ndjson")
+
+			got, err := LokiCodec.EncodeResponse(withAcceptedNDJSON(req).Context(), &LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: tc.direction,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+					Result:     streams,
+				},
+			})
+			require.NoError(t, err)
+			require.Equal(t, "application/x-ndjson", got.Header.Get("Content-Type"))
+			body, err := ioutil.ReadAll(got.Body)
+			require.NoError(t, err)
+			require.NoError(t, got.Body.Close())
+
+			var lines []string
+			for _, l := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+				var entry struct {
+					Stream    map[string]string `json:"stream"`
+					Timestamp string            `json:"ts"`
+					Line      string            `json:"line"`
+				}
+				require.NoError(t, json.Unmarshal([]byte(l), &entry), l)
+				require.Equal(t, entry.Line, entry.Timestamp)
+				require.NotEmpty(t, entry.Stream["foo"])
+				lines = append(lines, entry.Line)
+			}
+			require.Equal(t, tc.lines, lines)
+		})
+	}
+
+	// other media types keep the JSON response.
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	got, err := LokiCodec.EncodeResponse(withAcceptedNDJSON(req).Context(), &LokiResponse{
+		Status:  loghttp.QueryStatusSuccess,
+		Version: uint32(loghttp.VersionV1),
+		Data:    LokiData{ResultType: loghttp.ResultTypeStream, Result: streams},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "application/json", got.Header.Get("Content-Type"))
+}
+
+func Test_codec_EncodeResponse_StatsOnly(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?stats_only=true", nil)
+	require.NoError(t, err)
+	ctx := withStatsOnly(req).Context()
+	statistics := stats.Result{Summary: stats.Summary{TotalBytesProcessed: 1024, TotalLinesProcessed: 10}}
+	decode := func(r *http.Response) (string, int, stats.Result) {
+		var body struct {
+			Data struct {
+				ResultType string            `json:"resultType"`
+				Result     []json.RawMessage `json:"result"`
+				Stats      stats.Result      `json:"stats"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		require.NotNil(t, body.Data.Result)
+		return body.Data.ResultType, len(body.Data.Result), body.Data.Stats
+	}
+
+	for _, tc := range []struct {
+		name       string
+		res        queryrange.Response
+		resultType string
+	}{
+		{
+			name: "streams",
+			res: &LokiResponse{
+				Status:     loghttp.QueryStatusSuccess,
+				Version:    uint32(loghttp.VersionV1),
+				Data:       LokiData{ResultType: loghttp.ResultTypeStream, Result: logStreams},
+				Statistics: statistics,
+			},
+			resultType: loghttp.ResultTypeStream,
+		},
+		{
+			name: "matrix",
+			res: &LokiPromResponse{
+				Response: &queryrange.PrometheusResponse{
+					Status: loghttp.QueryStatusSuccess,
+					Data:   queryrange.PrometheusData{ResultType: loghttp.ResultTypeMatrix, Result: sampleStreams},
+				},
+				Statistics: statistics,
+			},
+			resultType: loghttp.ResultTypeMatrix,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := LokiCodec.EncodeResponse(ctx, tc.res)
+			require.NoError(t, err)
+			resultType, entries, gotStats := decode(got)
+			require.Equal(t, tc.resultType, resultType)
+			require.Zero(t, entries)
+			require.Equal(t, int64(1024), gotStats.Summary.TotalBytesProcessed)
+			require.Equal(t, int64(10), gotStats.Summary.TotalLinesProcessed)
+		})
+	}
+}
+
+func Test_codec_DecodeRequest_AlignStartEndToStep(t *testing.T) {
+	ctx := context.Background()
+	aligned := &Codec{alignStartEndToStep: true}
+	l := cacheKeyLimits{WithDefaultLimits(fakeLimits{}, queryrange.Config{SplitQueriesByInterval: time.Hour})}
+
+	decode := func(c queryrange.Codec, query string, start, end string) queryrange.Request {
+		u := "/loki/api/v1/query_range?" + url.Values{
+			"query": []string{query},
+			"start": []string{start},
+			"end":   []string{end},
+			"step":  []string{"60"},
+		}.Encode()
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		require.NoError(t, err)
+		r, err := c.DecodeRequest(ctx, req, nil)
+		require.NoError(t, err)
+		return r
+	}
+
+	const query = `sum(rate({foo="bar"}[1m]))`
+	first := decode(aligned, query, "1000.123", "3599.9")
+	second := decode(aligned, query, "1000.456", "3599.1")
+
+	require.Equal(t, int64(960000), first.GetStart())
+	require.Equal(t, int64(3600000), first.GetEnd())
+	require.Equal(t, first, second)
+	require.Equal(t, l.GenerateCacheKey("fake", first), l.GenerateCacheKey("fake", second))
+
+	// the executed query uses the aligned time range.
+	httpReq, err := aligned.EncodeRequest(ctx, first)
+	require.NoError(t, err)
+	require.Equal(t, "960000000000", httpReq.URL.Query().Get("start"))
+	require.Equal(t, "3600000000000", httpReq.URL.Query().Get("end"))
+
+	// without alignment, the start differs and so does the cache key.
+	first = decode(LokiCodec, query, "3600.123", "7199.9")
+	second = decode(LokiCodec, query, "3599.456", "7199.1")
+	require.NotEqual(t, first.GetStart(), second.GetStart())
+	require.NotEqual(t, l.GenerateCacheKey("fake", first), l.GenerateCacheKey("fake", second))
+
+	// log queries are never aligned.
+	logs := decode(aligned, `{foo="bar"}`, "1000.123", "3599.9")
+	require.Equal(t, int64(1000123), logs.GetStart())
+	require.Equal(t, int64(3599900), logs.GetEnd())
+}
+
+func Test_codec_EncodeResponse_ResponseBytes(t *testing.T) {
+	bodySize := func(r *http.Response) int64 {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NotZero(t, len(body))
+		return int64(len(body))
+	}
+
+	streams := &LokiResponse{
+		Status:  loghttp.QueryStatusSuccess,
+		Version: uint32(loghttp.VersionV1),
+		Data: LokiData{
+			ResultType: loghttp.ResultTypeStream,
+			Result:     logStreams,
+		},
+	}
+	got, err := LokiCodec.EncodeResponse(context.Background(), streams)
+	require.NoError(t, err)
+	require.Equal(t, bodySize(got), streams.Statistics.Summary.ResponseBytes)
+
+	matrix := &LokiPromResponse{
+		Response: &queryrange.PrometheusResponse{
+			Status: loghttp.QueryStatusSuccess,
+			Data: queryrange.PrometheusData{
+				ResultType: loghttp.ResultTypeMatrix,
+				Result:     sampleStreams,
+			},
+		},
+	}
+	got, err = LokiCodec.EncodeResponse(context.Background(), matrix)
+	require.NoError(t, err)
+	require.Equal(t, bodySize(got), matrix.Statistics.Summary.ResponseBytes)
+}
+
+func Test_codec_MergeResponse_Warnings(t *testing.T) {
+	ctx := context.Background()
+	decode := func(body string, req queryrange.Request) queryrange.Response {
+		res, err := LokiCodec.DecodeResponse(ctx, &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// streams
+	req := &LokiRequest{Direction: logproto.FORWARD, Limit: 100, Path: "/loki/api/v1/query_range"}
+	merged, err := LokiCodec.MergeResponse(
+		decode(`{"status":"success","warnings":["results may be partial"],"data":{"resultType":"streams","result":[]}}`, req),
+		decode(`{"status":"success","data":{"resultType":"streams","result":[]}}`, req),
+		decode(`{"status":"success","warnings":["a warning","results may be partial"],"data":{"resultType":"streams","result":[]}}`, req),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a warning", "results may be partial"}, merged.(*LokiResponse).Warnings)
+
+	encoded, err := LokiCodec.EncodeResponse(ctx, merged)
+	require.NoError(t, err)
+	var body struct {
+		Warnings []string `json:"warnings"`
+	}
+	require.NoError(t, json.NewDecoder(encoded.Body).Decode(&body))
+	require.Equal(t, []string{"a warning", "results may be partial"}, body.Warnings)
+
+	// matrix
+	merged, err = LokiCodec.MergeResponse(
+		decode(`{"status":"success","warnings":["results may be partial"],"data":{"resultType":"matrix","result":[]}}`, nil),
+		decode(`{"status":"success","data":{"resultType":"matrix","result":[]}}`, nil),
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"results may be partial"}, merged.(*LokiPromResponse).Warnings)
+
+	encoded, err = LokiCodec.EncodeResponse(ctx, merged)
+	require.NoError(t, err)
+	body.Warnings = nil
+	require.NoError(t, json.NewDecoder(encoded.Body).Decode(&body))
+	require.Equal(t, []string{"results may be partial"}, body.Warnings)
+
+	// no warnings
+	merged, err = LokiCodec.MergeResponse(
+		decode(`{"status":"success","data":{"resultType":"matrix","result":[]}}`, nil),
+	)
+	require.NoError(t, err)
+	require.Nil(t, merged.(*LokiPromResponse).Warnings)
+}
+
+func Test_mergeOrderedNonOverlappingStreams_Ordering(t *testing.T) {
+	const (
+		resps         = 3
+		streams       = 12
+		logsPerStream = 30
+	)
+
+	labelsOf := func(streams []logproto.Stream) []string {
+		res := make([]string, 0, len(streams))
+		for _, s := range streams {
+			res = append(res, s.Labels)
+		}
+		return res
+	}
+
+	for _, direction := range []logproto.Direction{logproto.FORWARD, logproto.BACKWARD} {
+		t.Run(direction.String(), func(t *testing.T) {
+			input := mkResps(resps, streams, logsPerStream, direction)
+			// shuffle streams within each response so the output order can't come from the input order.
+			r := rand.New(rand.NewSource(42))
+			for _, resp := range input {
+				r.Shuffle(len(resp.Data.Result), func(i, j int) {
+					resp.Data.Result[i], resp.Data.Result[j] = resp.Data.Result[j], resp.Data.Result[i]
+				})
+			}
+
+			// escape hatch: the limit covers every entry.
+			unlimited := labelsOf(mergeOrderedNonOverlappingStreams(input, streams*logsPerStream, direction, false))
+			// heap: one entry less than the total, every stream still contributes entries.
+			limited := labelsOf(mergeOrderedNonOverlappingStreams(input, streams*logsPerStream-1, direction, false))
+
+			require.Len(t, unlimited, streams)
+			require.Equal(t, unlimited, limited)
+			if direction == logproto.BACKWARD {
+				require.True(t, sort.IsSorted(sort.Reverse(sort.StringSlice(unlimited))))
+			} else {
+				require.True(t, sort.StringsAreSorted(unlimited))
+			}
+		})
+	}
+}
+
+func Test_codec_DecodeRequest_EmptyQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		query   string
+		wantErr bool
+	}{
+		{"missing", "", true},
+		{"whitespace", "  \t\n", true},
+		{"valid", `{foo="bar"}`, false},
+	} {
+		for _, path := range []string{"/loki/api/v1/query_range", "/loki/api/v1/query"} {
+			t.Run(tc.name+path, func(t *testing.T) {
+				params := url.Values{
+					"start": []string{fmt.Sprintf("%d", start.UnixNano())},
+					"end":   []string{fmt.Sprintf("%d", end.UnixNano())},
+					"time":  []string{fmt.Sprintf("%d", end.UnixNano())},
+				}
+				if tc.query != "" {
+					params.Set("query", tc.query)
+				}
+				req, err := http.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+				require.NoError(t, err)
+
+				_, err = LokiCodec.DecodeRequest(context.Background(), req, nil)
+				if tc.wantErr {
+					require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, "query cannot be empty"), err)
+					return
+				}
+				require.NoError(t, err)
+			})
+		}
+	}
+}
+
+func Test_codec_MergeResponse_NaNAtSplitBoundary(t *testing.T) {
+	promResponse := func(samples ...cortexpb.Sample) *LokiPromResponse {
+		return &LokiPromResponse{
+			Response: &queryrange.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data: queryrange.PrometheusData{
+					ResultType: loghttp.ResultTypeMatrix,
+					Result: []queryrange.SampleStream{
+						{
+							Labels:  []cortexpb.LabelAdapter{{Name: "foo", Value: "bar"}},
+							Samples: samples,
+						},
+					},
+				},
+			},
+		}
+	}
+
+	nan := math.NaN()
+	for _, tc := range []struct {
+		name     string
+		first    []cortexpb.Sample
+		second   []cortexpb.Sample
+		expected []cortexpb.Sample
+	}{
+		{
+			"NaN ends the first split",
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: nan}},
+			[]cortexpb.Sample{{TimestampMs: 2000, Value: 5}, {TimestampMs: 3000, Value: 6}},
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 5}, {TimestampMs: 3000, Value: 6}},
+		},
+		{
+			"NaN starts the second split",
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}},
+			[]cortexpb.Sample{{TimestampMs: 2000, Value: nan}, {TimestampMs: 3000, Value: 6}},
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}, {TimestampMs: 3000, Value: 6}},
+		},
+		{
+			"real values on both sides",
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}},
+			[]cortexpb.Sample{{TimestampMs: 2000, Value: 5}, {TimestampMs: 3000, Value: 6}},
+			[]cortexpb.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}, {TimestampMs: 3000, Value: 6}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			first, second := promResponse(tc.first...), promResponse(tc.second...)
+			// responses are not necessarily ordered by time.
+			merged, err := LokiCodec.MergeResponse(second, first)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, merged.(*LokiPromResponse).Response.Data.Result[0].Samples)
+			// inputs are left untouched.
+			require.Len(t, first.Response.Data.Result[0].Samples, len(tc.first))
+			require.Len(t, second.Response.Data.Result[0].Samples, len(tc.second))
+		})
+	}
+}
+
+func Test_codec_MergeResponse_StreamCount(t *testing.T) {
+	response := func(labels ...string) *LokiResponse {
+		res := &LokiResponse{
+			Status:     loghttp.QueryStatusSuccess,
+			Direction:  logproto.FORWARD,
+			Limit:      100,
+			Version:    1,
+			Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: int64(len(labels))}},
+			Data:       LokiData{ResultType: loghttp.ResultTypeStream},
+		}
+		for i, l := range labels {
+			res.Data.Result = append(res.Data.Result, logproto.Stream{
+				Labels:  l,
+				Entries: []logproto.Entry{{Timestamp: time.Unix(0, int64(i)), Line: l}},
+			})
+		}
+		return res
+	}
+
+	for _, tc := range []struct {
+		name      string
+		responses []queryrange.Response
+		expected  int64
+	}{
+		{
+			"disjoint",
+			[]queryrange.Response{response(`{app="foo"}`), response(`{app="bar"}`, `{app="baz"}`)},
+			3,
+		},
+		{
+			"overlapping",
+			[]queryrange.Response{response(`{app="foo"}`, `{app="bar"}`), response(`{app="bar"}`, `{app="foo"}`)},
+			2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, err := LokiCodec.MergeResponse(tc.responses...)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, merged.(*LokiResponse).StreamCount())
+			require.Equal(t, tc.expected, merged.(*LokiResponse).Statistics.Summary.TotalStreamsReturned)
+		})
+	}
+}
+
+func Test_codec_MergeResponse_QueryTags(t *testing.T) {
+	ctx := context.WithValue(context.Background(), httpreq.QueryTagsHTTPHeader, "Source=logvolhist,Feature=Beta")
+	decode := func(body string, req queryrange.Request) queryrange.Response {
+		res, err := LokiCodec.DecodeResponse(ctx, &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, req)
+		require.NoError(t, err)
+		return res
+	}
+
+	// streams
+	req := &LokiRequest{Direction: logproto.FORWARD, Limit: 100, Path: "/loki/api/v1/query_range"}
+	merged, err := LokiCodec.MergeResponse(
+		decode(`{"status":"success","data":{"resultType":"streams","result":[]}}`, req),
+		decode(`{"status":"success","data":{"resultType":"streams","result":[]}}`, req),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "Source=logvolhist,Feature=Beta", merged.(*LokiResponse).Statistics.Summary.QueryTags)
+
+	// matrix
+	merged, err = LokiCodec.MergeResponse(
+		decode(`{"status":"success","data":{"resultType":"matrix","result":[]}}`, nil),
+		decode(`{"status":"success","data":{"resultType":"matrix","result":[]}}`, nil),
+	)
+	require.NoError(t, err)
+	require.Equal(t, "Source=logvolhist,Feature=Beta", merged.(*LokiPromResponse).Statistics.Summary.QueryTags)
+
+	// tags already reported downstream are kept.
+	res := decode(`{"status":"success","data":{"resultType":"matrix","result":[],"stats":{"summary":{"queryTags":"Source=grafana"}}}}`, nil)
+	require.Equal(t, "Source=grafana", res.(*LokiPromResponse).Statistics.Summary.QueryTags)
+}
+
+func Test_codec_DecodeRequest_DuplicateParams(t *testing.T) {
+	rangeParams := func() url.Values {
+		return url.Values{
+			"query":     []string{`{foo="bar"}`},
+			"start":     []string{fmt.Sprintf("%d", start.UnixNano())},
+			"end":       []string{fmt.Sprintf("%d", end.UnixNano())},
+			"step":      []string{"1"},
+			"limit":     []string{"200"},
+			"direction": []string{"FORWARD"},
+		}
+	}
+	for _, param := range []string{"query", "start", "end", "step", "limit", "direction"} {
+		params := rangeParams()
+		params.Add(param, params.Get(param))
+		req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+params.Encode(), nil)
+		require.NoError(t, err)
+
+		_, err = LokiCodec.DecodeRequest(context.Background(), req, nil)
+		resp, ok := httpgrpc.HTTPResponseFromError(err)
+		require.True(t, ok, param)
+		require.Equal(t, int32(http.StatusBadRequest), resp.Code, param)
+		require.Contains(t, string(resp.Body), fmt.Sprintf("%q", param))
+	}
+
+	// a parameter set both in the URL and in the body is duplicated too.
+	req, err := http.NewRequest(http.MethodPost, "/loki/api/v1/query?time=1&query="+url.QueryEscape(`{foo="bar"}`), strings.NewReader("time=2"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = LokiCodec.DecodeRequest(context.Background(), req, nil)
+	resp, ok := httpgrpc.HTTPResponseFromError(err)
+	require.True(t, ok)
+	require.Equal(t, int32(http.StatusBadRequest), resp.Code)
+
+	// shards and match[] are multi valued.
+	params := rangeParams()
+	params["shards"] = []string{"0_of_2", "1_of_2"}
+	req, err = http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+params.Encode(), nil)
+	require.NoError(t, err)
+	got, err := LokiCodec.DecodeRequest(context.Background(), req, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0_of_2", "1_of_2"}, got.(*LokiRequest).Shards)
+
+	series := url.Values{
+		"match[]": []string{`{foo="bar"}`, `{foo="buzz"}`},
+		"start":   []string{fmt.Sprintf("%d", start.UnixNano())},
+		"end":     []string{fmt.Sprintf("%d", end.UnixNano())},
+	}
+	req, err = http.NewRequest(http.MethodGet, "/loki/api/v1/series?"+series.Encode(), nil)
+	require.NoError(t, err)
+	got, err = LokiCodec.DecodeRequest(context.Background(), req, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{`{foo="bar"}`, `{foo="buzz"}`}, got.(*LokiSeriesRequest).Match)
+}
+
+func Test_codec_DecodeRequest_PostBody(t *testing.T) {
+	for _, tc := range []struct {
+		path   string
+		params url.Values
+		want   queryrange.Request
+	}{
+		{
+			"/loki/api/v1/query_range",
+			url.Values{
+				"query":     []string{`{foo="bar"}`},
+				"start":     []string{fmt.Sprintf("%d", start.UnixNano())},
+				"end":       []string{fmt.Sprintf("%d", end.UnixNano())},
+				"step":      []string{"1"},
+				"limit":     []string{"200"},
+				"direction": []string{"FORWARD"},
+			},
+			&LokiRequest{
+				Query:     `{foo="bar"}`,
+				Limit:     200,
+				Step:      1000,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+				StartTs:   start,
+				EndTs:     end,
+			},
+		},
+		{
+			"/loki/api/v1/query",
+			url.Values{
+				"query":     []string{`{foo="bar"}`},
+				"time":      []string{fmt.Sprintf("%d", end.UnixNano())},
+				"limit":     []string{"200"},
+				"direction": []string{"FORWARD"},
+			},
+			&LokiInstantRequest{
+				Query:     `{foo="bar"}`,
+				Limit:     200,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query",
+				TimeTs:    end,
+			},
+		},
+		{
+			"/loki/api/v1/series",
+			url.Values{
+				"match[]": []string{`{foo="bar"}`, `{app="baz"}`},
+				"start":   []string{fmt.Sprintf("%d", start.UnixNano())},
+				"end":     []string{fmt.Sprintf("%d", end.UnixNano())},
+			},
+			&LokiSeriesRequest{
+				Match:   []string{`{app="baz"}`, `{foo="bar"}`}, // matchers are sorted when parsed.
+				Path:    "/loki/api/v1/series",
+				StartTs: start,
+				EndTs:   end,
+			},
+		},
+		{
+			"/loki/api/v1/labels",
+			url.Values{
+				"start": []string{fmt.Sprintf("%d", start.UnixNano())},
+				"end":   []string{fmt.Sprintf("%d", end.UnixNano())},
+			},
+			&LokiLabelNamesRequest{
+				Path:    "/loki/api/v1/labels",
+				StartTs: start,
+				EndTs:   end,
+			},
+		},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.params.Encode()))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			got, err := LokiCodec.DecodeRequest(context.Background(), req, nil)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_codec_EncodeRequest_MaxURLLength(t *testing.T) {
+	codec := &Codec{maxURLLength: 1024}
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		name     string
+		req      queryrange.Request
+		wantPost bool
+	}{
+		{
+			"short range query",
+			&LokiRequest{Query: `{foo="bar"}`, Limit: 100, Step: 1000, Direction: logproto.FORWARD, Path: "/loki/api/v1/query_range", StartTs: start, EndTs: end},
+			false,
+		},
+		{
+			"oversized range query",
+			&LokiRequest{Query: `{foo="bar"} |= "` + strings.Repeat("a", 2048) + `"`, Limit: 100, Step: 1000, Direction: logproto.FORWARD, Path: "/loki/api/v1/query_range", StartTs: start, EndTs: end},
+			true,
+		},
+		{
+			"oversized instant query",
+			&LokiInstantRequest{Query: `{foo="bar"} |= "` + strings.Repeat("a", 2048) + `"`, Limit: 100, Direction: logproto.FORWARD, Path: "/loki/api/v1/query", TimeTs: end},
+			true,
+		},
+		{
+			"oversized series query",
+			&LokiSeriesRequest{Match: []string{`{foo="` + strings.Repeat("a", 2048) + `"}`}, Path: "/loki/api/v1/series", StartTs: start, EndTs: end},
+			true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := codec.EncodeRequest(ctx, tc.req)
+			require.NoError(t, err)
+
+			if tc.wantPost {
+				require.Equal(t, http.MethodPost, req.Method)
+				require.Empty(t, req.URL.RawQuery)
+				require.Equal(t, req.URL.Path, req.RequestURI)
+				require.Equal(t, "application/x-www-form-urlencoded", req.Header.Get("Content-Type"))
+			} else {
+				require.Equal(t, http.MethodGet, req.Method)
+				require.NotEmpty(t, req.URL.RawQuery)
+			}
+
+			// the encoded request decodes back to the same request.
+			got, err := codec.DecodeRequest(ctx, req, nil)
+			require.NoError(t, err)
+			require.Equal(t, tc.req, got)
+		})
+	}
+}
+
+func Test_mergeOrderedNonOverlappingStreams_Duplicates(t *testing.T) {
+	entries := func(from, through int, direction logproto.Direction) []logproto.Entry {
+		var res []logproto.Entry
+		for i := from; i <= through; i++ {
+			res = append(res, logproto.Entry{Timestamp: time.Unix(int64(i), 0), Line: fmt.Sprintf("line %d", i)})
+		}
+		if direction == logproto.BACKWARD {
+			for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+				res[i], res[j] = res[j], res[i]
+			}
+		}
+		return res
+	}
+	response := func(e []logproto.Entry) *LokiResponse {
+		return &LokiResponse{Data: LokiData{Result: []logproto.Stream{{Labels: `{foo="bar"}`, Entries: e}}}}
+	}
+
+	for _, direction := range []logproto.Direction{logproto.FORWARD, logproto.BACKWARD} {
+		t.Run(direction.String(), func(t *testing.T) {
+			// the splits overlap on the entry at 3s.
+			resps := []*LokiResponse{response(entries(1, 3, direction)), response(entries(3, 5, direction))}
+			if direction == logproto.BACKWARD {
+				resps[0], resps[1] = resps[1], resps[0]
+			}
+
+			for _, limit := range []uint32{100, 4} {
+				merged := mergeOrderedNonOverlappingStreams(resps, limit, direction, false)
+				require.Len(t, merged, 1)
+
+				expected := entries(1, 5, direction)
+				if int(limit) < len(expected) {
+					expected = expected[:limit]
+				}
+				require.Equal(t, expected, merged[0].Entries, "limit %d", limit)
+			}
+		})
+	}
+}
+
+func Test_mergeOrderedNonOverlappingStreams_Unordered(t *testing.T) {
+	entry := func(i int) logproto.Entry {
+		return logproto.Entry{Timestamp: time.Unix(int64(i), 0), Line: fmt.Sprintf("line %d", i)}
+	}
+	response := func(labels string, ts ...int) *LokiResponse {
+		stream := logproto.Stream{Labels: labels}
+		for _, i := range ts {
+			stream.Entries = append(stream.Entries, entry(i))
+		}
+		return &LokiResponse{Data: LokiData{Result: []logproto.Stream{stream}}}
+	}
+	// the responses are unsorted and overlap, with a duplicated entry at 3s.
+	resps := []*LokiResponse{
+		response(`{foo="bar"}`, 5, 1, 3),
+		response(`{foo="bar"}`, 4, 3, 2),
+		response(`{foo="baz"}`, 7, 6),
+	}
+
+	for _, tc := range []struct {
+		direction logproto.Direction
+		limit     uint32
+		expected  map[string][]int
+	}{
+		{logproto.FORWARD, 100, map[string][]int{`{foo="bar"}`: {1, 2, 3, 4, 5}, `{foo="baz"}`: {6, 7}}},
+		{logproto.FORWARD, 3, map[string][]int{`{foo="bar"}`: {1, 2, 3}}},
+		{logproto.BACKWARD, 100, map[string][]int{`{foo="bar"}`: {5, 4, 3, 2, 1}, `{foo="baz"}`: {7, 6}}},
+		{logproto.BACKWARD, 3, map[string][]int{`{foo="bar"}`: {5}, `{foo="baz"}`: {7, 6}}},
+	} {
+		t.Run(fmt.Sprintf("%s %d", tc.direction, tc.limit), func(t *testing.T) {
+			merged := mergeOrderedNonOverlappingStreams(resps, tc.limit, tc.direction, true)
+			got := map[string][]int{}
+			for _, s := range merged {
+				for _, e := range s.Entries {
+					got[s.Labels] = append(got[s.Labels], int(e.Timestamp.Unix()))
+				}
+			}
+			require.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func Test_codec_MergeResponse_Direction(t *testing.T) {
+	forward := &LokiResponse{
+		Status:    loghttp.QueryStatusSuccess,
+		Direction: logproto.FORWARD,
+		Limit:     100,
+		Data: LokiData{
+			ResultType: loghttp.ResultTypeStream,
+			Result: []logproto.Stream{
+				{Labels: `{foo="bar"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(0, 1), Line: "1"}}},
+			},
+		},
+	}
+	backward := &LokiResponse{
+		Status:    loghttp.QueryStatusSuccess,
+		Direction: logproto.BACKWARD,
+		Limit:     100,
+		Data: LokiData{
+			ResultType: loghttp.ResultTypeStream,
+			Result: []logproto.Stream{
+				{Labels: `{foo="bar"}`, Entries: []logproto.Entry{{Timestamp: time.Unix(0, 2), Line: "2"}}},
+			},
+		},
+	}
+
+	_, err := LokiCodec.MergeResponse(forward, backward)
+	require.Error(t, err)
+
+	// sub-responses must match the direction of the original request.
+	_, err = LokiCodec.MergeRequestResponses(&LokiRequest{Direction: logproto.BACKWARD}, forward, forward)
+	require.Error(t, err)
+
+	merged, err := LokiCodec.MergeRequestResponses(&LokiRequest{Direction: logproto.BACKWARD}, backward, backward)
+	require.NoError(t, err)
+	require.Equal(t, logproto.BACKWARD, merged.(*LokiResponse).Direction)
+}
+
+func Test_codec_SubMillisecondStep(t *testing.T) {
+	for _, tc := range []struct {
+		step     string
+		expected int64
+	}{
+		{"0.0001", 1},
+		{"0.0005", 1},
+		{"0.001", 1},
+		{"0.0015", 1},
+		{"0.002", 2},
+		{"0.5", 500},
+	} {
+		t.Run(tc.step, func(t *testing.T) {
+			params := url.Values{
+				"query": []string{`rate({foo="bar"}[1s])`},
+				"start": []string{fmt.Sprintf("%d", time.Unix(100, 0).UnixNano())},
+				"end":   []string{fmt.Sprintf("%d", time.Unix(101, 0).UnixNano())},
+				"step":  []string{tc.step},
+			}
+			httpReq, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+params.Encode(), nil)
+			require.NoError(t, err)
+			req, err := LokiCodec.DecodeRequest(context.Background(), httpReq, nil)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, req.GetStep())
+
+			// the step survives splitting and encoding the sub-queries.
+			for _, sub := range splitMetricByTime(req, 400*time.Millisecond) {
+				require.Equal(t, tc.expected, sub.GetStep())
+				encoded, err := LokiCodec.EncodeRequest(context.Background(), sub)
+				require.NoError(t, err)
+				decoded, err := LokiCodec.DecodeRequest(context.Background(), encoded, nil)
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, decoded.GetStep())
+			}
+		})
+	}
+}
+
+func Test_codec_StreamsRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	req := &LokiRequest{
+		Query:     `{app="foo"}`,
+		Limit:     100,
+		Direction: logproto.BACKWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	entry := func(ns int64, line string) logproto.Entry {
+		return logproto.Entry{Timestamp: time.Unix(0, ns), Line: line}
+	}
+	// each split holds entries with nanosecond timestamps and lines needing escaping.
+	splits := [][]logproto.Entry{
+		{entry(1600000000000000004, "a \"quoted\"\tline"), entry(1600000000000000003, "multi\nline")},
+		{entry(1600000000000000002, "unicode ✓"), entry(1600000000000000001, "")},
+	}
+
+	var decoded []queryrange.Response
+	for _, entries := range splits {
+		res, err := LokiCodec.EncodeResponse(ctx, &LokiResponse{
+			Status:    loghttp.QueryStatusSuccess,
+			Direction: logproto.BACKWARD,
+			Limit:     100,
+			Version:   uint32(loghttp.VersionV1),
+			Data: LokiData{
+				ResultType: loghttp.ResultTypeStream,
+				Result:     []logproto.Stream{{Labels: `{app="foo"}`, Entries: entries}},
+			},
+		})
+		require.NoError(t, err)
+		resp, err := LokiCodec.DecodeResponse(ctx, res, req)
+		require.NoError(t, err)
+		decoded = append(decoded, resp)
+	}
+	merged, err := LokiCodec.MergeResponse(decoded...)
+	require.NoError(t, err)
+	res, err := LokiCodec.EncodeResponse(ctx, merged)
+	require.NoError(t, err)
+	final, err := LokiCodec.DecodeResponse(ctx, res, req)
+	require.NoError(t, err)
+
+	require.Equal(t, []logproto.Stream{{
+		Labels:  `{app="foo"}`,
+		Entries: append(append([]logproto.Entry{}, splits[0]...), splits[1]...),
+	}}, final.(*LokiResponse).Data.Result)
+}
+
+func Test_limitStreamsBytes(t *testing.T) {
+	entry := func(ns int64) logproto.Entry {
+		return logproto.Entry{Timestamp: time.Unix(0, ns), Line: "line"}
+	}
+	// each entry is estimated to 30 bytes.
+	streams := []logproto.Stream{
+		{Labels: `{app="b"}`, Entries: []logproto.Entry{entry(4), entry(2)}},
+		{Labels: `{app="a"}`, Entries: []logproto.Entry{entry(3), entry(1)}},
+	}
+
+	got, kept, total := limitStreamsBytes(streams, 120, logproto.BACKWARD)
+	require.Equal(t, streams, got)
+	require.Equal(t, 4, kept)
+	require.Equal(t, 4, total)
+
+	// the most recent entries across streams are kept first.
+	got, kept, total = limitStreamsBytes(streams, 100, logproto.BACKWARD)
+	require.Equal(t, []logproto.Stream{
+		{Labels: `{app="b"}`, Entries: []logproto.Entry{entry(4), entry(2)}},
+		{Labels: `{app="a"}`, Entries: []logproto.Entry{entry(3)}},
+	}, got)
+	require.Equal(t, 3, kept)
+	require.Equal(t, 4, total)
+
+	forward := []logproto.Stream{
+		{Labels: `{app="a"}`, Entries: []logproto.Entry{entry(1), entry(3)}},
+		{Labels: `{app="b"}`, Entries: []logproto.Entry{entry(2), entry(4)}},
+	}
+	got, kept, _ = limitStreamsBytes(forward, 60, logproto.FORWARD)
+	require.Equal(t, []logproto.Stream{
+		{Labels: `{app="a"}`, Entries: []logproto.Entry{entry(1)}},
+		{Labels: `{app="b"}`, Entries: []logproto.Entry{entry(2)}},
+	}, got)
+	require.Equal(t, 2, kept)
+
+	got, kept, _ = limitStreamsBytes(streams, 10, logproto.BACKWARD)
+	require.Empty(t, got)
+	require.Zero(t, kept)
+	// the input streams are left untouched.
+	require.Len(t, streams[0].Entries, 2)
+	require.Len(t, streams[1].Entries, 2)
+}
+
+func Test_codec_EncodeResponse_MaxBytes(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?max_bytes=100", nil)
+	require.NoError(t, err)
+	lreq := &LokiRequest{Query: `{app=~"a|b"}`, Limit: 100, Direction: logproto.BACKWARD, Path: "/loki/api/v1/query_range"}
+	entry := func(ns int64) logproto.Entry {
+		return logproto.Entry{Timestamp: time.Unix(0, ns), Line: "line"}
+	}
+	res := func() *LokiResponse {
+		return &LokiResponse{
+			Status:    loghttp.QueryStatusSuccess,
+			Direction: logproto.BACKWARD,
+			Limit:     100,
+			Version:   uint32(loghttp.VersionV1),
+			Data: LokiData{
+				ResultType: loghttp.ResultTypeStream,
+				Result: []logproto.Stream{
+					{Labels: `{app="b"}`, Entries: []logproto.Entry{entry(4), entry(2)}},
+					{Labels: `{app="a"}`, Entries: []logproto.Entry{entry(3), entry(1)}},
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		budget   int
+		entries  int
+		warnings []string
+	}{
+		{name: "no budget", entries: 4},
+		{name: "within budget", budget: 1000, entries: 4},
+		{name: "truncated", budget: 100, entries: 3, warnings: []string{fmt.Sprintf(maxBytesWarningTmpl, 3, 4, 100)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := req.Context()
+			if tc.budget > 0 {
+				ctx = withMaxBytes(req, tc.budget).Context()
+			}
+			got, err := LokiCodec.EncodeResponse(ctx, res())
+			require.NoError(t, err)
+			decoded, err := LokiCodec.DecodeResponse(context.Background(), got, lreq)
+			require.NoError(t, err)
+
+			var entries int
+			for _, s := range decoded.(*LokiResponse).Data.Result {
+				entries += len(s.Entries)
+			}
+			require.Equal(t, tc.entries, entries)
+			require.Equal(t, tc.warnings, decoded.(*LokiResponse).Warnings)
+		})
+	}
+}
+
+func Test_codec_MergeResponse_EmptyResponses(t *testing.T) {
+	promResponse := func(resultType string) *LokiPromResponse {
+		return &LokiPromResponse{
+			Response: &queryrange.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data: queryrange.PrometheusData{
+					ResultType: resultType,
+					Result: []queryrange.SampleStream{{
+						Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "a"}},
+						Samples: []cortexpb.Sample{{Value: 1, TimestampMs: 1000}},
+					}},
+				},
+			},
+			Statistics: stats.Result{Summary: stats.Summary{ResponseBytes: 10}},
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		req  queryrange.Request
+		res  queryrange.Response
+	}{
+		{
+			"streams",
+			&LokiRequest{Query: `{app="foo"}`, Limit: 100, Direction: logproto.BACKWARD, Path: "/loki/api/v1/query_range"},
+			&LokiResponse{
+				Status:    loghttp.QueryStatusSuccess,
+				Direction: logproto.BACKWARD,
+				Limit:     100,
+				Version:   uint32(loghttp.VersionV1),
+				Data: LokiData{
+					ResultType: loghttp.ResultTypeStream,
+					Result: []logproto.Stream{{
+						Labels:  `{app="foo"}`,
+						Entries: []logproto.Entry{{Timestamp: time.Unix(0, 1), Line: "foo"}},
+					}},
+				},
+			},
+		},
+		{
+			"matrix",
+			&LokiRequest{Query: `rate({app="foo"}[1m])`, Path: "/loki/api/v1/query_range"},
+			promResponse(loghttp.ResultTypeMatrix),
+		},
+		{
+			"vector",
+			&LokiInstantRequest{Query: `sum by (x) (rate({app="foo"}[1m]))`, Path: "/loki/api/v1/query"},
+			promResponse(loghttp.ResultTypeVector),
+		},
+		{
+			"series",
+			&LokiSeriesRequest{Match: []string{`{app="foo"}`}, Path: "/loki/api/v1/series"},
+			&LokiSeriesResponse{
+				Status:  loghttp.QueryStatusSuccess,
+				Version: uint32(loghttp.VersionV1),
+				Data:    []logproto.SeriesIdentifier{{Labels: map[string]string{"app": "foo"}}},
+			},
+		},
+		{
+			"label names",
+			&LokiLabelNamesRequest{Path: "/loki/api/v1/labels"},
+			&LokiLabelNamesResponse{
+				Status:  loghttp.QueryStatusSuccess,
+				Version: uint32(loghttp.VersionV1),
+				Data:    []string{"app"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			empty, err := NewEmptyResponse(context.Background(), tc.req)
+			require.NoError(t, err)
+
+			expected, err := LokiCodec.MergeRequestResponses(tc.req, tc.res)
+			require.NoError(t, err)
+
+			// empty responses are identity elements, wherever they are merged.
+			responses := [][]queryrange.Response{
+				{empty, tc.res},
+				{tc.res, empty},
+				{empty, tc.res, empty},
+			}
+			if _, ok := tc.res.(*LokiPromResponse); ok {
+				// whatever their result type.
+				responses = append(responses, []queryrange.Response{&LokiPromResponse{Response: queryrange.NewEmptyPrometheusResponse()}, tc.res})
+			}
+			for _, responses := range responses {
+				merged, err := LokiCodec.MergeRequestResponses(tc.req, responses...)
+				require.NoError(t, err)
+				require.Equal(t, expected, merged)
+			}
+		})
+	}
+}
+
+func Test_codec_MergeSeriesResponses(t *testing.T) {
+	response := func(values ...string) *LokiSeriesResponse {
+		res := &LokiSeriesResponse{Status: loghttp.QueryStatusSuccess, Version: uint32(loghttp.VersionV1)}
+		for _, v := range values {
+			res.Data = append(res.Data, logproto.SeriesIdentifier{Labels: map[string]string{"app": v}})
+		}
+		return res
+	}
+	responses := []queryrange.Response{response("a", "b"), response("b", "c"), response("d")}
+
+	for _, maxSeries := range []int{0, 4} {
+		merged, err := LokiCodec.MergeSeriesResponses(maxSeries, responses...)
+		require.NoError(t, err)
+		require.Equal(t, response("a", "b", "c", "d"), merged)
+	}
+
+	// the duplicated series doesn't count toward the limit, the merge fails on the 4th unique one.
+	_, err := LokiCodec.MergeSeriesResponses(3, responses...)
+	require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, 3), err)
+}
+
+func Test_codec_EncodeRequest_DownstreamHeaders(t *testing.T) {
+	ctx := context.WithValue(user.InjectOrgID(context.Background(), "1"), httpreq.QueryTagsHTTPHeader, "Source=logvolhist")
+	long := &LokiRequest{Query: `{foo="bar"} |= "` + strings.Repeat("a", 2048) + `"`, Limit: 100, Step: 1000, Direction: logproto.FORWARD, Path: "/loki/api/v1/query_range", StartTs: start, EndTs: end}
+
+	for _, tc := range []struct {
+		name     string
+		codec    *Codec
+		expected http.Header
+	}{
+		{
+			"unrestricted",
+			&Codec{maxURLLength: 1024},
+			http.Header{"X-Query-Tags": []string{"Source=logvolhist"}, "Content-Type": []string{"application/x-www-form-urlencoded"}},
+		},
+		{
+			"denied",
+			&Codec{maxURLLength: 1024, deniedHeaders: canonicalHeaders([]string{"x-query-tags", "content-type"})},
+			http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}},
+		},
+		{
+			"not allowed",
+			&Codec{maxURLLength: 1024, allowedHeaders: canonicalHeaders([]string{"Authorization"})},
+			http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}},
+		},
+		{
+			"allowed",
+			&Codec{maxURLLength: 1024, allowedHeaders: canonicalHeaders([]string{" x-query-tags"})},
+			http.Header{"X-Query-Tags": []string{"Source=logvolhist"}, "Content-Type": []string{"application/x-www-form-urlencoded"}},
+		},
+		{
+			"allowed and denied",
+			&Codec{maxURLLength: 1024, allowedHeaders: canonicalHeaders([]string{"X-Query-Tags"}), deniedHeaders: canonicalHeaders([]string{"X-Query-Tags"})},
+			http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := tc.codec.EncodeRequest(ctx, long)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, req.Header)
+
+			// the POST request still decodes back to the same request.
+			got, err := tc.codec.DecodeRequest(ctx, req, nil)
+			require.NoError(t, err)
+			require.Equal(t, long, got)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package queryrange
+
+import (
+	"math"
+
+	"github.com/cortexproject/cortex/pkg/cortexpb"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+)
+
+// downsampleSeries returns the series with their samples downsampled to at most maxPoints each.
+// The input series are left untouched.
+func downsampleSeries(series []queryrange.SampleStream, maxPoints int) []queryrange.SampleStream {
+	result := make([]queryrange.SampleStream, len(series))
+	for i, s := range series {
+		result[i] = queryrange.SampleStream{
+			Labels:  s.Labels,
+			Samples: downsampleLTTB(s.Samples, maxPoints),
+		}
+	}
+	return result
+}
+
+// downsampleLTTB downsamples the samples to maxPoints with the Largest-Triangle-Three-Buckets algorithm,
+// which keeps the visual shape of the series. The first and last samples are always kept, and samples
+// which already fit within maxPoints are returned as is.
+func downsampleLTTB(samples []cortexpb.Sample, maxPoints int) []cortexpb.Sample {
+	if maxPoints >= len(samples) || maxPoints < 2 {
+		return samples
+	}
+	last := len(samples) - 1
+	if maxPoints == 2 {
+		return []cortexpb.Sample{samples[0], samples[last]}
+	}
+
+	result := make([]cortexpb.Sample, 0, maxPoints)
+	result = append(result, samples[0])
+
+	// the samples between the first and the last ones are split into maxPoints-2 buckets, one sample is
+	// picked from each of them.
+	bucketSize := float64(len(samples)-2) / float64(maxPoints-2)
+	picked := 0
+	for i := 0; i < maxPoints-2; i++ {
+		start, end := int(float64(i)*bucketSize)+1, int(float64(i+1)*bucketSize)+1
+
+		// the average of the next bucket is the third point of the triangles, for the last bucket that is
+		// the last sample.
+		nextStart, nextEnd := end, int(float64(i+2)*bucketSize)+1
+		if nextEnd > len(samples) {
+			nextEnd = len(samples)
+		}
+		var avgX, avgY float64
+		for _, s := range samples[nextStart:nextEnd] {
+			avgX += float64(s.TimestampMs)
+			avgY += s.Value
+		}
+		avgX /= float64(nextEnd - nextStart)
+		avgY /= float64(nextEnd - nextStart)
+
+		a := samples[picked]
+		next, maxArea := start, -1.0
+		for j := start; j < end; j++ {
+			// twice the area of the triangle between the previously picked sample, this one and the average.
+			area := math.Abs((float64(a.TimestampMs)-avgX)*(samples[j].Value-a.Value) -
+				(float64(a.TimestampMs)-float64(samples[j].TimestampMs))*(avgY-a.Value))
+			if area > maxArea {
+				next, maxArea = j, area
+			}
+		}
+		result = append(result, samples[next])
+		picked = next
+	}
+
+	return append(result, samples[last])
+}
@@ -0,0 +1,119 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/cortexproject/cortex/pkg/cortexpb"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/loghttp"
+)
+
+func sineSamples(n int) []cortexpb.Sample {
+	samples := make([]cortexpb.Sample, n)
+	for i := range samples {
+		samples[i] = cortexpb.Sample{TimestampMs: int64(i) * 1000, Value: math.Sin(float64(i) / 10)}
+	}
+	return samples
+}
+
+func Test_downsampleLTTB(t *testing.T) {
+	for _, tc := range []struct {
+		samples, maxPoints, expected int
+	}{
+		{samples: 0, maxPoints: 10, expected: 0},
+		{samples: 5, maxPoints: 10, expected: 5},
+		{samples: 10, maxPoints: 10, expected: 10},
+		{samples: 11, maxPoints: 10, expected: 10},
+		{samples: 1000, maxPoints: 2, expected: 2},
+		{samples: 1000, maxPoints: 3, expected: 3},
+		{samples: 1000, maxPoints: 100, expected: 100},
+		{samples: 1001, maxPoints: 7, expected: 7},
+	} {
+		t.Run(fmt.Sprintf("%d to %d", tc.samples, tc.maxPoints), func(t *testing.T) {
+			samples := sineSamples(tc.samples)
+			got := downsampleLTTB(samples, tc.maxPoints)
+			require.Len(t, got, tc.expected)
+			if tc.samples == 0 {
+				return
+			}
+			require.Equal(t, samples[0], got[0])
+			require.Equal(t, samples[len(samples)-1], got[len(got)-1])
+			for i := 1; i < len(got); i++ {
+				require.Greater(t, got[i].TimestampMs, got[i-1].TimestampMs)
+			}
+		})
+	}
+}
+
+func Test_downsampleLTTB_KeepsSpikes(t *testing.T) {
+	samples := make([]cortexpb.Sample, 1000)
+	for i := range samples {
+		samples[i] = cortexpb.Sample{TimestampMs: int64(i) * 1000}
+	}
+	samples[421].Value = 100
+
+	got := downsampleLTTB(samples, 20)
+	require.Len(t, got, 20)
+	require.Contains(t, got, samples[421])
+}
+
+func Test_codec_EncodeResponse_MaxPoints(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range?max_points=10", nil)
+	require.NoError(t, err)
+	lreq := &LokiRequest{Query: `rate({app="foo"}[1m])`, Step: 1000, Path: "/loki/api/v1/query_range"}
+	res := func() *LokiPromResponse {
+		return &LokiPromResponse{
+			Response: &queryrange.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data: queryrange.PrometheusData{
+					ResultType: loghttp.ResultTypeMatrix,
+					Result: []queryrange.SampleStream{
+						{Labels: []cortexpb.LabelAdapter{{Name: "app", Value: "foo"}}, Samples: sineSamples(100)},
+						{Labels: []cortexpb.LabelAdapter{{Name: "app", Value: "bar"}}, Samples: sineSamples(5)},
+					},
+				},
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		maxPoints int
+		expected  []int
+	}{
+		{name: "not downsampled", expected: []int{100, 5}},
+		{name: "downsampled", maxPoints: 10, expected: []int{10, 5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := req.Context()
+			if tc.maxPoints > 0 {
+				ctx = withMaxPoints(req, tc.maxPoints).Context()
+			}
+			got, err := LokiCodec.EncodeResponse(ctx, res())
+			require.NoError(t, err)
+			decoded, err := LokiCodec.DecodeResponse(context.Background(), got, lreq)
+			require.NoError(t, err)
+
+			var points []int
+			for _, s := range decoded.(*LokiPromResponse).Response.Data.Result {
+				points = append(points, len(s.Samples))
+			}
+			require.Equal(t, tc.expected, points)
+		})
+	}
+}
+
+func Benchmark_downsampleLTTB(b *testing.B) {
+	samples := sineSamples(11000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		downsampleLTTB(samples, 1000)
+	}
+}
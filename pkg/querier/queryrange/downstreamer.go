@@ -3,6 +3,7 @@ package queryrange
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
@@ -10,6 +11,8 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
 
 	"github.com/grafana/loki/pkg/util/spanlogger"
 
@@ -27,9 +30,15 @@ type DownstreamHandler struct {
 }
 
 func ParamsToLokiRequest(params logql.Params, shards logql.Shards) queryrange.Request {
+	return downstreamRequest(params, shards, params.Query())
+}
+
+// downstreamRequest returns the request of query over shards with params, like
+// ParamsToLokiRequest(params, shards).WithQuery(query) does without copying the request.
+func downstreamRequest(params logql.Params, shards logql.Shards, query string) queryrange.Request {
 	if params.Start() == params.End() {
 		return &LokiInstantRequest{
-			Query:     params.Query(),
+			Query:     query,
 			Limit:     params.Limit(),
 			TimeTs:    params.Start(),
 			Direction: params.Direction(),
@@ -38,7 +47,7 @@ func ParamsToLokiRequest(params logql.Params, shards logql.Shards) queryrange.Re
 		}
 	}
 	return &LokiRequest{
-		Query:     params.Query(),
+		Query:     query,
 		Limit:     params.Limit(),
 		Step:      int64(params.Step() / time.Millisecond),
 		StartTs:   params.Start(),
@@ -69,9 +78,16 @@ type instance struct {
 	handler     queryrange.Handler
 }
 
+// Downstream runs the queries, which fail when any of the sharded ones has no response: the engine would
+// otherwise silently undercount the results of their shards.
 func (in instance) Downstream(ctx context.Context, queries []logql.DownstreamQuery) ([]logqlmodel.Result, error) {
-	return in.For(ctx, queries, func(qry logql.DownstreamQuery) (logqlmodel.Result, error) {
-		req := ParamsToLokiRequest(qry.Params, qry.Shards).WithQuery(qry.Expr.String())
+	total, err := queriesShardFactor(queries)
+	if err != nil {
+		return nil, err
+	}
+	missing := atomic.NewInt32(0)
+	results, err := in.For(ctx, queries, func(qry logql.DownstreamQuery) (logqlmodel.Result, error) {
+		req := downstreamRequest(qry.Params, qry.Shards, qry.Expr.String())
 		logger, ctx := spanlogger.New(ctx, "DownstreamHandler.instance")
 		defer logger.Finish()
 		level.Debug(logger).Log("shards", fmt.Sprintf("%+v", qry.Shards), "query", req.GetQuery(), "step", req.GetStep())
@@ -80,8 +96,34 @@ func (in instance) Downstream(ctx context.Context, queries []logql.DownstreamQue
 		if err != nil {
 			return logqlmodel.Result{}, err
 		}
+		if res == nil && len(qry.Shards) > 0 {
+			missing.Inc()
+			return logqlmodel.Result{}, nil
+		}
 		return ResponseToResult(res)
 	})
+	if err != nil {
+		return nil, err
+	}
+	if n := int(missing.Load()); n > 0 {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, missingShardsTmpl, n, total)
+	}
+	return results, nil
+}
+
+// queriesShardFactor returns the number of shards the sharded queries were split into, 0 if none is sharded.
+// It fails when they don't agree on it.
+func queriesShardFactor(queries []logql.DownstreamQuery) (int, error) {
+	var total int
+	for _, qry := range queries {
+		for _, shard := range qry.Shards {
+			if total != 0 && shard.Of != total {
+				return 0, httpgrpc.Errorf(http.StatusInternalServerError, inconsistentShardsTmpl, total, shard.Of)
+			}
+			total = shard.Of
+		}
+	}
+	return total, nil
 }
 
 // For runs a function against a list of queries, collecting the results or returning an error. The indices are preserved such that input[i] maps to output[i].
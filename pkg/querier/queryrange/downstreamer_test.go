@@ -331,6 +331,7 @@ func TestInstanceDownstream(t *testing.T) {
 			// so we assign them to scoped variables for later comparison.
 			got = req
 			want = ParamsToLokiRequest(params, queries[0].Shards).WithQuery(expr.String())
+			require.Equal(t, want, downstreamRequest(params, queries[0].Shards, expr.String()))
 
 			return expectedResp(), nil
 		},
@@ -347,6 +348,46 @@ func TestInstanceDownstream(t *testing.T) {
 	require.Equal(t, []logqlmodel.Result{expected}, results)
 }
 
+// Benchmark_downstreamRequest compares building the requests of the downstream queries of a query sharded
+// 256 ways by copying the request of the query to building them at once.
+func Benchmark_downstreamRequest(b *testing.B) {
+	const factor = 256
+	params := logql.NewLiteralParams(
+		`sum by (app) (rate({app="foo"} |= "bar" [1m]))`,
+		time.Unix(0, 0),
+		time.Unix(3600, 0),
+		time.Minute,
+		0,
+		logproto.BACKWARD,
+		1000,
+		nil,
+	)
+	expr, err := logql.ParseExpr(params.Query())
+	require.NoError(b, err)
+	queries := make([]logql.DownstreamQuery, 0, factor)
+	for i := 0; i < factor; i++ {
+		queries = append(queries, logql.DownstreamQuery{Expr: expr, Params: params, Shards: logql.Shards{{Shard: i, Of: factor}}})
+	}
+	query := expr.String()
+
+	b.Run("WithQuery", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, qry := range queries {
+				_ = ParamsToLokiRequest(qry.Params, qry.Shards).WithQuery(query)
+			}
+		}
+	})
+	b.Run("downstreamRequest", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			for _, qry := range queries {
+				_ = downstreamRequest(qry.Params, qry.Shards, query)
+			}
+		}
+	})
+}
+
 func TestCancelWhileWaitingResponse(t *testing.T) {
 	mkIn := func() *instance { return DownstreamHandler{nil}.Downstreamer().(*instance) }
 	in := mkIn()
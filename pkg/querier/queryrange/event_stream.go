@@ -0,0 +1,199 @@
+package queryrange
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	json "github.com/json-iterator/go"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+)
+
+const (
+	// eventStreamMediaType is the Accept media type streaming the progress of queries as server-sent events,
+	// followed by their result.
+	eventStreamMediaType = "text/event-stream"
+
+	queryProgressCtxKey ctxKeyType = "queryProgress"
+
+	eventProgress = "progress"
+	eventResult   = "result"
+	eventError    = "error"
+)
+
+// acceptsEventStream tells if the Accept header asks for server-sent events.
+func acceptsEventStream(h http.Header) bool {
+	for _, accept := range h.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			if mt, _, err := mime.ParseMediaType(mediaType); err == nil && mt == eventStreamMediaType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryProgress accumulates the statistics of the sub-queries of a query as they complete.
+type queryProgress struct {
+	mtx        sync.Mutex
+	subqueries int
+	stats      stats.Result
+}
+
+// QueryProgress is the payload of the progress events.
+type QueryProgress struct {
+	Subqueries     int   `json:"subqueries"`
+	BytesProcessed int64 `json:"bytes_processed"`
+	LinesProcessed int64 `json:"lines_processed"`
+}
+
+func (p *queryProgress) record(resp queryrange.Response) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.subqueries++
+	switch r := resp.(type) {
+	case *LokiResponse:
+		p.stats.Merge(r.Statistics)
+	case *LokiPromResponse:
+		p.stats.Merge(r.Statistics)
+	}
+}
+
+func (p *queryProgress) snapshot() QueryProgress {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return QueryProgress{
+		Subqueries:     p.subqueries,
+		BytesProcessed: p.stats.Summary.TotalBytesProcessed,
+		LinesProcessed: p.stats.Summary.TotalLinesProcessed,
+	}
+}
+
+// recordProgress records the response of a sub-query in the progress of the query of ctx, if it is tracked.
+func recordProgress(ctx context.Context, resp queryrange.Response) {
+	if p, ok := ctx.Value(queryProgressCtxKey).(*queryProgress); ok {
+		p.record(resp)
+	}
+}
+
+// streamEvents runs the round trip of the query in the background and returns right away a text/event-stream
+// response. It sends a progress event every interval, then a result event with the body of the response of
+// the query, or an error event. The body is written while it is read, the caller must close it.
+func streamEvents(req *http.Request, interval time.Duration, roundTrip func(*http.Request) (*http.Response, error)) *http.Response {
+	progress := &queryProgress{}
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(context.WithValue(ctx, queryProgressCtxKey, progress))
+
+	pr, pw := io.Pipe()
+	// unblocks the writes once the request is canceled, e.g. when the client is gone.
+	go func() {
+		<-ctx.Done()
+		_ = pw.CloseWithError(ctx.Err())
+	}()
+
+	go func() {
+		defer cancel()
+
+		var (
+			resp *http.Response
+			err  error
+			done = make(chan struct{})
+		)
+		go func() {
+			defer close(done)
+			resp, err = roundTrip(req)
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if werr := writeEventJSON(pw, eventProgress, progress.snapshot()); werr != nil {
+					cancel()
+					<-done
+					closeBody(resp)
+					return
+				}
+			case <-done:
+				_ = pw.CloseWithError(writeFinalEvent(pw, resp, err))
+				return
+			}
+		}
+	}()
+
+	return &http.Response{
+		Header: http.Header{
+			"Content-Type":  []string{eventStreamMediaType},
+			"Cache-Control": []string{"no-cache"},
+		},
+		Body:       pr,
+		StatusCode: http.StatusOK,
+	}
+}
+
+// writeFinalEvent writes the result event of the response of the query, or the error event of its failure.
+func writeFinalEvent(w io.Writer, resp *http.Response, err error) error {
+	if err != nil {
+		code := http.StatusInternalServerError
+		message := err.Error()
+		if r, ok := httpgrpc.HTTPResponseFromError(err); ok {
+			code, message = int(r.Code), string(r.Body)
+		}
+		return writeEventJSON(w, eventError, errorEvent{Status: "error", Code: code, Error: message})
+	}
+	defer closeBody(resp)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return writeEventJSON(w, eventError, errorEvent{Status: "error", Code: http.StatusInternalServerError, Error: err.Error()})
+	}
+	if resp.StatusCode/100 != 2 {
+		return writeEventJSON(w, eventError, errorEvent{Status: "error", Code: resp.StatusCode, Error: string(body)})
+	}
+	return writeEvent(w, eventResult, body)
+}
+
+type errorEvent struct {
+	Status string `json:"status"`
+	Code   int    `json:"code"`
+	Error  string `json:"error"`
+}
+
+func writeEventJSON(w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, event, data)
+}
+
+// writeEvent writes a server-sent event, each line of its data in its own data field.
+func writeEvent(w io.Writer, event string, data []byte) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func closeBody(resp *http.Response) {
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+}
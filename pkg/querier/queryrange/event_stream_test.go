@@ -0,0 +1,217 @@
+package queryrange
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+type testEvent struct {
+	event string
+	data  string
+}
+
+// readEvents reads the server-sent events of the body until it is closed.
+func readEvents(t *testing.T, body io.Reader) []testEvent {
+	var (
+		events  []testEvent
+		current testEvent
+	)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, current)
+			current = testEvent{}
+		case strings.HasPrefix(line, "event: "):
+			current.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if current.data != "" {
+				current.data += "\n"
+			}
+			current.data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func Test_acceptsEventStream(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                    false,
+		"application/json":                    false,
+		"text/event-stream":                   true,
+		"application/json, text/event-stream": true,
+		"text/event-stream; charset=utf-8":    true,
+	} {
+		h := http.Header{}
+		if accept != "" {
+			h.Set("Accept", accept)
+		}
+		require.Equal(t, expected, acceptsEventStream(h), accept)
+	}
+}
+
+func Test_streamEvents(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+	require.NoError(t, err)
+
+	t.Run("progress then result", func(t *testing.T) {
+		resume := make(chan struct{})
+		resp := streamEvents(req, time.Millisecond, func(r *http.Request) (*http.Response, error) {
+			recordProgress(r.Context(), &LokiResponse{Statistics: stats.Result{
+				Summary: stats.Summary{TotalBytesProcessed: 100, TotalLinesProcessed: 10},
+			}})
+			<-resume
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader("{\n\"status\":\"success\"\n}\n")),
+			}, nil
+		})
+		require.Equal(t, eventStreamMediaType, resp.Header.Get("Content-Type"))
+		defer resp.Body.Close()
+
+		// the query completes once a progress event of its sub-query has been read.
+		reader := bufio.NewReader(resp.Body)
+		go func() {
+			defer close(resume)
+			recorded := false
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || (recorded && line == "\n") {
+					return
+				}
+				recorded = recorded || strings.Contains(line, `"subqueries":1`)
+			}
+		}()
+		<-resume
+
+		events := readEvents(t, reader)
+		require.NotEmpty(t, events)
+		last := events[len(events)-1]
+		require.Equal(t, eventResult, last.event)
+		require.Equal(t, "{\n\"status\":\"success\"\n}", last.data)
+		for _, e := range events[:len(events)-1] {
+			require.Equal(t, eventProgress, e.event)
+			var progress QueryProgress
+			require.NoError(t, json.Unmarshal([]byte(e.data), &progress))
+			require.Equal(t, QueryProgress{Subqueries: 1, BytesProcessed: 100, LinesProcessed: 10}, progress)
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		resp     *http.Response
+		err      error
+		expected errorEvent
+	}{
+		{
+			name:     "httpgrpc error",
+			err:      httpgrpc.Errorf(http.StatusBadRequest, "bad query"),
+			expected: errorEvent{Status: "error", Code: http.StatusBadRequest, Error: "bad query"},
+		},
+		{
+			name:     "error",
+			err:      errors.New("boom"),
+			expected: errorEvent{Status: "error", Code: http.StatusInternalServerError, Error: "boom"},
+		},
+		{
+			name:     "error response",
+			resp:     &http.Response{StatusCode: http.StatusTooManyRequests, Body: ioutil.NopCloser(strings.NewReader("too many"))},
+			expected: errorEvent{Status: "error", Code: http.StatusTooManyRequests, Error: "too many"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := streamEvents(req, time.Hour, func(*http.Request) (*http.Response, error) {
+				return tc.resp, tc.err
+			})
+			defer resp.Body.Close()
+
+			events := readEvents(t, resp.Body)
+			require.Len(t, events, 1)
+			require.Equal(t, eventError, events[0].event)
+			var actual errorEvent
+			require.NoError(t, json.Unmarshal([]byte(events[0].data), &actual))
+			require.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestEventStreamTripperware(t *testing.T) {
+	cfg := testConfig
+	cfg.ProgressEventsInterval = 5 * time.Millisecond
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32, maxQueryParallelism: 1}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := promqlResult(matrix)
+	rt.setHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		h.ServeHTTP(w, r)
+	}))
+
+	lreq := &LokiRequest{
+		Query:     `rate({app="foo"} |= "foo"[1m])`,
+		Limit:     1000,
+		Step:      30000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", eventStreamMediaType)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+	resp, err := tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, eventStreamMediaType, resp.Header.Get("Content-Type"))
+	defer resp.Body.Close()
+
+	events := readEvents(t, resp.Body)
+	require.Greater(t, len(events), 1)
+	require.Equal(t, eventResult, events[len(events)-1].event, events[len(events)-1].data)
+	var result struct {
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(events[len(events)-1].data), &result))
+	require.Equal(t, "success", result.Status)
+
+	// the sub-queries are accounted in the progress events as they complete.
+	subqueries := 0
+	for _, e := range events[:len(events)-1] {
+		require.Equal(t, eventProgress, e.event)
+		var progress QueryProgress
+		require.NoError(t, json.Unmarshal([]byte(e.data), &progress))
+		require.GreaterOrEqual(t, progress.Subqueries, subqueries)
+		subqueries = progress.Subqueries
+	}
+	require.Equal(t, 2, *count)
+	require.LessOrEqual(t, subqueries, *count)
+}
@@ -0,0 +1,182 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/cortexproject/cortex/pkg/util"
+	"github.com/go-kit/log"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/tenant"
+)
+
+const (
+	// explainCtxKey is set for range queries requesting their plan instead of their result.
+	explainCtxKey ctxKeyType = "explain"
+
+	shardingReasonNotConfigured = "sharding disabled by the config"
+	shardingReasonNoShardingMap = "query can't be sharded"
+)
+
+// QueryPlan describes how the frontend executes a range query, it is returned instead of its result with
+// explain=true.
+type QueryPlan struct {
+	Tripperware string             `json:"tripperware"`
+	Middlewares []MiddlewareStatus `json:"middlewares"`
+	// SplitInterval is the interval the query is split by, empty when it isn't split.
+	SplitInterval string      `json:"split_interval,omitempty"`
+	Splits        []SplitPlan `json:"splits"`
+}
+
+// SplitPlan describes one of the sub-queries a range query is split into.
+type SplitPlan struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Shards is the shard factor of the sub-query, 0 when it isn't sharded.
+	Shards         int    `json:"shards"`
+	ShardingReason string `json:"sharding_reason,omitempty"`
+}
+
+// ExplainResponse is the response of the range queries with explain=true, it holds their plan.
+type ExplainResponse struct {
+	Plan QueryPlan
+}
+
+func (r *ExplainResponse) Reset()                                           { *r = ExplainResponse{} }
+func (r *ExplainResponse) String() string                                   { return fmt.Sprintf("%+v", r.Plan) }
+func (*ExplainResponse) ProtoMessage()                                      {}
+func (*ExplainResponse) GetHeaders() []*queryrange.PrometheusResponseHeader { return nil }
+
+// withExplain injects in the request context that the plan of the query should be returned instead of its result.
+func withExplain(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), explainCtxKey, true))
+}
+
+func explain(ctx context.Context) bool {
+	explain, _ := ctx.Value(explainCtxKey).(bool)
+	return explain
+}
+
+// explainPassthrough returns the plan of the range queries sent downstream as is, e.g. the log queries without
+// filters which are neither split nor sharded.
+func explainPassthrough(ctx context.Context, start, end time.Time) (*http.Response, error) {
+	return LokiCodec.EncodeResponse(ctx, &ExplainResponse{Plan: QueryPlan{
+		Tripperware: "none",
+		Middlewares: []MiddlewareStatus{},
+		Splits:      []SplitPlan{{Start: start, End: end}},
+	}})
+}
+
+// shardingConfigs returns the period configs of the schema queries are sharded over, nil when the config
+// disables sharding.
+func shardingConfigs(cfg Config, schema chunk.SchemaConfig) ShardingConfigs {
+	if !cfg.ShardedQueries {
+		return nil
+	}
+	return schema.Configs
+}
+
+// NewExplainMiddleware creates a middleware answering the range queries with explain=true with their plan
+// instead of executing them: the middlewares of their tripperware, the sub-queries splitter splits them into
+// and the shard factor of each over confs, nil when sharding is disabled. It must be placed right before the
+// split_by_interval middleware of the tripperware.
+func NewExplainMiddleware(tripperware TripperwareStatus, limits Limits, splitter Splitter, confs ShardingConfigs) queryrange.Middleware {
+	e := &explainer{
+		tripperware: tripperware,
+		limits:      limits,
+		splitter:    splitter,
+		// the plans must not be accounted as sharded queries.
+		metrics: logql.NewShardingMetrics(nil),
+	}
+	if hasShards(confs) {
+		e.confs = confs
+		e.sharder = &shardSplitter{limits: limits, now: time.Now, logger: log.NewNopLogger()}
+	}
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			if !explain(ctx) {
+				return next.Do(ctx, r)
+			}
+			return e.explain(ctx, r)
+		})
+	})
+}
+
+type explainer struct {
+	tripperware TripperwareStatus
+	limits      Limits
+	splitter    Splitter
+	confs       ShardingConfigs
+	sharder     *shardSplitter
+	metrics     *logql.ShardingMetrics
+}
+
+func (e *explainer) explain(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	userid, err := tenant.TenantID(ctx)
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	plan := QueryPlan{Tripperware: e.tripperware.Name, Middlewares: e.tripperware.Middlewares}
+	intervals, interval, err := splitIntervals(ctx, e.limits, e.splitter, userid, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(intervals) > 0 {
+		plan.SplitInterval = interval.String()
+	} else {
+		intervals = []queryrange.Request{r}
+	}
+
+	plan.Splits = make([]SplitPlan, 0, len(intervals))
+	for _, req := range intervals {
+		shards, reason, err := e.shards(ctx, userid, req)
+		if err != nil {
+			return nil, err
+		}
+		plan.Splits = append(plan.Splits, SplitPlan{
+			Start:          util.TimeFromMillis(req.GetStart()).UTC(),
+			End:            util.TimeFromMillis(req.GetEnd()).UTC(),
+			Shards:         shards,
+			ShardingReason: reason,
+		})
+	}
+	return &ExplainResponse{Plan: plan}, nil
+}
+
+// shards returns the shard factor of the sub-query of the tenant, 0 when it isn't sharded, and why.
+func (e *explainer) shards(ctx context.Context, userid string, r queryrange.Request) (int, string, error) {
+	if e.sharder == nil {
+		return 0, shardingReasonNotConfigured, nil
+	}
+	sharded, reason := e.sharder.route(ctx, userid, r)
+	if !sharded {
+		return 0, reason, nil
+	}
+	conf, err := e.confs.GetConf(r)
+	if err != nil {
+		return 0, err.Error(), nil
+	}
+	factor := shardFactor(ctx, conf.RowShards)
+	if factor < 2 {
+		return 0, shardingReasonOverride, nil
+	}
+	mapper, err := logql.NewShardMapper(factor, e.metrics)
+	if err != nil {
+		return 0, "", err
+	}
+	noop, _, err := mapper.Parse(r.GetQuery())
+	if err != nil {
+		return 0, "", httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if noop {
+		return 0, shardingReasonNoShardingMap, nil
+	}
+	return factor, reason, nil
+}
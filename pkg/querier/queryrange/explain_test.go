@@ -0,0 +1,162 @@
+package queryrange
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+func Test_ExplainMiddleware(t *testing.T) {
+	next := queryrange.HandlerFunc(func(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
+		t.Fatal("explained queries must not be executed")
+		return nil, nil
+	})
+	tripperware := TripperwareStatus{Name: "metric", Middlewares: []MiddlewareStatus{{"explain", true}}}
+	limits := fakeLimits{splits: map[string]time.Duration{"1": time.Hour}}
+	confs := ShardingConfigs{chunk.PeriodConfig{RowShards: 16}}
+	end := time.Date(2019, 12, 02, 11, 10, 0, 0, time.UTC)
+	req := &LokiRequest{
+		Query:   `sum(rate({app="foo"} |= "foo"[1m]))`,
+		StartTs: end.Add(-3 * time.Hour),
+		EndTs:   end,
+		Step:    60000,
+		Path:    "/loki/api/v1/query_range",
+	}
+	ctx := context.WithValue(user.InjectOrgID(context.Background(), "1"), explainCtxKey, true)
+
+	splitsOf := func(t *testing.T, resp queryrange.Response) []SplitPlan {
+		plan := resp.(*ExplainResponse).Plan
+		require.Equal(t, tripperware.Name, plan.Tripperware)
+		require.Equal(t, tripperware.Middlewares, plan.Middlewares)
+		require.Equal(t, "1h0m0s", plan.SplitInterval)
+		require.Len(t, plan.Splits, 4)
+		require.Equal(t, end.Add(-3*time.Hour), plan.Splits[0].Start)
+		require.Equal(t, end, plan.Splits[3].End)
+		return plan.Splits
+	}
+
+	t.Run("sharded", func(t *testing.T) {
+		resp, err := NewExplainMiddleware(tripperware, limits, splitMetricByTime, confs).Wrap(next).Do(ctx, req)
+		require.NoError(t, err)
+		for _, split := range splitsOf(t, resp) {
+			require.Equal(t, 16, split.Shards)
+			require.Equal(t, shardingReasonNoLookback, split.ShardingReason)
+		}
+	})
+
+	t.Run("shards override", func(t *testing.T) {
+		ctx := context.WithValue(ctx, shardsOverrideCtxKey, 6)
+		resp, err := NewExplainMiddleware(tripperware, limits, splitMetricByTime, confs).Wrap(next).Do(ctx, req)
+		require.NoError(t, err)
+		for _, split := range splitsOf(t, resp) {
+			require.Equal(t, 4, split.Shards)
+		}
+	})
+
+	t.Run("sharding disabled", func(t *testing.T) {
+		resp, err := NewExplainMiddleware(tripperware, limits, splitMetricByTime, nil).Wrap(next).Do(ctx, req)
+		require.NoError(t, err)
+		for _, split := range splitsOf(t, resp) {
+			require.Equal(t, 0, split.Shards)
+			require.Equal(t, shardingReasonNotConfigured, split.ShardingReason)
+		}
+	})
+
+	t.Run("neither splittable nor shardable", func(t *testing.T) {
+		req := req.WithQuery(`quantile_over_time(0.99, {app="foo"} | unwrap latency [1m]) by (app)`)
+		resp, err := NewExplainMiddleware(tripperware, limits, splitMetricByTime, confs).Wrap(next).Do(ctx, req)
+		require.NoError(t, err)
+		plan := resp.(*ExplainResponse).Plan
+		require.Empty(t, plan.SplitInterval)
+		require.Equal(t, []SplitPlan{{
+			Start:          end.Add(-3 * time.Hour),
+			End:            end,
+			ShardingReason: shardingReasonNoShardingMap,
+		}}, plan.Splits)
+	})
+
+	t.Run("not split", func(t *testing.T) {
+		resp, err := NewExplainMiddleware(tripperware, fakeLimits{}, splitMetricByTime, confs).Wrap(next).Do(ctx, req)
+		require.NoError(t, err)
+		plan := resp.(*ExplainResponse).Plan
+		require.Empty(t, plan.SplitInterval)
+		require.Equal(t, []SplitPlan{{
+			Start:          end.Add(-3 * time.Hour),
+			End:            end,
+			Shards:         16,
+			ShardingReason: shardingReasonNoLookback,
+		}}, plan.Splits)
+	})
+}
+
+func TestExplainTripperware(t *testing.T) {
+	cfg := testConfig
+	cfg.ShardedQueries = true
+	schema := chunk.SchemaConfig{Configs: []chunk.PeriodConfig{{RowShards: 8}}}
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxSeries: 1, maxQueryParallelism: 1}, schema, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := counter()
+	rt.setHandler(h)
+
+	for _, tc := range []struct {
+		query       string
+		tripperware string
+		splits      int
+		shards      int
+	}{
+		{query: `rate({app="foo"} |= "foo"[1m])`, tripperware: "metric", splits: 2, shards: 8},
+		{query: `{app="foo"} |= "foo"`, tripperware: "log_filter", splits: 2, shards: 8},
+		{query: `{app="foo"}`, tripperware: "none", splits: 1},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			lreq := &LokiRequest{
+				Query:     tc.query,
+				Limit:     1000,
+				Step:      30000,
+				StartTs:   testTime.Add(-6 * time.Hour),
+				EndTs:     testTime,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			}
+			ctx := user.InjectOrgID(context.Background(), "1")
+			req, err := LokiCodec.EncodeRequest(ctx, lreq)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			req.URL.RawQuery += "&explain=true"
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			resp, err := tpw(rt).RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var plan QueryPlan
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+
+			require.Equal(t, tc.tripperware, plan.Tripperware)
+			require.Len(t, plan.Splits, tc.splits)
+			if tc.splits > 1 {
+				require.Equal(t, testConfig.SplitQueriesByInterval.String(), plan.SplitInterval)
+				require.Contains(t, plan.Middlewares, MiddlewareStatus{"sharding", true})
+			}
+			for _, split := range plan.Splits {
+				require.Equal(t, tc.shards, split.Shards)
+			}
+		})
+	}
+	require.Equal(t, 0, *count)
+}
@@ -0,0 +1,61 @@
+package queryrange
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/weaveworks/common/httpgrpc"
+)
+
+// faultInjectionAllowed is only set in binaries built with the faultinjection build tag,
+// so that a configuration mistake can't inject faults in production.
+var faultInjectionAllowed = false
+
+// FaultInjectionConfig configures synthetic latency and failures injected into downstream requests,
+// to load test the retry, cancellation and timeout behavior of the frontend.
+type FaultInjectionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Latency is added to a LatencyRatio fraction of the requests.
+	Latency      time.Duration `yaml:"latency"`
+	LatencyRatio float64       `yaml:"latency_ratio"`
+	// ErrorRatio is the fraction of the requests failing with a 500.
+	ErrorRatio float64 `yaml:"error_ratio"`
+}
+
+// NewFaultInjectionMiddleware returns a middleware delaying and failing a fraction of the requests.
+// It is a no-op unless enabled in the config and the binary is built with the faultinjection build tag.
+func NewFaultInjectionMiddleware(cfg FaultInjectionConfig) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		if !cfg.Enabled || !faultInjectionAllowed {
+			return next
+		}
+		return faultInjector{
+			cfg:  cfg,
+			next: next,
+		}
+	})
+}
+
+type faultInjector struct {
+	cfg  FaultInjectionConfig
+	next queryrange.Handler
+}
+
+func (f faultInjector) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	if f.cfg.Latency > 0 && rand.Float64() < f.cfg.LatencyRatio {
+		t := time.NewTimer(f.cfg.Latency)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+	if rand.Float64() < f.cfg.ErrorRatio {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, "injected fault")
+	}
+	return f.next.Do(ctx, r)
+}
@@ -0,0 +1,8 @@
+//go:build faultinjection
+// +build faultinjection
+
+package queryrange
+
+func init() {
+	faultInjectionAllowed = true
+}
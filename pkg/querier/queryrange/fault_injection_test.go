@@ -0,0 +1,70 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+)
+
+func Test_FaultInjectionMiddleware(t *testing.T) {
+	var calls int
+	next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		calls++
+		return &LokiResponse{}, nil
+	})
+	req := &LokiRequest{Query: `{app="foo"}`}
+
+	faulty := FaultInjectionConfig{Enabled: true, ErrorRatio: 1, Latency: time.Hour, LatencyRatio: 1}
+
+	t.Run("not allowed without the build tag", func(t *testing.T) {
+		defer func(allowed bool) { faultInjectionAllowed = allowed }(faultInjectionAllowed)
+		faultInjectionAllowed = false
+
+		calls = 0
+		_, err := NewFaultInjectionMiddleware(faulty).Wrap(next).Do(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+	})
+
+	defer func(allowed bool) { faultInjectionAllowed = allowed }(faultInjectionAllowed)
+	faultInjectionAllowed = true
+
+	t.Run("disabled", func(t *testing.T) {
+		calls = 0
+		cfg := faulty
+		cfg.Enabled = false
+		_, err := NewFaultInjectionMiddleware(cfg).Wrap(next).Do(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		calls = 0
+		_, err := NewFaultInjectionMiddleware(FaultInjectionConfig{Enabled: true, ErrorRatio: 1}).Wrap(next).Do(context.Background(), req)
+		require.Equal(t, httpgrpc.Errorf(http.StatusInternalServerError, "injected fault"), err)
+		require.Equal(t, 0, calls)
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		calls = 0
+		start := time.Now()
+		_, err := NewFaultInjectionMiddleware(FaultInjectionConfig{Enabled: true, Latency: 50 * time.Millisecond, LatencyRatio: 1}).Wrap(next).Do(context.Background(), req)
+		require.NoError(t, err)
+		require.Equal(t, 1, calls)
+		require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("latency honors cancellation", func(t *testing.T) {
+		calls = 0
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := NewFaultInjectionMiddleware(faulty).Wrap(next).Do(ctx, req)
+		require.Equal(t, context.DeadlineExceeded, err)
+		require.Equal(t, 0, calls)
+	})
+}
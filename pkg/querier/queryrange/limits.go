@@ -1,8 +1,14 @@
 package queryrange
 
 import (
+	"bytes"
 	"context"
+	stdjson "encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"time"
@@ -11,33 +17,67 @@ import (
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/cortexproject/cortex/pkg/util"
 	"github.com/cortexproject/cortex/pkg/util/validation"
+	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log/level"
 	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/prometheus/model/timestamp"
 	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
+	"go.uber.org/atomic"
 
 	"github.com/grafana/loki/pkg/util/spanlogger"
 
 	"github.com/grafana/loki/pkg/tenant"
 
 	"github.com/grafana/loki/pkg/logql"
+	logqllog "github.com/grafana/loki/pkg/logql/log"
 )
 
 const (
-	limitErrTmpl = "maximum of series (%d) reached for a single query"
+	limitErrTmpl       = "maximum of series (%d) reached for a single query"
+	streamLimitErrTmpl = "maximum of streams (%d) matched for a single query"
+
+	maxEntriesLimitErrTmpl      = "max entries limit per query exceeded, limit > max_entries_limit (%d > %d)"
+	errQueryOutsideLookbackTmpl = "the query time range is entirely before the max query lookback (%s)"
+	maxQuerySplitsErrTmpl       = "the query would be split into %d sub-queries, which exceeds the limit of %d (max_query_splits)"
+	blockedQueryLabelErrTmpl    = "querying the label %q is not allowed"
+	blockedQueryFunctionErrTmpl = "using the function %q in queries is not allowed"
+	maxConcurrentMetadataTmpl   = "too many concurrent %s queries, the limit is %d (max_concurrent_metadata_queries)"
+	maxQueryBytesErrTmpl        = "the query processed %s, which exceeds the limit of %s (max_query_bytes)"
+	maxConcurrentDashboardTmpl  = "too many concurrent queries of the dashboard %q, the limit is %d (max_concurrent_queries_per_dashboard)"
+
+	// dashboardQueryTag is the query tag identifying the dashboard sending a query, e.g. X-Query-Tags: dashboard=<uid>.
+	dashboardQueryTag = "dashboard"
 )
 
-// Limits extends the cortex limits interface with support for per tenant splitby parameters
+// Limits extends the cortex limits interface with support for per tenant splitby parameters.
+// Middlewares read them on every request and never keep a tenant limit across requests,
+// so that the runtime config reloads of the overrides apply to the next request.
 type Limits interface {
 	queryrange.Limits
 	logql.Limits
 	QuerySplitDuration(string) time.Duration
 	MaxQuerySeries(string) int
+	MaxStreamsMatchedPerQuery(string) int
 	MaxEntriesLimitPerQuery(string) int
 	MinShardingLookback(string) time.Duration
+	QueryCacheKeyJitter(string) bool
+	MaxQuerySplits(string) int
+	MaxQuerySplitsMode(string) string
+	BlockedQueryLabels(string) []string
+	BlockedQueryFunctions(string) []string
+	AllowPartialResults(string) bool
+	MaxConcurrentMetadataQueries(string) int
+	MaxQueryBytes(string) int
+	ResultsCacheTTL(string) time.Duration
+	AutoStep(string) bool
+	ExposeLimitsHeaders(string) bool
+	MaxConcurrentQueriesPerDashboard(string) int
+	ShardingEnabled(string) bool
 }
 
+// limits only holds the static split interval defaults, the tenant overrides are read from
+// the wrapped Limits on every call.
 type limits struct {
 	Limits
 	splitDuration time.Duration
@@ -77,21 +117,42 @@ func WithSplitByLimits(l Limits, splitBy time.Duration) Limits {
 	}
 }
 
+// noCacheKeyJitterLimits disables the jitter of the cache key time buckets and split boundaries.
+type noCacheKeyJitterLimits struct {
+	Limits
+}
+
+func (noCacheKeyJitterLimits) QueryCacheKeyJitter(string) bool {
+	return false
+}
+
 // cacheKeyLimits intersects Limits and CacheSplitter
 type cacheKeyLimits struct {
 	Limits
 }
 
 // GenerateCacheKey will panic if it encounters a 0 split duration. We ensure against this by requiring
-// a nonzero split interval when caching is enabled
+// a nonzero split interval when caching is enabled, see Config.Validate.
 func (l cacheKeyLimits) GenerateCacheKey(userID string, r queryrange.Request) string {
 	split := l.QuerySplitDuration(userID)
-	currentInterval := r.GetStart() / int64(split/time.Millisecond)
+	start := r.GetStart()
+	if l.QueryCacheKeyJitter(userID) {
+		start -= cacheKeyOffset(userID, split)
+	}
+	currentInterval := start / int64(split/time.Millisecond)
 	// include both the currentInterval and the split duration in key to ensure
 	// a cache key can't be reused when an interval changes
 	return fmt.Sprintf("%s:%s:%d:%d:%d", userID, r.GetQuery(), r.GetStep(), currentInterval, split)
 }
 
+// cacheKeyOffset returns the offset in milliseconds applied to the cache key time buckets of a tenant.
+// It is derived from the tenant ID so that it is stable across requests and spread over the split interval.
+func cacheKeyOffset(userID string, split time.Duration) int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(userID))
+	return int64(h.Sum64() % uint64(split/time.Millisecond))
+}
+
 type limitsMiddleware struct {
 	Limits
 	next queryrange.Handler
@@ -116,6 +177,15 @@ func (l limitsMiddleware) Do(ctx context.Context, r queryrange.Request) (queryra
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
 
+	resp, err := l.enforce(ctx, log, r, tenantIDs)
+	if err != nil || !exposeLimitsHeaders(tenantIDs, l) {
+		return resp, err
+	}
+	return withLimitsHeaders(resp, effectiveLimitsHeaders(tenantIDs, l)), nil
+}
+
+// enforce applies the query limits of the tenants to r before handing it to the next handler.
+func (l limitsMiddleware) enforce(ctx context.Context, log *spanlogger.SpanLogger, r queryrange.Request, tenantIDs []string) (queryrange.Response, error) {
 	// Clamp the time range based on the max query lookback.
 
 	if maxQueryLookback := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, l.MaxQueryLookback); maxQueryLookback > 0 {
@@ -130,7 +200,7 @@ func (l limitsMiddleware) Do(ctx context.Context, r queryrange.Request) (queryra
 				"redEnd", util.FormatTimeMillis(r.GetEnd()),
 				"maxQueryLookback", maxQueryLookback)
 
-			return NewEmptyResponse(r)
+			return NewEmptyResponse(ctx, r)
 		}
 
 		if r.GetStart() < minStartTime {
@@ -152,87 +222,529 @@ func (l limitsMiddleware) Do(ctx context.Context, r queryrange.Request) (queryra
 		}
 	}
 
-	return l.next.Do(ctx, r)
+	if err := checkBlockedQueryFunctions(ctx, r, blockedNames(tenantIDs, l.BlockedQueryFunctions)); err != nil {
+		return nil, err
+	}
+
+	blocked := blockedNames(tenantIDs, l.BlockedQueryLabels)
+	if len(blocked) == 0 {
+		return l.next.Do(ctx, r)
+	}
+
+	if req, ok := r.(*LokiSeriesRequest); ok {
+		for _, m := range req.Match {
+			matchers, err := logql.ParseMatchers(m)
+			if err != nil {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+			for _, matcher := range matchers {
+				if _, ok := blocked[matcher.Name]; ok {
+					return nil, httpgrpc.Errorf(http.StatusBadRequest, blockedQueryLabelErrTmpl, matcher.Name)
+				}
+			}
+		}
+	}
+
+	resp, err := l.next.Do(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	// the values of a label aren't label names, the blocked label of a label values request is rejected by the roundtripper.
+	if req, ok := r.(*LokiLabelNamesRequest); ok && req.labelName() != "" {
+		return resp, nil
+	}
+	if res, ok := resp.(*LokiLabelNamesResponse); ok {
+		names := make([]string, 0, len(res.Data))
+		for _, name := range res.Data {
+			if _, ok := blocked[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		filtered := *res
+		filtered.Data = names
+		return &filtered, nil
+	}
+	return resp, nil
 }
 
-type seriesLimiter struct {
-	hashes map[uint64]struct{}
-	rw     sync.RWMutex
-	buf    []byte // buf used for hashing to avoid allocations.
+// blockedNames returns the union of the names the tenants are not allowed to query, e.g. their BlockedQueryLabels.
+func blockedNames(tenantIDs []string, names func(string) []string) map[string]struct{} {
+	var blocked map[string]struct{}
+	for _, tenantID := range tenantIDs {
+		for _, name := range names(tenantID) {
+			if name == "" {
+				continue
+			}
+			if blocked == nil {
+				blocked = make(map[string]struct{})
+			}
+			blocked[name] = struct{}{}
+		}
+	}
+	return blocked
+}
 
-	maxSeries int
-	next      queryrange.Handler
+// checkBlockedLabel rejects the label values queries of a label blocked for the tenants of the context.
+func checkBlockedLabel(ctx context.Context, limits Limits, name string) error {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	if _, ok := blockedNames(tenantIDs, limits.BlockedQueryLabels)[name]; ok {
+		return httpgrpc.Errorf(http.StatusBadRequest, blockedQueryLabelErrTmpl, name)
+	}
+	return nil
 }
 
-type seriesLimiterMiddleware int
+// checkBlockedQueryFunctions rejects the LogQL queries using any of the blocked functions.
+func checkBlockedQueryFunctions(ctx context.Context, r queryrange.Request, blocked map[string]struct{}) error {
+	if len(blocked) == 0 {
+		return nil
+	}
+	switch r.(type) {
+	case *LokiRequest, *LokiInstantRequest:
+	default:
+		return nil
+	}
+	expr, err := parsedExpr(ctx, r)
+	if err != nil {
+		return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	return checkExprFunctions(expr, blocked)
+}
+
+// checkBlockedFunctions rejects the expressions using any of the functions blocked for the tenants of the context.
+// The round tripper checks the queries of every query op with it, including those which aren't handled by
+// the limits middleware, e.g. the log queries sent straight downstream.
+func checkBlockedFunctions(ctx context.Context, limits Limits, expr logql.Expr) error {
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	return checkExprFunctions(expr, blockedNames(tenantIDs, limits.BlockedQueryFunctions))
+}
+
+func checkExprFunctions(expr logql.Expr, blocked map[string]struct{}) error {
+	if len(blocked) == 0 {
+		return nil
+	}
+	for _, name := range queryFunctions(expr) {
+		if _, ok := blocked[name]; ok {
+			return httpgrpc.Errorf(http.StatusBadRequest, blockedQueryFunctionErrTmpl, name)
+		}
+	}
+	return nil
+}
+
+// queryFunctions returns the functions used by the expression, in the order they are walked: range and vector
+// aggregations, label_replace, the ip line and label filters and the unwrap conversion functions.
+func queryFunctions(expr logql.Expr) []string {
+	var names []string
+	expr.Walk(func(e interface{}) {
+		switch e := e.(type) {
+		case *logql.RangeAggregationExpr:
+			names = append(names, e.Operation)
+			if u := e.Left.Unwrap; u != nil {
+				if u.Operation != "" {
+					names = append(names, u.Operation)
+				}
+				for _, f := range u.PostFilters {
+					names = appendLabelFilterFunctions(names, f)
+				}
+			}
+		case *logql.VectorAggregationExpr:
+			names = append(names, e.Operation)
+		case *logql.LabelReplaceExpr:
+			names = append(names, logql.OpLabelReplace)
+		case *logql.LineFilterExpr:
+			if e.Op != "" {
+				names = append(names, e.Op)
+			}
+		case *logql.LabelFilterExpr:
+			names = appendLabelFilterFunctions(names, e.LabelFilterer)
+		}
+	})
+	return names
+}
+
+// appendLabelFilterFunctions appends the ip function to names when the label filter, or any of the filters it
+// combines, is an ip filter.
+func appendLabelFilterFunctions(names []string, f logqllog.LabelFilterer) []string {
+	switch f := f.(type) {
+	case *logqllog.IPLabelFilter:
+		return append(names, logql.OpFilterIP)
+	case *logqllog.BinaryLabelFilter:
+		return appendLabelFilterFunctions(appendLabelFilterFunctions(names, f.Left), f.Right)
+	}
+	return names
+}
+
+// metadataConcurrency caps the number of series and of labels queries each tenant runs concurrently.
+type metadataConcurrency struct {
+	limits Limits
+
+	mtx      sync.Mutex
+	inflight map[metadataQueryKey]int
+}
+
+type metadataQueryKey struct {
+	tenant string
+	op     string
+}
+
+// NewMetadataConcurrencyMiddleware creates a middleware rejecting with a 429 the series and labels queries
+// of a tenant already running MaxConcurrentMetadataQueries queries of the same kind. Other requests are
+// passed through.
+func NewMetadataConcurrencyMiddleware(limits Limits) queryrange.Middleware {
+	c := &metadataConcurrency{
+		limits:   limits,
+		inflight: make(map[metadataQueryKey]int),
+	}
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			var op string
+			switch r := r.(type) {
+			case *LokiSeriesRequest:
+				op = SeriesOp
+			case *LokiLabelNamesRequest:
+				op = getOperation(r.Path)
+			default:
+				return next.Do(ctx, r)
+			}
+			userID, err := tenant.TenantID(ctx)
+			if err != nil {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+			key := metadataQueryKey{tenant: userID, op: op}
+			if err := c.acquire(key); err != nil {
+				return nil, err
+			}
+			defer c.release(key)
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+func (c *metadataConcurrency) acquire(key metadataQueryKey) error {
+	max := c.limits.MaxConcurrentMetadataQueries(key.tenant)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if max > 0 && c.inflight[key] >= max {
+		return httpgrpc.Errorf(http.StatusTooManyRequests, maxConcurrentMetadataTmpl, key.op, max)
+	}
+	c.inflight[key]++
+	return nil
+}
+
+func (c *metadataConcurrency) release(key metadataQueryKey) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.inflight[key]--; c.inflight[key] <= 0 {
+		delete(c.inflight, key)
+	}
+}
+
+// dashboardConcurrency caps the number of queries each dashboard of a tenant runs concurrently, so that an
+// auto-refreshing dashboard with many panels can't take over the query capacity of the tenant.
+type dashboardConcurrency struct {
+	limits Limits
+
+	mtx      sync.Mutex
+	inflight map[dashboardQueryKey]int
+}
+
+type dashboardQueryKey struct {
+	tenant    string
+	dashboard string
+}
+
+func newDashboardConcurrency(limits Limits) *dashboardConcurrency {
+	return &dashboardConcurrency{
+		limits:   limits,
+		inflight: make(map[dashboardQueryKey]int),
+	}
+}
+
+// acquire takes a slot for the query of the request context, identified by its dashboard query tag, and
+// returns the function releasing it. Queries without a dashboard tag or tenant limit are not capped.
+func (c *dashboardConcurrency) acquire(ctx context.Context) (func(), error) {
+	dashboard := queryTagValue(getQueryTags(ctx), dashboardQueryTag)
+	if dashboard == "" {
+		return func() {}, nil
+	}
+	tenantIDs, err := tenant.TenantIDs(ctx)
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	max := validation.SmallestPositiveIntPerTenant(tenantIDs, c.limits.MaxConcurrentQueriesPerDashboard)
+	if max <= 0 {
+		return func() {}, nil
+	}
+
+	key := dashboardQueryKey{tenant: tenant.JoinTenantIDs(tenantIDs), dashboard: dashboard}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.inflight[key] >= max {
+		return nil, httpgrpc.Errorf(http.StatusTooManyRequests, maxConcurrentDashboardTmpl, dashboard, max)
+	}
+	c.inflight[key]++
+	return func() { c.release(key) }, nil
+}
+
+func (c *dashboardConcurrency) release(key dashboardQueryKey) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.inflight[key]--; c.inflight[key] <= 0 {
+		delete(c.inflight, key)
+	}
+}
+
+type seriesLimiter struct {
+	hashes  map[uint64]struct{}
+	streams map[string]struct{}
+	rw      sync.RWMutex
+
+	maxSeries  int
+	maxStreams int
+	onLimit    func(error)
+	next       queryrange.Handler
+}
+
+type seriesLimiterMiddleware struct {
+	maxSeries  int
+	maxStreams int
+	onLimit    func(error)
+}
 
 // newSeriesLimiter creates a new series limiter middleware for use for a single request.
-func newSeriesLimiter(maxSeries int) queryrange.Middleware {
-	return seriesLimiterMiddleware(maxSeries)
+// maxStreams bounds the unique streams returned by log and series queries, 0 disables it.
+// onLimit, when not nil, is called with the limit error once a limit is reached, e.g. to cancel
+// the sub-queries still running.
+func newSeriesLimiter(maxSeries, maxStreams int, onLimit func(error)) queryrange.Middleware {
+	return seriesLimiterMiddleware{
+		maxSeries:  maxSeries,
+		maxStreams: maxStreams,
+		onLimit:    onLimit,
+	}
 }
 
 // Wrap wraps a global handler and returns a per request limited handler.
 // The handler returned is thread safe.
 func (slm seriesLimiterMiddleware) Wrap(next queryrange.Handler) queryrange.Handler {
 	return &seriesLimiter{
-		hashes:    make(map[uint64]struct{}),
-		maxSeries: int(slm),
-		buf:       make([]byte, 0, 1024),
-		next:      next,
+		hashes:     make(map[uint64]struct{}),
+		streams:    make(map[string]struct{}),
+		maxSeries:  slm.maxSeries,
+		maxStreams: slm.maxStreams,
+		onLimit:    slm.onLimit,
+		next:       next,
 	}
 }
 
 func (sl *seriesLimiter) Do(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
 	// no need to fire a request if the limit is already reached.
-	if sl.isLimitReached() {
-		return nil, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, sl.maxSeries)
+	if err := sl.limitErr(); err != nil {
+		return nil, err
 	}
 	res, err := sl.next.Do(ctx, req)
 	if err != nil {
 		return res, err
 	}
-	promResponse, ok := res.(*LokiPromResponse)
-	if !ok {
+	switch response := res.(type) {
+	case *LokiPromResponse:
+		if response.Response == nil {
+			return res, nil
+		}
+		// hash outside of the lock so that concurrent splits don't serialize on it.
+		hashes := hashSeries(response.Response.Data.Result)
+		sl.rw.Lock()
+		for _, hash := range hashes {
+			sl.hashes[hash] = struct{}{}
+		}
+		sl.rw.Unlock()
+	case *LokiResponse:
+		if sl.maxStreams <= 0 {
+			return res, nil
+		}
+		sl.rw.Lock()
+		for _, s := range response.Data.Result {
+			sl.streams[s.Labels] = struct{}{}
+		}
+		sl.rw.Unlock()
+	case *LokiSeriesResponse:
+		if sl.maxStreams <= 0 {
+			return res, nil
+		}
+		sl.rw.Lock()
+		for _, s := range response.Data {
+			sl.streams[s.String()] = struct{}{}
+		}
+		sl.rw.Unlock()
+	default:
 		return res, nil
 	}
-	if promResponse.Response == nil {
+	if err := sl.limitErr(); err != nil {
+		if sl.onLimit != nil {
+			sl.onLimit(err)
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// bytesLimiter aborts the sub-queries of a single query once the bytes they processed exceed a limit.
+type bytesLimiter struct {
+	processed *atomic.Int64
+	maxBytes  int64
+	next      queryrange.Handler
+}
+
+type bytesLimiterMiddleware struct {
+	maxBytes int64
+}
+
+// newBytesLimiter creates a new bytes limiter middleware for use for a single request, 0 disables it.
+func newBytesLimiter(maxBytes int) queryrange.Middleware {
+	return bytesLimiterMiddleware{
+		maxBytes: int64(maxBytes),
+	}
+}
+
+// Wrap wraps a global handler and returns a per request limited handler.
+// The handler returned is thread safe.
+func (blm bytesLimiterMiddleware) Wrap(next queryrange.Handler) queryrange.Handler {
+	if blm.maxBytes <= 0 {
+		return next
+	}
+	return &bytesLimiter{
+		processed: atomic.NewInt64(0),
+		maxBytes:  blm.maxBytes,
+		next:      next,
+	}
+}
+
+func (bl *bytesLimiter) Do(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
+	// no need to fire a request if the limit is already reached.
+	if err := bl.limitErr(bl.processed.Load()); err != nil {
+		return nil, err
+	}
+	res, err := bl.next.Do(ctx, req)
+	if err != nil {
+		return res, err
+	}
+	var processed int64
+	switch response := res.(type) {
+	case *LokiResponse:
+		processed = response.Statistics.Summary.TotalBytesProcessed
+	case *LokiPromResponse:
+		processed = response.Statistics.Summary.TotalBytesProcessed
+	default:
 		return res, nil
 	}
-	sl.rw.Lock()
+	if err := bl.limitErr(bl.processed.Add(processed)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// limitErr returns a 400 error if processed exceeds the bytes limit.
+func (bl *bytesLimiter) limitErr(processed int64) error {
+	if processed > bl.maxBytes {
+		return httpgrpc.Errorf(http.StatusBadRequest, maxQueryBytesErrTmpl, humanize.Bytes(uint64(processed)), humanize.Bytes(uint64(bl.maxBytes)))
+	}
+	return nil
+}
+
+// hashBufPool pools the buffers used for hashing series labels to avoid allocations.
+var hashBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
+}
+
+// hashSeries returns the labels hash of each series.
+func hashSeries(series []queryrange.SampleStream) []uint64 {
+	buf := hashBufPool.Get().(*[]byte)
+	defer hashBufPool.Put(buf)
+
+	hashes := make([]uint64, 0, len(series))
 	var hash uint64
-	for _, s := range promResponse.Response.Data.Result {
+	for _, s := range series {
 		lbs := cortexpb.FromLabelAdaptersToLabels(s.Labels)
-		hash, sl.buf = lbs.HashWithoutLabels(sl.buf, []string(nil)...)
-		sl.hashes[hash] = struct{}{}
-	}
-	sl.rw.Unlock()
-	if sl.isLimitReached() {
-		return nil, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, sl.maxSeries)
+		hash, *buf = lbs.HashWithoutLabels(*buf, []string(nil)...)
+		hashes = append(hashes, hash)
 	}
-	return res, nil
+	return hashes
 }
 
-func (sl *seriesLimiter) isLimitReached() bool {
+// limitErr returns a 400 error if either the series or the streams limit has been exceeded.
+func (sl *seriesLimiter) limitErr() error {
 	sl.rw.RLock()
 	defer sl.rw.RUnlock()
-	return len(sl.hashes) > sl.maxSeries
+	if len(sl.hashes) > sl.maxSeries {
+		return httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, sl.maxSeries)
+	}
+	if sl.maxStreams > 0 && len(sl.streams) > sl.maxStreams {
+		return httpgrpc.Errorf(http.StatusBadRequest, streamLimitErrTmpl, sl.maxStreams)
+	}
+	return nil
+}
+
+// DownstreamResolver returns the scheme and host sub-queries should be sent to, e.g. to route them to tenant specific queriers.
+// An empty host leaves the request untouched for the next roundtripper to handle.
+type DownstreamResolver func(ctx context.Context) (scheme, host string)
+
+// withDownstream returns a copy of req sent to the scheme and host chosen by resolve, or req itself when
+// there is none.
+func withDownstream(req *http.Request, resolve DownstreamResolver) *http.Request {
+	if resolve == nil {
+		return req
+	}
+	scheme, host := resolve(req.Context())
+	if host == "" {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	u := *req.URL
+	u.Scheme, u.Host = scheme, host
+	req.URL = &u
+	req.Host = host
+	return req
+}
+
+// downstreamRoundTripper sends the requests to the scheme and host chosen by its resolver.
+type downstreamRoundTripper struct {
+	next    http.RoundTripper
+	resolve DownstreamResolver
+}
+
+func (rt downstreamRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return rt.next.RoundTrip(withDownstream(r, rt.resolve))
 }
 
 type limitedRoundTripper struct {
-	next   http.RoundTripper
-	limits Limits
+	next    http.RoundTripper
+	limits  Limits
+	resolve DownstreamResolver
+	// truncatedBodyRetries is how many times sub-queries whose response body is cut short are sent again.
+	truncatedBodyRetries int
 
 	codec      queryrange.Codec
 	middleware queryrange.Middleware
 }
 
 // NewLimitedRoundTripper creates a new roundtripper that enforces MaxQueryParallelism to the `next` roundtripper across `middlewares`.
-func NewLimitedRoundTripper(next http.RoundTripper, codec queryrange.Codec, limits Limits, middlewares ...queryrange.Middleware) http.RoundTripper {
+// resolve is optional and allows to choose where each sub-query is sent. Sub-queries whose response body is cut
+// short, e.g. by a connection reset, are sent again up to truncatedBodyRetries times.
+func NewLimitedRoundTripper(next http.RoundTripper, codec queryrange.Codec, limits Limits, resolve DownstreamResolver, truncatedBodyRetries int, middlewares ...queryrange.Middleware) http.RoundTripper {
 	transport := limitedRoundTripper{
-		next:       next,
-		codec:      codec,
-		limits:     limits,
-		middleware: queryrange.MergeMiddlewares(middlewares...),
+		next:                 next,
+		codec:                codec,
+		limits:               limits,
+		resolve:              resolve,
+		truncatedBodyRetries: truncatedBodyRetries,
+		middleware:           queryrange.MergeMiddlewares(middlewares...),
 	}
 	return transport
 }
@@ -260,7 +772,7 @@ func (rt limitedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 	var (
 		wg           sync.WaitGroup
 		intermediate = make(chan work)
-		ctx, cancel  = context.WithCancel(r.Context())
+		ctx, cancel  = context.WithCancel(withParsedExprs(r.Context()))
 	)
 	defer func() {
 		cancel()
@@ -274,6 +786,10 @@ func (rt limitedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 	}
 
 	if span := opentracing.SpanFromContext(ctx); span != nil {
+		// the sub-queries of the request are logged with its query hash.
+		if span.BaggageItem(queryHashBaggage) == "" {
+			span.SetBaggageItem(queryHashBaggage, requestQueryHash(ctx, request))
+		}
 		request.LogToSpan(span)
 	}
 	userid, err := tenant.TenantID(ctx)
@@ -291,6 +807,9 @@ func (rt limitedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 				select {
 				case w := <-intermediate:
 					resp, err := rt.do(w.ctx, w.req)
+					if err == nil {
+						recordProgress(w.ctx, resp)
+					}
 					w.result <- result{response: resp, err: err}
 				case <-ctx.Done():
 					return
@@ -321,20 +840,68 @@ func (rt limitedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 }
 
 func (rt limitedRoundTripper) do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "limitedRoundTripper.do")
+	defer sp.Finish()
+	r.LogToSpan(sp)
+
+	for retries := 0; ; retries++ {
+		response, truncated, err := rt.roundTrip(ctx, r)
+		if !truncated || retries >= rt.truncatedBodyRetries || ctx.Err() != nil {
+			return response, err
+		}
+		level.Warn(spanlogger.FromContext(ctx)).Log("msg", "retrying sub-query with a truncated response body", "retry", retries+1, "err", err)
+	}
+}
+
+// roundTrip sends the sub-query downstream and decodes its response. It returns whether decoding failed
+// because the response body was cut short, only detected when truncated bodies are retried.
+func (rt limitedRoundTripper) roundTrip(ctx context.Context, r queryrange.Request) (queryrange.Response, bool, error) {
 	request, err := rt.codec.EncodeRequest(ctx, r)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if err := user.InjectOrgIDIntoHTTPRequest(ctx, request); err != nil {
-		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		return nil, false, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
 
-	response, err := rt.next.RoundTrip(request)
+	response, err := rt.next.RoundTrip(withDownstream(request, rt.resolve))
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	// the body is replaced once read, the downstream one is closed.
+	downstreamBody := response.Body
+	defer func() { _ = downstreamBody.Close() }()
+
+	if rt.truncatedBodyRetries == 0 || response.StatusCode/100 != 2 {
+		resp, err := rt.codec.DecodeResponse(ctx, response, r)
+		return resp, false, err
+	}
+
+	var body []byte
+	if buffer, ok := response.Body.(Buffer); ok {
+		body = buffer.Bytes()
+	} else {
+		body, err = ioutil.ReadAll(response.Body)
+		if err != nil {
+			// the connection was closed or reset before the whole body was read.
+			return nil, true, httpgrpc.Errorf(http.StatusInternalServerError, "error decoding response: %v", err)
+		}
+		response.Body = readBody{bytes.NewBuffer(body)}
 	}
-	defer func() { _ = response.Body.Close() }()
+	resp, err := rt.codec.DecodeResponse(ctx, response, r)
+	return resp, err != nil && truncatedJSON(body), err
+}
+
+// readBody is a response body already read, it implements Buffer so that decoding it doesn't copy it again.
+type readBody struct {
+	*bytes.Buffer
+}
+
+func (readBody) Close() error { return nil }
 
-	return rt.codec.DecodeResponse(ctx, response, r)
+// truncatedJSON returns whether body is the beginning of a JSON document cut short, rather than an invalid one.
+func truncatedJSON(body []byte) bool {
+	err := stdjson.NewDecoder(bytes.NewReader(body)).Decode(&stdjson.RawMessage{})
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
@@ -0,0 +1,92 @@
+package queryrange
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/cortexproject/cortex/pkg/util/validation"
+)
+
+// The effective limits of the tenants of a query, set on its response when one of them enables them.
+const (
+	limitSplitIntervalHeader       = "X-Loki-Limit-Split-Interval"
+	limitMaxEntriesHeader          = "X-Loki-Limit-Max-Entries"
+	limitMaxQueryLookbackHeader    = "X-Loki-Limit-Max-Query-Lookback"
+	limitMaxQueryParallelismHeader = "X-Loki-Limit-Max-Query-Parallelism"
+)
+
+var limitsHeaders = []string{
+	limitSplitIntervalHeader,
+	limitMaxEntriesHeader,
+	limitMaxQueryLookbackHeader,
+	limitMaxQueryParallelismHeader,
+}
+
+// exposeLimitsHeaders returns whether one of the tenants enables the limits headers.
+func exposeLimitsHeaders(tenantIDs []string, l Limits) bool {
+	for _, tenantID := range tenantIDs {
+		if l.ExposeLimitsHeaders(tenantID) {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveLimitsHeaders returns the limits headers resolved for the tenants the same way the middlewares
+// enforcing them do. Durations are formatted as Go durations, and 0 means unlimited.
+func effectiveLimitsHeaders(tenantIDs []string, l Limits) []queryrange.PrometheusResponseHeader {
+	values := []string{
+		validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, l.QuerySplitDuration).String(),
+		strconv.Itoa(validation.SmallestPositiveNonZeroIntPerTenant(tenantIDs, l.MaxEntriesLimitPerQuery)),
+		validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, l.MaxQueryLookback).String(),
+		strconv.Itoa(validation.SmallestPositiveIntPerTenant(tenantIDs, l.MaxQueryParallelism)),
+	}
+	headers := make([]queryrange.PrometheusResponseHeader, 0, len(limitsHeaders))
+	for i, name := range limitsHeaders {
+		headers = append(headers, queryrange.PrometheusResponseHeader{Name: name, Values: []string{values[i]}})
+	}
+	return headers
+}
+
+// withLimitsHeaders adds the limits headers to res.
+func withLimitsHeaders(res queryrange.Response, headers []queryrange.PrometheusResponseHeader) queryrange.Response {
+	switch r := res.(type) {
+	case *LokiResponse:
+		r.Headers = append(r.Headers, headers...)
+	case *LokiPromResponse:
+		for i := range headers {
+			r.Response.Headers = append(r.Response.Headers, &headers[i])
+		}
+	case *LokiSeriesResponse:
+		r.Headers = append(r.Headers, headers...)
+	case *LokiLabelNamesResponse:
+		r.Headers = append(r.Headers, headers...)
+	}
+	return res
+}
+
+// markLimitsHeaders sets the limits headers of res, if any, on its encoded resp.
+func markLimitsHeaders(resp *http.Response, res queryrange.Response) *http.Response {
+	var headers []queryrange.PrometheusResponseHeader
+	switch r := res.(type) {
+	case *LokiResponse:
+		headers = r.Headers
+	case *LokiPromResponse:
+		for _, h := range r.Response.Headers {
+			headers = append(headers, *h)
+		}
+	case *LokiSeriesResponse:
+		headers = r.Headers
+	case *LokiLabelNamesResponse:
+		headers = r.Headers
+	}
+	for _, h := range headers {
+		for _, name := range limitsHeaders {
+			if h.Name == name && len(h.Values) > 0 {
+				resp.Header.Set(name, h.Values[0])
+			}
+		}
+	}
+	return resp
+}
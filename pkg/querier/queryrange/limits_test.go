@@ -1,24 +1,35 @@
 package queryrange
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/cortexproject/cortex/pkg/cortexpb"
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-client-go"
+	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
 	"go.uber.org/atomic"
 
+	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/grafana/loki/pkg/logqlmodel"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/util/httpreq"
 	"github.com/grafana/loki/pkg/util/marshal"
 )
 
@@ -50,6 +61,74 @@ func TestLimits(t *testing.T) {
 	)
 }
 
+func Test_cacheKeyJitter(t *testing.T) {
+	l := cacheKeyLimits{WithDefaultLimits(fakeLimits{cacheKeyJitter: true}, queryrange.Config{SplitQueriesByInterval: time.Hour})}
+
+	// the offset is stable for a tenant and bounded by the split interval.
+	require.Equal(t, cacheKeyOffset("a", time.Hour), cacheKeyOffset("a", time.Hour))
+	require.NotEqual(t, cacheKeyOffset("a", time.Hour), cacheKeyOffset("b", time.Hour))
+	require.Less(t, cacheKeyOffset("a", time.Hour), int64(time.Hour/time.Millisecond))
+
+	r := &LokiRequest{
+		Query:   "qry",
+		StartTs: time.Unix(0, 0).Add(10 * time.Hour),
+		Step:    int64(time.Minute / time.Millisecond),
+	}
+	require.Equal(t, l.GenerateCacheKey("a", r), l.GenerateCacheKey("a", r))
+
+	// the request start lands in the previous bucket once offset.
+	offset := cacheKeyOffset("a", time.Hour)
+	require.NotZero(t, offset)
+	require.Equal(
+		t,
+		fmt.Sprintf("%s:%s:%d:%d:%d", "a", r.GetQuery(), r.GetStep(), 9, int64(time.Hour)),
+		l.GenerateCacheKey("a", r),
+	)
+
+	// without jitter buckets are aligned to the split interval.
+	l = cacheKeyLimits{WithDefaultLimits(fakeLimits{}, queryrange.Config{SplitQueriesByInterval: time.Hour})}
+	require.Equal(
+		t,
+		fmt.Sprintf("%s:%s:%d:%d:%d", "a", r.GetQuery(), r.GetStep(), 10, int64(time.Hour)),
+		l.GenerateCacheKey("a", r),
+	)
+}
+
+func Test_cacheKeyJitter_SplitBoundaries(t *testing.T) {
+	l := WithDefaultLimits(fakeLimits{cacheKeyJitter: true}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+	offset := time.Duration(cacheKeyOffset("a", time.Hour)) * time.Millisecond
+	start := time.Unix(0, 0).Add(10 * time.Hour).UTC()
+	r := &LokiRequest{
+		Query:   `rate({app="foo"}[1m])`,
+		StartTs: start,
+		EndTs:   start.Add(3 * time.Hour),
+		Step:    int64(time.Minute / time.Millisecond),
+	}
+
+	intervals, interval, err := splitIntervals(context.Background(), l, splitMetricByTime, "a", r)
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, interval)
+	require.Len(t, intervals, 4)
+	require.Equal(t, start, intervals[0].(*LokiRequest).StartTs)
+	require.Equal(t, r.EndTs, intervals[3].(*LokiRequest).EndTs)
+	for _, req := range intervals[1:] {
+		// the sub-queries start on the first step after the offset boundaries.
+		require.Less(t, (time.Duration(req.GetStart())*time.Millisecond-offset)%time.Hour, time.Minute)
+	}
+	for _, req := range intervals {
+		// each sub-query is cached in a single time bucket.
+		require.Equal(t,
+			cacheKeyLimits{l}.GenerateCacheKey("a", req),
+			cacheKeyLimits{l}.GenerateCacheKey("a", req.WithStartEnd(req.GetEnd(), req.GetEnd())),
+		)
+	}
+
+	// the index tables alignment ignores the jitter.
+	intervals, _, err = splitIntervals(context.Background(), noCacheKeyJitterLimits{l}, splitMetricByTime, "a", r)
+	require.NoError(t, err)
+	require.Len(t, intervals, 3)
+}
+
 func Test_seriesLimiter(t *testing.T) {
 	cfg := testConfig
 	cfg.SplitQueriesByInterval = time.Hour
@@ -139,6 +218,122 @@ func Test_seriesLimiter(t *testing.T) {
 	require.LessOrEqual(t, *c, 4)
 }
 
+func Test_bytesLimiter(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		name     string
+		maxBytes int
+		calls    int
+		err      bool
+	}{
+		{name: "unlimited", calls: 4},
+		{name: "under the limit", maxBytes: 160, calls: 4},
+		// the third sub-query exceeds the limit and the last one is aborted.
+		{name: "over the limit", maxBytes: 100, calls: 3, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				calls.Inc()
+				return &LokiPromResponse{
+					Response:   queryrange.NewEmptyPrometheusResponse(),
+					Statistics: stats.Result{Summary: stats.Summary{TotalBytesProcessed: 40}},
+				}, nil
+			})
+
+			l := WithDefaultLimits(fakeLimits{maxQueryBytes: tc.maxBytes}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+			split := SplitByIntervalMiddleware(l, LokiCodec, splitMetricByTime, nilMetrics).Wrap(next)
+
+			_, err := split.Do(ctx, &LokiRequest{
+				StartTs:   time.Unix(0, 0),
+				EndTs:     time.Unix(0, (4 * time.Hour).Nanoseconds()),
+				Query:     `sum by (app) (rate({app="foo"} |= "foo" [1m]))`,
+				Step:      15000,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			})
+			require.Equal(t, int32(tc.calls), calls.Load())
+			if !tc.err {
+				require.NoError(t, err)
+				return
+			}
+			resp, ok := httpgrpc.HTTPResponseFromError(err)
+			require.True(t, ok)
+			require.Equal(t, int32(http.StatusBadRequest), resp.Code)
+			require.Contains(t, string(resp.Body), "max_query_bytes")
+		})
+	}
+}
+
+func Test_streamsLimiter(t *testing.T) {
+	cfg := testConfig
+	cfg.SplitQueriesByInterval = time.Hour
+	cfg.CacheResults = false
+	// split in 6 with 2 in // max.
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxSeries: 1, maxStreamsMatched: 1, maxQueryParallelism: 2}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"} |= "foo"`,
+		Limit:     1000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+
+	req = req.WithContext(ctx)
+	err = user.InjectOrgIDIntoHTTPRequest(ctx, req)
+	require.NoError(t, err)
+
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	// every split returns the same stream.
+	count, h := promqlResult(streams)
+	rt.setHandler(h)
+
+	_, err = tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 6, *count)
+
+	// every split returns a different stream.
+	c := new(int)
+	m := &sync.Mutex{}
+	h = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		defer func() {
+			*c++
+		}()
+		if err := marshal.WriteQueryResponseJSON(logqlmodel.Result{
+			Data: logqlmodel.Streams{
+				{
+					Entries: []logproto.Entry{{Timestamp: testTime.Add(-4 * time.Hour), Line: "foo"}},
+					Labels:  fmt.Sprintf(`{filename="/var/hostlog/apport.log", job="varlogs", split="%d"}`, *c),
+				},
+			},
+		}, rw); err != nil {
+			panic(err)
+		}
+	})
+	rt.setHandler(h)
+
+	_, err = tpw(rt).RoundTrip(req)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "maximum of streams (1) matched for a single query")
+	require.LessOrEqual(t, *c, 4)
+}
+
 func Test_MaxQueryParallelism(t *testing.T) {
 	maxQueryParallelism := 2
 	f, err := newfakeRoundTripper()
@@ -159,7 +354,7 @@ func Test_MaxQueryParallelism(t *testing.T) {
 	r, err := http.NewRequestWithContext(ctx, "GET", "/query_range", http.NoBody)
 	require.Nil(t, err)
 
-	_, _ = NewLimitedRoundTripper(f, LokiCodec, fakeLimits{maxQueryParallelism: maxQueryParallelism},
+	_, _ = NewLimitedRoundTripper(f, LokiCodec, fakeLimits{maxQueryParallelism: maxQueryParallelism}, nil, 0,
 		queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
 			return queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
 				var wg sync.WaitGroup
@@ -179,6 +374,224 @@ func Test_MaxQueryParallelism(t *testing.T) {
 	require.LessOrEqual(t, maxFound, maxQueryParallelism, "max query parallelism: ", maxFound, " went over the configured one:", maxQueryParallelism)
 }
 
+func Test_LimitedRoundTripperSpans(t *testing.T) {
+	reporter := jaeger.NewInMemoryReporter()
+	tr, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), reporter)
+	defer closer.Close()
+	prev := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tr)
+	defer opentracing.SetGlobalTracer(prev)
+
+	f, err := newfakeRoundTripper()
+	require.Nil(t, err)
+	defer f.Close()
+	_, h := promqlResult(matrix)
+	f.setHandler(h)
+
+	parent := tr.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(user.InjectOrgID(context.Background(), "foo"), parent)
+	r, err := http.NewRequestWithContext(ctx, "GET", "/loki/api/v1/query_range?query=rate({app=\"foo\"}[1m])&start=0&end=3600&step=60", http.NoBody)
+	require.Nil(t, err)
+
+	_, err = NewLimitedRoundTripper(f, LokiCodec, fakeLimits{maxQueryParallelism: 2}, nil, 0,
+		queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+			return queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+				var wg sync.WaitGroup
+				for i := 0; i < 3; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, _ = next.Do(c, r)
+					}()
+				}
+				wg.Wait()
+				return next.Do(c, r)
+			})
+		}),
+	).RoundTrip(r)
+	require.NoError(t, err)
+	parent.Finish()
+
+	var children int
+	for _, s := range reporter.GetSpans() {
+		sp := s.(*jaeger.Span)
+		if sp.OperationName() != "limitedRoundTripper.do" {
+			continue
+		}
+		children++
+		require.Equal(t, parent.Context().(jaeger.SpanContext).SpanID(), sp.SpanContext().ParentID())
+		require.NotEmpty(t, sp.Logs())
+	}
+	require.Equal(t, 4, children)
+}
+
+func Test_LimitedRoundTripperQueryHash(t *testing.T) {
+	reporter := jaeger.NewInMemoryReporter()
+	tr, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), reporter)
+	defer closer.Close()
+	prev := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tr)
+	defer opentracing.SetGlobalTracer(prev)
+
+	f, err := newfakeRoundTripper()
+	require.Nil(t, err)
+	defer f.Close()
+	_, h := promqlResult(matrix)
+	f.setHandler(h)
+
+	parent := tr.StartSpan("parent")
+	ctx := opentracing.ContextWithSpan(user.InjectOrgID(context.Background(), "foo"), parent)
+	// the query spans three days, so do its sub-queries.
+	start, end := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC), time.Date(2022, 1, 12, 12, 0, 0, 0, time.UTC)
+	r, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("/loki/api/v1/query_range?query=rate({app=\"foo\"}[1m])&start=%d&end=%d&step=3600", start.Unix(), end.Unix()), http.NoBody)
+	require.Nil(t, err)
+
+	limits := fakeLimits{maxQueryParallelism: 2, maxSeries: 1000, splits: map[string]time.Duration{"foo": 24 * time.Hour}}
+	_, err = NewLimitedRoundTripper(f, LokiCodec, limits, nil, 0,
+		SplitByIntervalMiddleware(limits, LokiCodec, splitMetricByTime, nilMetrics),
+	).RoundTrip(r)
+	require.NoError(t, err)
+	parent.Finish()
+
+	req, err := LokiCodec.DecodeRequest(ctx, r, nil)
+	require.NoError(t, err)
+	expected := requestQueryHash(context.Background(), req)
+
+	var subqueries int
+	for _, s := range reporter.GetSpans() {
+		sp := s.(*jaeger.Span)
+		if sp.OperationName() != "limitedRoundTripper.do" {
+			continue
+		}
+		subqueries++
+		var hash string
+		for _, record := range sp.Logs() {
+			for _, field := range record.Fields {
+				if field.Key() == "query_hash" {
+					hash = field.Value().(string)
+				}
+			}
+		}
+		require.Equal(t, expected, hash)
+	}
+	require.Equal(t, 3, subqueries)
+}
+
+func Test_LimitedRoundTripperDownstreamResolver(t *testing.T) {
+	f, err := newfakeRoundTripper()
+	require.Nil(t, err)
+	defer f.Close()
+	count, h := promqlResult(matrix)
+	f.setHandler(h)
+
+	// routes tenant "foo" to the fake querier, others are left untouched.
+	resolve := func(ctx context.Context) (string, string) {
+		if id, _ := user.ExtractOrgID(ctx); id == "foo" {
+			return "http", f.host
+		}
+		return "", ""
+	}
+	passthrough := queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return next
+	})
+	rt := NewLimitedRoundTripper(http.DefaultTransport, LokiCodec, fakeLimits{}, resolve, 0, passthrough)
+
+	for _, tc := range []struct {
+		tenant string
+		err    bool
+	}{
+		{"foo", false},
+		{"bar", true}, // no host to send the request to.
+	} {
+		t.Run(tc.tenant, func(t *testing.T) {
+			ctx := user.InjectOrgID(context.Background(), tc.tenant)
+			r, err := http.NewRequestWithContext(ctx, "GET", "/loki/api/v1/query_range?query=rate({app=\"foo\"}[1m])&start=0&end=3600&step=60", http.NoBody)
+			require.Nil(t, err)
+			_, err = rt.RoundTrip(r)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+	require.Equal(t, 1, *count)
+}
+
+// resetReader returns its data then fails like a connection reset mid-body.
+type resetReader struct {
+	data []byte
+}
+
+func (r *resetReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func Test_LimitedRoundTripperTruncatedBodyRetries(t *testing.T) {
+	body := []byte(matrixString)
+	truncatedJSON := func() io.Reader { return bytes.NewReader(body[:len(body)/2]) }
+	reset := func() io.Reader { return &resetReader{data: body[:len(body)/2]} }
+	invalidJSON := func() io.Reader { return strings.NewReader(`{"status": ]`) }
+
+	for _, tc := range []struct {
+		name      string
+		retries   int
+		truncated []func() io.Reader
+		calls     int
+		err       bool
+	}{
+		{name: "truncated JSON", retries: 2, truncated: []func() io.Reader{truncatedJSON}, calls: 2},
+		{name: "connection reset", retries: 2, truncated: []func() io.Reader{reset, truncatedJSON}, calls: 3},
+		{name: "retries exhausted", retries: 1, truncated: []func() io.Reader{reset, truncatedJSON}, calls: 2, err: true},
+		{name: "retries disabled", retries: 0, truncated: []func() io.Reader{truncatedJSON}, calls: 1, err: true},
+		{name: "invalid JSON", retries: 2, truncated: []func() io.Reader{invalidJSON}, calls: 1, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls, closed := atomic.NewInt32(0), atomic.NewInt32(0)
+			next := queryrange.RoundTripFunc(func(*http.Request) (*http.Response, error) {
+				var reader io.Reader = bytes.NewReader(body)
+				if n := int(calls.Inc()); n <= len(tc.truncated) {
+					reader = tc.truncated[n-1]()
+				}
+				return &http.Response{StatusCode: http.StatusOK, Body: closeCounter{Reader: reader, closed: closed}}, nil
+			})
+			passthrough := queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+				return next
+			})
+			rt := NewLimitedRoundTripper(next, LokiCodec, fakeLimits{maxQueryParallelism: 1}, nil, tc.retries, passthrough)
+
+			ctx := user.InjectOrgID(context.Background(), "foo")
+			r, err := http.NewRequestWithContext(ctx, "GET", "/loki/api/v1/query_range?query=rate({app=\"foo\"}[1m])&start=0&end=3600&step=60", http.NoBody)
+			require.NoError(t, err)
+			_, err = rt.RoundTrip(r)
+			require.Equal(t, int32(tc.calls), calls.Load())
+			// every downstream body is closed, including those read to be retried.
+			require.Equal(t, calls.Load(), closed.Load())
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+// closeCounter counts the response bodies closed.
+type closeCounter struct {
+	io.Reader
+	closed *atomic.Int32
+}
+
+func (c closeCounter) Close() error {
+	c.closed.Inc()
+	return nil
+}
+
 func Test_MaxQueryParallelismLateScheduling(t *testing.T) {
 	maxQueryParallelism := 2
 	f, err := newfakeRoundTripper()
@@ -193,7 +606,7 @@ func Test_MaxQueryParallelismLateScheduling(t *testing.T) {
 	r, err := http.NewRequestWithContext(ctx, "GET", "/query_range", http.NoBody)
 	require.Nil(t, err)
 
-	_, _ = NewLimitedRoundTripper(f, LokiCodec, fakeLimits{maxQueryParallelism: maxQueryParallelism},
+	_, _ = NewLimitedRoundTripper(f, LokiCodec, fakeLimits{maxQueryParallelism: maxQueryParallelism}, nil, 0,
 		queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
 			return queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
 				for i := 0; i < 10; i++ {
@@ -239,3 +652,312 @@ func Test_MaxQueryLookBack(t *testing.T) {
 	_, err = tpw(rt).RoundTrip(req)
 	require.NoError(t, err)
 }
+
+func Test_BlockedQueryLabels(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	middleware := NewLimitsMiddleware(fakeLimits{blockedQueryLabels: []string{"pod", "trace_id"}})
+
+	t.Run("series matchers", func(t *testing.T) {
+		var called bool
+		h := middleware.Wrap(queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+			called = true
+			return &LokiSeriesResponse{}, nil
+		}))
+		req := &LokiSeriesRequest{
+			StartTs: testTime.Add(-time.Hour),
+			EndTs:   testTime,
+			Path:    "/loki/api/v1/series",
+		}
+
+		req.Match = []string{`{app="foo"}`, `{app="bar", pod=~"bar-.*"}`}
+		_, err := h.Do(ctx, req)
+		require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, `querying the label "pod" is not allowed`), err)
+		require.False(t, called)
+
+		req.Match = []string{`{app="foo", namespace="default"}`}
+		_, err = h.Do(ctx, req)
+		require.NoError(t, err)
+		require.True(t, called)
+	})
+
+	t.Run("label names", func(t *testing.T) {
+		h := middleware.Wrap(queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+			return &LokiLabelNamesResponse{
+				Status: "success",
+				Data:   []string{"app", "namespace", "pod", "trace_id"},
+			}, nil
+		}))
+		res, err := h.Do(ctx, &LokiLabelNamesRequest{
+			StartTs: testTime.Add(-time.Hour),
+			EndTs:   testTime,
+			Path:    "/loki/api/v1/labels",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"app", "namespace"}, res.(*LokiLabelNamesResponse).Data)
+	})
+}
+
+func Test_BlockedQueryFunctions(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	middleware := NewLimitsMiddleware(fakeLimits{
+		maxQueryParallelism:   1,
+		blockedQueryFunctions: []string{"ip", "quantile_over_time", "label_replace", "duration"},
+	})
+
+	for _, tc := range []struct {
+		query   string
+		blocked string
+	}{
+		{query: `{app="foo"} |= "bar"`},
+		{query: `sum by (pod) (rate({app="foo"} | json [5m]))`},
+		{query: `sum_over_time({app="foo"} | logfmt | unwrap bytes(size) [5m])`},
+		{query: `{app="foo"} |= ip("10.0.0.0/8")`, blocked: "ip"},
+		{query: `{app="foo"} | logfmt | status="500" or addr = ip("10.0.0.1")`, blocked: "ip"},
+		{query: `sum(quantile_over_time(0.99, {app="foo"} | logfmt | unwrap latency [5m]))`, blocked: "quantile_over_time"},
+		{query: `max_over_time({app="foo"} | logfmt | unwrap duration(latency) [5m])`, blocked: "duration"},
+		{query: `label_replace(rate({app="foo"}[5m]), "dst", "$1", "src", "(.*)")`, blocked: "label_replace"},
+		{query: `rate({app="foo"}[5m]) / rate({app="bar"} |= ip("10.0.0.1") [5m])`, blocked: "ip"},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			var called bool
+			h := middleware.Wrap(queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+				called = true
+				return &LokiResponse{}, nil
+			}))
+			_, err := h.Do(ctx, &LokiRequest{
+				Query:   tc.query,
+				StartTs: testTime.Add(-time.Hour),
+				EndTs:   testTime,
+				Limit:   100,
+				Path:    "/loki/api/v1/query_range",
+			})
+			if tc.blocked == "" {
+				require.NoError(t, err)
+				require.True(t, called)
+				return
+			}
+			require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, blockedQueryFunctionErrTmpl, tc.blocked), err)
+			require.False(t, called)
+		})
+	}
+}
+
+func Benchmark_seriesLimiter(b *testing.B) {
+	series := make([]queryrange.SampleStream, 1000)
+	for i := range series {
+		series[i] = queryrange.SampleStream{
+			Labels: []cortexpb.LabelAdapter{
+				{Name: "app", Value: "foo"},
+				{Name: "pod", Value: fmt.Sprintf("pod-%d", i)},
+			},
+		}
+	}
+	res := &LokiPromResponse{
+		Response: &queryrange.PrometheusResponse{
+			Data: queryrange.PrometheusData{Result: series},
+		},
+	}
+	next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		return res, nil
+	})
+
+	// shared buffer is the previous approach, hashing with a single buffer under the lock.
+	b.Run("shared buffer", func(b *testing.B) {
+		var (
+			mtx    sync.Mutex
+			buf    = make([]byte, 0, 1024)
+			hashes = make(map[uint64]struct{})
+		)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				mtx.Lock()
+				var hash uint64
+				for _, s := range res.Response.Data.Result {
+					lbs := cortexpb.FromLabelAdaptersToLabels(s.Labels)
+					hash, buf = lbs.HashWithoutLabels(buf, []string(nil)...)
+					hashes[hash] = struct{}{}
+				}
+				mtx.Unlock()
+			}
+		})
+	})
+
+	b.Run("pooled buffers", func(b *testing.B) {
+		limiter := newSeriesLimiter(len(series), 0, nil).Wrap(next)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, err := limiter.Do(context.Background(), &LokiRequest{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
+func Test_MetadataConcurrency(t *testing.T) {
+	var (
+		started = make(chan struct{}, 1)
+		unblock = make(chan struct{})
+	)
+	next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+		started <- struct{}{}
+		<-unblock
+		return &LokiSeriesResponse{}, nil
+	})
+	handler := NewMetadataConcurrencyMiddleware(fakeLimits{maxConcurrentMetadata: 2}).Wrap(next)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 4)
+	)
+	do := func(ctx context.Context, r queryrange.Request) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := handler.Do(ctx, r)
+			errs <- err
+		}()
+		<-started
+	}
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	series := &LokiSeriesRequest{Match: []string{`{app="foo"}`}}
+	do(ctx, series)
+	do(ctx, series)
+
+	// the tenant series queries are at the limit.
+	_, err := handler.Do(ctx, series)
+	resp, ok := httpgrpc.HTTPResponseFromError(err)
+	require.True(t, ok)
+	require.Equal(t, int32(http.StatusTooManyRequests), resp.Code)
+
+	// labels queries and other tenants have their own limit.
+	do(ctx, &LokiLabelNamesRequest{})
+	do(user.InjectOrgID(context.Background(), "2"), series)
+
+	close(unblock)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// the slots are released once the queries are done.
+	_, err = handler.Do(ctx, series)
+	require.NoError(t, err)
+}
+
+func Test_DashboardConcurrency(t *testing.T) {
+	withTags := func(tenantID, tags string) context.Context {
+		return context.WithValue(user.InjectOrgID(context.Background(), tenantID), httpreq.QueryTagsHTTPHeader, tags)
+	}
+	c := newDashboardConcurrency(fakeLimits{maxDashboardQueries: 2})
+	dashboard := withTags("1", "Source=grafana,Dashboard=abc")
+
+	// concurrent queries of the same dashboard beyond the limit are rejected.
+	var (
+		done = make(chan struct{})
+		errs = make(chan error)
+	)
+	for i := 0; i < 5; i++ {
+		go func() {
+			release, err := c.acquire(dashboard)
+			errs <- err
+			if err == nil {
+				<-done
+				release()
+			}
+		}()
+	}
+	var accepted, rejected int
+	for i := 0; i < 5; i++ {
+		err := <-errs
+		if err == nil {
+			accepted++
+			continue
+		}
+		resp, ok := httpgrpc.HTTPResponseFromError(err)
+		require.True(t, ok)
+		require.Equal(t, int32(http.StatusTooManyRequests), resp.Code)
+		rejected++
+	}
+	require.Equal(t, 2, accepted)
+	require.Equal(t, 3, rejected)
+
+	// other dashboards, tenants and queries without a dashboard tag have their own limit.
+	for _, ctx := range []context.Context{
+		withTags("1", "dashboard=def"),
+		withTags("2", "dashboard=abc"),
+		withTags("1", "Source=grafana"),
+		withTags("1", "Source=grafana"),
+		withTags("1", "Source=grafana"),
+	} {
+		release, err := c.acquire(ctx)
+		require.NoError(t, err)
+		defer release()
+	}
+
+	// the slots are released once the queries are done.
+	close(done)
+	require.Eventually(t, func() bool {
+		release, err := c.acquire(dashboard)
+		if err != nil {
+			return false
+		}
+		release()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	// the dashboards are not capped without a limit.
+	c = newDashboardConcurrency(fakeLimits{})
+	for i := 0; i < 5; i++ {
+		_, err := c.acquire(dashboard)
+		require.NoError(t, err)
+	}
+}
+
+func Test_LimitsHeaders(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req := &LokiRequest{
+		Query:   `{app="foo"}`,
+		Limit:   100,
+		StartTs: testTime.Add(-time.Hour),
+		EndTs:   testTime,
+		Path:    "/loki/api/v1/query_range",
+	}
+	next := queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		return &LokiResponse{Status: "success", Data: LokiData{ResultType: loghttp.ResultTypeStream}}, nil
+	})
+
+	for _, expose := range []bool{false, true} {
+		t.Run(strconv.FormatBool(expose), func(t *testing.T) {
+			l := fakeLimits{
+				splits:                  map[string]time.Duration{"1": 30 * time.Minute},
+				maxEntriesLimitPerQuery: 5000,
+				maxQueryLookback:        30 * 24 * time.Hour,
+				maxQueryParallelism:     16,
+				exposeLimitsHeaders:     expose,
+			}
+			res, err := NewLimitsMiddleware(l).Wrap(next).Do(ctx, req)
+			require.NoError(t, err)
+			resp, err := LokiCodec.EncodeResponse(ctx, res)
+			require.NoError(t, err)
+
+			if !expose {
+				for _, name := range limitsHeaders {
+					require.Empty(t, resp.Header.Get(name), name)
+				}
+				return
+			}
+			require.Equal(t, "30m0s", resp.Header.Get(limitSplitIntervalHeader))
+			require.Equal(t, "5000", resp.Header.Get(limitMaxEntriesHeader))
+			require.Equal(t, "720h0m0s", resp.Header.Get(limitMaxQueryLookbackHeader))
+			require.Equal(t, "16", resp.Header.Get(limitMaxQueryParallelismHeader))
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package queryrange
 
 import (
+	"container/heap"
 	"sort"
 
 	"github.com/grafana/loki/pkg/logproto"
@@ -23,6 +24,8 @@ type byDir struct {
 	markers   []entries
 	direction logproto.Direction
 	labels    string
+	// unordered tells not to trust the markers to be sorted nor to only overlap at their boundaries.
+	unordered bool
 }
 
 func (a byDir) Len() int      { return len(a.markers) }
@@ -42,16 +45,51 @@ func (a byDir) EntriesCount() (n int) {
 	return n
 }
 
+// merge concatenates the markers in order. When adjacent splits overlap, the leading entries of a marker
+// which are identical to the last merged entry are dropped.
 func (a byDir) merge() []logproto.Entry {
+	if a.unordered {
+		return a.mergeUnordered()
+	}
 	result := make([]logproto.Entry, 0, a.EntriesCount())
 
 	sort.Sort(a)
 	for _, m := range a.markers {
+		if n := len(result); n > 0 {
+			last := result[n-1]
+			for len(m) > 0 && m[0].Timestamp.Equal(last.Timestamp) && m[0].Line == last.Line {
+				m = m[1:]
+			}
+		}
 		result = append(result, m...)
 	}
 	return result
 }
 
+// mergeUnordered concatenates the markers and sorts their entries by timestamp in the direction, dropping
+// the entries identical to the previous one.
+func (a byDir) mergeUnordered() []logproto.Entry {
+	all := make([]logproto.Entry, 0, a.EntriesCount())
+	for _, m := range a.markers {
+		all = append(all, m...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if a.direction == logproto.BACKWARD {
+			return all[i].Timestamp.After(all[j].Timestamp)
+		}
+		return all[i].Timestamp.Before(all[j].Timestamp)
+	})
+
+	result := all[:0]
+	for _, e := range all {
+		if n := len(result); n > 0 && e.Timestamp.Equal(result[n-1].Timestamp) && e.Line == result[n-1].Line {
+			continue
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
 // priorityqueue is used for extracting a limited # of entries from a set of sorted streams
 type priorityqueue struct {
 	streams   []*logproto.Stream
@@ -85,11 +123,12 @@ func (pq *priorityqueue) Pop() interface{} {
 	pq.streams[n-1] = nil // avoid memory leak
 	pq.streams = pq.streams[:n-1]
 
-	// put the rest of the stream back into the priorityqueue if more entries exist
+	// put the rest of the stream back into the priorityqueue if more entries exist. It must go through
+	// heap.Push so that it is sifted up into its place rather than left at the bottom of the heap.
 	if len(stream.Entries) > 1 {
 		remaining := *stream
 		remaining.Entries = remaining.Entries[1:]
-		pq.Push(&remaining)
+		heap.Push(pq, &remaining)
 	}
 
 	stream.Entries = stream.Entries[:1]
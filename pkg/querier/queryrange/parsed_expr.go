@@ -0,0 +1,71 @@
+package queryrange
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+
+	"github.com/grafana/loki/pkg/logql"
+)
+
+// parseExpr parses LogQL queries, it can be replaced in tests to count parses.
+var parseExpr = logql.ParseExpr
+
+type parsedExprsCtxKey struct{}
+
+// parsedExprs memoizes the parsed queries of a request and of its sub-requests, keyed by query, so that the
+// middlewares handling them parse each query only once. It lives in the context of the request.
+type parsedExprs struct {
+	mtx   sync.Mutex
+	exprs map[string]logql.Expr
+}
+
+// withParsedExprs returns a context memoizing the parsed queries of the request, unless ctx already does.
+func withParsedExprs(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(parsedExprsCtxKey{}).(*parsedExprs); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, parsedExprsCtxKey{}, &parsedExprs{exprs: map[string]logql.Expr{}})
+}
+
+// parsedQuery returns the parsed query, parsing it on first use only within the request of ctx. Outside of
+// a request, i.e. without withParsedExprs, it is parsed on every call. The returned expression is shared by
+// all the callers handling the request and must not be modified, see clonedExpr.
+func parsedQuery(ctx context.Context, query string) (logql.Expr, error) {
+	p, ok := ctx.Value(parsedExprsCtxKey{}).(*parsedExprs)
+	if !ok {
+		return parseExpr(query)
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if expr, ok := p.exprs[query]; ok {
+		return expr, nil
+	}
+	expr, err := parseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	p.exprs[query] = expr
+	return expr, nil
+}
+
+// parsedExpr returns the parsed query of req, see parsedQuery.
+func parsedExpr(ctx context.Context, req queryrange.Request) (logql.Expr, error) {
+	return parsedQuery(ctx, req.GetQuery())
+}
+
+// clonedExpr returns a copy of the parsed query of req, which the caller is free to modify
+// without affecting the expression shared by parsedExpr.
+func clonedExpr(req queryrange.Request) (logql.Expr, error) {
+	return parseExpr(req.GetQuery())
+}
+
+// classifyRequest returns the QueryClass of the query of req.
+func classifyRequest(ctx context.Context, req queryrange.Request) (QueryClass, error) {
+	expr, err := parsedExpr(ctx, req)
+	if err != nil {
+		return QueryClass{}, err
+	}
+	return classifyExpr(expr), nil
+}
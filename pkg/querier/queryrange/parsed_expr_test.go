@@ -0,0 +1,127 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+// countParses counts the queries parsed by parseExpr until the test ends.
+func countParses(t *testing.T) *int {
+	var parses int
+	f := parseExpr
+	t.Cleanup(func() { parseExpr = f })
+	parseExpr = func(query string) (logql.Expr, error) {
+		parses++
+		return logql.ParseExpr(query)
+	}
+	return &parses
+}
+
+func Test_parsedExpr_ParsesOncePerRequest(t *testing.T) {
+	parses := countParses(t)
+	ctx := withParsedExprs(context.Background())
+
+	req := &LokiInstantRequest{
+		Query:  `sum by (x) (rate({app="foo"}[1m]))`,
+		TimeTs: time.Unix(1, 0),
+		Path:   "/loki/api/v1/query",
+	}
+
+	empty, err := NewEmptyResponse(ctx, req)
+	require.NoError(t, err)
+	require.IsType(t, &LokiPromResponse{}, empty)
+	_, err = classifyRequest(ctx, req)
+	require.NoError(t, err)
+	expr, err := parsedExpr(ctx, req)
+	require.NoError(t, err)
+	require.IsType(t, &logql.VectorAggregationExpr{}, expr)
+	require.Equal(t, 1, *parses)
+
+	// the sub-requests with the same query share it.
+	_, err = parsedExpr(withParsedExprs(ctx), req.WithShards(logql.Shards{{Shard: 0, Of: 2}}))
+	require.NoError(t, err)
+	require.Equal(t, 1, *parses)
+
+	// a rewritten query is parsed again.
+	_, err = parsedExpr(ctx, req.WithQuery(`sum by (x) (count_over_time({app="foo"}[1m]))`))
+	require.NoError(t, err)
+	require.Equal(t, 2, *parses)
+
+	// other requests and callers outside of a request parse it again.
+	_, err = parsedExpr(withParsedExprs(context.Background()), req)
+	require.NoError(t, err)
+	_, err = parsedExpr(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, 4, *parses)
+}
+
+func Test_parsedExpr_DecodedRangeRequest(t *testing.T) {
+	parses := countParses(t)
+
+	for _, tc := range []struct {
+		query string
+		want  interface{}
+	}{
+		{`rate({app="foo"}[1m])`, &LokiPromResponse{}},
+		{`{app="foo"}`, &LokiResponse{}},
+	} {
+		*parses = 0
+		ctx := withParsedExprs(context.Background())
+		httpReq, err := http.NewRequest(http.MethodGet,
+			fmt.Sprintf(`/loki/api/v1/query_range?start=1&end=2&query=%s&step=1`, tc.query), nil)
+		require.NoError(t, err)
+		req, err := LokiCodec.DecodeRequest(ctx, httpReq, nil)
+		require.NoError(t, err)
+
+		// the class of the query is derived from the query parsed at decode time.
+		empty, err := NewEmptyResponse(ctx, req)
+		require.NoError(t, err)
+		require.IsType(t, tc.want, empty)
+		require.Equal(t, 1, *parses)
+	}
+}
+
+func Test_parsedExpr_Tripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryParallelism: 1, maxSeries: 1000}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	_, h := promqlResult(matrix)
+	rt.setHandler(h)
+
+	lreq := &LokiRequest{
+		Query:     `rate({app="foo"} |= "foo"[1m])`,
+		Limit:     1000,
+		Step:      30000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+	// the query of the request and of its sub-queries is parsed once by the round tripper and the tripperware.
+	parses := countParses(t)
+	_, err = tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, *parses)
+}
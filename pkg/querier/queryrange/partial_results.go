@@ -0,0 +1,75 @@
+package queryrange
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+)
+
+const (
+	// partialResultsHeader is set to the number of failed sub-queries on the responses of split
+	// queries which only merge the results of the sub-queries which succeeded.
+	partialResultsHeader = "X-Loki-Partial-Results"
+
+	partialResultsWarningTmpl = "partial results: %d of %d sub-queries failed"
+)
+
+// withPartialResults marks res as only holding the results of the sub-queries which succeeded,
+// failed out of total sub-queries having failed.
+func withPartialResults(res queryrange.Response, failed, total int) queryrange.Response {
+	header := queryrange.PrometheusResponseHeader{
+		Name:   partialResultsHeader,
+		Values: []string{strconv.Itoa(failed)},
+	}
+	warning := fmt.Sprintf(partialResultsWarningTmpl, failed, total)
+	switch r := res.(type) {
+	case *LokiResponse:
+		r.Headers = append(r.Headers, header)
+		r.Warnings = append(r.Warnings, warning)
+	case *LokiPromResponse:
+		r.Response.Headers = append(r.Response.Headers, &header)
+		r.Warnings = append(r.Warnings, warning)
+	case *LokiSeriesResponse:
+		r.Headers = append(r.Headers, header)
+	case *LokiLabelNamesResponse:
+		r.Headers = append(r.Headers, header)
+	}
+	return res
+}
+
+// partialResults returns the number of failed sub-queries res is missing the results of, as set
+// by withPartialResults, or an empty string if res is complete.
+func partialResults(res queryrange.Response) string {
+	var headers []queryrange.PrometheusResponseHeader
+	switch r := res.(type) {
+	case *LokiResponse:
+		headers = r.Headers
+	case *LokiPromResponse:
+		for _, h := range r.Response.Headers {
+			if h.Name == partialResultsHeader && len(h.Values) > 0 {
+				return h.Values[0]
+			}
+		}
+	case *LokiSeriesResponse:
+		headers = r.Headers
+	case *LokiLabelNamesResponse:
+		headers = r.Headers
+	}
+	for _, h := range headers {
+		if h.Name == partialResultsHeader && len(h.Values) > 0 {
+			return h.Values[0]
+		}
+	}
+	return ""
+}
+
+// markPartialResults sets the status code of the encoded resp of res to 206 when res is partial.
+func markPartialResults(resp *http.Response, res queryrange.Response) *http.Response {
+	if failed := partialResults(res); failed != "" {
+		resp.StatusCode = http.StatusPartialContent
+		resp.Header.Set(partialResultsHeader, failed)
+	}
+	return resp
+}
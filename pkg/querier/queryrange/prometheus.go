@@ -59,6 +59,8 @@ func (p *LokiPromResponse) encode(ctx context.Context) (*http.Response, error) {
 	if sp != nil {
 		sp.LogFields(otlog.Int("bytes", len(b)))
 	}
+	// recorded once serialized for the query stats, so it can't be part of the response itself.
+	p.Statistics.Summary.ResponseBytes = int64(len(b))
 
 	resp := http.Response{
 		Header: http.Header{
@@ -90,8 +92,9 @@ func (p *LokiPromResponse) marshalVector() ([]byte, error) {
 			Result     loghttp.Vector `json:"result"`
 			Statistics stats.Result   `json:"stats,omitempty"`
 		} `json:"data,omitempty"`
-		ErrorType string `json:"errorType,omitempty"`
-		Error     string `json:"error,omitempty"`
+		ErrorType string   `json:"errorType,omitempty"`
+		Error     string   `json:"error,omitempty"`
+		Warnings  []string `json:"warnings,omitempty"`
 	}{
 		Error: p.Response.Error,
 		Data: struct {
@@ -105,6 +108,7 @@ func (p *LokiPromResponse) marshalVector() ([]byte, error) {
 		},
 		ErrorType: p.Response.ErrorType,
 		Status:    p.Response.Status,
+		Warnings:  p.Warnings,
 	})
 }
 
@@ -116,8 +120,9 @@ func (p *LokiPromResponse) marshalMatrix() ([]byte, error) {
 			queryrange.PrometheusData
 			Statistics stats.Result `json:"stats,omitempty"`
 		} `json:"data,omitempty"`
-		ErrorType string `json:"errorType,omitempty"`
-		Error     string `json:"error,omitempty"`
+		ErrorType string   `json:"errorType,omitempty"`
+		Error     string   `json:"error,omitempty"`
+		Warnings  []string `json:"warnings,omitempty"`
 	}{
 		Error: p.Response.Error,
 		Data: struct {
@@ -129,5 +134,6 @@ func (p *LokiPromResponse) marshalMatrix() ([]byte, error) {
 		},
 		ErrorType: p.Response.ErrorType,
 		Status:    p.Response.Status,
+		Warnings:  p.Warnings,
 	})
 }
@@ -0,0 +1,40 @@
+package queryrange
+
+import (
+	"github.com/grafana/loki/pkg/logql"
+)
+
+// QueryClass describes the shape of a LogQL query as seen by the query frontend.
+type QueryClass struct {
+	// Metric is true for sample queries, false for log queries.
+	Metric bool
+	// Shardable is true when the query can be executed across shards.
+	Shardable bool
+	// SplitSafe is true when the query can be split by time, i.e it doesn't contain
+	// any of the NonSplittableOps.
+	SplitSafe bool
+}
+
+// ClassifyQuery parses the query once and returns its QueryClass.
+func ClassifyQuery(query string) (QueryClass, error) {
+	expr, err := logql.ParseExpr(query)
+	if err != nil {
+		return QueryClass{}, err
+	}
+	return classifyExpr(expr), nil
+}
+
+func classifyExpr(expr logql.Expr) QueryClass {
+	_, metric := expr.(logql.SampleExpr)
+	class := QueryClass{
+		Metric:    metric,
+		Shardable: expr.Shardable(),
+		SplitSafe: true,
+	}
+	expr.Walk(func(e interface{}) {
+		if r, ok := e.(*logql.RangeAggregationExpr); ok && NonSplittableOps[r.Operation] {
+			class.SplitSafe = false
+		}
+	})
+	return class
+}
@@ -0,0 +1,32 @@
+package queryrange
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ClassifyQuery(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  QueryClass
+	}{
+		{`{app="foo"}`, QueryClass{Metric: false, Shardable: true, SplitSafe: true}},
+		{`{app="foo"} |= "bar" | logfmt | level="error"`, QueryClass{Metric: false, Shardable: true, SplitSafe: true}},
+		{`{app="foo"} | label_format foo=bar`, QueryClass{Metric: false, Shardable: false, SplitSafe: true}},
+		{`sum by (app) (rate({app="foo"} |= "bar" [1m]))`, QueryClass{Metric: true, Shardable: true, SplitSafe: true}},
+		{`count_over_time({app="foo"}[5m])`, QueryClass{Metric: true, Shardable: true, SplitSafe: true}},
+		{`topk(10, rate({app="foo"}[1m]))`, QueryClass{Metric: true, Shardable: false, SplitSafe: true}},
+		{`quantile_over_time(0.99, {app="foo"} | unwrap latency [5m]) by (app)`, QueryClass{Metric: true, Shardable: false, SplitSafe: false}},
+		{`sum(stddev_over_time({app="foo"} | unwrap latency [5m]) by (app))`, QueryClass{Metric: true, Shardable: false, SplitSafe: false}},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			got, err := ClassifyQuery(tc.query)
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+
+	_, err := ClassifyQuery(`not a query`)
+	require.Error(t, err)
+}
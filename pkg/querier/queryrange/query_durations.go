@@ -0,0 +1,90 @@
+package queryrange
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/tenant"
+)
+
+// maxQueryDurations is the number of query fingerprints whose duration is remembered.
+const maxQueryDurations = 1024
+
+// stringLiteral matches the double quoted strings of a normalized LogQL query.
+var stringLiteral = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// QueryFingerprint normalizes a query and strips its string literals, such as the values of its
+// label matchers and line filters, so that queries with the same shape share a fingerprint.
+func QueryFingerprint(query string) string {
+	if expr, err := logql.ParseExpr(query); err == nil {
+		query = expr.String()
+	}
+	return stringLiteral.ReplaceAllString(query, `""`)
+}
+
+// requestFingerprint is QueryFingerprint reusing the expression already parsed for the request.
+func requestFingerprint(ctx context.Context, r queryrange.Request) string {
+	query := r.GetQuery()
+	if expr, err := parsedExpr(ctx, r); err == nil {
+		query = expr.String()
+	}
+	return stringLiteral.ReplaceAllString(query, `""`)
+}
+
+// queryDurationKey keys the durations by tenant so that tenants never see each other's queries.
+type queryDurationKey struct {
+	tenant, fingerprint string
+}
+
+// QueryDurations remembers the duration of recent query fingerprints per tenant,
+// so that expensive queries can be told apart before they run.
+type QueryDurations struct {
+	cache *lru.Cache
+}
+
+// NewQueryDurations creates a QueryDurations remembering up to size fingerprints.
+func NewQueryDurations(size int) (*QueryDurations, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryDurations{cache: cache}, nil
+}
+
+// Observe records the duration of the request r of tenantID.
+func (d *QueryDurations) Observe(ctx context.Context, tenantID string, r queryrange.Request, duration time.Duration) {
+	d.cache.Add(queryDurationKey{tenant: tenantID, fingerprint: requestFingerprint(ctx, r)}, duration)
+}
+
+// Get returns the last recorded duration of the fingerprint of query for tenantID.
+func (d *QueryDurations) Get(tenantID, query string) (time.Duration, bool) {
+	v, ok := d.cache.Get(queryDurationKey{tenant: tenantID, fingerprint: QueryFingerprint(query)})
+	if !ok {
+		return 0, false
+	}
+	return v.(time.Duration), true
+}
+
+// NewQueryDurationsMiddleware records the wall time of the successful requests.
+// It must wrap the split and sharding middlewares so that a query is recorded once and not per sub-request.
+func NewQueryDurationsMiddleware(durations *QueryDurations) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			tenantIDs, err := tenant.TenantIDs(ctx)
+			if err != nil {
+				return next.Do(ctx, r)
+			}
+			start := time.Now()
+			res, err := next.Do(ctx, r)
+			if err == nil {
+				durations.Observe(ctx, tenant.JoinTenantIDs(tenantIDs), r, time.Since(start))
+			}
+			return res, err
+		})
+	})
+}
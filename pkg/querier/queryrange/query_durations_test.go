@@ -0,0 +1,125 @@
+package queryrange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+func Test_QueryFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		same bool
+	}{
+		{`{app="foo"} |= "error"`, `{app="bar"} |= "warn"`, true},
+		{`{app="foo"}|="error"`, `{app="bar"} |= "warn"`, true},
+		{`sum(rate({app="foo"}[5m]))`, `sum(rate({app="bar"} [5m]))`, true},
+		{`{app="foo", ns="\"quoted\""}`, `{app="bar", ns="other"}`, true},
+		{`{app="foo"} |= "error"`, `{app="foo"} != "error"`, false},
+		{`sum(rate({app="foo"}[5m]))`, `sum(rate({app="foo"}[1h]))`, false},
+		{`{app="foo"}`, `{job="foo"}`, false},
+	} {
+		t.Run(tc.a+" "+tc.b, func(t *testing.T) {
+			require.Equal(t, tc.same, QueryFingerprint(tc.a) == QueryFingerprint(tc.b), "%s\n%s", QueryFingerprint(tc.a), QueryFingerprint(tc.b))
+		})
+	}
+}
+
+func Test_QueryDurationsMiddleware(t *testing.T) {
+	durations, err := NewQueryDurations(2)
+	require.NoError(t, err)
+
+	var delay time.Duration
+	next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+		time.Sleep(delay)
+		return &LokiResponse{}, nil
+	})
+	h := NewQueryDurationsMiddleware(durations).Wrap(next)
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	_, ok := durations.Get("1", `{app="foo"}`)
+	require.False(t, ok)
+
+	delay = 20 * time.Millisecond
+	_, err = h.Do(ctx, &LokiRequest{Query: `{app="foo"}`})
+	require.NoError(t, err)
+
+	// queries with the same fingerprint share their duration.
+	d, ok := durations.Get("1", `{app="bar"}`)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, d, delay)
+
+	// but only within the same tenant.
+	_, ok = durations.Get("2", `{app="bar"}`)
+	require.False(t, ok)
+
+	// the least recently used fingerprints are evicted.
+	delay = 0
+	_, err = h.Do(ctx, &LokiRequest{Query: `{job="foo"}`})
+	require.NoError(t, err)
+	_, err = h.Do(user.InjectOrgID(context.Background(), "2"), &LokiRequest{Query: `{job="foo"}`})
+	require.NoError(t, err)
+	_, ok = durations.Get("1", `{app="foo"}`)
+	require.False(t, ok)
+	_, ok = durations.Get("2", `{job="foo"}`)
+	require.True(t, ok)
+
+	// failed requests aren't recorded.
+	failing := NewQueryDurationsMiddleware(durations).Wrap(queryrange.HandlerFunc(func(context.Context, queryrange.Request) (queryrange.Response, error) {
+		return nil, context.Canceled
+	}))
+	_, err = failing.Do(ctx, &LokiRequest{Query: `{namespace="foo"}`})
+	require.Error(t, err)
+	_, ok = durations.Get("1", `{namespace="foo"}`)
+	require.False(t, ok)
+}
+
+func TestTripperware_QueryDuration(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"} |= "foo"`,
+		Limit:     1000,
+		StartTs:   testTime.Add(-2 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+	_, h := promqlResult(streams)
+	rt.setHandler(h)
+	queryRT := tpw(rt)
+	_, err = queryRT.RoundTrip(req)
+	require.NoError(t, err)
+
+	durations, ok := queryRT.(interface {
+		QueryDuration(string, string) (time.Duration, bool)
+	})
+	require.True(t, ok)
+	_, ok = durations.QueryDuration("1", `{app="bar"} |= "bar"`)
+	require.True(t, ok)
+	_, ok = durations.QueryDuration("2", `{app="bar"} |= "bar"`)
+	require.False(t, ok)
+	_, ok = durations.QueryDuration("1", `sum(rate({app="foo"}[1m]))`)
+	require.False(t, ok)
+}
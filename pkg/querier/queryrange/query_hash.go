@@ -0,0 +1,91 @@
+package queryrange
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/prometheus/model/timestamp"
+
+	"github.com/grafana/loki/pkg/logql"
+)
+
+// queryHashBucket is the time bucket of the end of requests included in their query hash, so that the
+// refreshes of a query within the same bucket share the hash. Its sub-queries share it through queryHashBaggage.
+const queryHashBucket = 24 * time.Hour
+
+// queryHash returns a stable hash of a normalized query and the time bucket of its end, allowing to group
+// the spans of the sub-queries of a single logical query.
+func queryHash(query string, end int64) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(query))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(strconv.FormatInt(timestamp.Time(end).Truncate(queryHashBucket).Unix(), 10)))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// queryHashBaggage is the baggage item of the span of a query holding its query hash. The spans of its
+// sub-queries descend from it and are logged with the hash of the query rather than their own, which
+// would differ when the query is split across time buckets.
+const queryHashBaggage = "query_hash"
+
+// requestQueryHash returns the query hash of r.
+func requestQueryHash(ctx context.Context, r queryrange.Request) string {
+	switch r := r.(type) {
+	case *LokiSeriesRequest:
+		return queryHash(normalizedMatchers(r.GetMatch()), r.GetEnd())
+	case *LokiLabelNamesRequest:
+		return queryHash(r.GetPath(), r.GetEnd())
+	}
+	return queryHash(normalizedQuery(ctx, r), r.GetEnd())
+}
+
+// spanQueryHash returns the query hash to log r with on sp: the one of the query r is a sub-query of,
+// or the one of r if it isn't one.
+func spanQueryHash(sp opentracing.Span, r queryrange.Request) string {
+	if hash := sp.BaggageItem(queryHashBaggage); hash != "" {
+		return hash
+	}
+	if _, ok := sp.Tracer().(opentracing.NoopTracer); ok {
+		// nothing is logged on the spans when tracing is disabled, don't parse the query for them.
+		return ""
+	}
+	// the spans have no request context, the query is parsed again.
+	return requestQueryHash(context.Background(), r)
+}
+
+// normalizedQuery returns the LogQL query of r in its canonical form, or as is if it doesn't parse.
+func normalizedQuery(ctx context.Context, r queryrange.Request) string {
+	switch r.(type) {
+	case *LokiRequest, *LokiInstantRequest:
+		if expr, err := parsedExpr(ctx, r); err == nil {
+			return expr.String()
+		}
+	}
+	return r.GetQuery()
+}
+
+// normalizedMatchers returns the series matchers in their canonical form, sorted.
+func normalizedMatchers(groups []string) string {
+	normalized := make([]string, 0, len(groups))
+	for _, group := range groups {
+		matchers, err := logql.ParseMatchers(group)
+		if err != nil {
+			normalized = append(normalized, group)
+			continue
+		}
+		strs := make([]string, 0, len(matchers))
+		for _, m := range matchers {
+			strs = append(strs, m.String())
+		}
+		sort.Strings(strs)
+		normalized = append(normalized, "{"+strings.Join(strs, ",")+"}")
+	}
+	sort.Strings(normalized)
+	return strings.Join(normalized, ",")
+}
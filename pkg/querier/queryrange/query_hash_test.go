@@ -0,0 +1,51 @@
+package queryrange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_queryHash(t *testing.T) {
+	day := time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC)
+	hash := func(r *LokiRequest) string {
+		return queryHash(normalizedQuery(context.Background(), r), r.GetEnd())
+	}
+	req := &LokiRequest{
+		Query:   `sum by (app) (rate({app="foo"} |= "bar" [1m]))`,
+		StartTs: day.Add(time.Hour),
+		EndTs:   day.Add(2 * time.Hour),
+	}
+
+	// splits, shards and refreshes of the same query share the hash.
+	for _, equivalent := range []*LokiRequest{
+		{Query: `sum  by(app)(rate({app="foo"}|="bar"[1m]))`, StartTs: day.Add(time.Hour), EndTs: day.Add(2 * time.Hour)},
+		{Query: req.Query, StartTs: day.Add(2 * time.Hour), EndTs: day.Add(3 * time.Hour)},
+		{Query: req.Query, StartTs: day.Add(time.Hour), EndTs: day.Add(2 * time.Hour), Shards: []string{"0_of_16"}},
+	} {
+		require.Equal(t, hash(req), hash(equivalent), equivalent.Query)
+	}
+
+	for _, different := range []*LokiRequest{
+		{Query: `sum by (app) (rate({app="foo"} |= "baz" [1m]))`, StartTs: day.Add(time.Hour), EndTs: day.Add(2 * time.Hour)},
+		{Query: `sum by (app) (rate({app="foo"} |= "bar" [5m]))`, StartTs: day.Add(time.Hour), EndTs: day.Add(2 * time.Hour)},
+		{Query: req.Query, StartTs: day.Add(25 * time.Hour), EndTs: day.Add(26 * time.Hour)},
+	} {
+		require.NotEqual(t, hash(req), hash(different), different.Query)
+	}
+
+	// the hash is shared across request types.
+	instant := &LokiInstantRequest{Query: req.Query, TimeTs: day.Add(2 * time.Hour)}
+	require.Equal(t, hash(req), queryHash(normalizedQuery(context.Background(), instant), instant.GetEnd()))
+
+	require.Equal(t,
+		normalizedMatchers([]string{`{app="foo", job="bar"}`, `{env="prod"}`}),
+		normalizedMatchers([]string{`{env="prod"}`, `{job="bar",app="foo"}`}),
+	)
+	require.NotEqual(t,
+		normalizedMatchers([]string{`{app="foo"}`}),
+		normalizedMatchers([]string{`{app="bar"}`}),
+	)
+}
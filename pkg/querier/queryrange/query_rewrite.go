@@ -0,0 +1,72 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/weaveworks/common/httpgrpc"
+)
+
+// QueryRewriter rewrites the LogQL queries received by the frontend, e.g. to inject a label matcher of the
+// team owning the query. The label names and values requests have no query and aren't rewritten, so a
+// rewriter can't restrict the labels they return.
+type QueryRewriter interface {
+	Rewrite(ctx context.Context, query string) (string, error)
+}
+
+// QueryRewriterFunc is a function implementing QueryRewriter.
+type QueryRewriterFunc func(ctx context.Context, query string) (string, error)
+
+// Rewrite implements QueryRewriter.
+func (f QueryRewriterFunc) Rewrite(ctx context.Context, query string) (string, error) {
+	return f(ctx, query)
+}
+
+// rewriteQueries rewrites the queries of the parsed request before it is dispatched, so that the splitting,
+// sharding and caching middlewares and the queriers only ever see the rewritten queries, whichever path the
+// request takes: the query of range and instant queries and the matchers of series queries. The label names
+// and values requests have no selector and are left untouched, as are all requests when the rewriter is nil.
+func rewriteQueries(req *http.Request, rewriter QueryRewriter) error {
+	if rewriter == nil {
+		return nil
+	}
+	var params []string
+	switch getOperation(req.URL.Path) {
+	case QueryRangeOp, InstantQueryOp:
+		params = []string{"query"}
+	case SeriesOp:
+		params = []string{"match", "match[]"}
+	default:
+		return nil
+	}
+
+	form := make(url.Values, len(req.Form))
+	for key, values := range req.Form {
+		form[key] = values
+	}
+	rewritten := false
+	for _, param := range params {
+		values := form[param]
+		if len(values) == 0 {
+			continue
+		}
+		queries := make([]string, len(values))
+		for i, query := range values {
+			q, err := rewriter.Rewrite(req.Context(), query)
+			if err != nil {
+				if _, ok := httpgrpc.HTTPResponseFromError(err); ok {
+					return err
+				}
+				return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+			queries[i] = q
+			rewritten = rewritten || q != query
+		}
+		form[param] = queries
+	}
+	if rewritten {
+		setForm(req, form)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package queryrange
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+// teamRewriter injects the team matcher of the team owning the query.
+var teamRewriter = QueryRewriterFunc(func(_ context.Context, query string) (string, error) {
+	if !strings.Contains(query, `{app="foo"}`) {
+		return "", errors.New("unknown app")
+	}
+	return strings.Replace(query, `{app="foo"}`, `{app="foo", team="a"}`, 1), nil
+})
+
+func TestQueryRewriteTripperware(t *testing.T) {
+	cfg := testConfig
+	cfg.QueryRewriter = teamRewriter
+	l := fakeLimits{maxQueryParallelism: 1, maxSeries: 1000, splits: map[string]time.Duration{"1": time.Hour}}
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, l, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	_, matrixHandler := promqlResult(matrix)
+	_, streamsHandler := promqlResult(streams)
+	_, seriesHandler := seriesResult(series)
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, tc := range []struct {
+		name string
+		req  queryrange.Request
+		res  http.Handler
+	}{
+		{
+			name: "metric",
+			req: &LokiRequest{
+				Query:     `sum(rate({app="foo"}[1m]))`,
+				Limit:     1000,
+				Step:      30000,
+				StartTs:   testTime.Add(-2 * time.Hour),
+				EndTs:     testTime,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			},
+			res: matrixHandler,
+		},
+		{
+			name: "log without filter",
+			req: &LokiRequest{
+				Query:     `{app="foo"}`,
+				Limit:     1000,
+				StartTs:   testTime.Add(-2 * time.Hour),
+				EndTs:     testTime,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			},
+			res: streamsHandler,
+		},
+		{
+			name: "instant log",
+			req: &LokiInstantRequest{
+				Query:     `{app="foo"}`,
+				Limit:     1000,
+				TimeTs:    testTime,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query",
+			},
+			res: streamsHandler,
+		},
+		{
+			name: "series",
+			req: &LokiSeriesRequest{
+				Match:   []string{`{app="foo"}`},
+				StartTs: testTime.Add(-2 * time.Hour),
+				EndTs:   testTime,
+				Path:    "/loki/api/v1/series",
+			},
+			res: seriesHandler,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := LokiCodec.EncodeRequest(ctx, tc.req)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			var (
+				mtx     sync.Mutex
+				queries []string
+				keys    []string
+			)
+			rt.setHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if dreq, err := LokiCodec.DecodeRequest(r.Context(), r, nil); err == nil {
+					mtx.Lock()
+					if s, ok := dreq.(*LokiSeriesRequest); ok {
+						queries = append(queries, s.Match...)
+					} else {
+						queries = append(queries, dreq.GetQuery())
+						keys = append(keys, cacheKeyLimits{WithDefaultLimits(l, cfg.Config)}.GenerateCacheKey("1", dreq))
+					}
+					mtx.Unlock()
+				}
+				tc.res.ServeHTTP(w, r)
+			}))
+			_, err = tpw(rt).RoundTrip(req)
+			require.NoError(t, err)
+
+			require.NotEmpty(t, queries)
+			for _, query := range queries {
+				require.Contains(t, query, `{app="foo", team="a"}`)
+			}
+			// the rewritten query is the one cached.
+			for _, key := range keys {
+				require.Contains(t, key, `{app="foo", team="a"}`)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		req, err := LokiCodec.EncodeRequest(ctx, &LokiInstantRequest{
+			Query:     `{app="bar"}`,
+			Limit:     1000,
+			TimeTs:    testTime,
+			Direction: logproto.FORWARD,
+			Path:      "/loki/api/v1/query",
+		})
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+		count, h := counter()
+		rt.setHandler(h)
+		_, err = tpw(rt).RoundTrip(req)
+		resp, ok := httpgrpc.HTTPResponseFromError(err)
+		require.True(t, ok)
+		require.Equal(t, int32(http.StatusBadRequest), resp.Code)
+		require.Equal(t, 0, *count)
+	})
+}
+
+func Test_rewriteQueries(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	t.Run("query string", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="foo"}`)+"&limit=10", nil)
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		req.RequestURI = req.URL.RequestURI()
+		require.NoError(t, req.ParseForm())
+
+		require.NoError(t, rewriteQueries(req, teamRewriter))
+		require.Equal(t, `{app="foo", team="a"}`, req.Form.Get("query"))
+		require.Equal(t, `{app="foo", team="a"}`, req.URL.Query().Get("query"))
+		require.Equal(t, "10", req.URL.Query().Get("limit"))
+		require.Equal(t, req.URL.RequestURI(), req.RequestURI)
+	})
+
+	t.Run("form body", func(t *testing.T) {
+		body := url.Values{"match[]": {`{app="foo"}`}}.Encode()
+		req, err := http.NewRequest(http.MethodPost, "/loki/api/v1/series", strings.NewReader(body))
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		require.NoError(t, req.ParseForm())
+
+		require.NoError(t, rewriteQueries(req, teamRewriter))
+		require.Equal(t, `{app="foo", team="a"}`, req.Form.Get("match[]"))
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		form, err := url.ParseQuery(string(b))
+		require.NoError(t, err)
+		require.Equal(t, `{app="foo", team="a"}`, form.Get("match[]"))
+		require.Equal(t, int64(len(b)), req.ContentLength)
+	})
+
+	t.Run("labels", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		require.NoError(t, req.ParseForm())
+		require.NoError(t, rewriteQueries(req, teamRewriter))
+		require.Empty(t, req.URL.RawQuery)
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query?query="+url.QueryEscape(`{app="bar"}`), nil)
+		require.NoError(t, err)
+		require.NoError(t, req.ParseForm())
+		require.NoError(t, rewriteQueries(req, nil))
+		require.Equal(t, `{app="bar"}`, req.Form.Get("query"))
+	})
+}
@@ -0,0 +1,120 @@
+package queryrange
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/util/httpreq"
+)
+
+const (
+	errInvalidQueryTagTmpl  = "invalid query tag %q: tags must be comma separated key=value pairs with an allowed key"
+	errQueryTagsTooLongTmpl = "query tags are %d characters long, exceeding the maximum of %d"
+)
+
+// QueryTagsConfig configures the validation of the query tags of the X-Query-Tags header before they are
+// forwarded downstream and recorded in the query stats. Tags are only validated when one of the options is set.
+type QueryTagsConfig struct {
+	MaxLength     int                    `yaml:"max_length"`
+	AllowedKeys   flagext.StringSliceCSV `yaml:"allowed_keys"`
+	RejectInvalid bool                   `yaml:"reject_invalid"`
+}
+
+// RegisterFlags adds the flags required to configure this flag set.
+func (cfg *QueryTagsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxLength, "querier.query-tags-max-length", 0, "Maximum length of the query tags, longer ones are truncated to their leading tags fitting within it. 0 for no limit.")
+	f.Var(&cfg.AllowedKeys, "querier.query-tags-allowed-keys", "Comma separated list of the keys of the query tags which are kept, case insensitive. Empty to allow any key.")
+	f.BoolVar(&cfg.RejectInvalid, "querier.query-tags-reject-invalid", false, "Reject the queries with malformed, disallowed or too long query tags instead of dropping or truncating them.")
+}
+
+func (cfg QueryTagsConfig) enabled() bool {
+	return cfg.MaxLength > 0 || len(cfg.AllowedKeys) > 0 || cfg.RejectInvalid
+}
+
+// validQueryTags returns the tags which are well formed key=value pairs with an allowed key, truncated to
+// the maximum length. It fails instead of dropping or truncating tags when RejectInvalid is set.
+func (cfg QueryTagsConfig) validQueryTags(tags string) (string, error) {
+	valid := make([]string, 0, strings.Count(tags, ",")+1)
+	length := 0
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if !cfg.validQueryTag(tag) {
+			if cfg.RejectInvalid {
+				return "", httpgrpc.Errorf(http.StatusBadRequest, errInvalidQueryTagTmpl, tag)
+			}
+			continue
+		}
+		if len(valid) > 0 {
+			length++ // separator
+		}
+		length += len(tag)
+		if cfg.MaxLength > 0 && length > cfg.MaxLength {
+			if cfg.RejectInvalid {
+				return "", httpgrpc.Errorf(http.StatusBadRequest, errQueryTagsTooLongTmpl, len(tags), cfg.MaxLength)
+			}
+			break
+		}
+		valid = append(valid, tag)
+	}
+	return strings.Join(valid, ","), nil
+}
+
+func (cfg QueryTagsConfig) validQueryTag(tag string) bool {
+	parts := strings.Split(tag, "=")
+	if len(parts) != 2 {
+		return false
+	}
+	key := strings.TrimSpace(parts[0])
+	if key == "" {
+		return false
+	}
+	if len(cfg.AllowedKeys) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedKeys {
+		if strings.EqualFold(key, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryTagValue returns the value of the query tag with the given key, case insensitive, or "" when missing.
+func queryTagValue(tags, key string) string {
+	for _, tag := range strings.Split(tags, ",") {
+		parts := strings.Split(tag, "=")
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), key) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// withValidQueryTags replaces the query tags of the request context and of its header with their valid ones,
+// as requests forwarded as is downstream carry the header rather than the context.
+func withValidQueryTags(req *http.Request, cfg QueryTagsConfig) (*http.Request, error) {
+	tags := getQueryTags(req.Context())
+	if tags == "" || !cfg.enabled() {
+		return req, nil
+	}
+	valid, err := cfg.validQueryTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(context.WithValue(req.Context(), httpreq.QueryTagsHTTPHeader, valid))
+	req.Header = req.Header.Clone()
+	if valid == "" {
+		req.Header.Del(string(httpreq.QueryTagsHTTPHeader))
+	} else {
+		req.Header.Set(string(httpreq.QueryTagsHTTPHeader), valid)
+	}
+	return req, nil
+}
@@ -0,0 +1,106 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/util/httpreq"
+)
+
+func Test_QueryTagsConfig_validQueryTags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      QueryTagsConfig
+		tags     string
+		expected string
+		err      error
+	}{
+		{
+			name:     "valid",
+			cfg:      QueryTagsConfig{MaxLength: 64, AllowedKeys: []string{"source", "feature"}},
+			tags:     "Source=logvolhist,Feature=Beta",
+			expected: "Source=logvolhist,Feature=Beta",
+		},
+		{
+			name:     "malformed dropped",
+			cfg:      QueryTagsConfig{MaxLength: 64},
+			tags:     "Source=logvolhist, nokey ,=empty,a=b=c, Feature=Beta",
+			expected: "Source=logvolhist,Feature=Beta",
+		},
+		{
+			name: "malformed rejected",
+			cfg:  QueryTagsConfig{RejectInvalid: true},
+			tags: "Source=logvolhist,nokey",
+			err:  httpgrpc.Errorf(http.StatusBadRequest, errInvalidQueryTagTmpl, "nokey"),
+		},
+		{
+			name:     "disallowed dropped",
+			cfg:      QueryTagsConfig{AllowedKeys: []string{"source"}},
+			tags:     "Source=logvolhist,User=12345",
+			expected: "Source=logvolhist",
+		},
+		{
+			name: "disallowed rejected",
+			cfg:  QueryTagsConfig{AllowedKeys: []string{"source"}, RejectInvalid: true},
+			tags: "Source=logvolhist,User=12345",
+			err:  httpgrpc.Errorf(http.StatusBadRequest, errInvalidQueryTagTmpl, "User=12345"),
+		},
+		{
+			name:     "oversized truncated",
+			cfg:      QueryTagsConfig{MaxLength: 20},
+			tags:     "Source=logvolhist,Feature=Beta",
+			expected: "Source=logvolhist",
+		},
+		{
+			name: "oversized rejected",
+			cfg:  QueryTagsConfig{MaxLength: 20, RejectInvalid: true},
+			tags: "Source=logvolhist,Feature=Beta",
+			err:  httpgrpc.Errorf(http.StatusBadRequest, errQueryTagsTooLongTmpl, 30, 20),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tags, err := tc.cfg.validQueryTags(tc.tags)
+			if tc.err != nil {
+				require.Equal(t, tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, tags)
+		})
+	}
+}
+
+func Test_withValidQueryTags(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+	require.NoError(t, err)
+	req.Header.Set(string(httpreq.QueryTagsHTTPHeader), "Source=logvolhist,nokey")
+	req = req.WithContext(context.WithValue(req.Context(), httpreq.QueryTagsHTTPHeader, "Source=logvolhist,nokey"))
+
+	// tags are forwarded as is unless validated.
+	got, err := withValidQueryTags(req, QueryTagsConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "Source=logvolhist,nokey", getQueryTags(got.Context()))
+	require.Equal(t, "Source=logvolhist,nokey", got.Header.Get(string(httpreq.QueryTagsHTTPHeader)))
+
+	got, err = withValidQueryTags(req, QueryTagsConfig{MaxLength: 64})
+	require.NoError(t, err)
+	require.Equal(t, "Source=logvolhist", getQueryTags(got.Context()))
+	require.Equal(t, "Source=logvolhist", got.Header.Get(string(httpreq.QueryTagsHTTPHeader)))
+	// the caller's request is left untouched.
+	require.Equal(t, "Source=logvolhist,nokey", req.Header.Get(string(httpreq.QueryTagsHTTPHeader)))
+
+	got, err = withValidQueryTags(req, QueryTagsConfig{AllowedKeys: []string{"dashboard"}})
+	require.NoError(t, err)
+	require.Equal(t, "", getQueryTags(got.Context()))
+	require.NotContains(t, got.Header, string(httpreq.QueryTagsHTTPHeader))
+}
+
+func Test_queryTagValue(t *testing.T) {
+	require.Equal(t, "abc", queryTagValue("Source=grafana, Dashboard = abc ,Panel=1", "dashboard"))
+	require.Equal(t, "", queryTagValue("Source=grafana,nokey,Panel=1", "dashboard"))
+	require.Equal(t, "", queryTagValue("", "dashboard"))
+}
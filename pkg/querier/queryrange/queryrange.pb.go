@@ -43,6 +43,9 @@ type LokiRequest struct {
 	Direction logproto.Direction `protobuf:"varint,6,opt,name=direction,proto3,enum=logproto.Direction" json:"direction,omitempty"`
 	Path      string             `protobuf:"bytes,7,opt,name=path,proto3" json:"path,omitempty"`
 	Shards    []string           `protobuf:"bytes,8,rep,name=shards,proto3" json:"shards"`
+	// isMetricQuery is set at decode time to avoid parsing the query again.
+	IsMetricQuery  bool                      `protobuf:"varint,9,opt,name=isMetricQuery,proto3" json:"isMetricQuery,omitempty"`
+	CachingOptions queryrange.CachingOptions `protobuf:"bytes,10,opt,name=cachingOptions,proto3" json:"cachingOptions"`
 }
 
 func (m *LokiRequest) Reset()      { *m = LokiRequest{} }
@@ -133,6 +136,20 @@ func (m *LokiRequest) GetShards() []string {
 	return nil
 }
 
+func (m *LokiRequest) GetIsMetricQuery() bool {
+	if m != nil {
+		return m.IsMetricQuery
+	}
+	return false
+}
+
+func (m *LokiRequest) GetCachingOptions() queryrange.CachingOptions {
+	if m != nil {
+		return m.CachingOptions
+	}
+	return queryrange.CachingOptions{}
+}
+
 type LokiInstantRequest struct {
 	Query     string             `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
 	Limit     uint32             `protobuf:"varint,2,opt,name=limit,proto3" json:"limit,omitempty"`
@@ -226,6 +243,7 @@ type LokiResponse struct {
 	Version    uint32                                                                            `protobuf:"varint,7,opt,name=version,proto3" json:"version,omitempty"`
 	Statistics stats.Result                                                                      `protobuf:"bytes,8,opt,name=statistics,proto3" json:"statistics"`
 	Headers    []github_com_cortexproject_cortex_pkg_querier_queryrange.PrometheusResponseHeader `protobuf:"bytes,9,rep,name=Headers,proto3,customtype=github.com/cortexproject/cortex/pkg/querier/queryrange.PrometheusResponseHeader" json:"-"`
+	Warnings   []string                                                                          `protobuf:"bytes,10,rep,name=Warnings,proto3" json:"warnings,omitempty"`
 }
 
 func (m *LokiResponse) Reset()      { *m = LokiResponse{} }
@@ -316,6 +334,13 @@ func (m *LokiResponse) GetStatistics() stats.Result {
 	return stats.Result{}
 }
 
+func (m *LokiResponse) GetWarnings() []string {
+	if m != nil {
+		return m.Warnings
+	}
+	return nil
+}
+
 type LokiSeriesRequest struct {
 	Match   []string  `protobuf:"bytes,1,rep,name=match,proto3" json:"match,omitempty"`
 	StartTs time.Time `protobuf:"bytes,2,opt,name=startTs,proto3,stdtime" json:"startTs"`
@@ -452,9 +477,10 @@ func (m *LokiSeriesResponse) GetVersion() uint32 {
 }
 
 type LokiLabelNamesRequest struct {
-	StartTs time.Time `protobuf:"bytes,1,opt,name=startTs,proto3,stdtime" json:"startTs"`
-	EndTs   time.Time `protobuf:"bytes,2,opt,name=endTs,proto3,stdtime" json:"endTs"`
-	Path    string    `protobuf:"bytes,3,opt,name=path,proto3" json:"path,omitempty"`
+	StartTs    time.Time `protobuf:"bytes,1,opt,name=startTs,proto3,stdtime" json:"startTs"`
+	EndTs      time.Time `protobuf:"bytes,2,opt,name=endTs,proto3,stdtime" json:"endTs"`
+	Path       string    `protobuf:"bytes,3,opt,name=path,proto3" json:"path,omitempty"`
+	WithCounts bool      `protobuf:"varint,4,opt,name=withCounts,proto3" json:"withCounts,omitempty"`
 }
 
 func (m *LokiLabelNamesRequest) Reset()      { *m = LokiLabelNamesRequest{} }
@@ -510,11 +536,20 @@ func (m *LokiLabelNamesRequest) GetPath() string {
 	return ""
 }
 
+func (m *LokiLabelNamesRequest) GetWithCounts() bool {
+	if m != nil {
+		return m.WithCounts
+	}
+	return false
+}
+
 type LokiLabelNamesResponse struct {
 	Status  string                                                                            `protobuf:"bytes,1,opt,name=Status,proto3" json:"status"`
 	Data    []string                                                                          `protobuf:"bytes,2,rep,name=Data,proto3" json:"data,omitempty"`
 	Version uint32                                                                            `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
 	Headers []github_com_cortexproject_cortex_pkg_querier_queryrange.PrometheusResponseHeader `protobuf:"bytes,4,rep,name=Headers,proto3,customtype=github.com/cortexproject/cortex/pkg/querier/queryrange.PrometheusResponseHeader" json:"-"`
+	// Counts are the numbers of series of the label values of Data, when requested with counts.
+	Counts []uint64 `protobuf:"varint,5,rep,packed,name=Counts,proto3" json:"counts,omitempty"`
 }
 
 func (m *LokiLabelNamesResponse) Reset()      { *m = LokiLabelNamesResponse{} }
@@ -570,6 +605,13 @@ func (m *LokiLabelNamesResponse) GetVersion() uint32 {
 	return 0
 }
 
+func (m *LokiLabelNamesResponse) GetCounts() []uint64 {
+	if m != nil {
+		return m.Counts
+	}
+	return nil
+}
+
 type LokiData struct {
 	ResultType string                                        `protobuf:"bytes,1,opt,name=ResultType,proto3" json:"resultType"`
 	Result     []github_com_grafana_loki_pkg_logproto.Stream `protobuf:"bytes,2,rep,name=Result,proto3,customtype=github.com/grafana/loki/pkg/logproto.Stream" json:"result"`
@@ -618,6 +660,7 @@ func (m *LokiData) GetResultType() string {
 type LokiPromResponse struct {
 	Response   *queryrange.PrometheusResponse `protobuf:"bytes,1,opt,name=response,proto3" json:"response,omitempty"`
 	Statistics stats.Result                   `protobuf:"bytes,2,opt,name=statistics,proto3" json:"statistics"`
+	Warnings   []string                       `protobuf:"bytes,3,rep,name=warnings,proto3" json:"warnings,omitempty"`
 }
 
 func (m *LokiPromResponse) Reset()      { *m = LokiPromResponse{} }
@@ -666,6 +709,13 @@ func (m *LokiPromResponse) GetStatistics() stats.Result {
 	return stats.Result{}
 }
 
+func (m *LokiPromResponse) GetWarnings() []string {
+	if m != nil {
+		return m.Warnings
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*LokiRequest)(nil), "queryrange.LokiRequest")
 	proto.RegisterType((*LokiInstantRequest)(nil), "queryrange.LokiInstantRequest")
@@ -683,65 +733,72 @@ func init() {
 }
 
 var fileDescriptor_51b9d53b40d11902 = []byte{
-	// 913 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xdc, 0x56, 0x4f, 0x6f, 0x23, 0x35,
-	0x14, 0x8f, 0xf3, 0xb7, 0x71, 0xd9, 0x02, 0xee, 0xb2, 0x3b, 0x2a, 0xd2, 0x4c, 0x14, 0x21, 0x08,
-	0x82, 0x9d, 0x88, 0x2e, 0x5c, 0x10, 0xa0, 0xdd, 0xd1, 0xf2, 0x67, 0xa5, 0x15, 0x20, 0x6f, 0x0e,
-	0x5c, 0xdd, 0x8c, 0x3b, 0x19, 0x3a, 0x33, 0x9e, 0xda, 0x0e, 0xa2, 0x37, 0xae, 0xdc, 0xf6, 0x06,
-	0x7c, 0x02, 0x10, 0x67, 0xf8, 0x0e, 0x3d, 0xf6, 0xb8, 0x5a, 0x89, 0x81, 0xa6, 0x17, 0xc8, 0x69,
-	0x3f, 0x02, 0xb2, 0x3d, 0x93, 0xb8, 0xa8, 0x85, 0xa6, 0xbd, 0xa0, 0xbd, 0x24, 0x7e, 0xcf, 0xef,
-	0xd9, 0xef, 0xf7, 0x7b, 0x3f, 0x3f, 0x0d, 0x7c, 0x2d, 0xdf, 0x8b, 0x86, 0xfb, 0x53, 0xca, 0x63,
-	0xca, 0xf5, 0xff, 0x01, 0x27, 0x59, 0x44, 0xad, 0xa5, 0x9f, 0x73, 0x26, 0x19, 0x82, 0x4b, 0xcf,
-	0xd6, 0xad, 0x28, 0x96, 0x93, 0xe9, 0x8e, 0x3f, 0x66, 0xe9, 0x30, 0x62, 0x11, 0x1b, 0xea, 0x90,
-	0x9d, 0xe9, 0xae, 0xb6, 0xb4, 0xa1, 0x57, 0x26, 0x75, 0xeb, 0x65, 0x75, 0x47, 0xc2, 0x22, 0xb3,
-	0x51, 0x2d, 0xca, 0xcd, 0x5e, 0xb9, 0xb9, 0x9f, 0xa4, 0x2c, 0xa4, 0xc9, 0x50, 0x48, 0x22, 0x85,
-	0xf9, 0x2d, 0x23, 0x3e, 0xb6, 0x6e, 0x1b, 0x33, 0x2e, 0xe9, 0xd7, 0x39, 0x67, 0x5f, 0xd2, 0xb1,
-	0x2c, 0xad, 0xe1, 0x05, 0x21, 0x6c, 0x79, 0x11, 0x63, 0x51, 0x42, 0x97, 0xd5, 0xca, 0x38, 0xa5,
-	0x42, 0x92, 0x34, 0x37, 0x01, 0xfd, 0x5f, 0xea, 0x70, 0xfd, 0x01, 0xdb, 0x8b, 0x31, 0xdd, 0x9f,
-	0x52, 0x21, 0xd1, 0x75, 0xd8, 0xd2, 0x87, 0x38, 0xa0, 0x07, 0x06, 0x5d, 0x6c, 0x0c, 0xe5, 0x4d,
-	0xe2, 0x34, 0x96, 0x4e, 0xbd, 0x07, 0x06, 0xd7, 0xb0, 0x31, 0x10, 0x82, 0x4d, 0x21, 0x69, 0xee,
-	0x34, 0x7a, 0x60, 0xd0, 0xc0, 0x7a, 0x8d, 0x3e, 0x80, 0x1d, 0x21, 0x09, 0x97, 0x23, 0xe1, 0x34,
-	0x7b, 0x60, 0xb0, 0xbe, 0xbd, 0xe5, 0x9b, 0x12, 0xfc, 0xaa, 0x04, 0x7f, 0x54, 0x95, 0x10, 0xac,
-	0x1d, 0x16, 0x5e, 0xed, 0xd1, 0xef, 0x1e, 0xc0, 0x55, 0x12, 0x7a, 0x17, 0xb6, 0x68, 0x16, 0x8e,
-	0x84, 0xd3, 0x5a, 0x21, 0xdb, 0xa4, 0xa0, 0xb7, 0x60, 0x37, 0x8c, 0x39, 0x1d, 0xcb, 0x98, 0x65,
-	0x4e, 0xbb, 0x07, 0x06, 0x1b, 0xdb, 0x9b, 0xfe, 0x82, 0xfb, 0x7b, 0xd5, 0x16, 0x5e, 0x46, 0x29,
-	0x08, 0x39, 0x91, 0x13, 0xa7, 0xa3, 0xd1, 0xea, 0x35, 0xea, 0xc3, 0xb6, 0x98, 0x10, 0x1e, 0x0a,
-	0x67, 0xad, 0xd7, 0x18, 0x74, 0x03, 0x38, 0x2f, 0xbc, 0xd2, 0x83, 0xcb, 0xff, 0xfe, 0x5f, 0x00,
-	0x22, 0x45, 0xdb, 0xfd, 0x4c, 0x48, 0x92, 0xc9, 0xcb, 0xb0, 0xf7, 0x1e, 0x6c, 0xab, 0x66, 0x8c,
-	0x84, 0xe6, 0xef, 0xa2, 0x50, 0xcb, 0x9c, 0xd3, 0x58, 0x9b, 0x2b, 0x61, 0x6d, 0x9d, 0x89, 0xb5,
-	0x7d, 0x2e, 0xd6, 0xef, 0x9a, 0xf0, 0x39, 0x23, 0x11, 0x91, 0xb3, 0x4c, 0x50, 0x95, 0xf4, 0x50,
-	0x12, 0x39, 0x15, 0x06, 0x66, 0x99, 0xa4, 0x3d, 0xb8, 0xdc, 0x41, 0x77, 0x60, 0xf3, 0x1e, 0x91,
-	0x44, 0x43, 0x5e, 0xdf, 0xbe, 0xee, 0x5b, 0xca, 0x54, 0x67, 0xa9, 0xbd, 0xe0, 0x86, 0x42, 0x35,
-	0x2f, 0xbc, 0x8d, 0x90, 0x48, 0xf2, 0x26, 0x4b, 0x63, 0x49, 0xd3, 0x5c, 0x1e, 0x60, 0x9d, 0x89,
-	0xde, 0x81, 0xdd, 0x0f, 0x39, 0x67, 0x7c, 0x74, 0x90, 0x53, 0x4d, 0x51, 0x37, 0xb8, 0x39, 0x2f,
-	0xbc, 0x4d, 0x5a, 0x39, 0xad, 0x8c, 0x65, 0x24, 0x7a, 0x1d, 0xb6, 0xb4, 0xa1, 0x49, 0xe9, 0x06,
-	0x9b, 0xf3, 0xc2, 0x7b, 0x5e, 0xa7, 0x58, 0xe1, 0x26, 0xe2, 0x34, 0x87, 0xad, 0x0b, 0x71, 0xb8,
-	0x68, 0x65, 0xdb, 0x6e, 0xa5, 0x03, 0x3b, 0x5f, 0x51, 0x2e, 0xd4, 0x31, 0x1d, 0xed, 0xaf, 0x4c,
-	0x74, 0x17, 0x42, 0x45, 0x4c, 0x2c, 0x64, 0x3c, 0x56, 0x7a, 0x52, 0x64, 0x5c, 0xf3, 0xcd, 0x53,
-	0xc7, 0x54, 0x4c, 0x13, 0x19, 0xa0, 0x92, 0x05, 0x2b, 0x10, 0x5b, 0x6b, 0xf4, 0x3d, 0x80, 0x9d,
-	0x4f, 0x28, 0x09, 0x29, 0x17, 0x4e, 0xb7, 0xd7, 0x18, 0xac, 0x6f, 0xbf, 0x62, 0xb3, 0xf9, 0x39,
-	0x67, 0x29, 0x95, 0x13, 0x3a, 0x15, 0x55, 0x7f, 0x4c, 0x70, 0xf0, 0xc5, 0x93, 0xc2, 0xfb, 0xec,
-	0x72, 0x73, 0xe4, 0xdc, 0x43, 0xe7, 0x85, 0x07, 0x6e, 0xe1, 0xaa, 0x9c, 0xfe, 0x6f, 0x00, 0xbe,
-	0xa8, 0xba, 0xf9, 0x50, 0x1d, 0x20, 0xac, 0x47, 0x90, 0x12, 0x39, 0x9e, 0x38, 0x40, 0x49, 0x0a,
-	0x1b, 0xc3, 0x1e, 0x0c, 0xf5, 0x2b, 0x0d, 0x86, 0xc6, 0xea, 0x83, 0xa1, 0x52, 0x7e, 0xf3, 0x4c,
-	0xe5, 0xb7, 0xce, 0x55, 0xfe, 0xaf, 0x75, 0xf3, 0xca, 0x2b, 0x7c, 0x2b, 0xe8, 0xff, 0xa3, 0x85,
-	0xfe, 0x1b, 0xba, 0xda, 0x85, 0xac, 0xcc, 0x59, 0xf7, 0x43, 0x9a, 0xc9, 0x78, 0x37, 0xa6, 0xfc,
-	0x3f, 0x5e, 0x81, 0x25, 0xad, 0xc6, 0x69, 0x69, 0xd9, 0xba, 0x68, 0xfe, 0xbf, 0x74, 0xf1, 0x23,
-	0x80, 0x2f, 0x29, 0xde, 0x1e, 0x90, 0x1d, 0x9a, 0x7c, 0x4a, 0xd2, 0xa5, 0x36, 0x2c, 0x15, 0x80,
-	0x2b, 0xa9, 0xa0, 0x7e, 0x79, 0x15, 0x34, 0x96, 0x2a, 0xe8, 0xff, 0x50, 0x87, 0x37, 0xfe, 0x59,
-	0xe9, 0x0a, 0x5d, 0x7e, 0xd5, 0xea, 0x72, 0x37, 0x40, 0xcf, 0x56, 0x17, 0x7f, 0x06, 0x70, 0xad,
-	0x9a, 0xd5, 0xc8, 0x87, 0xd0, 0xcc, 0x2b, 0x3d, 0x8e, 0x0d, 0x23, 0x1b, 0x6a, 0x6a, 0xf1, 0x85,
-	0x17, 0x5b, 0x11, 0x28, 0x83, 0x6d, 0x63, 0x95, 0x2f, 0xe0, 0xa6, 0xf5, 0x02, 0x24, 0xa7, 0x24,
-	0xbd, 0x1b, 0x92, 0x5c, 0x52, 0x1e, 0xbc, 0xaf, 0xda, 0xf4, 0xa4, 0xf0, 0xde, 0xb0, 0x3f, 0xb0,
-	0x38, 0xd9, 0x25, 0x19, 0x19, 0x26, 0x6c, 0x2f, 0x1e, 0xda, 0x5f, 0x52, 0x65, 0xae, 0xea, 0x84,
-	0xb9, 0x17, 0x97, 0xb7, 0xf4, 0xbf, 0x05, 0xf0, 0x05, 0x55, 0xac, 0xc2, 0xb6, 0x68, 0xe1, 0x1d,
-	0xb8, 0xc6, 0xcb, 0x75, 0x29, 0x37, 0xf7, 0xdf, 0xc9, 0x0d, 0x9a, 0x87, 0x85, 0x07, 0xf0, 0x22,
-	0x0b, 0xdd, 0x3e, 0x35, 0xbf, 0xeb, 0x67, 0xcd, 0x6f, 0x95, 0x52, 0xb3, 0x27, 0x76, 0xf0, 0xf6,
-	0xd1, 0xb1, 0x5b, 0x7b, 0x7c, 0xec, 0xd6, 0x9e, 0x1e, 0xbb, 0xe0, 0x9b, 0x99, 0x0b, 0x7e, 0x9a,
-	0xb9, 0xe0, 0x70, 0xe6, 0x82, 0xa3, 0x99, 0x0b, 0xfe, 0x98, 0xb9, 0xe0, 0xcf, 0x99, 0x5b, 0x7b,
-	0x3a, 0x73, 0xc1, 0xa3, 0x13, 0xb7, 0x76, 0x74, 0xe2, 0xd6, 0x1e, 0x9f, 0xb8, 0xb5, 0x9d, 0xb6,
-	0x46, 0x78, 0xfb, 0xef, 0x00, 0x00, 0x00, 0xff, 0xff, 0x52, 0x92, 0xbf, 0x59, 0x9f, 0x0a, 0x00,
-	0x00,
+	// 1031 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xdc, 0x56, 0x4f, 0x6f, 0x1b, 0x45,
+	0x14, 0xf7, 0x78, 0x6d, 0xc7, 0x9e, 0xd0, 0x50, 0x26, 0x21, 0x5d, 0x19, 0x69, 0xd7, 0xb2, 0x2a,
+	0x30, 0xa2, 0xb5, 0x85, 0x0b, 0x17, 0x04, 0xa8, 0xdd, 0x16, 0x68, 0xa5, 0x42, 0x61, 0x6b, 0x09,
+	0xae, 0x93, 0xf5, 0x64, 0xbd, 0xc4, 0xfb, 0x27, 0x33, 0x63, 0x4a, 0x6e, 0x7c, 0x84, 0x1e, 0xf9,
+	0x00, 0x20, 0x21, 0xee, 0x7c, 0x86, 0x56, 0xe2, 0x92, 0x63, 0x55, 0x89, 0x85, 0x38, 0x17, 0xf0,
+	0xa9, 0x1f, 0x01, 0xcd, 0x9f, 0xb5, 0xc7, 0x55, 0x02, 0x71, 0x7a, 0x41, 0x5c, 0xec, 0x79, 0x6f,
+	0xde, 0x9b, 0x79, 0xef, 0xf7, 0x7e, 0xef, 0xcd, 0xc2, 0x37, 0xb2, 0xbd, 0xb0, 0xb7, 0x3f, 0x21,
+	0x34, 0x22, 0x54, 0xfe, 0x1f, 0x50, 0x9c, 0x84, 0xc4, 0x58, 0x76, 0x33, 0x9a, 0xf2, 0x14, 0xc1,
+	0x85, 0xa6, 0x79, 0x35, 0x8c, 0xf8, 0x68, 0xb2, 0xd3, 0x0d, 0xd2, 0xb8, 0x17, 0xa6, 0x61, 0xda,
+	0x93, 0x26, 0x3b, 0x93, 0x5d, 0x29, 0x49, 0x41, 0xae, 0x94, 0x6b, 0xf3, 0x35, 0x71, 0xc7, 0x38,
+	0x0d, 0xd5, 0x46, 0xb1, 0xd0, 0x9b, 0x2d, 0xbd, 0xb9, 0x3f, 0x8e, 0xd3, 0x21, 0x19, 0xf7, 0x18,
+	0xc7, 0x9c, 0xa9, 0x5f, 0x6d, 0xf1, 0x89, 0x71, 0x5b, 0x90, 0x52, 0x4e, 0xbe, 0xcd, 0x68, 0xfa,
+	0x35, 0x09, 0xb8, 0x96, 0x7a, 0x67, 0x4c, 0xa1, 0xe9, 0x86, 0x69, 0x1a, 0x8e, 0xc9, 0x22, 0x5a,
+	0x1e, 0xc5, 0x84, 0x71, 0x1c, 0x67, 0xca, 0xa0, 0xfd, 0x83, 0x05, 0xd7, 0xef, 0xa6, 0x7b, 0x91,
+	0x4f, 0xf6, 0x27, 0x84, 0x71, 0xb4, 0x05, 0xab, 0xf2, 0x10, 0x1b, 0xb4, 0x40, 0xa7, 0xe1, 0x2b,
+	0x41, 0x68, 0xc7, 0x51, 0x1c, 0x71, 0xbb, 0xdc, 0x02, 0x9d, 0x0b, 0xbe, 0x12, 0x10, 0x82, 0x15,
+	0xc6, 0x49, 0x66, 0x5b, 0x2d, 0xd0, 0xb1, 0x7c, 0xb9, 0x46, 0x1f, 0xc2, 0x35, 0xc6, 0x31, 0xe5,
+	0x03, 0x66, 0x57, 0x5a, 0xa0, 0xb3, 0xde, 0x6f, 0x76, 0x55, 0x08, 0xdd, 0x22, 0x84, 0xee, 0xa0,
+	0x08, 0xc1, 0xab, 0x3f, 0xce, 0xdd, 0xd2, 0xc3, 0xdf, 0x5d, 0xe0, 0x17, 0x4e, 0xe8, 0x3d, 0x58,
+	0x25, 0xc9, 0x70, 0xc0, 0xec, 0xea, 0x0a, 0xde, 0xca, 0x05, 0xbd, 0x0d, 0x1b, 0xc3, 0x88, 0x92,
+	0x80, 0x47, 0x69, 0x62, 0xd7, 0x5a, 0xa0, 0xb3, 0xd1, 0xdf, 0xec, 0xce, 0xb1, 0xbf, 0x55, 0x6c,
+	0xf9, 0x0b, 0x2b, 0x91, 0x42, 0x86, 0xf9, 0xc8, 0x5e, 0x93, 0xd9, 0xca, 0x35, 0x6a, 0xc3, 0x1a,
+	0x1b, 0x61, 0x3a, 0x64, 0x76, 0xbd, 0x65, 0x75, 0x1a, 0x1e, 0x9c, 0xe5, 0xae, 0xd6, 0xf8, 0xfa,
+	0x1f, 0x5d, 0x86, 0x17, 0x22, 0xf6, 0x29, 0xe1, 0x34, 0x0a, 0xbe, 0x90, 0x70, 0x35, 0x5a, 0xa0,
+	0x53, 0xf7, 0x97, 0x95, 0xe8, 0x36, 0xdc, 0x08, 0x70, 0x30, 0x8a, 0x92, 0xf0, 0x5e, 0x26, 0xae,
+	0x63, 0x36, 0xd4, 0x59, 0x19, 0x85, 0xba, 0xb9, 0x64, 0xe1, 0x55, 0x44, 0x56, 0xfe, 0x73, 0x7e,
+	0xed, 0xbf, 0x00, 0x44, 0xa2, 0x4c, 0x77, 0x12, 0xc6, 0x71, 0xc2, 0xcf, 0x53, 0xad, 0xf7, 0x61,
+	0x4d, 0x14, 0x7f, 0xc0, 0x6c, 0x4b, 0x07, 0x71, 0x16, 0x68, 0xb5, 0xcf, 0x32, 0xb6, 0x95, 0x95,
+	0xb0, 0xad, 0x9e, 0x88, 0x6d, 0xed, 0x34, 0x6c, 0xdb, 0xbf, 0x56, 0xe0, 0x4b, 0x8a, 0x92, 0x2c,
+	0x4b, 0x13, 0x46, 0x84, 0xd3, 0x7d, 0x8e, 0xf9, 0x84, 0xa9, 0x34, 0xb5, 0x93, 0xd4, 0xf8, 0x7a,
+	0x07, 0x5d, 0x87, 0x95, 0x5b, 0x98, 0x63, 0x99, 0xf2, 0x7a, 0x7f, 0xcb, 0x04, 0x58, 0x9c, 0x25,
+	0xf6, 0xbc, 0x6d, 0x91, 0xd5, 0x2c, 0x77, 0x37, 0x86, 0x98, 0xe3, 0x2b, 0x69, 0x1c, 0x71, 0x12,
+	0x67, 0xfc, 0xc0, 0x97, 0x9e, 0xe8, 0x5d, 0xd8, 0xf8, 0x88, 0xd2, 0x94, 0x0e, 0x0e, 0x32, 0x22,
+	0x21, 0x6a, 0x78, 0x97, 0x66, 0xb9, 0xbb, 0x49, 0x0a, 0xa5, 0xe1, 0xb1, 0xb0, 0x44, 0x6f, 0xc2,
+	0xaa, 0x14, 0x24, 0x28, 0x0d, 0x6f, 0x73, 0x96, 0xbb, 0x2f, 0x4b, 0x17, 0xc3, 0x5c, 0x59, 0x2c,
+	0x63, 0x58, 0x3d, 0x13, 0x86, 0xf3, 0x52, 0xd6, 0xcc, 0x52, 0xda, 0x70, 0xed, 0x1b, 0x42, 0x99,
+	0x38, 0x66, 0x4d, 0xea, 0x0b, 0x11, 0xdd, 0x80, 0x50, 0x00, 0x13, 0x31, 0x1e, 0x05, 0x82, 0xbf,
+	0x02, 0x8c, 0x0b, 0x5d, 0x35, 0x5a, 0x7c, 0xc2, 0x26, 0x63, 0xee, 0x21, 0x8d, 0x82, 0x61, 0xe8,
+	0x1b, 0x6b, 0xf4, 0x3d, 0x80, 0x6b, 0xb7, 0x09, 0x1e, 0x12, 0xca, 0xec, 0x46, 0xcb, 0xea, 0xac,
+	0xf7, 0x2f, 0x9b, 0x68, 0x7e, 0x4e, 0xd3, 0x98, 0xf0, 0x11, 0x99, 0xb0, 0xa2, 0x3e, 0xca, 0xd8,
+	0xfb, 0xea, 0x69, 0xee, 0xde, 0x3b, 0xdf, 0xdc, 0x3a, 0xf5, 0xd0, 0x59, 0xee, 0x82, 0xab, 0x7e,
+	0x11, 0x0e, 0xea, 0xc3, 0xfa, 0x97, 0x98, 0x26, 0x51, 0x12, 0x8a, 0x4e, 0x12, 0xfc, 0xd9, 0x9e,
+	0xe5, 0x2e, 0x7a, 0xa0, 0x75, 0x06, 0xe2, 0x73, 0xbb, 0xf6, 0x6f, 0x00, 0xbe, 0x22, 0x18, 0x70,
+	0x5f, 0x5c, 0xca, 0x8c, 0xc6, 0x89, 0x31, 0x0f, 0x46, 0x36, 0x10, 0xc7, 0xf8, 0x4a, 0x30, 0x87,
+	0x57, 0xf9, 0x85, 0x86, 0x97, 0xb5, 0xfa, 0xf0, 0x2a, 0xba, 0xa5, 0x72, 0x62, 0xb7, 0x54, 0x4f,
+	0xed, 0x96, 0x5f, 0xca, 0x10, 0x99, 0xf9, 0xad, 0xd0, 0x33, 0x1f, 0xcf, 0x7b, 0xc6, 0x92, 0xd1,
+	0xce, 0xa9, 0xa8, 0xce, 0xba, 0x33, 0x24, 0x09, 0x8f, 0x76, 0x23, 0x42, 0xff, 0xa5, 0x73, 0x0c,
+	0x3a, 0x5a, 0xcb, 0x74, 0x34, 0xb9, 0x54, 0xf9, 0x4f, 0x71, 0xa9, 0xfd, 0x08, 0xc0, 0x57, 0x05,
+	0x6e, 0x77, 0xf1, 0x0e, 0x19, 0x7f, 0x86, 0xe3, 0x05, 0x37, 0x0c, 0x16, 0x80, 0x17, 0x62, 0x41,
+	0xf9, 0xfc, 0x2c, 0xb0, 0x0c, 0x16, 0x38, 0x10, 0x3e, 0x88, 0xf8, 0xe8, 0x66, 0x3a, 0x49, 0xb8,
+	0x7a, 0x55, 0xeb, 0xbe, 0xa1, 0x69, 0x3f, 0x2a, 0xc3, 0xed, 0xe7, 0x33, 0x59, 0x81, 0x05, 0xaf,
+	0x1b, 0x2c, 0x68, 0x78, 0xe8, 0x7f, 0x55, 0x65, 0x74, 0x05, 0xd6, 0x34, 0x6e, 0xa2, 0x83, 0x2a,
+	0xde, 0xd6, 0x2c, 0x77, 0x2f, 0x06, 0x52, 0x63, 0x24, 0xa8, 0x6d, 0xda, 0x3f, 0x03, 0x58, 0x2f,
+	0x5e, 0x0b, 0xd4, 0x85, 0x50, 0x4d, 0x4c, 0xf9, 0x20, 0x28, 0xfc, 0x36, 0xc4, 0xdc, 0xa4, 0x73,
+	0xad, 0x6f, 0x58, 0xa0, 0x04, 0xd6, 0x94, 0xa4, 0xfb, 0xe9, 0x92, 0xd1, 0x4f, 0x9c, 0x12, 0x1c,
+	0xdf, 0x18, 0xe2, 0x8c, 0x13, 0xea, 0x7d, 0x20, 0x8a, 0xfe, 0x34, 0x77, 0xdf, 0x32, 0x3f, 0x29,
+	0x29, 0xde, 0xc5, 0x09, 0xee, 0x8d, 0xd3, 0xbd, 0xa8, 0x67, 0x7e, 0x3b, 0x6a, 0x5f, 0x51, 0x37,
+	0x75, 0xaf, 0xaf, 0x6f, 0x69, 0xff, 0x08, 0xe0, 0x45, 0x11, 0xac, 0x40, 0x62, 0x5e, 0xf0, 0xeb,
+	0xb0, 0x4e, 0xf5, 0x5a, 0x93, 0xd7, 0xf9, 0xe7, 0x52, 0xc8, 0xef, 0x0d, 0xe0, 0xcf, 0xbd, 0xd0,
+	0xb5, 0xa5, 0x17, 0xa4, 0x7c, 0xd2, 0x0b, 0xa2, 0x3e, 0x51, 0xcc, 0x37, 0xa3, 0x09, 0xeb, 0xc5,
+	0x10, 0xb6, 0x2d, 0x39, 0x51, 0xe7, 0xb2, 0xf7, 0xce, 0xe1, 0x91, 0x53, 0x7a, 0x72, 0xe4, 0x94,
+	0x9e, 0x1d, 0x39, 0xe0, 0xbb, 0xa9, 0x03, 0x7e, 0x9a, 0x3a, 0xe0, 0xf1, 0xd4, 0x01, 0x87, 0x53,
+	0x07, 0xfc, 0x31, 0x75, 0xc0, 0x9f, 0x53, 0xa7, 0xf4, 0x6c, 0xea, 0x80, 0x87, 0xc7, 0x4e, 0xe9,
+	0xf0, 0xd8, 0x29, 0x3d, 0x39, 0x76, 0x4a, 0x3b, 0x35, 0x99, 0xfd, 0xb5, 0xbf, 0x07, 0x00, 0x1a,
+	0x70, 0x83, 0x90, 0xad, 0x0b, 0x00, 0x00,
 }
 
 func (this *LokiRequest) Equal(that interface{}) bool {
@@ -792,6 +849,12 @@ func (this *LokiRequest) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if this.IsMetricQuery != that1.IsMetricQuery {
+		return false
+	}
+	if !this.CachingOptions.Equal(&that1.CachingOptions) {
+		return false
+	}
 	return true
 }
 func (this *LokiInstantRequest) Equal(that interface{}) bool {
@@ -889,6 +952,14 @@ func (this *LokiResponse) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if len(this.Warnings) != len(that1.Warnings) {
+		return false
+	}
+	for i := range this.Warnings {
+		if this.Warnings[i] != that1.Warnings[i] {
+			return false
+		}
+	}
 	return true
 }
 func (this *LokiSeriesRequest) Equal(that interface{}) bool {
@@ -1008,6 +1079,9 @@ func (this *LokiLabelNamesRequest) Equal(that interface{}) bool {
 	if this.Path != that1.Path {
 		return false
 	}
+	if this.WithCounts != that1.WithCounts {
+		return false
+	}
 	return true
 }
 func (this *LokiLabelNamesResponse) Equal(that interface{}) bool {
@@ -1051,6 +1125,14 @@ func (this *LokiLabelNamesResponse) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if len(this.Counts) != len(that1.Counts) {
+		return false
+	}
+	for i := range this.Counts {
+		if this.Counts[i] != that1.Counts[i] {
+			return false
+		}
+	}
 	return true
 }
 func (this *LokiData) Equal(that interface{}) bool {
@@ -1110,13 +1192,21 @@ func (this *LokiPromResponse) Equal(that interface{}) bool {
 	if !this.Statistics.Equal(&that1.Statistics) {
 		return false
 	}
+	if len(this.Warnings) != len(that1.Warnings) {
+		return false
+	}
+	for i := range this.Warnings {
+		if this.Warnings[i] != that1.Warnings[i] {
+			return false
+		}
+	}
 	return true
 }
 func (this *LokiRequest) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 12)
+	s := make([]string, 0, 14)
 	s = append(s, "&queryrange.LokiRequest{")
 	s = append(s, "Query: "+fmt.Sprintf("%#v", this.Query)+",\n")
 	s = append(s, "Limit: "+fmt.Sprintf("%#v", this.Limit)+",\n")
@@ -1126,6 +1216,8 @@ func (this *LokiRequest) GoString() string {
 	s = append(s, "Direction: "+fmt.Sprintf("%#v", this.Direction)+",\n")
 	s = append(s, "Path: "+fmt.Sprintf("%#v", this.Path)+",\n")
 	s = append(s, "Shards: "+fmt.Sprintf("%#v", this.Shards)+",\n")
+	s = append(s, "IsMetricQuery: "+fmt.Sprintf("%#v", this.IsMetricQuery)+",\n")
+	s = append(s, "CachingOptions: "+strings.Replace(this.CachingOptions.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1148,7 +1240,7 @@ func (this *LokiResponse) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 13)
+	s := make([]string, 0, 14)
 	s = append(s, "&queryrange.LokiResponse{")
 	s = append(s, "Status: "+fmt.Sprintf("%#v", this.Status)+",\n")
 	s = append(s, "Data: "+strings.Replace(this.Data.GoString(), `&`, ``, 1)+",\n")
@@ -1159,6 +1251,7 @@ func (this *LokiResponse) GoString() string {
 	s = append(s, "Version: "+fmt.Sprintf("%#v", this.Version)+",\n")
 	s = append(s, "Statistics: "+strings.Replace(this.Statistics.GoString(), `&`, ``, 1)+",\n")
 	s = append(s, "Headers: "+fmt.Sprintf("%#v", this.Headers)+",\n")
+	s = append(s, "Warnings: "+fmt.Sprintf("%#v", this.Warnings)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1199,11 +1292,12 @@ func (this *LokiLabelNamesRequest) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 7)
+	s := make([]string, 0, 8)
 	s = append(s, "&queryrange.LokiLabelNamesRequest{")
 	s = append(s, "StartTs: "+fmt.Sprintf("%#v", this.StartTs)+",\n")
 	s = append(s, "EndTs: "+fmt.Sprintf("%#v", this.EndTs)+",\n")
 	s = append(s, "Path: "+fmt.Sprintf("%#v", this.Path)+",\n")
+	s = append(s, "WithCounts: "+fmt.Sprintf("%#v", this.WithCounts)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1211,12 +1305,13 @@ func (this *LokiLabelNamesResponse) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 8)
+	s := make([]string, 0, 9)
 	s = append(s, "&queryrange.LokiLabelNamesResponse{")
 	s = append(s, "Status: "+fmt.Sprintf("%#v", this.Status)+",\n")
 	s = append(s, "Data: "+fmt.Sprintf("%#v", this.Data)+",\n")
 	s = append(s, "Version: "+fmt.Sprintf("%#v", this.Version)+",\n")
 	s = append(s, "Headers: "+fmt.Sprintf("%#v", this.Headers)+",\n")
+	s = append(s, "Counts: "+fmt.Sprintf("%#v", this.Counts)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1235,12 +1330,13 @@ func (this *LokiPromResponse) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 6)
+	s := make([]string, 0, 7)
 	s = append(s, "&queryrange.LokiPromResponse{")
 	if this.Response != nil {
 		s = append(s, "Response: "+fmt.Sprintf("%#v", this.Response)+",\n")
 	}
 	s = append(s, "Statistics: "+strings.Replace(this.Statistics.GoString(), `&`, ``, 1)+",\n")
+	s = append(s, "Warnings: "+fmt.Sprintf("%#v", this.Warnings)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -1272,6 +1368,26 @@ func (m *LokiRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	{
+		size, err := m.CachingOptions.MarshalToSizedBuffer(dAtA[:i])
+		if err != nil {
+			return 0, err
+		}
+		i -= size
+		i = encodeVarintQueryrange(dAtA, i, uint64(size))
+	}
+	i--
+	dAtA[i] = 0x52
+	if m.IsMetricQuery {
+		i--
+		if m.IsMetricQuery {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x48
+	}
 	if len(m.Shards) > 0 {
 		for iNdEx := len(m.Shards) - 1; iNdEx >= 0; iNdEx-- {
 			i -= len(m.Shards[iNdEx])
@@ -1413,6 +1529,15 @@ func (m *LokiResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Warnings) > 0 {
+		for iNdEx := len(m.Warnings) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Warnings[iNdEx])
+			copy(dAtA[i:], m.Warnings[iNdEx])
+			i = encodeVarintQueryrange(dAtA, i, uint64(len(m.Warnings[iNdEx])))
+			i--
+			dAtA[i] = 0x52
+		}
+	}
 	if len(m.Headers) > 0 {
 		for iNdEx := len(m.Headers) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -1633,6 +1758,16 @@ func (m *LokiLabelNamesRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.WithCounts {
+		i--
+		if m.WithCounts {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x20
+	}
 	if len(m.Path) > 0 {
 		i -= len(m.Path)
 		copy(dAtA[i:], m.Path)
@@ -1679,6 +1814,24 @@ func (m *LokiLabelNamesResponse) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.Counts) > 0 {
+		dAtA11 := make([]byte, len(m.Counts)*10)
+		var j10 int
+		for _, num := range m.Counts {
+			for num >= 1<<7 {
+				dAtA11[j10] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j10++
+			}
+			dAtA11[j10] = uint8(num)
+			j10++
+		}
+		i -= j10
+		copy(dAtA[i:], dAtA11[:j10])
+		i = encodeVarintQueryrange(dAtA, i, uint64(j10))
+		i--
+		dAtA[i] = 0x2a
+	}
 	if len(m.Headers) > 0 {
 		for iNdEx := len(m.Headers) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -1781,6 +1934,15 @@ func (m *LokiPromResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Warnings) > 0 {
+		for iNdEx := len(m.Warnings) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Warnings[iNdEx])
+			copy(dAtA[i:], m.Warnings[iNdEx])
+			i = encodeVarintQueryrange(dAtA, i, uint64(len(m.Warnings[iNdEx])))
+			i--
+			dAtA[i] = 0x1a
+		}
+	}
 	{
 		size, err := m.Statistics.MarshalToSizedBuffer(dAtA[:i])
 		if err != nil {
@@ -1850,6 +2012,11 @@ func (m *LokiRequest) Size() (n int) {
 			n += 1 + l + sovQueryrange(uint64(l))
 		}
 	}
+	if m.IsMetricQuery {
+		n += 2
+	}
+	l = m.CachingOptions.Size()
+	n += 1 + l + sovQueryrange(uint64(l))
 	return n
 }
 
@@ -1921,6 +2088,12 @@ func (m *LokiResponse) Size() (n int) {
 			n += 1 + l + sovQueryrange(uint64(l))
 		}
 	}
+	if len(m.Warnings) > 0 {
+		for _, s := range m.Warnings {
+			l = len(s)
+			n += 1 + l + sovQueryrange(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -1995,6 +2168,9 @@ func (m *LokiLabelNamesRequest) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovQueryrange(uint64(l))
 	}
+	if m.WithCounts {
+		n += 2
+	}
 	return n
 }
 
@@ -2023,6 +2199,13 @@ func (m *LokiLabelNamesResponse) Size() (n int) {
 			n += 1 + l + sovQueryrange(uint64(l))
 		}
 	}
+	if len(m.Counts) > 0 {
+		l = 0
+		for _, e := range m.Counts {
+			l += sovQueryrange(uint64(e))
+		}
+		n += 1 + sovQueryrange(uint64(l)) + l
+	}
 	return n
 }
 
@@ -2057,6 +2240,12 @@ func (m *LokiPromResponse) Size() (n int) {
 	}
 	l = m.Statistics.Size()
 	n += 1 + l + sovQueryrange(uint64(l))
+	if len(m.Warnings) > 0 {
+		for _, s := range m.Warnings {
+			l = len(s)
+			n += 1 + l + sovQueryrange(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -2079,6 +2268,8 @@ func (this *LokiRequest) String() string {
 		`Direction:` + fmt.Sprintf("%v", this.Direction) + `,`,
 		`Path:` + fmt.Sprintf("%v", this.Path) + `,`,
 		`Shards:` + fmt.Sprintf("%v", this.Shards) + `,`,
+		`IsMetricQuery:` + fmt.Sprintf("%v", this.IsMetricQuery) + `,`,
+		`CachingOptions:` + strings.Replace(strings.Replace(fmt.Sprintf("%v", this.CachingOptions), "CachingOptions", "queryrange.CachingOptions", 1), `&`, ``, 1) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2112,6 +2303,7 @@ func (this *LokiResponse) String() string {
 		`Version:` + fmt.Sprintf("%v", this.Version) + `,`,
 		`Statistics:` + strings.Replace(strings.Replace(fmt.Sprintf("%v", this.Statistics), "Result", "stats.Result", 1), `&`, ``, 1) + `,`,
 		`Headers:` + fmt.Sprintf("%v", this.Headers) + `,`,
+		`Warnings:` + fmt.Sprintf("%v", this.Warnings) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2156,6 +2348,7 @@ func (this *LokiLabelNamesRequest) String() string {
 		`StartTs:` + strings.Replace(strings.Replace(fmt.Sprintf("%v", this.StartTs), "Timestamp", "types.Timestamp", 1), `&`, ``, 1) + `,`,
 		`EndTs:` + strings.Replace(strings.Replace(fmt.Sprintf("%v", this.EndTs), "Timestamp", "types.Timestamp", 1), `&`, ``, 1) + `,`,
 		`Path:` + fmt.Sprintf("%v", this.Path) + `,`,
+		`WithCounts:` + fmt.Sprintf("%v", this.WithCounts) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2169,6 +2362,7 @@ func (this *LokiLabelNamesResponse) String() string {
 		`Data:` + fmt.Sprintf("%v", this.Data) + `,`,
 		`Version:` + fmt.Sprintf("%v", this.Version) + `,`,
 		`Headers:` + fmt.Sprintf("%v", this.Headers) + `,`,
+		`Counts:` + fmt.Sprintf("%v", this.Counts) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2191,6 +2385,7 @@ func (this *LokiPromResponse) String() string {
 	s := strings.Join([]string{`&LokiPromResponse{`,
 		`Response:` + strings.Replace(fmt.Sprintf("%v", this.Response), "PrometheusResponse", "queryrange.PrometheusResponse", 1) + `,`,
 		`Statistics:` + strings.Replace(strings.Replace(fmt.Sprintf("%v", this.Statistics), "Result", "stats.Result", 1), `&`, ``, 1) + `,`,
+		`Warnings:` + fmt.Sprintf("%v", this.Warnings) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -2451,6 +2646,59 @@ func (m *LokiRequest) Unmarshal(dAtA []byte) error {
 			}
 			m.Shards = append(m.Shards, string(dAtA[iNdEx:postIndex]))
 			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field IsMetricQuery", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowQueryrange
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.IsMetricQuery = bool(v != 0)
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CachingOptions", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowQueryrange
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if err := m.CachingOptions.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipQueryrange(dAtA[iNdEx:])
@@ -2977,6 +3225,38 @@ func (m *LokiResponse) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Warnings", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowQueryrange
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Warnings = append(m.Warnings, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipQueryrange(dAtA[iNdEx:])
@@ -3515,6 +3795,26 @@ func (m *LokiLabelNamesRequest) Unmarshal(dAtA []byte) error {
 			}
 			m.Path = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field WithCounts", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowQueryrange
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.WithCounts = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipQueryrange(dAtA[iNdEx:])
@@ -3685,6 +3985,82 @@ func (m *LokiLabelNamesResponse) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType == 0 {
+				var v uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowQueryrange
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= uint64(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.Counts = append(m.Counts, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowQueryrange
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthQueryrange
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthQueryrange
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				var count int
+				for _, integer := range dAtA[iNdEx:postIndex] {
+					if integer < 128 {
+						count++
+					}
+				}
+				elementCount = count
+				if elementCount != 0 && len(m.Counts) == 0 {
+					m.Counts = make([]uint64, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowQueryrange
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.Counts = append(m.Counts, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field Counts", wireType)
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipQueryrange(dAtA[iNdEx:])
@@ -3926,6 +4302,38 @@ func (m *LokiPromResponse) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Warnings", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowQueryrange
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthQueryrange
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Warnings = append(m.Warnings, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipQueryrange(dAtA[iNdEx:])
@@ -11,6 +11,8 @@ import (
 	util_log "github.com/cortexproject/cortex/pkg/util/log"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/weaveworks/common/httpgrpc"
@@ -26,6 +28,11 @@ import (
 
 var errInvalidShardingRange = errors.New("Query does not fit in a single sharding configuration")
 
+const (
+	missingShardsTmpl      = "missing the responses of %d of %d shards"
+	inconsistentShardsTmpl = "inconsistent shard factors %d and %d of a sharded query"
+)
+
 // NewQueryShardMiddleware creates a middleware which downstreams queries after AST mapping and query encoding.
 func NewQueryShardMiddleware(
 	logger log.Logger,
@@ -57,8 +64,9 @@ func NewQueryShardMiddleware(
 				queryrange.InstrumentMiddleware("shardingware", middlewareMetrics),
 				mapperware,
 			).Wrap(next),
-			now:  time.Now,
-			next: queryrange.InstrumentMiddleware("sharding-bypass", middlewareMetrics).Wrap(next),
+			now:    time.Now,
+			next:   queryrange.InstrumentMiddleware("sharding-bypass", middlewareMetrics).Wrap(next),
+			logger: logger,
 		}
 	})
 }
@@ -97,7 +105,12 @@ func (ast *astMapperware) Do(ctx context.Context, r queryrange.Request) (queryra
 		return ast.next.Do(ctx, r)
 	}
 
-	mapper, err := logql.NewShardMapper(int(conf.RowShards), ast.metrics)
+	factor := shardFactor(ctx, conf.RowShards)
+	if factor < 2 {
+		return ast.next.Do(ctx, r)
+	}
+
+	mapper, err := logql.NewShardMapper(factor, ast.metrics)
 	if err != nil {
 		return nil, err
 	}
@@ -189,23 +202,61 @@ type shardSplitter struct {
 	shardingware queryrange.Handler // handler for sharded queries
 	next         queryrange.Handler // handler for non-sharded queries
 	now          func() time.Time   // injectable time.Now
+	logger       log.Logger
 }
 
+// The reasons for which the shardSplitter sends requests to the sharding handler or not, logged on their span.
+const (
+	shardingReasonDisabled       = "sharding disabled for the tenant"
+	shardingReasonNoLookback     = "no min sharding lookback"
+	shardingReasonBeyondLookback = "beyond min sharding lookback"
+	shardingReasonWithinLookback = "within min sharding lookback"
+)
+
 func (splitter *shardSplitter) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
 	userid, err := tenant.TenantID(ctx)
 	if err != nil {
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
+	sharded, reason := splitter.route(ctx, userid, r)
+	logSharding(ctx, sharded, reason)
+	if sharded {
+		return splitter.shardingware.Do(ctx, r)
+	}
+	return splitter.next.Do(ctx, r)
+}
+
+// route returns whether the request of the tenant is sent to the sharding handler, and why.
+func (splitter *shardSplitter) route(ctx context.Context, userid string, r queryrange.Request) (bool, string) {
+	if !splitter.limits.ShardingEnabled(userid) {
+		return false, shardingReasonDisabled
+	}
+	if shards, ok := shardsOverride(ctx); ok && shards < 2 {
+		return false, shardingReasonOverride
+	}
 	minShardingLookback := splitter.limits.MinShardingLookback(userid)
 	if minShardingLookback == 0 {
-		return splitter.shardingware.Do(ctx, r)
+		return true, shardingReasonNoLookback
 	}
 	cutoff := splitter.now().Add(-minShardingLookback)
 	// Only attempt to shard queries which are older than the sharding lookback (the period for which ingesters are also queried).
 	if !cutoff.After(util.TimeFromMillis(r.GetEnd())) {
-		return splitter.next.Do(ctx, r)
+		level.Debug(util_log.WithContext(ctx, splitter.logger)).Log(
+			"msg", "skipped sharding for request ending within the min sharding lookback",
+			"end", util.FormatTimeMillis(r.GetEnd()),
+			"cutoff", cutoff,
+			"min_sharding_lookback", minShardingLookback,
+		)
+		return false, shardingReasonWithinLookback
+	}
+	return true, shardingReasonBeyondLookback
+}
+
+// logSharding logs on the span of ctx whether its request is sent to the sharding handler, and why.
+func logSharding(ctx context.Context, sharded bool, reason string) {
+	if sp := opentracing.SpanFromContext(ctx); sp != nil {
+		sp.LogFields(otlog.Bool("sharded", sharded), otlog.String("sharding_reason", reason))
 	}
-	return splitter.shardingware.Do(ctx, r)
 }
 
 func hasShards(confs ShardingConfigs) bool {
@@ -264,6 +315,7 @@ func NewSeriesQueryShardMiddleware(
 	shardingMetrics *logql.ShardingMetrics,
 	limits queryrange.Limits,
 	merger queryrange.Merger,
+	failOnMissingShards bool,
 ) queryrange.Middleware {
 
 	noshards := !hasShards(confs)
@@ -285,6 +337,7 @@ func NewSeriesQueryShardMiddleware(
 				metrics: shardingMetrics,
 				limits:  limits,
 				merger:  merger,
+				strict:  failOnMissingShards,
 			},
 		)
 	})
@@ -297,6 +350,7 @@ type seriesShardingHandler struct {
 	metrics *logql.ShardingMetrics
 	limits  queryrange.Limits
 	merger  queryrange.Merger
+	strict  bool // fail on missing shards instead of warning
 }
 
 func (ss *seriesShardingHandler) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
@@ -307,7 +361,8 @@ func (ss *seriesShardingHandler) Do(ctx context.Context, r queryrange.Request) (
 		return ss.next.Do(ctx, r)
 	}
 
-	if conf.RowShards <= 1 {
+	factor := shardFactor(ctx, conf.RowShards)
+	if factor <= 1 {
 		return ss.next.Do(ctx, r)
 	}
 
@@ -317,24 +372,95 @@ func (ss *seriesShardingHandler) Do(ctx context.Context, r queryrange.Request) (
 	}
 
 	ss.metrics.Shards.WithLabelValues("series").Inc()
-	ss.metrics.ShardFactor.Observe(float64(conf.RowShards))
-
-	requests := make([]queryrange.Request, 0, conf.RowShards)
-	for i := 0; i < int(conf.RowShards); i++ {
-		shardedRequest := *req
-		shardedRequest.Shards = []string{astmapper.ShardAnnotation{
+	ss.metrics.ShardFactor.Observe(float64(factor))
+
+	// the sharded requests are allocated at once and share the matchers of req.
+	var (
+		shardedRequests = make([]LokiSeriesRequest, factor)
+		requests        = make([]queryrange.Request, 0, factor)
+	)
+	for i := range shardedRequests {
+		shardedRequests[i] = *req
+		shardedRequests[i].Shards = []string{astmapper.ShardAnnotation{
 			Shard: i,
-			Of:    int(conf.RowShards),
+			Of:    factor,
 		}.String()}
-		requests = append(requests, &shardedRequest)
+		requests = append(requests, &shardedRequests[i])
 	}
 	requestResponses, err := queryrange.DoRequests(ctx, ss.next, requests, ss.limits)
 	if err != nil {
 		return nil, err
 	}
+	return mergeShardResponses(util_log.WithContext(ctx, ss.logger), ss.merger, r, ss.strict, requestResponses)
+}
+
+// mergeShardResponses merges the responses of the shards r was split into, after checking that they cover
+// all of them: a missing shard would silently undercount the merged results. Missing shards fail the merge
+// when strict, and are otherwise logged and reported as a warning on the responses carrying warnings.
+func mergeShardResponses(logger log.Logger, merger queryrange.Merger, r queryrange.Request, strict bool, requestResponses []queryrange.RequestResponse) (queryrange.Response, error) {
+	missing, total, err := shardCoverage(requestResponses)
+	if err != nil {
+		return nil, err
+	}
 	responses := make([]queryrange.Response, 0, len(requestResponses))
 	for _, res := range requestResponses {
-		responses = append(responses, res.Response)
+		if res.Response != nil {
+			responses = append(responses, res.Response)
+		}
+	}
+	if missing <= 0 {
+		return mergeRequestResponses(merger, r, responses...)
+	}
+
+	if strict || len(responses) == 0 {
+		return nil, httpgrpc.Errorf(http.StatusInternalServerError, missingShardsTmpl, missing, total)
+	}
+	level.Warn(logger).Log("msg", "merging incomplete sharded query", "missing", missing, "shards", total)
+	res, err := mergeRequestResponses(merger, r, responses...)
+	if err != nil {
+		return nil, err
+	}
+	warning := fmt.Sprintf(missingShardsTmpl, missing, total)
+	switch res := res.(type) {
+	case *LokiResponse:
+		res.Warnings = append(res.Warnings, warning)
+	case *LokiPromResponse:
+		res.Warnings = append(res.Warnings, warning)
+	}
+	return res, nil
+}
+
+// shardCoverage returns how many of the shards of the sharded requests have no response, and the number of
+// shards they were split into. It fails when the requests don't agree on the number of shards.
+func shardCoverage(requestResponses []queryrange.RequestResponse) (missing, total int, err error) {
+	covered := make(map[int]struct{}, len(requestResponses))
+	for _, res := range requestResponses {
+		shards, err := logql.ParseShards(requestShards(res.Request))
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, shard := range shards {
+			if total != 0 && shard.Of != total {
+				return 0, 0, httpgrpc.Errorf(http.StatusInternalServerError, inconsistentShardsTmpl, total, shard.Of)
+			}
+			total = shard.Of
+			if res.Response != nil {
+				covered[shard.Shard] = struct{}{}
+			}
+		}
+	}
+	return total - len(covered), total, nil
+}
+
+// requestShards returns the encoded shards of r.
+func requestShards(r queryrange.Request) []string {
+	switch r := r.(type) {
+	case *LokiRequest:
+		return r.Shards
+	case *LokiInstantRequest:
+		return r.Shards
+	case *LokiSeriesRequest:
+		return r.Shards
 	}
-	return ss.merger.MergeResponse(responses...)
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net/http"
 	"sort"
 	"sync"
 	"testing"
@@ -14,7 +15,11 @@ import (
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/cortexproject/cortex/pkg/util"
 	"github.com/go-kit/log"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/stretchr/testify/require"
+	"github.com/uber/jaeger-client-go"
+	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
 
 	"github.com/grafana/loki/pkg/loghttp"
@@ -83,30 +88,47 @@ func Test_shardSplitter(t *testing.T) {
 	for _, tc := range []struct {
 		desc        string
 		lookback    time.Duration
+		disabled    bool
 		shouldShard bool
+		reason      string
 	}{
 		{
 			desc:        "older than lookback",
 			lookback:    -time.Minute, // a negative lookback will ensure the entire query doesn't cross the sharding boundary & can safely be sharded.
 			shouldShard: true,
+			reason:      shardingReasonBeyondLookback,
 		},
 		{
 			desc:        "overlaps lookback",
 			lookback:    end.Sub(start) / 2, // intersect the request causing it to avoid sharding
 			shouldShard: false,
+			reason:      shardingReasonWithinLookback,
 		},
 		{
 			desc:        "newer than lookback",
 			lookback:    end.Sub(start) + 1, // the entire query is in the ingester range and should avoid sharding.
 			shouldShard: false,
+			reason:      shardingReasonWithinLookback,
 		},
 		{
 			desc:        "default",
 			lookback:    0,
 			shouldShard: true,
+			reason:      shardingReasonNoLookback,
+		},
+		{
+			desc:        "disabled for the tenant",
+			lookback:    -time.Minute,
+			disabled:    true,
+			shouldShard: false,
+			reason:      shardingReasonDisabled,
 		},
 	} {
 		t.Run(tc.desc, func(t *testing.T) {
+			reporter := jaeger.NewInMemoryReporter()
+			tr, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), reporter)
+			defer closer.Close()
+
 			var didShard bool
 			splitter := &shardSplitter{
 				shardingware: queryrange.HandlerFunc(func(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
@@ -117,11 +139,16 @@ func Test_shardSplitter(t *testing.T) {
 				now:  func() time.Time { return end },
 				limits: fakeLimits{
 					minShardingLookback: tc.lookback,
+					shardingDisabled:    tc.disabled,
 				},
+				logger: log.NewNopLogger(),
 			}
 
-			resp, err := splitter.Do(user.InjectOrgID(context.Background(), "1"), req)
+			sp := tr.StartSpan("sharding")
+			ctx := opentracing.ContextWithSpan(user.InjectOrgID(context.Background(), "1"), sp)
+			resp, err := splitter.Do(ctx, req)
 			require.Nil(t, err)
+			sp.Finish()
 
 			require.Equal(t, tc.shouldShard, didShard)
 			require.Nil(t, err)
@@ -131,6 +158,12 @@ func Test_shardSplitter(t *testing.T) {
 			} else {
 				require.Equal(t, lokiResps[1], resp)
 			}
+
+			spans := reporter.GetSpans()
+			require.Len(t, spans, 1)
+			logs := spans[0].(*jaeger.Span).Logs()
+			require.Len(t, logs, 1)
+			require.Equal(t, []otlog.Field{otlog.Bool("sharded", tc.shouldShard), otlog.String("sharding_reason", tc.reason)}, logs[0].Fields)
 		})
 	}
 }
@@ -303,6 +336,128 @@ func Test_InstantSharding(t *testing.T) {
 	require.Equal(t, loghttp.QueryStatusSuccess, response.(*LokiPromResponse).Response.Status)
 }
 
+func Test_InstantSharding_SumBy(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	sharding := NewQueryShardMiddleware(log.NewNopLogger(), ShardingConfigs{
+		chunk.PeriodConfig{
+			RowShards: 3,
+		},
+	}, queryrange.NewInstrumentMiddlewareMetrics(nil),
+		nilShardingMetrics,
+		fakeLimits{
+			maxSeries:           math.MaxInt32,
+			maxQueryParallelism: 10,
+		})
+	// each shard holds a part of the samples of x="a", only the first one holds x="b".
+	response, err := sharding.Wrap(queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+		result := []queryrange.SampleStream{{
+			Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "a"}},
+			Samples: []cortexpb.Sample{{Value: 1, TimestampMs: 10}},
+		}}
+		if r.(*LokiInstantRequest).Shards[0] == "0_of_3" {
+			result = append(result, queryrange.SampleStream{
+				Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "b"}},
+				Samples: []cortexpb.Sample{{Value: 5, TimestampMs: 10}},
+			})
+		}
+		return &LokiPromResponse{Response: &queryrange.PrometheusResponse{
+			Status: loghttp.QueryStatusSuccess,
+			Data: queryrange.PrometheusData{
+				ResultType: loghttp.ResultTypeVector,
+				Result:     result,
+			},
+		}}, nil
+	})).Do(ctx, &LokiInstantRequest{
+		Query:  `sum by (x) (rate({app="foo"}[1m]))`,
+		TimeTs: util.TimeFromMillis(10),
+		Path:   "/v1/query",
+	})
+	require.NoError(t, err)
+	// the series of the shards are summed by labels instead of being concatenated.
+	require.Equal(t, queryrange.PrometheusData{
+		ResultType: loghttp.ResultTypeVector,
+		Result: []queryrange.SampleStream{
+			{
+				Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "a"}},
+				Samples: []cortexpb.Sample{{Value: 3, TimestampMs: 10}},
+			},
+			{
+				Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "b"}},
+				Samples: []cortexpb.Sample{{Value: 5, TimestampMs: 10}},
+			},
+		},
+	}, response.(*LokiPromResponse).Response.Data)
+}
+
+func Test_InstantSharding_MissingShards(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	sharding := NewQueryShardMiddleware(log.NewNopLogger(), ShardingConfigs{
+		chunk.PeriodConfig{
+			RowShards: 3,
+		},
+	}, queryrange.NewInstrumentMiddlewareMetrics(nil),
+		nilShardingMetrics,
+		fakeLimits{
+			maxSeries:           math.MaxInt32,
+			maxQueryParallelism: 10,
+		})
+	// drops the response of the second shard.
+	_, err := sharding.Wrap(queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+		if r.(*LokiInstantRequest).Shards[0] == "1_of_3" {
+			return nil, nil
+		}
+		return &LokiPromResponse{Response: &queryrange.PrometheusResponse{
+			Status: loghttp.QueryStatusSuccess,
+			Data: queryrange.PrometheusData{
+				ResultType: loghttp.ResultTypeVector,
+				Result: []queryrange.SampleStream{{
+					Labels:  []cortexpb.LabelAdapter{{Name: "x", Value: "a"}},
+					Samples: []cortexpb.Sample{{Value: 1, TimestampMs: 10}},
+				}},
+			},
+		}}, nil
+	})).Do(ctx, &LokiInstantRequest{
+		Query:  `sum by (x) (rate({app="foo"}[1m]))`,
+		TimeTs: util.TimeFromMillis(10),
+		Path:   "/v1/query",
+	})
+	require.Equal(t, httpgrpc.Errorf(http.StatusInternalServerError, missingShardsTmpl, 1, 3), err)
+}
+
+func Test_InstantSharding_DisabledForTenant(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	sharding := NewQueryShardMiddleware(log.NewNopLogger(), ShardingConfigs{
+		chunk.PeriodConfig{
+			RowShards: 3,
+		},
+	}, queryrange.NewInstrumentMiddlewareMetrics(nil),
+		nilShardingMetrics,
+		fakeLimits{
+			maxSeries:           math.MaxInt32,
+			maxQueryParallelism: 10,
+			shardingDisabled:    true,
+		})
+	var reqs []*LokiInstantRequest
+	_, err := sharding.Wrap(queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+		reqs = append(reqs, r.(*LokiInstantRequest))
+		return &LokiPromResponse{Response: &queryrange.PrometheusResponse{
+			Data: queryrange.PrometheusData{ResultType: loghttp.ResultTypeVector},
+		}}, nil
+	})).Do(ctx, &LokiInstantRequest{
+		Query:  `rate({app="foo"}[1m])`,
+		TimeTs: util.TimeFromMillis(10),
+		Path:   "/v1/query",
+	})
+	require.NoError(t, err)
+	// the query is sent downstream as is rather than split into shards.
+	require.Len(t, reqs, 1)
+	require.Empty(t, reqs[0].Shards)
+	require.Equal(t, `rate({app="foo"}[1m])`, reqs[0].Query)
+}
+
 func Test_SeriesShardingHandler(t *testing.T) {
 	sharding := NewSeriesQueryShardMiddleware(log.NewNopLogger(), ShardingConfigs{
 		chunk.PeriodConfig{
@@ -315,6 +470,7 @@ func Test_SeriesShardingHandler(t *testing.T) {
 			maxQueryParallelism: 10,
 		},
 		LokiCodec,
+		false,
 	)
 	ctx := user.InjectOrgID(context.Background(), "1")
 
@@ -382,3 +538,76 @@ func Test_SeriesShardingHandler(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected, actual)
 }
+
+func Test_SeriesShardingHandler_MissingShards(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	// drops the response of the second shard.
+	next := queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+		req := r.(*LokiSeriesRequest)
+		if req.Shards[0] == "1_of_3" {
+			return nil, nil
+		}
+		return &LokiSeriesResponse{
+			Status:  "success",
+			Version: 1,
+			Data:    []logproto.SeriesIdentifier{{Labels: map[string]string{"shard": req.Shards[0]}}},
+		}, nil
+	})
+	req := &LokiSeriesRequest{
+		Match:   []string{`{foo="bar"}`},
+		StartTs: time.Unix(0, 1),
+		EndTs:   time.Unix(0, 10),
+		Path:    "/loki/api/v1/series",
+	}
+
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			sharding := NewSeriesQueryShardMiddleware(log.NewNopLogger(), ShardingConfigs{
+				chunk.PeriodConfig{RowShards: 3},
+			},
+				queryrange.NewInstrumentMiddlewareMetrics(nil),
+				nilShardingMetrics,
+				fakeLimits{maxQueryParallelism: 10},
+				LokiCodec,
+				strict,
+			)
+			res, err := sharding.Wrap(next).Do(ctx, req)
+			if strict {
+				require.Equal(t, httpgrpc.Errorf(http.StatusInternalServerError, missingShardsTmpl, 1, 3), err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, res.(*LokiSeriesResponse).Data, 2)
+		})
+	}
+}
+
+func Test_mergeShardResponses(t *testing.T) {
+	shard := func(i int) queryrange.RequestResponse {
+		return queryrange.RequestResponse{
+			Request: &LokiRequest{Query: `sum(rate({app="foo"}[1m]))`, Shards: []string{fmt.Sprintf("%d_of_3", i)}},
+			Response: &LokiPromResponse{Response: &queryrange.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data:   queryrange.PrometheusData{ResultType: loghttp.ResultTypeMatrix},
+			}},
+		}
+	}
+	r := &LokiRequest{Query: `sum(rate({app="foo"}[1m]))`}
+
+	res, err := mergeShardResponses(log.NewNopLogger(), LokiCodec, r, false, []queryrange.RequestResponse{shard(0), shard(1), shard(2)})
+	require.NoError(t, err)
+	require.Empty(t, res.(*LokiPromResponse).Warnings)
+
+	res, err = mergeShardResponses(log.NewNopLogger(), LokiCodec, r, false, []queryrange.RequestResponse{shard(0), shard(2)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"missing the responses of 1 of 3 shards"}, res.(*LokiPromResponse).Warnings)
+
+	_, err = mergeShardResponses(log.NewNopLogger(), LokiCodec, r, true, []queryrange.RequestResponse{shard(0), shard(2)})
+	require.Error(t, err)
+
+	// the shards must agree on the shard factor.
+	other := shard(1)
+	other.Request = &LokiRequest{Query: `sum(rate({app="foo"}[1m]))`, Shards: []string{"1_of_4"}}
+	_, err = mergeShardResponses(log.NewNopLogger(), LokiCodec, r, false, []queryrange.RequestResponse{shard(0), other, shard(2)})
+	require.Equal(t, httpgrpc.Errorf(http.StatusInternalServerError, inconsistentShardsTmpl, 3, 4), err)
+}
@@ -0,0 +1,39 @@
+package queryrange
+
+import (
+	"context"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"go.uber.org/atomic"
+)
+
+const recomputedCtxKey ctxKeyType = "recomputed"
+
+// withCacheStats wraps the results cache middleware to count the splits of metric queries going through it,
+// and those entirely served from the cache, in the statistics of their responses. The counts are summed when
+// the responses of the splits are merged, telling how many of the splits of a query were cache hits.
+func withCacheStats(cacheMiddleware queryrange.Middleware) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		// the results cache only calls the next handler for the parts of a split missing from the cache.
+		cached := cacheMiddleware.Wrap(queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			if recomputed, ok := ctx.Value(recomputedCtxKey).(*atomic.Bool); ok {
+				recomputed.Store(true)
+			}
+			return next.Do(ctx, r)
+		}))
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			recomputed := atomic.NewBool(false)
+			res, err := cached.Do(context.WithValue(ctx, recomputedCtxKey, recomputed), r)
+			if err != nil {
+				return nil, err
+			}
+			if res, ok := res.(*LokiPromResponse); ok {
+				res.Statistics.Summary.TotalSplits = 1
+				if !recomputed.Load() {
+					res.Statistics.Summary.CachedSplits = 1
+				}
+			}
+			return res, nil
+		})
+	})
+}
@@ -0,0 +1,79 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	cortexcache "github.com/cortexproject/cortex/pkg/chunk/cache"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/cortexproject/cortex/pkg/util/validation"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/storage/chunk/cache"
+	"github.com/grafana/loki/pkg/tenant"
+)
+
+const resultsCacheTTLCtxKey ctxKeyType = "resultsCacheTTL"
+
+// NewResultsCacheTTLMiddleware injects the results cache time to live of the tenants of requests in their
+// context, for the results cache to store their entries with it. It must come before the results cache.
+func NewResultsCacheTTLMiddleware(limits Limits) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+			tenantIDs, err := tenant.TenantIDs(ctx)
+			if err != nil {
+				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+			}
+			if ttl := validation.SmallestPositiveNonZeroDurationPerTenant(tenantIDs, limits.ResultsCacheTTL); ttl > 0 {
+				ctx = context.WithValue(ctx, resultsCacheTTLCtxKey, ttl)
+			}
+			return next.Do(ctx, r)
+		})
+	})
+}
+
+// ttlCache stores the entries with the time to live found in the context as the expiration of the fifo,
+// memcached and redis caches it wraps. Entries without it expire with the expiration of the wrapped cache.
+type ttlCache struct {
+	cache.Cache
+}
+
+func (c ttlCache) Store(ctx context.Context, keys []string, bufs [][]byte) {
+	if ttl, ok := ctx.Value(resultsCacheTTLCtxKey).(time.Duration); ok {
+		ctx = cache.WithExpiration(ctx, ttl)
+	}
+	c.Cache.Store(ctx, keys, bufs)
+}
+
+// withTTLCache returns cfg with the cache it configures wrapped by a ttlCache, for the results cache
+// middleware to use it. The cache is built by the Loki cache package whose stores honor the expiration
+// of the context, from the same config.
+func withTTLCache(cfg queryrange.ResultsCacheConfig, reg prometheus.Registerer, logger log.Logger) (queryrange.ResultsCacheConfig, error) {
+	if cfg.CacheConfig.Cache != nil {
+		cfg.CacheConfig.Cache = ttlCache{cfg.CacheConfig.Cache}
+		return cfg, nil
+	}
+	c, err := cache.New(lokiCacheConfig(cfg.CacheConfig), reg, logger)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CacheConfig.Cache = ttlCache{c}
+	return cfg, nil
+}
+
+// lokiCacheConfig converts the Cortex cache config of the results cache to the Loki one.
+func lokiCacheConfig(cfg cortexcache.Config) cache.Config {
+	return cache.Config{
+		EnableFifoCache: cfg.EnableFifoCache,
+		DefaultValidity: cfg.DefaultValidity,
+		Background:      cache.BackgroundConfig(cfg.Background),
+		Memcache:        cache.MemcachedConfig(cfg.Memcache),
+		MemcacheClient:  cache.MemcachedClientConfig(cfg.MemcacheClient),
+		Redis:           cache.RedisConfig(cfg.Redis),
+		Fifocache:       cache.FifoCacheConfig(cfg.Fifocache),
+		Prefix:          cfg.Prefix,
+	}
+}
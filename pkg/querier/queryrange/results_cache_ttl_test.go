@@ -0,0 +1,63 @@
+package queryrange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/chunk/cache"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+)
+
+// tenantTTLLimits sets the results cache TTL of each tenant.
+type tenantTTLLimits struct {
+	fakeLimits
+	ttls map[string]time.Duration
+}
+
+func (l tenantTTLLimits) ResultsCacheTTL(user string) time.Duration {
+	return l.ttls[user]
+}
+
+func Test_ResultsCacheTTL(t *testing.T) {
+	cfg, err := withTTLCache(queryrange.ResultsCacheConfig{CacheConfig: cache.Config{
+		EnableFifoCache: true,
+		Fifocache:       cache.FifoCacheConfig{MaxSizeItems: 10, Validity: 100 * time.Millisecond},
+	}}, nil, util_log.Logger)
+	require.NoError(t, err)
+	c := cfg.CacheConfig.Cache
+	defer c.Stop()
+
+	l := tenantTTLLimits{ttls: map[string]time.Duration{
+		"short": time.Millisecond,
+		"long":  time.Hour,
+	}}
+	// stores the entry of the tenant under its name, as the results cache would.
+	store := NewResultsCacheTTLMiddleware(l).Wrap(queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+		tenant, err := user.ExtractOrgID(ctx)
+		require.NoError(t, err)
+		c.Store(ctx, []string{tenant}, [][]byte{[]byte("entry of " + tenant)})
+		return &LokiPromResponse{}, nil
+	}))
+	for _, tenant := range []string{"short", "long", "default"} {
+		_, err := store.Do(user.InjectOrgID(context.Background(), tenant), &LokiRequest{})
+		require.NoError(t, err)
+	}
+
+	fetch := func() []string {
+		found, bufs, _ := c.Fetch(context.Background(), []string{"short", "long", "default"})
+		for i := range found {
+			require.Equal(t, "entry of "+found[i], string(bufs[i]))
+		}
+		return found
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, []string{"long", "default"}, fetch())
+
+	// entries of tenants without TTL expire with the cache, the others may outlive it.
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, []string{"long"}, fetch())
+}
@@ -1,13 +1,19 @@
 package queryrange
 
 import (
+	"context"
 	"flag"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/labels"
@@ -23,17 +29,70 @@ import (
 
 // Config is the configuration for the queryrange tripperware
 type Config struct {
-	queryrange.Config `yaml:",inline"`
+	queryrange.Config    `yaml:",inline"`
+	AlignStartEndToStep  bool   `yaml:"align_start_end_to_step"`
+	ClampMaxEntriesLimit bool   `yaml:"clamp_max_entries_limit"`
+	MaxRequestURLLength  int    `yaml:"max_request_url_length"`
+	SplitInstantQueries  bool   `yaml:"split_instant_queries"`
+	FailOnMissingShards  bool   `yaml:"fail_on_missing_shards"`
+	SortMergedEntries    bool   `yaml:"sort_merged_entries"`
+	AllowShardsOverride  bool   `yaml:"allow_shards_override"`
+	TruncatedBodyRetries int    `yaml:"truncated_body_retries"`
+	SplitAlignment       string `yaml:"split_alignment"`
+
+	// ProgressEventsInterval enables the server-sent events of the progress of queries, 0 to disable them.
+	ProgressEventsInterval time.Duration `yaml:"progress_events_interval"`
+
+	// CacheableSteps are the only steps of the metric range queries whose results are cached, when set.
+	CacheableSteps DurationsCSV `yaml:"cacheable_steps"`
+
+	// DownstreamAllowedHeaders and DownstreamDeniedHeaders restrict the headers set on sub-queries.
+	DownstreamAllowedHeaders flagext.StringSliceCSV `yaml:"downstream_allowed_headers"`
+	DownstreamDeniedHeaders  flagext.StringSliceCSV `yaml:"downstream_denied_headers"`
+
+	// QueryTags validates the query tags before they are forwarded and recorded.
+	QueryTags QueryTagsConfig `yaml:"query_tags"`
+
+	// FaultInjection is only honored by binaries built with the faultinjection build tag.
+	FaultInjection FaultInjectionConfig `yaml:"fault_injection"`
+
+	// DownstreamResolver optionally chooses the scheme and host the sub-queries, the label requests and the requests
+	// forwarded as is are sent to.
+	DownstreamResolver DownstreamResolver `yaml:"-"`
+
+	// QueryRewriter optionally rewrites the queries before they are dispatched, split, sharded and cached.
+	QueryRewriter QueryRewriter `yaml:"-"`
 }
 
 // RegisterFlags adds the flags required to configure this flag set.
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.Config.RegisterFlags(f)
+	cfg.QueryTags.RegisterFlags(f)
+	f.BoolVar(&cfg.AlignStartEndToStep, "querier.align-start-end-to-step", false, "Snap the start of metric range queries down and their end up to their step when decoding them, to improve results cache hit rates.")
+	f.BoolVar(&cfg.ClampMaxEntriesLimit, "querier.clamp-max-entries-limit", false, "Lower the limit of log queries exceeding the tenant max_entries_limit_per_query down to that limit instead of rejecting them.")
+	f.IntVar(&cfg.MaxRequestURLLength, "querier.max-request-url-length", 0, "Sub-queries whose URL would be longer than this are sent downstream as POST requests with a form encoded body instead. 0 to always use GET.")
+	f.BoolVar(&cfg.SplitInstantQueries, "querier.split-instant-queries", false, "Split instant metric queries whose range selector is longer than the split interval into sub-queries over consecutive sub-ranges. Only queries whose aggregation distributes over time are split.")
+	f.BoolVar(&cfg.FailOnMissingShards, "querier.fail-on-missing-shards", false, "Fail sharded queries missing the responses of some of their shards instead of returning their merged results with a warning.")
+	f.BoolVar(&cfg.SortMergedEntries, "querier.sort-merged-entries", false, "Sort the entries of each stream by timestamp when merging the responses of log sub-queries, rather than trusting the queriers to return them in order. This guards against misbehaving queriers at the cost of a sort.")
+	f.BoolVar(&cfg.AllowShardsOverride, "querier.allow-shards-override", false, "Allow queries to force their shard factor with the X-Loki-Shards header, e.g. to reproduce shard specific bugs. 0 and 1 disable their sharding, other factors are clamped to the row shards of the schema and rounded down to one of their divisors. The header can't enable sharding where the config or the tenant limits disable it.")
+	f.StringVar(&cfg.SplitAlignment, "querier.split-alignment", SplitAlignmentInterval, "How the sub-queries of log and metric range queries are aligned. Supported values are: "+strings.Join(SplitAlignments, ", ")+". With index_tables, they are aligned to the index tables of the schema and span as many whole tables as fit in the split interval, at least one, to improve the cache locality of object store backed indexes.")
+	f.DurationVar(&cfg.ProgressEventsInterval, "querier.progress-events-interval", 0, "Interval of the progress events sent to the range and instant queries requesting a text/event-stream response, with the number of sub-queries completed and the bytes and lines they processed so far, before their result. 0 to disable the event streams, such queries then get their usual response.")
+	f.IntVar(&cfg.TruncatedBodyRetries, "querier.truncated-body-retries", 0, "Number of times sub-queries whose response body is cut short, e.g. by a connection reset, are sent again before failing the query. This is independent of the retries of failed sub-queries. 0 to disable.")
+	f.Var(&cfg.CacheableSteps, "querier.cacheable-steps", "Comma separated list of the steps of the metric range queries whose results are cached, other steps bypass the results cache. Restricting them avoids filling the cache with steps computed from the dashboard width, such as Grafana's $__auto. Empty to cache any step.")
+	f.Var(&cfg.DownstreamAllowedHeaders, "querier.downstream-allowed-headers", "Comma separated list of the only headers which may be set on the sub-queries sent downstream, case insensitive. Empty to allow any header. The Content-Type of POST sub-queries is always kept.")
+	f.Var(&cfg.DownstreamDeniedHeaders, "querier.downstream-denied-headers", "Comma separated list of headers which are never set on the sub-queries sent downstream, case insensitive. The Content-Type of POST sub-queries is always kept.")
 }
 
 // Validate validates the config.
 func (cfg *Config) Validate() error {
+	if err := validateSplitAlignment(cfg.SplitAlignment); err != nil {
+		return err
+	}
 	if cfg.CacheResults {
+		// cache keys are derived from the split interval, which defaults to this one for every tenant.
+		if cfg.SplitQueriesByInterval <= 0 {
+			return errors.New("querier.cache-results may only be enabled in conjunction with a non-zero querier.split-queries-by-interval, please set the latter")
+		}
 		if err := cfg.ResultsCacheConfig.Validate(); err != nil {
 			return errors.Wrap(err, "invalid ResultsCache config")
 		}
@@ -57,36 +116,54 @@ func NewTripperware(
 	// Ensure that QuerySplitDuration uses configuration defaults.
 	// This avoids divide by zero errors when determining cache keys where user specific overrides don't exist.
 	limits = WithDefaultLimits(limits, cfg.Config)
+	if cfg.SplitAlignment == SplitAlignmentIndexTables {
+		// the splits are aligned to the index tables and can't be offset like the cache key time buckets.
+		limits = noCacheKeyJitterLimits{limits}
+	}
 
 	instrumentMetrics := queryrange.NewInstrumentMiddlewareMetrics(registerer)
 	retryMetrics := queryrange.NewRetryMiddlewareMetrics(registerer)
 	shardingMetrics := logql.NewShardingMetrics(registerer)
 	splitByMetrics := NewSplitByMetrics(registerer)
 
-	metricsTripperware, cache, err := NewMetricTripperware(cfg, log, limits, schema, LokiCodec,
-		PrometheusExtractor{}, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics, registerer)
+	codec := &Codec{
+		alignStartEndToStep: cfg.AlignStartEndToStep,
+		maxURLLength:        cfg.MaxRequestURLLength,
+		allowedHeaders:      canonicalHeaders(cfg.DownstreamAllowedHeaders),
+		deniedHeaders:       canonicalHeaders(cfg.DownstreamDeniedHeaders),
+		cacheableSteps:      cfg.CacheableSteps,
+		sortMergedEntries:   cfg.SortMergedEntries,
+	}
+
+	durations, err := NewQueryDurations(maxQueryDurations)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metricsTripperware, cache, err := NewMetricTripperware(cfg, log, limits, schema, codec,
+		PrometheusExtractor{}, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics, durations, registerer)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// NOTE: When we would start caching response from non-metric queries we would have to consider cache gen headers as well in
 	// MergeResponse implementation for Loki codecs same as it is done in Cortex at https://github.com/cortexproject/cortex/blob/21bad57b346c730d684d6d0205efef133422ab28/pkg/querier/queryrange/query_range.go#L170
-	logFilterTripperware, err := NewLogFilterTripperware(cfg, log, limits, schema, LokiCodec, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics)
+	logFilterTripperware, err := NewLogFilterTripperware(cfg, log, limits, schema, codec, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics, durations)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	seriesTripperware, err := NewSeriesTripperware(cfg, log, limits, LokiCodec, instrumentMetrics, retryMetrics, splitByMetrics, shardingMetrics, schema)
+	seriesTripperware, err := NewSeriesTripperware(cfg, log, limits, codec, instrumentMetrics, retryMetrics, splitByMetrics, shardingMetrics, schema)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	labelsTripperware, err := NewLabelsTripperware(cfg, log, limits, LokiCodec, instrumentMetrics, retryMetrics, splitByMetrics)
+	labelsTripperware, err := NewLabelsTripperware(cfg, log, limits, codec, instrumentMetrics, retryMetrics, splitByMetrics)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	instantMetricTripperware, err := NewInstantMetricTripperware(cfg, log, limits, schema, LokiCodec, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics)
+	instantMetricTripperware, err := NewInstantMetricTripperware(cfg, log, limits, schema, codec, instrumentMetrics, retryMetrics, shardingMetrics, splitByMetrics, durations)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -96,7 +173,16 @@ func NewTripperware(
 		seriesRT := seriesTripperware(next)
 		labelsRT := labelsTripperware(next)
 		instantRT := instantMetricTripperware(next)
-		return newRoundTripper(next, logFilterRT, metricRT, seriesRT, labelsRT, instantRT, limits)
+		rt := newRoundTripper(next, logFilterRT, metricRT, seriesRT, labelsRT, instantRT, limits, log, cfg.ClampMaxEntriesLimit)
+		rt.durations = durations
+		rt.queryTags = cfg.QueryTags
+		rt.allowShardsOverride = cfg.AllowShardsOverride
+		rt.progressEventsInterval = cfg.ProgressEventsInterval
+		rt.rewriter = cfg.QueryRewriter
+		rt.codec = codec
+		rt.resolve = cfg.DownstreamResolver
+		rt.logCodec = NewLimitedRoundTripper(next, codec, limits, cfg.DownstreamResolver, cfg.TruncatedBodyRetries)
+		return rt
 	}, cache, nil
 }
 
@@ -104,37 +190,125 @@ type roundTripper struct {
 	next, log, metric, series, labels, instantMetric http.RoundTripper
 
 	limits Limits
+	logger log.Logger
+	// clampLimit lowers the limit of log queries to the tenant max entries limit instead of rejecting them.
+	clampLimit bool
+	// durations holds the duration of the recent queries of each tenant.
+	durations *QueryDurations
+	queryTags QueryTagsConfig
+	// allowShardsOverride honors the shard factor of the X-Loki-Shards header of the queries.
+	allowShardsOverride bool
+	// dashboards caps the queries each dashboard runs concurrently.
+	dashboards *dashboardConcurrency
+	// progressEventsInterval is the interval of the progress events of the queries requesting server-sent
+	// events, 0 to ignore such requests.
+	progressEventsInterval time.Duration
+	// rewriter rewrites the queries of every query op before they are dispatched, nil to leave them untouched.
+	rewriter QueryRewriter
+	// codec filters the headers of the requests forwarded as is downstream like those of its sub-queries.
+	codec *Codec
+	// resolve optionally chooses where the requests forwarded as is are sent, like the sub-queries.
+	resolve DownstreamResolver
+	// logCodec sends the log queries which are neither split nor sharded downstream through the codec,
+	// for those whose response must be re-encoded, e.g. to cap it with max_bytes or stream it as NDJSON.
+	logCodec http.RoundTripper
+}
+
+// QueryDuration returns the duration of the last query of tenantID with the same fingerprint.
+func (r roundTripper) QueryDuration(tenantID, query string) (time.Duration, bool) {
+	if r.durations == nil {
+		return 0, false
+	}
+	return r.durations.Get(tenantID, query)
 }
 
 // newRoundTripper creates a new queryrange roundtripper
-func newRoundTripper(next, log, metric, series, labels, instantMetric http.RoundTripper, limits Limits) roundTripper {
+func newRoundTripper(next, log, metric, series, labels, instantMetric http.RoundTripper, limits Limits, logger log.Logger, clampLimit bool) roundTripper {
 	return roundTripper{
 		log:           log,
 		limits:        limits,
+		logger:        logger,
+		clampLimit:    clampLimit,
 		metric:        metric,
 		series:        series,
 		labels:        labels,
 		instantMetric: instantMetric,
 		next:          next,
+		dashboards:    newDashboardConcurrency(limits),
 	}
 }
 
 func (r roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	err := req.ParseForm()
+	if r.progressEventsInterval > 0 && acceptsEventStream(req.Header) {
+		if op := getOperation(req.URL.Path); op == QueryRangeOp || op == InstantQueryOp {
+			return streamEvents(req, r.progressEventsInterval, r.roundTrip), nil
+		}
+	}
+	return r.roundTrip(req)
+}
+
+func (r roundTripper) roundTrip(req *http.Request) (*http.Response, error) {
+	// the queries parsed here are reused by the tripperwares.
+	req = req.WithContext(withParsedExprs(req.Context()))
+	req = withAcceptedVersion(req)
+	req = withAcceptedNDJSON(req)
+	req, err := withValidQueryTags(req, r.queryTags)
+	if err != nil {
+		return nil, err
+	}
+	req, err = withShardsOverride(req, r.allowShardsOverride)
 	if err != nil {
+		return nil, err
+	}
+	release, err := r.dashboards.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := req.ParseForm(); err != nil {
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
+	// DecodeRequest validates them as well, but not every request is decoded before it is sent downstream.
+	if err := validateSingleValuedParams(req.Form); err != nil {
+		return nil, err
+	}
+	if err := rewriteQueries(req, r.rewriter); err != nil {
+		return nil, err
+	}
 
 	switch op := getOperation(req.URL.Path); op {
 	case QueryRangeOp:
-		rangeQuery, err := loghttp.ParseRangeQuery(req)
+		req, err = withAutoStep(req, r.limits)
+		if err != nil {
+			return nil, err
+		}
+		rangeQuery, adjusted, err := parseRangeQuery(req)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
-		expr, err := logql.ParseExpr(rangeQuery.Query)
+		if adjusted {
+			// DecodeRequest adjusts the step the same way, the response is warned about it.
+			req = req.WithContext(context.WithValue(req.Context(), stepAdjustedCtxKey, rangeQuery.Step))
+		}
+		if rangeQuery.StatsOnly {
+			req = withStatsOnly(req)
+		}
+		if rangeQuery.MaxBytes > 0 {
+			req = withMaxBytes(req, rangeQuery.MaxBytes)
+		}
+		if rangeQuery.MaxPoints > 0 {
+			req = withMaxPoints(req, rangeQuery.MaxPoints)
+		}
+		if rangeQuery.Explain {
+			req = withExplain(req)
+		}
+		expr, err := parsedQuery(req.Context(), rangeQuery.Query)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
+		if err := checkBlockedFunctions(req.Context(), r.limits, expr); err != nil {
+			return nil, err
+		}
 		switch e := expr.(type) {
 		case logql.SampleExpr:
 			return r.metric.RoundTrip(req)
@@ -143,23 +317,39 @@ func (r roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 			if err != nil {
 				return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 			}
-			if err := validateLimits(req, rangeQuery.Limit, r.limits); err != nil {
+			if r.clampLimit {
+				if err := clampLimit(r.logger, req, rangeQuery.Limit, r.limits); err != nil {
+					return nil, err
+				}
+			} else if err := validateLimits(req, rangeQuery.Limit, r.limits); err != nil {
 				return nil, err
 			}
 			// Only filter expressions are query sharded
 			if !expr.HasFilter() {
-				return r.next.RoundTrip(req)
+				if explain(req.Context()) {
+					return explainPassthrough(req.Context(), rangeQuery.Start, rangeQuery.End)
+				}
+				// the entries over max_bytes are dropped, and the entries are streamed as NDJSON, by the codec
+				// when it encodes the response.
+				if (rangeQuery.MaxBytes > 0 || acceptsNDJSON(req.Header)) && r.logCodec != nil {
+					return r.logCodec.RoundTrip(req)
+				}
+				return r.forward(req)
 			}
 			return r.log.RoundTrip(req)
 
 		default:
-			return r.next.RoundTrip(req)
+			return r.forward(req)
 		}
 	case SeriesOp:
 		_, err := logql.ParseAndValidateSeriesQuery(req)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
+		req, err = withSeriesFormat(req)
+		if err != nil {
+			return nil, err
+		}
 		return r.series.RoundTrip(req)
 	case LabelNamesOp:
 		_, err := loghttp.ParseLabelQuery(req)
@@ -167,30 +357,70 @@ func (r roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
 		return r.labels.RoundTrip(req)
+	case LabelValuesOp:
+		if err := checkBlockedLabel(req.Context(), r.limits, labelValuesName(req.URL.Path)); err != nil {
+			return nil, err
+		}
+		if _, err := loghttp.ParseLabelQuery(req); err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+		if _, err := loghttp.ParseLabelWithCounts(req); err != nil {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+		}
+		return r.labels.RoundTrip(req)
 	case InstantQueryOp:
 		instantQuery, err := loghttp.ParseInstantQuery(req)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
-		expr, err := logql.ParseExpr(instantQuery.Query)
+		if instantQuery.StatsOnly {
+			req = withStatsOnly(req)
+		}
+		expr, err := parsedQuery(req.Context(), instantQuery.Query)
 		if err != nil {
 			return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 		}
+		if err := checkBlockedFunctions(req.Context(), r.limits, expr); err != nil {
+			return nil, err
+		}
 		switch expr.(type) {
 		case logql.SampleExpr:
 			return r.instantMetric.RoundTrip(req)
+		case logql.LogSelectorExpr:
+			if r.clampLimit {
+				if err := clampLimit(r.logger, req, instantQuery.Limit, r.limits); err != nil {
+					return nil, err
+				}
+			}
+			return r.forward(req)
 		default:
-			return r.next.RoundTrip(req)
+			return r.forward(req)
 		}
 	default:
-		return r.next.RoundTrip(req)
+		return r.forward(req)
+	}
+}
+
+// forward sends the request as is downstream, without the headers which aren't allowed on sub-queries.
+func (r roundTripper) forward(req *http.Request) (*http.Response, error) {
+	if r.codec != nil && (len(r.codec.allowedHeaders) > 0 || len(r.codec.deniedHeaders) > 0) {
+		// the caller's request is left untouched.
+		req = req.WithContext(req.Context())
+		req.Header = req.Header.Clone()
+		r.codec.filterHeaders(req.Header)
 	}
+	return r.next.RoundTrip(withDownstream(req, r.resolve))
 }
 
 // transformRegexQuery backport the old regexp params into the v1 query format
 func transformRegexQuery(req *http.Request, expr logql.LogSelectorExpr) (logql.LogSelectorExpr, error) {
 	regexp := req.Form.Get("regexp")
 	if regexp != "" {
+		// the filter is added to a copy, the parsed query is shared with the tripperwares.
+		expr, err := logql.ParseLogSelector(expr.String(), false)
+		if err != nil {
+			return nil, err
+		}
 		filterExpr, err := logql.AddFilterExpr(expr, labels.MatchRegexp, "", regexp)
 		if err != nil {
 			return nil, err
@@ -206,6 +436,26 @@ func transformRegexQuery(req *http.Request, expr logql.LogSelectorExpr) (logql.L
 	return expr, nil
 }
 
+// setForm replaces the parsed form of the request and encodes it where it was sent, in the body of form
+// requests or else in the query string, as the requests forwarded as is downstream are read from there again.
+func setForm(req *http.Request, form url.Values) {
+	encoded := form.Encode()
+	req.Form = form
+	if len(req.PostForm) > 0 {
+		req.PostForm = form
+		req.URL.RawQuery = ""
+		req.Body = ioutil.NopCloser(strings.NewReader(encoded))
+		req.ContentLength = int64(len(encoded))
+		req.Header.Del("Content-Length")
+	} else {
+		req.URL.RawQuery = encoded
+	}
+	// the request URI is what the httpgrpc code looks at.
+	if req.RequestURI != "" {
+		req.RequestURI = req.URL.RequestURI()
+	}
+}
+
 // validates log entries limits
 func validateLimits(req *http.Request, reqLimit uint32, limits Limits) error {
 	userID, err := tenant.TenantID(req.Context())
@@ -215,17 +465,45 @@ func validateLimits(req *http.Request, reqLimit uint32, limits Limits) error {
 
 	maxEntriesLimit := limits.MaxEntriesLimitPerQuery(userID)
 	if int(reqLimit) > maxEntriesLimit && maxEntriesLimit != 0 {
-		return httpgrpc.Errorf(http.StatusBadRequest,
-			"max entries limit per query exceeded, limit > max_entries_limit (%d > %d)", reqLimit, maxEntriesLimit)
+		return httpgrpc.Errorf(http.StatusBadRequest, maxEntriesLimitErrTmpl, reqLimit, maxEntriesLimit)
 	}
 	return nil
 }
 
+// clampLimit lowers the limit parameter of the request down to the tenant max entries limit
+// when it exceeds it, the querier would reject the request otherwise.
+func clampLimit(logger log.Logger, req *http.Request, reqLimit uint32, limits Limits) error {
+	userID, err := tenant.TenantID(req.Context())
+	if err != nil {
+		return httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+
+	maxEntriesLimit := limits.MaxEntriesLimitPerQuery(userID)
+	if maxEntriesLimit == 0 || int(reqLimit) <= maxEntriesLimit {
+		return nil
+	}
+
+	limit := strconv.Itoa(maxEntriesLimit)
+	params := req.URL.Query()
+	params.Set("limit", limit)
+	req.URL.RawQuery = params.Encode()
+	// the form has already been parsed, update it as well so the new limit is picked up
+	// whether it was sent in the query string or in the body.
+	req.Form.Set("limit", limit)
+	if req.PostForm.Get("limit") != "" {
+		req.PostForm.Set("limit", limit)
+	}
+
+	level.Debug(logger).Log("msg", "clamped query limit to the max entries limit", "org_id", userID, "limit", reqLimit, "max_entries_limit", maxEntriesLimit)
+	return nil
+}
+
 const (
 	InstantQueryOp = "instant_query"
 	QueryRangeOp   = "query_range"
 	SeriesOp       = "series"
 	LabelNamesOp   = "labels"
+	LabelValuesOp  = "label_values"
 )
 
 func getOperation(path string) string {
@@ -236,6 +514,8 @@ func getOperation(path string) string {
 		return SeriesOp
 	case strings.HasSuffix(path, "/labels") || strings.HasSuffix(path, "/label"):
 		return LabelNamesOp
+	case isLabelValuesPath(path):
+		return LabelValuesOp
 	case strings.HasSuffix(path, "/v1/query"):
 		return InstantQueryOp
 	default:
@@ -243,6 +523,21 @@ func getOperation(path string) string {
 	}
 }
 
+// isLabelValuesPath returns whether path is a label values request path, e.g. /loki/api/v1/label/{name}/values.
+func isLabelValuesPath(path string) bool {
+	if !strings.HasSuffix(path, "/values") {
+		return false
+	}
+	path = strings.TrimSuffix(path, "/values")
+	return strings.HasSuffix(path[:strings.LastIndex(path, "/")+1], "/label/")
+}
+
+// labelValuesName returns the name of the label of a label values request path, e.g. /loki/api/v1/label/{name}/values.
+func labelValuesName(path string) string {
+	path = strings.TrimSuffix(path, "/values")
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
 // NewLogFilterTripperware creates a new frontend tripperware responsible for handling log requests with regex.
 func NewLogFilterTripperware(
 	cfg Config,
@@ -254,33 +549,23 @@ func NewLogFilterTripperware(
 	retryMiddlewareMetrics *queryrange.RetryMiddlewareMetrics,
 	shardingMetrics *logql.ShardingMetrics,
 	splitByMetrics *SplitByMetrics,
+	durations *QueryDurations,
 ) (queryrange.Tripperware, error) {
-	queryRangeMiddleware := []queryrange.Middleware{
-		StatsCollectorMiddleware(),
-		NewLimitsMiddleware(limits),
-		queryrange.InstrumentMiddleware("split_by_interval", instrumentMetrics),
-		SplitByIntervalMiddleware(limits, codec, splitByTime, splitByMetrics),
-	}
-
-	if cfg.ShardedQueries {
-		queryRangeMiddleware = append(queryRangeMiddleware,
-			NewQueryShardMiddleware(
-				log,
-				schema.Configs,
-				instrumentMetrics, // instrumentation is included in the sharding middleware
-				shardingMetrics,
-				limits,
-			),
-		)
-	}
-
-	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(queryRangeMiddleware, queryrange.InstrumentMiddleware("retry", instrumentMetrics), queryrange.NewRetryMiddleware(log, cfg.MaxRetries, retryMiddlewareMetrics))
-	}
+	queryRangeMiddleware := buildChain(logFilterChain(cfg, chainDeps{
+		log:               log,
+		limits:            limits,
+		schema:            schema,
+		codec:             codec,
+		instrumentMetrics: instrumentMetrics,
+		retryMetrics:      retryMiddlewareMetrics,
+		shardingMetrics:   shardingMetrics,
+		splitByMetrics:    splitByMetrics,
+		durations:         durations,
+	}))
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		if len(queryRangeMiddleware) > 0 {
-			return NewLimitedRoundTripper(next, codec, limits, queryRangeMiddleware...)
+			return NewLimitedRoundTripper(next, codec, limits, cfg.DownstreamResolver, cfg.TruncatedBodyRetries, queryRangeMiddleware...)
 		}
 		return next
 	}, nil
@@ -298,35 +583,20 @@ func NewSeriesTripperware(
 	shardingMetrics *logql.ShardingMetrics,
 	schema chunk.SchemaConfig,
 ) (queryrange.Tripperware, error) {
-	queryRangeMiddleware := []queryrange.Middleware{
-		NewLimitsMiddleware(limits),
-		queryrange.InstrumentMiddleware("split_by_interval", instrumentMetrics),
-		// The Series API needs to pull one chunk per series to extract the label set, which is much cheaper than iterating through all matching chunks.
-		// Force a 24 hours split by for series API, this will be more efficient with our static daily bucket storage.
-		// This would avoid queriers downloading chunks for same series over and over again for serving smaller queries.
-		SplitByIntervalMiddleware(WithSplitByLimits(limits, 24*time.Hour), codec, splitByTime, splitByMetrics),
-	}
-
-	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(queryRangeMiddleware, queryrange.InstrumentMiddleware("retry", instrumentMetrics), queryrange.NewRetryMiddleware(log, cfg.MaxRetries, retryMiddlewareMetrics))
-	}
-
-	if cfg.ShardedQueries {
-		queryRangeMiddleware = append(queryRangeMiddleware,
-			NewSeriesQueryShardMiddleware(
-				log,
-				schema.Configs,
-				instrumentMetrics,
-				shardingMetrics,
-				limits,
-				codec,
-			),
-		)
-	}
+	queryRangeMiddleware := buildChain(seriesChain(cfg, chainDeps{
+		log:               log,
+		limits:            limits,
+		schema:            schema,
+		codec:             codec,
+		instrumentMetrics: instrumentMetrics,
+		retryMetrics:      retryMiddlewareMetrics,
+		shardingMetrics:   shardingMetrics,
+		splitByMetrics:    splitByMetrics,
+	}))
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		if len(queryRangeMiddleware) > 0 {
-			return NewLimitedRoundTripper(next, codec, limits, queryRangeMiddleware...)
+			return NewLimitedRoundTripper(next, codec, limits, cfg.DownstreamResolver, cfg.TruncatedBodyRetries, queryRangeMiddleware...)
 		}
 		return next
 	}, nil
@@ -342,19 +612,19 @@ func NewLabelsTripperware(
 	retryMiddlewareMetrics *queryrange.RetryMiddlewareMetrics,
 	splitByMetrics *SplitByMetrics,
 ) (queryrange.Tripperware, error) {
-	queryRangeMiddleware := []queryrange.Middleware{
-		NewLimitsMiddleware(limits),
-		queryrange.InstrumentMiddleware("split_by_interval", instrumentMetrics),
-		// Force a 24 hours split by for labels API, this will be more efficient with our static daily bucket storage.
-		// This is because the labels API is an index-only operation.
-		SplitByIntervalMiddleware(WithSplitByLimits(limits, 24*time.Hour), codec, splitByTime, splitByMetrics),
-	}
-
-	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(queryRangeMiddleware, queryrange.InstrumentMiddleware("retry", instrumentMetrics), queryrange.NewRetryMiddleware(log, cfg.MaxRetries, retryMiddlewareMetrics))
-	}
+	queryRangeMiddleware := buildChain(labelsChain(cfg, chainDeps{
+		log:               log,
+		limits:            limits,
+		codec:             codec,
+		instrumentMetrics: instrumentMetrics,
+		retryMetrics:      retryMiddlewareMetrics,
+		splitByMetrics:    splitByMetrics,
+	}))
 
 	return func(next http.RoundTripper) http.RoundTripper {
+		if cfg.DownstreamResolver != nil {
+			next = downstreamRoundTripper{next: next, resolve: cfg.DownstreamResolver}
+		}
 		if len(queryRangeMiddleware) > 0 {
 			// Do not forward any request header.
 			return queryrange.NewRoundTripper(next, codec, nil, queryRangeMiddleware...)
@@ -375,28 +645,19 @@ func NewMetricTripperware(
 	retryMiddlewareMetrics *queryrange.RetryMiddlewareMetrics,
 	shardingMetrics *logql.ShardingMetrics,
 	splitByMetrics *SplitByMetrics,
+	durations *QueryDurations,
 	registerer prometheus.Registerer,
 ) (queryrange.Tripperware, Stopper, error) {
-	queryRangeMiddleware := []queryrange.Middleware{StatsCollectorMiddleware(), NewLimitsMiddleware(limits)}
-	if cfg.AlignQueriesWithStep {
-		queryRangeMiddleware = append(
-			queryRangeMiddleware,
-			queryrange.InstrumentMiddleware("step_align", instrumentMetrics),
-			queryrange.StepAlignMiddleware,
-		)
-	}
-
-	queryRangeMiddleware = append(
-		queryRangeMiddleware,
-		queryrange.InstrumentMiddleware("split_by_interval", instrumentMetrics),
-		SplitByIntervalMiddleware(limits, codec, splitMetricByTime, splitByMetrics),
-	)
-
 	var c cache.Cache
+	var resultsCache queryrange.Middleware
 	if cfg.CacheResults {
+		resultsCacheCfg, err := withTTLCache(cfg.ResultsCacheConfig, registerer, log)
+		if err != nil {
+			return nil, nil, err
+		}
 		queryCacheMiddleware, cache, err := queryrange.NewResultsCacheMiddleware(
 			log,
-			cfg.ResultsCacheConfig,
+			resultsCacheCfg,
 			cacheKeyLimits{limits},
 			limits,
 			codec,
@@ -411,37 +672,26 @@ func NewMetricTripperware(
 			return nil, nil, err
 		}
 		c = cache
-		queryRangeMiddleware = append(
-			queryRangeMiddleware,
-			queryrange.InstrumentMiddleware("results_cache", instrumentMetrics),
-			queryCacheMiddleware,
-		)
+		resultsCache = queryCacheMiddleware
 	}
 
-	if cfg.ShardedQueries {
-		queryRangeMiddleware = append(queryRangeMiddleware,
-			NewQueryShardMiddleware(
-				log,
-				schema.Configs,
-				instrumentMetrics, // instrumentation is included in the sharding middleware
-				shardingMetrics,
-				limits,
-			),
-		)
-	}
-
-	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(
-			queryRangeMiddleware,
-			queryrange.InstrumentMiddleware("retry", instrumentMetrics),
-			queryrange.NewRetryMiddleware(log, cfg.MaxRetries, retryMiddlewareMetrics),
-		)
-	}
+	queryRangeMiddleware := buildChain(metricChain(cfg, chainDeps{
+		log:               log,
+		limits:            limits,
+		schema:            schema,
+		codec:             codec,
+		instrumentMetrics: instrumentMetrics,
+		retryMetrics:      retryMiddlewareMetrics,
+		shardingMetrics:   shardingMetrics,
+		splitByMetrics:    splitByMetrics,
+		durations:         durations,
+		resultsCache:      resultsCache,
+	}))
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		// Finally, if the user selected any query range middleware, stitch it in.
 		if len(queryRangeMiddleware) > 0 {
-			rt := NewLimitedRoundTripper(next, codec, limits, queryRangeMiddleware...)
+			rt := NewLimitedRoundTripper(next, codec, limits, cfg.DownstreamResolver, cfg.TruncatedBodyRetries, queryRangeMiddleware...)
 			return queryrange.RoundTripFunc(func(r *http.Request) (*http.Response, error) {
 				if !strings.HasSuffix(r.URL.Path, "/query_range") {
 					return next.RoundTrip(r)
@@ -464,32 +714,22 @@ func NewInstantMetricTripperware(
 	retryMiddlewareMetrics *queryrange.RetryMiddlewareMetrics,
 	shardingMetrics *logql.ShardingMetrics,
 	splitByMetrics *SplitByMetrics,
+	durations *QueryDurations,
 ) (queryrange.Tripperware, error) {
-	queryRangeMiddleware := []queryrange.Middleware{StatsCollectorMiddleware(), NewLimitsMiddleware(limits)}
-
-	if cfg.ShardedQueries {
-		queryRangeMiddleware = append(queryRangeMiddleware,
-			NewQueryShardMiddleware(
-				log,
-				schema.Configs,
-				instrumentMetrics, // instrumentation is included in the sharding middleware
-				shardingMetrics,
-				limits,
-			),
-		)
-	}
-
-	if cfg.MaxRetries > 0 {
-		queryRangeMiddleware = append(
-			queryRangeMiddleware,
-			queryrange.InstrumentMiddleware("retry", instrumentMetrics),
-			queryrange.NewRetryMiddleware(log, cfg.MaxRetries, retryMiddlewareMetrics),
-		)
-	}
+	queryRangeMiddleware := buildChain(instantMetricChain(cfg, chainDeps{
+		log:               log,
+		limits:            limits,
+		schema:            schema,
+		instrumentMetrics: instrumentMetrics,
+		retryMetrics:      retryMiddlewareMetrics,
+		shardingMetrics:   shardingMetrics,
+		splitByMetrics:    splitByMetrics,
+		durations:         durations,
+	}))
 
 	return func(next http.RoundTripper) http.RoundTripper {
 		if len(queryRangeMiddleware) > 0 {
-			return NewLimitedRoundTripper(next, codec, limits, queryRangeMiddleware...)
+			return NewLimitedRoundTripper(next, codec, limits, cfg.DownstreamResolver, cfg.TruncatedBodyRetries, queryRangeMiddleware...)
 		}
 		return next
 	}, nil
@@ -3,12 +3,15 @@ package queryrange
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -24,15 +27,17 @@ import (
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/user"
 
+	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
 	"github.com/grafana/loki/pkg/logqlmodel"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
 	"github.com/grafana/loki/pkg/storage/chunk"
 	"github.com/grafana/loki/pkg/util/marshal"
 )
 
 var (
 	testTime   = time.Date(2019, 12, 02, 11, 10, 10, 10, time.UTC)
-	testConfig = Config{queryrange.Config{
+	testConfig = Config{Config: queryrange.Config{
 		SplitQueriesByInterval: 4 * time.Hour,
 		AlignQueriesWithStep:   true,
 		MaxRetries:             3,
@@ -108,6 +113,18 @@ var (
 )
 
 // those tests are mostly for testing the glue between all component and make sure they activate correctly.
+func TestConfig_Validate(t *testing.T) {
+	cfg := testConfig
+	require.NoError(t, cfg.Validate())
+
+	// caching without a split interval would panic when generating cache keys.
+	cfg.SplitQueriesByInterval = 0
+	require.Error(t, cfg.Validate())
+
+	cfg.CacheResults = false
+	require.NoError(t, cfg.Validate())
+}
+
 func TestMetricsTripperware(t *testing.T) {
 	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32}, chunk.SchemaConfig{}, nil)
 	if stopper != nil {
@@ -171,6 +188,226 @@ func TestMetricsTripperware(t *testing.T) {
 	require.Equal(t, lokiResponse.(*LokiPromResponse).Response, lokiCacheResponse.(*LokiPromResponse).Response)
 }
 
+func TestMetricsTripperware_NoCache(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+
+	lreq := &LokiRequest{
+		Query:     `rate({app="foo"} |= "foo"[1m])`,
+		Limit:     1000,
+		Step:      30000, // 30sec
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/query_range",
+	}
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	newRequest := func(cacheControl string) *http.Request {
+		req, err := LokiCodec.EncodeRequest(ctx, lreq)
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+		if cacheControl != "" {
+			req.Header.Set("Cache-Control", cacheControl)
+		}
+		return req
+	}
+
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	for _, tc := range []struct {
+		name         string
+		cacheControl string
+	}{
+		// the results aren't looked up in the cache nor stored in it.
+		{name: "no-cache", cacheControl: "no-cache"},
+		// so they aren't cached for the following requests.
+		{name: "cacheable"},
+		// and they aren't looked up even though they are now cached.
+		{name: "no-store", cacheControl: "max-age=0, no-store"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			count, h := promqlResult(matrix)
+			rt.setHandler(h)
+			_, err := tpw(rt).RoundTrip(newRequest(tc.cacheControl))
+			require.NoError(t, err)
+			// 2 split queries.
+			require.Equal(t, 2, *count)
+		})
+	}
+}
+
+func TestMetricsTripperware_CacheableSteps(t *testing.T) {
+	cfg := testConfig
+	cfg.CacheableSteps = DurationsCSV{time.Minute}
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, tc := range []struct {
+		name   string
+		step   time.Duration
+		cached bool
+	}{
+		{name: "aligned", step: time.Minute, cached: true},
+		{name: "not aligned", step: 37 * time.Second, cached: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lreq := &LokiRequest{
+				Query:     `rate({app="foo"} |= "foo"[1m])`,
+				Limit:     1000,
+				Step:      tc.step.Milliseconds(),
+				StartTs:   testTime.Add(-6 * time.Hour),
+				EndTs:     testTime,
+				Direction: logproto.FORWARD,
+				Path:      "/query_range",
+			}
+			do := func() int {
+				req, err := LokiCodec.EncodeRequest(ctx, lreq)
+				require.NoError(t, err)
+				req = req.WithContext(ctx)
+				require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+				count, h := promqlResult(matrix)
+				rt.setHandler(h)
+				_, err = tpw(rt).RoundTrip(req)
+				require.NoError(t, err)
+				return *count
+			}
+
+			// 2 split queries.
+			require.Equal(t, 2, do())
+			if tc.cached {
+				require.Equal(t, 0, do())
+			} else {
+				require.Equal(t, 2, do())
+			}
+		})
+	}
+}
+
+func TestMetricsTripperware_CachedSplits(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32, maxQueryLength: 12 * time.Hour}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	_, h := promqlResult(matrix)
+	rt.setHandler(h)
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	do := func(start time.Time) stats.Summary {
+		lreq := &LokiRequest{
+			Query:     `rate({app="foo"} |= "foo"[1m])`,
+			Limit:     1000,
+			Step:      30000, // 30sec
+			StartTs:   start,
+			EndTs:     testTime,
+			Direction: logproto.FORWARD,
+			Path:      "/query_range",
+		}
+		req, err := LokiCodec.EncodeRequest(ctx, lreq)
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+		resp, err := tpw(rt).RoundTrip(req)
+		require.NoError(t, err)
+		res, err := LokiCodec.DecodeResponse(ctx, resp, lreq)
+		require.NoError(t, err)
+		return res.(*LokiPromResponse).Statistics.Summary
+	}
+
+	// 2 splits, 05:10-08:00 and 08:00-11:10, computed then cached.
+	summary := do(testTime.Add(-6 * time.Hour))
+	require.Equal(t, int64(2), summary.TotalSplits)
+	require.Equal(t, int64(0), summary.CachedSplits)
+
+	summary = do(testTime.Add(-6 * time.Hour))
+	require.Equal(t, int64(2), summary.TotalSplits)
+	require.Equal(t, int64(2), summary.CachedSplits)
+
+	// 3 splits, 01:10-04:00 is computed, 04:00-08:00 is partially cached and 08:00-11:10 is cached.
+	summary = do(testTime.Add(-10 * time.Hour))
+	require.Equal(t, int64(3), summary.TotalSplits)
+	require.Equal(t, int64(1), summary.CachedSplits)
+}
+
+func TestMetricsTripperware_AutoStep(t *testing.T) {
+	lreq := &LokiRequest{
+		Query:     `rate({app="foo"} |= "foo"[1m])`,
+		Limit:     1000,
+		Step:      1, // 1ms, way more than the maximum number of points.
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, autoStep := range []bool{false, true} {
+		t.Run(strconv.FormatBool(autoStep), func(t *testing.T) {
+			tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxSeries: math.MaxInt32, autoStep: autoStep}, chunk.SchemaConfig{}, nil)
+			if stopper != nil {
+				defer stopper.Stop()
+			}
+			require.NoError(t, err)
+			rt, err := newfakeRoundTripper()
+			require.NoError(t, err)
+			defer rt.Close()
+
+			req, err := LokiCodec.EncodeRequest(ctx, lreq)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			var steps []string
+			_, h := promqlResult(matrix)
+			rt.setHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				steps = append(steps, r.URL.Query().Get("step"))
+				h.ServeHTTP(w, r)
+			}))
+			resp, err := tpw(rt).RoundTrip(req)
+			if !autoStep {
+				httpResp, ok := httpgrpc.HTTPResponseFromError(err)
+				require.True(t, ok)
+				require.Equal(t, int32(http.StatusBadRequest), httpResp.Code)
+				require.Empty(t, steps)
+				return
+			}
+			require.NoError(t, err)
+
+			step := loghttp.AutoStep(6 * time.Hour)
+			require.NotEmpty(t, steps)
+			for _, s := range steps {
+				require.Equal(t, fmt.Sprintf("%f", step.Seconds()), s)
+			}
+			var body struct {
+				Warnings []string `json:"warnings"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Equal(t, []string{fmt.Sprintf(stepAdjustedWarningTmpl, step, loghttp.MaxPointsPerSeries)}, body.Warnings)
+		})
+	}
+}
+
 func TestLogFilterTripperware(t *testing.T) {
 	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
 	if stopper != nil {
@@ -218,6 +455,56 @@ func TestLogFilterTripperware(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestLimitsReloadTripperware(t *testing.T) {
+	limits := &fakeLimits{}
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, limits, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"} |= "foo"`,
+		Limit:     1000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	err = user.InjectOrgIDIntoHTTPRequest(ctx, req)
+	require.NoError(t, err)
+
+	// split by the default 4h interval.
+	count, h := promqlResult(streams)
+	rt.setHandler(h)
+	_, err = tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, *count)
+
+	// reloaded overrides apply to the next request.
+	limits.splits = map[string]time.Duration{"1": time.Hour}
+	count, h = promqlResult(streams)
+	rt.setHandler(h)
+	_, err = tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 6, *count)
+
+	limits.maxQueryLength = time.Hour
+	count, h = promqlResult(streams)
+	rt.setHandler(h)
+	_, err = tpw(rt).RoundTrip(req)
+	require.Error(t, err)
+	require.Equal(t, 0, *count)
+}
+
 func TestInstantQueryTripperware(t *testing.T) {
 	testShardingConfig := testConfig
 	testShardingConfig.ShardedQueries = true
@@ -297,6 +584,79 @@ func TestSeriesTripperware(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestSeriesTripperware_Format(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryLength: 48 * time.Hour}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	lreq := &LokiSeriesRequest{
+		Match:   []string{`{job="varlogs"}`},
+		StartTs: testTime.Add(-25 * time.Hour),
+		EndTs:   testTime,
+		Path:    "/loki/api/v1/series",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		format   string
+		expected string
+		code     int
+	}{
+		{
+			format:   "",
+			expected: `{"status":"success","data":[{"filename":"/var/hostlog/apport.log","job":"varlogs"},{"filename":"/var/hostlog/test.log","job":"varlogs"}]}`,
+			code:     http.StatusOK,
+		},
+		{
+			format:   seriesFormatFull,
+			expected: `{"status":"success","data":[{"filename":"/var/hostlog/apport.log","job":"varlogs"},{"filename":"/var/hostlog/test.log","job":"varlogs"}]}`,
+			code:     http.StatusOK,
+		},
+		{
+			format:   seriesFormatCount,
+			expected: `{"status":"success","data":{"count":2}}`,
+			code:     http.StatusOK,
+		},
+		{
+			format: "labels",
+			code:   http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			req, err := LokiCodec.EncodeRequest(ctx, lreq)
+			require.NoError(t, err)
+			if tc.format != "" {
+				q := req.URL.Query()
+				q.Set(seriesFormatParam, tc.format)
+				req.URL.RawQuery = q.Encode()
+				req.RequestURI = req.URL.RequestURI()
+			}
+			req = req.WithContext(ctx)
+			err = user.InjectOrgIDIntoHTTPRequest(ctx, req)
+			require.NoError(t, err)
+
+			_, h := seriesResult(series)
+			rt.setHandler(h)
+			resp, err := tpw(rt).RoundTrip(req)
+			if tc.code != http.StatusOK {
+				httpResp, ok := httpgrpc.HTTPResponseFromError(err)
+				require.True(t, ok)
+				require.Equal(t, int32(tc.code), httpResp.Code)
+				return
+			}
+			require.NoError(t, err)
+			body, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tc.expected, string(body))
+		})
+	}
+}
+
 func TestLabelsTripperware(t *testing.T) {
 	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryLength: 48 * time.Hour}, chunk.SchemaConfig{}, nil)
 	if stopper != nil {
@@ -338,7 +698,7 @@ func TestLabelsTripperware(t *testing.T) {
 	lokiLabelsResponse, err := LokiCodec.DecodeResponse(ctx, resp, lreq)
 	res, ok := lokiLabelsResponse.(*LokiLabelNamesResponse)
 	require.Equal(t, true, ok)
-	require.Equal(t, []string{"foo", "bar", "blop", "blip"}, res.Data)
+	require.Equal(t, []string{"bar", "blip", "blop", "foo"}, res.Data)
 	require.Equal(t, "success", res.Status)
 	require.NoError(t, err)
 }
@@ -401,6 +761,52 @@ func TestUnhandledPath(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestTripperwareDownstreamResolver(t *testing.T) {
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	cfg := testConfig
+	cfg.DownstreamResolver = func(ctx context.Context) (string, string) {
+		return "http", rt.host
+	}
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxQueryLength: 48 * time.Hour}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+
+	handler := newFakeHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, marshal.WriteLabelResponseJSON(logproto.LabelResponse{Values: []string{"foo"}}, w))
+		}),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.NoError(t, marshal.WriteLabelResponseJSON(logproto.LabelResponse{Values: []string{"bar"}}, w))
+		}),
+	)
+	rt.setHandler(handler)
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, path := range []string{
+		// split and sent by the labels tripperware.
+		fmt.Sprintf("/loki/api/v1/labels?start=%d&end=%d", testTime.Add(-2*time.Hour).UnixNano(), testTime.UnixNano()),
+		// forwarded as is.
+		"/loki/api/v1/labels/foo/values",
+	} {
+		req, err := http.NewRequest(http.MethodGet, path, nil)
+		require.NoError(t, err)
+		req = req.WithContext(ctx)
+		require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+		// the default transport can't send requests without a host.
+		resp, err := tpw(http.DefaultTransport).RoundTrip(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+	require.Equal(t, 2, handler.count)
+}
+
 func TestRegexpParamsSupport(t *testing.T) {
 	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
 	if stopper != nil {
@@ -480,6 +886,8 @@ func TestPostQueries(t *testing.T) {
 			return nil, nil
 		}),
 		fakeLimits{},
+		util_log.Logger,
+		false,
 	).RoundTrip(req)
 	require.NoError(t, err)
 }
@@ -515,6 +923,58 @@ func TestEntriesLimitsTripperware(t *testing.T) {
 	require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, "max entries limit per query exceeded, limit > max_entries_limit (10000 > 5000)"), err)
 }
 
+func TestEntriesLimitsClampTripperware(t *testing.T) {
+	cfg := testConfig
+	cfg.ClampMaxEntriesLimit = true
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{maxEntriesLimitPerQuery: 5000}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	for _, path := range []string{"/loki/api/v1/query_range", "/loki/api/v1/query"} {
+		t.Run(path, func(t *testing.T) {
+			var lreq queryrange.Request = &LokiRequest{
+				Query:     `{app="foo"}`, // no regex so it should go to the querier
+				Limit:     10000,
+				StartTs:   testTime.Add(-6 * time.Hour),
+				EndTs:     testTime,
+				Direction: logproto.FORWARD,
+				Path:      path,
+			}
+			if path == "/loki/api/v1/query" {
+				lreq = &LokiInstantRequest{
+					Query:     `{app="foo"}`,
+					Limit:     10000,
+					TimeTs:    testTime,
+					Direction: logproto.FORWARD,
+					Path:      path,
+				}
+			}
+
+			ctx := user.InjectOrgID(context.Background(), "1")
+			req, err := LokiCodec.EncodeRequest(ctx, lreq)
+			require.NoError(t, err)
+
+			req = req.WithContext(ctx)
+			err = user.InjectOrgIDIntoHTTPRequest(ctx, req)
+			require.NoError(t, err)
+
+			count, h := promqlResult(streams)
+			rt.setHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "5000", r.URL.Query().Get("limit"))
+				h.ServeHTTP(rw, r)
+			}))
+			_, err = tpw(rt).RoundTrip(req)
+			require.NoError(t, err)
+			require.Equal(t, 1, *count)
+		})
+	}
+}
+
 func TestEntriesLimitWithZeroTripperware(t *testing.T) {
 	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
 	if stopper != nil {
@@ -546,14 +1006,315 @@ func TestEntriesLimitWithZeroTripperware(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestBlockedQueryFunctionsTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{blockedQueryFunctions: []string{"ip"}}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := counter()
+	rt.setHandler(h)
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, lreq := range []queryrange.Request{
+		&LokiInstantRequest{
+			Query:     `{app="foo"} |= ip("10.0.0.1")`,
+			Limit:     1000,
+			TimeTs:    testTime,
+			Direction: logproto.FORWARD,
+			Path:      "/loki/api/v1/query",
+		},
+		&LokiRequest{
+			Query:     `{app="foo"} | logfmt | addr = ip("10.0.0.1")`,
+			Limit:     1000,
+			StartTs:   testTime.Add(-6 * time.Hour),
+			EndTs:     testTime,
+			Direction: logproto.FORWARD,
+			Path:      "/loki/api/v1/query_range",
+		},
+	} {
+		t.Run(lreq.GetQuery(), func(t *testing.T) {
+			req, err := LokiCodec.EncodeRequest(ctx, lreq)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			_, err = tpw(rt).RoundTrip(req)
+			require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, blockedQueryFunctionErrTmpl, "ip"), err)
+			require.Equal(t, 0, *count)
+		})
+	}
+}
+
+func TestDownstreamHeadersTripperware(t *testing.T) {
+	cfg := testConfig
+	cfg.DownstreamDeniedHeaders = []string{"authorization"}
+	tpw, stopper, err := NewTripperware(cfg, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	var authorization []string
+	count, h := promqlResult(streams)
+	rt.setHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		h.ServeHTTP(w, r)
+	}))
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"}`, // no filter so it is forwarded as is to the querier
+		Limit:     1000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+	req.Header.Set("Authorization", "Bearer secret")
+
+	_, err = tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, *count)
+	require.Equal(t, []string{""}, authorization)
+	// the header of the caller's request is left untouched.
+	require.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+}
+
+func TestDuplicateParamsTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := counter()
+	rt.setHandler(h)
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, path := range []string{"/loki/api/v1/query", "/loki/api/v1/query_range"} {
+		t.Run(path, func(t *testing.T) {
+			// a log query without filter is forwarded as is to the querier, without being decoded.
+			params := url.Values{"query": {`{app="foo"}`}, "limit": {"10", "10000"}}
+			req, err := http.NewRequest(http.MethodGet, path+"?"+params.Encode(), nil)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			_, err = tpw(rt).RoundTrip(req)
+			require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, errDuplicateParamTmpl, "limit"), err)
+			require.Equal(t, 0, *count)
+		})
+	}
+}
+
+func TestLabelValuesTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{blockedQueryLabels: []string{"secret"}}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	for _, tc := range []struct {
+		path    string
+		blocked bool
+	}{
+		{path: "/loki/api/v1/label/app/values"},
+		{path: "/loki/api/v1/label/secret/values", blocked: true},
+		{path: "/api/prom/label/secret/values", blocked: true},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			count, h := labelsResult(logproto.LabelResponse{Values: []string{"foo"}})
+			rt.setHandler(h)
+			req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+			require.NoError(t, err)
+			req = req.WithContext(ctx)
+			require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+			_, err = tpw(rt).RoundTrip(req)
+			if tc.blocked {
+				require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, blockedQueryLabelErrTmpl, "secret"), err)
+				require.Equal(t, 0, *count)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, *count)
+		})
+	}
+}
+
+func TestLabelValuesWithCountsTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryLength: 48 * time.Hour}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+
+	lreq := &LokiLabelNamesRequest{
+		StartTs:    testTime.Add(-25 * time.Hour), // split in 2 sub-queries
+		EndTs:      testTime,
+		Path:       "/loki/api/v1/label/app/values",
+		WithCounts: true,
+	}
+
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+
+	req = req.WithContext(ctx)
+	err = user.InjectOrgIDIntoHTTPRequest(ctx, req)
+	require.NoError(t, err)
+
+	handler := newFakeHandler(
+		// the series of foo have entries in both sub-queries, they are counted by each of them.
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "true", r.URL.Query().Get("with_counts"))
+			require.NoError(t, marshal.WriteLabelCountsResponseJSON([]loghttp.LabelValueCount{{Value: "bar", Count: 2}, {Value: "foo", Count: 100}}, w))
+		}),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "true", r.URL.Query().Get("with_counts"))
+			require.NoError(t, marshal.WriteLabelCountsResponseJSON([]loghttp.LabelValueCount{{Value: "blip", Count: 1}, {Value: "foo", Count: 23}}, w))
+		}),
+	)
+	rt.setHandler(handler)
+	resp, err := tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, handler.count)
+
+	var res loghttp.LabelCountsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	require.Equal(t, loghttp.LabelCountsResponse{
+		Status: "success",
+		Data: []loghttp.LabelValueCount{
+			{Value: "bar", Count: 2},
+			{Value: "blip", Count: 1},
+			{Value: "foo", Count: 123},
+		},
+	}, res)
+}
+
+func TestMaxBytesTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryParallelism: 1}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := promqlResult(streams)
+	rt.setHandler(h)
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"}`, // no filter so it is neither split nor sharded
+		Limit:     1000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	params := req.URL.Query()
+	params.Set("max_bytes", "40")
+	req.URL.RawQuery = params.Encode()
+	req = req.WithContext(ctx)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+
+	resp, err := tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, *count)
+	res, err := LokiCodec.DecodeResponse(ctx, resp, lreq)
+	require.NoError(t, err)
+
+	result := res.(*LokiResponse).Data.Result
+	require.Len(t, result, 1)
+	require.Equal(t, []logproto.Entry{{Timestamp: testTime.Add(-4 * time.Hour), Line: "foo"}}, result[0].Entries)
+	require.Equal(t, []string{fmt.Sprintf(maxBytesWarningTmpl, 1, 2, 40)}, res.(*LokiResponse).Warnings)
+}
+
+func TestNDJSONTripperware(t *testing.T) {
+	tpw, stopper, err := NewTripperware(testConfig, util_log.Logger, fakeLimits{maxQueryParallelism: 1}, chunk.SchemaConfig{}, nil)
+	if stopper != nil {
+		defer stopper.Stop()
+	}
+	require.NoError(t, err)
+	rt, err := newfakeRoundTripper()
+	require.NoError(t, err)
+	defer rt.Close()
+	count, h := promqlResult(streams)
+	rt.setHandler(h)
+
+	lreq := &LokiRequest{
+		Query:     `{app="foo"}`, // no filter so it is neither split nor sharded
+		Limit:     1000,
+		StartTs:   testTime.Add(-6 * time.Hour),
+		EndTs:     testTime,
+		Direction: logproto.FORWARD,
+		Path:      "/loki/api/v1/query_range",
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req, err := LokiCodec.EncodeRequest(ctx, lreq)
+	require.NoError(t, err)
+	req = req.WithContext(ctx)
+	require.NoError(t, user.InjectOrgIDIntoHTTPRequest(ctx, req))
+	req.Header.Set("Accept", ndjsonMediaType)
+
+	resp, err := tpw(rt).RoundTrip(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, *count)
+	require.Equal(t, ndjsonMediaType, resp.Header.Get("Content-Type"))
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"line":"foo"`)
+	require.Contains(t, lines[1], `"line":"barr"`)
+}
+
 type fakeLimits struct {
 	maxQueryLength          time.Duration
 	maxQueryParallelism     int
 	maxQueryLookback        time.Duration
 	maxEntriesLimitPerQuery int
 	maxSeries               int
+	maxStreamsMatched       int
 	splits                  map[string]time.Duration
 	minShardingLookback     time.Duration
+	cacheKeyJitter          bool
+	maxQuerySplits          int
+	maxQuerySplitsMode      string
+	blockedQueryLabels      []string
+	blockedQueryFunctions   []string
+	allowPartialResults     bool
+	maxConcurrentMetadata   int
+	maxQueryBytes           int
+	resultsCacheTTL         time.Duration
+	autoStep                bool
+	exposeLimitsHeaders     bool
+	maxDashboardQueries     int
+	shardingDisabled        bool
 }
 
 func (f fakeLimits) QuerySplitDuration(key string) time.Duration {
@@ -585,6 +1346,62 @@ func (f fakeLimits) MaxQuerySeries(string) int {
 	return f.maxSeries
 }
 
+func (f fakeLimits) MaxStreamsMatchedPerQuery(string) int {
+	return f.maxStreamsMatched
+}
+
+func (f fakeLimits) QueryCacheKeyJitter(string) bool {
+	return f.cacheKeyJitter
+}
+
+func (f fakeLimits) MaxQuerySplits(string) int {
+	return f.maxQuerySplits
+}
+
+func (f fakeLimits) MaxQuerySplitsMode(string) string {
+	return f.maxQuerySplitsMode
+}
+
+func (f fakeLimits) BlockedQueryLabels(string) []string {
+	return f.blockedQueryLabels
+}
+
+func (f fakeLimits) BlockedQueryFunctions(string) []string {
+	return f.blockedQueryFunctions
+}
+
+func (f fakeLimits) AllowPartialResults(string) bool {
+	return f.allowPartialResults
+}
+
+func (f fakeLimits) MaxConcurrentMetadataQueries(string) int {
+	return f.maxConcurrentMetadata
+}
+
+func (f fakeLimits) MaxQueryBytes(string) int {
+	return f.maxQueryBytes
+}
+
+func (f fakeLimits) ResultsCacheTTL(string) time.Duration {
+	return f.resultsCacheTTL
+}
+
+func (f fakeLimits) AutoStep(string) bool {
+	return f.autoStep
+}
+
+func (f fakeLimits) ExposeLimitsHeaders(string) bool {
+	return f.exposeLimitsHeaders
+}
+
+func (f fakeLimits) MaxConcurrentQueriesPerDashboard(string) int {
+	return f.maxDashboardQueries
+}
+
+func (f fakeLimits) ShardingEnabled(string) bool {
+	return !f.shardingDisabled
+}
+
 func (f fakeLimits) MaxCacheFreshness(string) time.Duration {
 	return 1 * time.Minute
 }
@@ -644,6 +1461,19 @@ func seriesResult(v logproto.SeriesResponse) (*int, http.Handler) {
 	})
 }
 
+func labelsResult(v logproto.LabelResponse) (*int, http.Handler) {
+	count := 0
+	var lock sync.Mutex
+	return &count, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err := marshal.WriteLabelResponseJSON(v, w); err != nil {
+			panic(err)
+		}
+		count++
+	})
+}
+
 type fakeHandler struct {
 	count int
 	lock  sync.Mutex
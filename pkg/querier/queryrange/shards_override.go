@@ -0,0 +1,55 @@
+package queryrange
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/weaveworks/common/httpgrpc"
+)
+
+const (
+	// shardsOverrideHeader forces the shard factor of a single query, e.g. to reproduce shard specific bugs.
+	// 0 and 1 disable its sharding.
+	shardsOverrideHeader = "X-Loki-Shards"
+
+	shardsOverrideCtxKey ctxKeyType = "shardsOverride"
+
+	errInvalidShardsOverrideTmpl = "invalid " + shardsOverrideHeader + " header %q, it must be a non-negative integer"
+
+	shardingReasonOverride = "sharding disabled by the " + shardsOverrideHeader + " header"
+)
+
+// withShardsOverride injects in the request context the shard factor of its X-Loki-Shards header, when allowed.
+func withShardsOverride(req *http.Request, allowed bool) (*http.Request, error) {
+	value := req.Header.Get(shardsOverrideHeader)
+	if !allowed || value == "" {
+		return req, nil
+	}
+	shards, err := strconv.Atoi(value)
+	if err != nil || shards < 0 {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, errInvalidShardsOverrideTmpl, value)
+	}
+	return req.WithContext(context.WithValue(req.Context(), shardsOverrideCtxKey, shards)), nil
+}
+
+func shardsOverride(ctx context.Context) (int, bool) {
+	shards, ok := ctx.Value(shardsOverrideCtxKey).(int)
+	return shards, ok
+}
+
+// shardFactor returns the shard factor of the queries of ctx over a period config with rowShards. It is the one
+// of their X-Loki-Shards header when set, clamped to rowShards and rounded down to one of its divisors so that
+// the shards still partition the index rows and the ingester index shards. Factors below 2 disable sharding.
+func shardFactor(ctx context.Context, rowShards uint32) int {
+	shards, ok := shardsOverride(ctx)
+	if !ok || shards >= int(rowShards) {
+		return int(rowShards)
+	}
+	for ; shards > 1; shards-- {
+		if int(rowShards)%shards == 0 {
+			return shards
+		}
+	}
+	return shards
+}
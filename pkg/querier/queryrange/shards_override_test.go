@@ -0,0 +1,173 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+func Test_withShardsOverride(t *testing.T) {
+	newRequest := func(header string) *http.Request {
+		req, err := http.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set(shardsOverrideHeader, header)
+		}
+		return req
+	}
+
+	// the header is ignored unless allowed.
+	req, err := withShardsOverride(newRequest("4"), false)
+	require.NoError(t, err)
+	_, ok := shardsOverride(req.Context())
+	require.False(t, ok)
+
+	req, err = withShardsOverride(newRequest(""), true)
+	require.NoError(t, err)
+	_, ok = shardsOverride(req.Context())
+	require.False(t, ok)
+
+	req, err = withShardsOverride(newRequest("4"), true)
+	require.NoError(t, err)
+	shards, ok := shardsOverride(req.Context())
+	require.True(t, ok)
+	require.Equal(t, 4, shards)
+
+	for _, invalid := range []string{"-1", "four"} {
+		_, err = withShardsOverride(newRequest(invalid), true)
+		require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, errInvalidShardsOverrideTmpl, invalid), err)
+	}
+}
+
+func Test_shardFactor(t *testing.T) {
+	require.Equal(t, 16, shardFactor(context.Background(), 16))
+
+	for _, tc := range []struct {
+		override, expected int
+	}{
+		{override: 0, expected: 0},
+		{override: 1, expected: 1},
+		{override: 2, expected: 2},
+		{override: 3, expected: 2},
+		{override: 6, expected: 4},
+		{override: 8, expected: 8},
+		{override: 15, expected: 8},
+		{override: 16, expected: 16},
+		{override: 64, expected: 16},
+	} {
+		t.Run(fmt.Sprint(tc.override), func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), shardsOverrideCtxKey, tc.override)
+			require.Equal(t, tc.expected, shardFactor(ctx, 16))
+		})
+	}
+}
+
+func Test_astMapper_ShardsOverride(t *testing.T) {
+	for _, tc := range []struct {
+		override int
+		expected []string
+	}{
+		{override: 2, expected: []string{"0_of_2", "1_of_2"}},
+		{override: 3, expected: []string{"0_of_2", "1_of_2"}},
+		{override: 8, expected: []string{"0_of_4", "1_of_4", "2_of_4", "3_of_4"}},
+		{override: 1, expected: nil},
+	} {
+		t.Run(fmt.Sprint(tc.override), func(t *testing.T) {
+			var (
+				mtx    sync.Mutex
+				shards []string
+			)
+			handler := queryrange.HandlerFunc(func(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				shards = append(shards, req.(*LokiRequest).Shards...)
+				return &LokiResponse{
+					Status:    loghttp.QueryStatusSuccess,
+					Direction: logproto.BACKWARD,
+					Limit:     100,
+					Version:   1,
+					Data:      LokiData{ResultType: loghttp.ResultTypeStream},
+				}, nil
+			})
+			mware := newASTMapperware(
+				ShardingConfigs{chunk.PeriodConfig{RowShards: 4}},
+				handler,
+				log.NewNopLogger(),
+				nilShardingMetrics,
+				fakeLimits{maxSeries: math.MaxInt32, maxQueryParallelism: 1},
+			)
+
+			ctx := context.WithValue(context.Background(), shardsOverrideCtxKey, tc.override)
+			_, err := mware.Do(ctx, defaultReq().WithQuery(`{foo="bar"} |= "baz"`))
+			require.NoError(t, err)
+			require.ElementsMatch(t, tc.expected, shards)
+		})
+	}
+}
+
+func Test_shardSplitter_ShardsOverride(t *testing.T) {
+	var didShard bool
+	splitter := &shardSplitter{
+		shardingware: queryrange.HandlerFunc(func(ctx context.Context, req queryrange.Request) (queryrange.Response, error) {
+			didShard = true
+			return lokiResps[0], nil
+		}),
+		next:   mockHandler(lokiResps[1], nil),
+		now:    time.Now,
+		limits: fakeLimits{},
+		logger: log.NewNopLogger(),
+	}
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	_, err := splitter.Do(context.WithValue(ctx, shardsOverrideCtxKey, 0), defaultReq())
+	require.NoError(t, err)
+	require.False(t, didShard)
+
+	_, err = splitter.Do(context.WithValue(ctx, shardsOverrideCtxKey, 2), defaultReq())
+	require.NoError(t, err)
+	require.True(t, didShard)
+}
+
+func Test_SeriesShardingHandler_ShardsOverride(t *testing.T) {
+	sharding := NewSeriesQueryShardMiddleware(
+		log.NewNopLogger(),
+		ShardingConfigs{chunk.PeriodConfig{RowShards: 4}},
+		queryrange.NewInstrumentMiddlewareMetrics(nil),
+		nilShardingMetrics,
+		fakeLimits{maxQueryParallelism: 10},
+		LokiCodec,
+		true,
+	)
+	var (
+		mtx    sync.Mutex
+		shards []string
+	)
+	ctx := context.WithValue(user.InjectOrgID(context.Background(), "1"), shardsOverrideCtxKey, 2)
+	_, err := sharding.Wrap(queryrange.HandlerFunc(func(c context.Context, r queryrange.Request) (queryrange.Response, error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		shards = append(shards, r.(*LokiSeriesRequest).Shards...)
+		return &LokiSeriesResponse{Status: "success", Version: 1}, nil
+	})).Do(ctx, &LokiSeriesRequest{
+		Match:   []string{`{foo="bar"}`},
+		StartTs: time.Unix(0, 1),
+		EndTs:   time.Unix(0, 10),
+		Path:    "/loki/api/v1/series",
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"0_of_2", "1_of_2"}, shards)
+}
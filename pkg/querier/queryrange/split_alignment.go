@@ -0,0 +1,129 @@
+package queryrange
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+const (
+	// SplitAlignmentInterval aligns the sub-queries of metric queries to multiples of the split interval,
+	// the ones of log queries start every split interval from their start.
+	SplitAlignmentInterval = "interval"
+	// SplitAlignmentIndexTables aligns the sub-queries to the index tables of the schema.
+	SplitAlignmentIndexTables = "index_tables"
+)
+
+// SplitAlignments lists the supported alignments of the sub-queries.
+var SplitAlignments = []string{SplitAlignmentInterval, SplitAlignmentIndexTables}
+
+func validateSplitAlignment(alignment string) error {
+	switch alignment {
+	case "", SplitAlignmentInterval, SplitAlignmentIndexTables:
+		return nil
+	default:
+		return fmt.Errorf("unsupported split alignment %q, supported values are %q", alignment, SplitAlignments)
+	}
+}
+
+// splitters returns the splitters of the log and metric range queries for the split alignment of the config.
+func splitters(cfg Config, schema chunk.SchemaConfig) (log, metric Splitter) {
+	if cfg.SplitAlignment != SplitAlignmentIndexTables {
+		return splitByTime, splitMetricByTime
+	}
+	return splitByIndexTables(schema.Configs), splitMetricByIndexTables(schema.Configs)
+}
+
+// splitByIndexTables returns a splitter whose sub-queries are aligned to the index tables of the schema, so
+// that each of them reads whole tables. They span as many consecutive tables as fit in the split interval, at
+// least one.
+func splitByIndexTables(configs []chunk.PeriodConfig) Splitter {
+	return func(req queryrange.Request, interval time.Duration) []queryrange.Request {
+		return splitByRanges(req, func(start, end time.Time, callback func(start, end time.Time)) {
+			for start.Before(end) {
+				newEnd := indexTablesEnd(configs, interval, start, end)
+				callback(start, newEnd)
+				start = newEnd
+			}
+		})
+	}
+}
+
+// splitMetricByIndexTables is splitByIndexTables for metric queries. Their sub-queries end on the last step
+// before the table boundary and the next ones start a step later, so that each step is evaluated once.
+func splitMetricByIndexTables(configs []chunk.PeriodConfig) Splitter {
+	return func(r queryrange.Request, interval time.Duration) []queryrange.Request {
+		var reqs []queryrange.Request
+		lokiReq := r.(*LokiRequest)
+		step := time.Duration(lokiReq.Step) * time.Millisecond
+		for start := lokiReq.StartTs; start.Before(lokiReq.EndTs); {
+			end := lokiReq.EndTs
+			if boundary := indexTablesEnd(configs, interval, start, lokiReq.EndTs); boundary.Before(lokiReq.EndTs) {
+				end = start.Add((boundary.Sub(start) - 1) / step * step)
+				if !end.Add(step).Before(lokiReq.EndTs) {
+					end = lokiReq.EndTs
+				}
+			}
+			reqs = append(reqs, &LokiRequest{
+				Query:          lokiReq.Query,
+				Limit:          lokiReq.Limit,
+				Step:           lokiReq.Step,
+				Direction:      lokiReq.Direction,
+				Path:           lokiReq.Path,
+				StartTs:        start,
+				EndTs:          end,
+				IsMetricQuery:  lokiReq.IsMetricQuery,
+				CachingOptions: lokiReq.CachingOptions,
+			})
+			start = end.Add(step)
+		}
+		return reqs
+	}
+}
+
+// indexTablesEnd returns the end of the sub-query starting at start: the last table boundary within the
+// interval, or the first one after start if there is none, capped to end.
+func indexTablesEnd(configs []chunk.PeriodConfig, interval time.Duration, start, end time.Time) time.Time {
+	newEnd := nextIndexTableBoundary(configs, start)
+	for !newEnd.IsZero() && newEnd.Before(end) {
+		next := nextIndexTableBoundary(configs, newEnd)
+		if next.IsZero() || next.Sub(start) > interval {
+			break
+		}
+		newEnd = next
+	}
+	if newEnd.IsZero() || newEnd.After(end) {
+		return end
+	}
+	return newEnd
+}
+
+// nextIndexTableBoundary returns the first index table boundary of the schema after t: the start of the next
+// table of the period config of t, or of the next period config, whichever comes first. It returns the zero
+// time when t is within the last table.
+func nextIndexTableBoundary(configs []chunk.PeriodConfig, t time.Time) time.Time {
+	for i, cfg := range configs {
+		if from := cfg.From.Time.Time(); from.After(t) {
+			return from
+		}
+		if i+1 < len(configs) && !configs[i+1].From.Time.Time().After(t) {
+			continue
+		}
+
+		// the tables of a period config are numbered from the epoch, see PeriodicTableConfig.TableFor.
+		var next time.Time
+		if period := cfg.IndexTables.Period; period > 0 {
+			next = time.Unix(0, (t.UnixNano()/period.Nanoseconds()+1)*period.Nanoseconds())
+		}
+		if i+1 < len(configs) {
+			if from := configs[i+1].From.Time.Time(); next.IsZero() || from.Before(next) {
+				next = from
+			}
+		}
+		return next
+	}
+	return time.Time{}
+}
@@ -0,0 +1,167 @@
+package queryrange
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/validation"
+)
+
+func mustTime(t *testing.T, value string) time.Time {
+	ts, err := time.Parse(time.RFC3339, value)
+	require.NoError(t, err)
+	return ts
+}
+
+// splitRanges formats the time ranges of the sub-queries.
+func splitRanges(reqs []queryrange.Request) [][2]string {
+	ranges := make([][2]string, 0, len(reqs))
+	for _, req := range reqs {
+		start, end := req.(*LokiRequest).StartTs, req.(*LokiRequest).EndTs
+		ranges = append(ranges, [2]string{start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)})
+	}
+	return ranges
+}
+
+// testPeriodConfigs are daily index tables until 2020-01-03, then weekly ones, which start on Thursdays.
+func testPeriodConfigs(t *testing.T) []chunk.PeriodConfig {
+	return []chunk.PeriodConfig{
+		{
+			From:        chunk.DayTime{Time: model.TimeFromUnix(mustTime(t, "2020-01-01T00:00:00Z").Unix())},
+			IndexTables: chunk.PeriodicTableConfig{Period: 24 * time.Hour},
+		},
+		{
+			From:        chunk.DayTime{Time: model.TimeFromUnix(mustTime(t, "2020-01-03T00:00:00Z").Unix())},
+			IndexTables: chunk.PeriodicTableConfig{Period: 7 * 24 * time.Hour},
+		},
+	}
+}
+
+func Test_splitByIndexTables(t *testing.T) {
+	configs := testPeriodConfigs(t)
+	req := &LokiRequest{
+		Query:   `{app="foo"} |= "foo"`,
+		StartTs: mustTime(t, "2020-01-01T18:00:00Z"),
+		EndTs:   mustTime(t, "2020-01-10T06:00:00Z"),
+	}
+
+	// the fixed interval splits start every interval from the start of the query, across the tables.
+	fixed := splitByTime(req, 24*time.Hour)
+	require.Len(t, fixed, 9)
+	require.Equal(t, [2]string{"2020-01-01T18:00:00Z", "2020-01-02T18:00:00Z"}, splitRanges(fixed)[0])
+
+	for _, tc := range []struct {
+		interval time.Duration
+		expected [][2]string
+	}{
+		{
+			interval: 24 * time.Hour,
+			expected: [][2]string{
+				{"2020-01-01T18:00:00Z", "2020-01-02T00:00:00Z"},
+				{"2020-01-02T00:00:00Z", "2020-01-03T00:00:00Z"},
+				// a weekly table is longer than the interval, but isn't split.
+				{"2020-01-03T00:00:00Z", "2020-01-09T00:00:00Z"},
+				{"2020-01-09T00:00:00Z", "2020-01-10T06:00:00Z"},
+			},
+		},
+		{
+			interval: 48 * time.Hour,
+			expected: [][2]string{
+				{"2020-01-01T18:00:00Z", "2020-01-03T00:00:00Z"},
+				{"2020-01-03T00:00:00Z", "2020-01-09T00:00:00Z"},
+				{"2020-01-09T00:00:00Z", "2020-01-10T06:00:00Z"},
+			},
+		},
+	} {
+		t.Run(tc.interval.String(), func(t *testing.T) {
+			require.Equal(t, tc.expected, splitRanges(splitByIndexTables(configs)(req, tc.interval)))
+		})
+	}
+}
+
+func Test_splitMetricByIndexTables(t *testing.T) {
+	configs := testPeriodConfigs(t)
+	req := &LokiRequest{
+		Query:   `rate({app="foo"}[1m])`,
+		StartTs: mustTime(t, "2020-01-01T18:00:00Z"),
+		EndTs:   mustTime(t, "2020-01-10T06:00:00Z"),
+		Step:    time.Hour.Milliseconds(),
+	}
+
+	// the fixed interval splits are aligned to multiples of the interval.
+	fixed := splitMetricByTime(req, 24*time.Hour)
+	require.Len(t, fixed, 10)
+	require.Equal(t, [2]string{"2020-01-03T00:00:00Z", "2020-01-03T23:00:00Z"}, splitRanges(fixed)[2])
+
+	require.Equal(t, [][2]string{
+		{"2020-01-01T18:00:00Z", "2020-01-01T23:00:00Z"},
+		{"2020-01-02T00:00:00Z", "2020-01-02T23:00:00Z"},
+		{"2020-01-03T00:00:00Z", "2020-01-08T23:00:00Z"},
+		{"2020-01-09T00:00:00Z", "2020-01-10T06:00:00Z"},
+	}, splitRanges(splitMetricByIndexTables(configs)(req, 24*time.Hour)))
+}
+
+func Test_nextIndexTableBoundary(t *testing.T) {
+	configs := testPeriodConfigs(t)
+	for _, tc := range []struct {
+		t, expected string
+	}{
+		{t: "2019-12-31T12:00:00Z", expected: "2020-01-01T00:00:00Z"},
+		{t: "2020-01-01T00:00:00Z", expected: "2020-01-02T00:00:00Z"},
+		{t: "2020-01-02T12:00:00Z", expected: "2020-01-03T00:00:00Z"},
+		{t: "2020-01-03T00:00:00Z", expected: "2020-01-09T00:00:00Z"},
+		{t: "2020-01-09T00:00:00Z", expected: "2020-01-16T00:00:00Z"},
+	} {
+		next := nextIndexTableBoundary(configs, mustTime(t, tc.t))
+		require.Equal(t, tc.expected, next.UTC().Format(time.RFC3339), tc.t)
+	}
+
+	// the tables of a non periodic config never end.
+	require.True(t, nextIndexTableBoundary([]chunk.PeriodConfig{{}}, mustTime(t, "2020-01-01T00:00:00Z")).IsZero())
+}
+
+func Test_splitIntervals_IndexTablesMaxQuerySplits(t *testing.T) {
+	req := &LokiRequest{
+		Query:   `{app="foo"} |= "foo"`,
+		StartTs: mustTime(t, "2020-01-02T12:00:00Z"),
+		EndTs:   mustTime(t, "2020-01-03T12:00:00Z"),
+	}
+	limits := fakeLimits{
+		splits:             map[string]time.Duration{"1": time.Hour},
+		maxQuerySplits:     1,
+		maxQuerySplitsMode: validation.QuerySplitsModeWiden,
+	}
+	// the query spans two period configs, the interval is widened until its splits are merged.
+	intervals, interval, err := splitIntervals(context.Background(), limits, splitByIndexTables(testPeriodConfigs(t)), "1", req)
+	require.NoError(t, err)
+	require.Equal(t, [][2]string{{"2020-01-02T12:00:00Z", "2020-01-03T12:00:00Z"}}, splitRanges(intervals))
+	require.Equal(t, 256*time.Hour, interval)
+
+	// the splits at the boundary of the period configs fit in the limit.
+	limits.maxQuerySplits = 2
+	intervals, interval, err = splitIntervals(context.Background(), limits, splitByIndexTables(testPeriodConfigs(t)), "1", req)
+	require.NoError(t, err)
+	require.Len(t, intervals, 2)
+	require.Equal(t, time.Hour, interval)
+
+	// the splits aligned to the interval are merged once it is wide enough, even when widening it once doesn't
+	// reduce them.
+	limits.maxQuerySplits = 1
+	intervals, interval, err = splitIntervals(context.Background(), limits, splitMetricByTime, "1", &LokiRequest{
+		Query:   `rate({app="foo"}[1m])`,
+		Step:    60000,
+		StartTs: mustTime(t, "2020-01-02T01:30:00Z"),
+		EndTs:   mustTime(t, "2020-01-02T02:30:00Z"),
+	})
+	require.NoError(t, err)
+	require.Len(t, intervals, 1)
+	require.Equal(t, mustTime(t, "2020-01-02T01:30:00Z"), intervals[0].(*LokiRequest).StartTs)
+	require.Equal(t, mustTime(t, "2020-01-02T02:30:00Z"), intervals[0].(*LokiRequest).EndTs)
+	require.Greater(t, interval, 2*time.Hour)
+}
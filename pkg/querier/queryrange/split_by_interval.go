@@ -3,6 +3,7 @@ package queryrange
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
@@ -11,12 +12,23 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/weaveworks/common/httpgrpc"
+	"go.uber.org/atomic"
 
 	"github.com/grafana/loki/pkg/tenant"
 
 	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/validation"
 )
 
+// NonSplittableOps lists the range vector operations which don't distribute over time splits.
+// Queries containing any of them are sent downstream as a single sub-query.
+var NonSplittableOps = map[string]bool{
+	logql.OpRangeTypeQuantile: true,
+	logql.OpRangeTypeStddev:   true,
+	logql.OpRangeTypeStdvar:   true,
+}
+
 type lokiResult struct {
 	req queryrange.Request
 	ch  chan *packedResp
@@ -28,7 +40,8 @@ type packedResp struct {
 }
 
 type SplitByMetrics struct {
-	splits prometheus.Histogram
+	splits       prometheus.Histogram
+	failedSplits prometheus.Counter
 }
 
 func NewSplitByMetrics(r prometheus.Registerer) *SplitByMetrics {
@@ -39,6 +52,11 @@ func NewSplitByMetrics(r prometheus.Registerer) *SplitByMetrics {
 			Help:      "Number of time-based partitions (sub-requests) per request",
 			Buckets:   prometheus.ExponentialBuckets(1, 4, 5), // 1 -> 1024
 		}),
+		failedSplits: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Name:      "query_frontend_failed_partitions_total",
+			Help:      "Total number of time-based partitions (sub-requests) which failed in requests returning partial results",
+		}),
 	}
 }
 
@@ -89,11 +107,28 @@ func (h *splitByInterval) Process(
 	threshold int64,
 	input []*lokiResult,
 	userID string,
-) ([]queryrange.Response, error) {
-	var responses []queryrange.Response
+) ([]queryrange.Response, int, error) {
+	var (
+		responses  []queryrange.Response
+		failed     int
+		failure    error
+		allowFails = h.limits.AllowPartialResults(userID)
+	)
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	// reaching the series limit cancels the splits still running rather than waiting for them.
+	var (
+		limitErr  = atomic.NewError(nil)
+		limitOnce sync.Once
+	)
+	onLimit := func(err error) {
+		limitOnce.Do(func() {
+			limitErr.Store(err)
+			cancel()
+		})
+	}
+
 	ch := h.Feed(ctx, input)
 
 	// queries with 0 limits should not be exited early
@@ -108,8 +143,9 @@ func (h *splitByInterval) Process(
 		p = len(input)
 	}
 
-	// per request wrapped handler for limiting the amount of series.
-	next := newSeriesLimiter(h.limits.MaxQuerySeries(userID)).Wrap(h.next)
+	// per request wrapped handlers for limiting the amount of series and of bytes processed.
+	next := newSeriesLimiter(h.limits.MaxQuerySeries(userID), h.limits.MaxStreamsMatchedPerQuery(userID), onLimit).Wrap(h.next)
+	next = newBytesLimiter(h.limits.MaxQueryBytes(userID)).Wrap(next)
 	for i := 0; i < p; i++ {
 		go h.loop(ctx, ch, next)
 	}
@@ -117,10 +153,18 @@ func (h *splitByInterval) Process(
 	for _, x := range input {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			if err := limitErr.Load(); err != nil {
+				return nil, 0, err
+			}
+			return nil, 0, ctx.Err()
 		case data := <-x.ch:
 			if data.err != nil {
-				return nil, data.err
+				if !allowFails || isClientError(data.err) {
+					return nil, 0, data.err
+				}
+				failed++
+				failure = data.err
+				continue
 			}
 
 			responses = append(responses, data.resp)
@@ -130,7 +174,7 @@ func (h *splitByInterval) Process(
 				threshold -= casted.Count()
 
 				if threshold <= 0 {
-					return responses, nil
+					return responses, failed, nil
 				}
 
 			}
@@ -138,7 +182,18 @@ func (h *splitByInterval) Process(
 		}
 	}
 
-	return responses, nil
+	// there's nothing to return if all the splits failed.
+	if len(responses) == 0 && failure != nil {
+		return nil, 0, failure
+	}
+	return responses, failed, nil
+}
+
+// isClientError tells if err is an httpgrpc error with a 4xx status code, such as a limit being
+// reached, which is reported as is instead of being tolerated in partial results.
+func isClientError(err error) bool {
+	resp, ok := httpgrpc.HTTPResponseFromError(err)
+	return ok && resp.Code/100 == 4
 }
 
 func (h *splitByInterval) loop(ctx context.Context, ch <-chan *lokiResult, next queryrange.Handler) {
@@ -159,19 +214,84 @@ func (h *splitByInterval) loop(ctx context.Context, ch <-chan *lokiResult, next
 	}
 }
 
+// splitIntervals returns the sub-requests the request of the tenant is split into and their interval, widened
+// to fit the max query splits of the tenant if need be. The interval is 0 when the request isn't split.
+func splitIntervals(ctx context.Context, limits Limits, splitter Splitter, userid string, r queryrange.Request) ([]queryrange.Request, time.Duration, error) {
+	interval := limits.QuerySplitDuration(userid)
+	if interval == 0 || !isSplittable(ctx, r) {
+		return nil, 0, nil
+	}
+	if limits.QueryCacheKeyJitter(userid) {
+		// the split boundaries are offset like the cache key time buckets so that each sub-query is cached in one.
+		splitter = offsetSplitter(splitter, time.Duration(cacheKeyOffset(userid, interval))*time.Millisecond)
+	}
+
+	intervals := splitter(r, interval)
+	if maxSplits := limits.MaxQuerySplits(userid); maxSplits > 0 && len(intervals) > maxSplits {
+		if limits.MaxQuerySplitsMode(userid) != validation.QuerySplitsModeWiden {
+			return nil, 0, httpgrpc.Errorf(http.StatusBadRequest, maxQuerySplitsErrTmpl, len(intervals), maxSplits)
+		}
+		// widen the interval until the number of splits fits the limit,
+		// split boundaries are aligned so this may need more than one pass.
+		for len(intervals) > maxSplits {
+			n := len(intervals)
+			interval *= time.Duration((n + maxSplits - 1) / maxSplits)
+			intervals = splitter(r, interval)
+			// widening once may not reduce the splits, e.g. when a boundary aligned to the wider interval is
+			// still within the query, but it can't merge them anymore once it exceeds the end of the query.
+			if len(intervals) >= n && interval > time.Duration(r.GetEnd())*time.Millisecond {
+				return nil, 0, httpgrpc.Errorf(http.StatusBadRequest, maxQuerySplitsErrTmpl, n, maxSplits)
+			}
+		}
+	}
+	return intervals, interval, nil
+}
+
+// offsetSplitter shifts the split boundaries of splitter by offset.
+func offsetSplitter(splitter Splitter, offset time.Duration) Splitter {
+	return func(r queryrange.Request, interval time.Duration) []queryrange.Request {
+		reqs := splitter(shiftRequest(r, -offset), interval)
+		for i, req := range reqs {
+			reqs[i] = shiftRequest(req, offset)
+		}
+		return reqs
+	}
+}
+
+// shiftRequest returns a copy of the request with its time range shifted by d.
+func shiftRequest(r queryrange.Request, d time.Duration) queryrange.Request {
+	switch req := r.(type) {
+	case *LokiRequest:
+		shifted := *req
+		shifted.StartTs, shifted.EndTs = req.StartTs.Add(d), req.EndTs.Add(d)
+		return &shifted
+	case *LokiSeriesRequest:
+		shifted := *req
+		shifted.StartTs, shifted.EndTs = req.StartTs.Add(d), req.EndTs.Add(d)
+		return &shifted
+	case *LokiLabelNamesRequest:
+		shifted := *req
+		shifted.StartTs, shifted.EndTs = req.StartTs.Add(d), req.EndTs.Add(d)
+		return &shifted
+	default:
+		return r
+	}
+}
+
 func (h *splitByInterval) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
 	userid, err := tenant.TenantID(ctx)
 	if err != nil {
 		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
 	}
 
-	interval := h.limits.QuerySplitDuration(userid)
-	// skip split by if unset
+	intervals, interval, err := splitIntervals(ctx, h.limits, h.splitter, userid, r)
+	if err != nil {
+		return nil, err
+	}
+	// skip split by if unset or not splittable
 	if interval == 0 {
 		return h.next.Do(ctx, r)
 	}
-
-	intervals := h.splitter(r, interval)
 	h.metrics.splits.Observe(float64(len(intervals)))
 
 	// no interval should not be processed by the frontend.
@@ -207,31 +327,91 @@ func (h *splitByInterval) Do(ctx context.Context, r queryrange.Request) (queryra
 		})
 	}
 
-	resps, err := h.Process(ctx, h.limits.MaxQueryParallelism(userid), limit, input, userid)
+	resps, failed, err := h.Process(ctx, h.limits.MaxQueryParallelism(userid), limit, input, userid)
 	if err != nil {
 		return nil, err
 	}
-	return h.merger.MergeResponse(resps...)
+	var res queryrange.Response
+	if m, ok := h.merger.(seriesMerger); ok && isSeriesRequest(r) {
+		res, err = m.MergeSeriesResponses(h.limits.MaxQuerySeries(userid), resps...)
+	} else {
+		res, err = mergeRequestResponses(h.merger, r, resps...)
+	}
+	if err != nil || failed == 0 {
+		return res, err
+	}
+	h.metrics.failedSplits.Add(float64(failed))
+	return withPartialResults(res, failed, len(input)), nil
+}
+
+// requestMerger is implemented by mergers which can make use of the original request
+// when merging the responses of its sub-requests.
+type requestMerger interface {
+	MergeRequestResponses(r queryrange.Request, responses ...queryrange.Response) (queryrange.Response, error)
+}
+
+// mergeRequestResponses merges the responses of the sub-requests of r, passing r along
+// when the merger supports it.
+func mergeRequestResponses(merger queryrange.Merger, r queryrange.Request, responses ...queryrange.Response) (queryrange.Response, error) {
+	if m, ok := merger.(requestMerger); ok {
+		return m.MergeRequestResponses(r, responses...)
+	}
+	return merger.MergeResponse(responses...)
+}
+
+// seriesMerger is implemented by mergers which can stop merging series responses once they
+// hold more than a maximum of unique series.
+type seriesMerger interface {
+	MergeSeriesResponses(maxSeries int, responses ...queryrange.Response) (queryrange.Response, error)
+}
+
+func isSeriesRequest(r queryrange.Request) bool {
+	_, ok := r.(*LokiSeriesRequest)
+	return ok
+}
+
+// isSplittable tells if a request can be split by time, which is not the case for queries
+// containing any of the NonSplittableOps.
+func isSplittable(ctx context.Context, r queryrange.Request) bool {
+	req, ok := r.(*LokiRequest)
+	if !ok {
+		return true
+	}
+	class, err := classifyRequest(ctx, req)
+	if err != nil {
+		// let the downstream report the parsing error.
+		return true
+	}
+	return class.SplitSafe
 }
 
 func splitByTime(req queryrange.Request, interval time.Duration) []queryrange.Request {
+	return splitByRanges(req, func(start, end time.Time, callback func(start, end time.Time)) {
+		forInterval(interval, start, end, callback)
+	})
+}
+
+// splitByRanges splits the request into the consecutive sub-ranges of its time range forRanges calls back with.
+func splitByRanges(req queryrange.Request, forRanges func(start, end time.Time, callback func(start, end time.Time))) []queryrange.Request {
 	var reqs []queryrange.Request
 
 	switch r := req.(type) {
 	case *LokiRequest:
-		forInterval(interval, r.StartTs, r.EndTs, func(start, end time.Time) {
+		forRanges(r.StartTs, r.EndTs, func(start, end time.Time) {
 			reqs = append(reqs, &LokiRequest{
-				Query:     r.Query,
-				Limit:     r.Limit,
-				Step:      r.Step,
-				Direction: r.Direction,
-				Path:      r.Path,
-				StartTs:   start,
-				EndTs:     end,
+				Query:          r.Query,
+				Limit:          r.Limit,
+				Step:           r.Step,
+				Direction:      r.Direction,
+				Path:           r.Path,
+				StartTs:        start,
+				EndTs:          end,
+				IsMetricQuery:  r.IsMetricQuery,
+				CachingOptions: r.CachingOptions,
 			})
 		})
 	case *LokiSeriesRequest:
-		forInterval(interval, r.StartTs, r.EndTs, func(start, end time.Time) {
+		forRanges(r.StartTs, r.EndTs, func(start, end time.Time) {
 			reqs = append(reqs, &LokiSeriesRequest{
 				Match:   r.Match,
 				Path:    r.Path,
@@ -241,11 +421,12 @@ func splitByTime(req queryrange.Request, interval time.Duration) []queryrange.Re
 			})
 		})
 	case *LokiLabelNamesRequest:
-		forInterval(interval, r.StartTs, r.EndTs, func(start, end time.Time) {
+		forRanges(r.StartTs, r.EndTs, func(start, end time.Time) {
 			reqs = append(reqs, &LokiLabelNamesRequest{
-				Path:    r.Path,
-				StartTs: start,
-				EndTs:   end,
+				Path:       r.Path,
+				StartTs:    start,
+				EndTs:      end,
+				WithCounts: r.WithCounts,
 			})
 		})
 	default:
@@ -271,13 +452,15 @@ func splitMetricByTime(r queryrange.Request, interval time.Duration) []queryrang
 	if lokiReq.Step >= interval.Milliseconds() {
 		forInterval(time.Duration(lokiReq.Step*1e6), lokiReq.StartTs, lokiReq.EndTs, func(start, end time.Time) {
 			reqs = append(reqs, &LokiRequest{
-				Query:     lokiReq.Query,
-				Limit:     lokiReq.Limit,
-				Step:      lokiReq.Step,
-				Direction: lokiReq.Direction,
-				Path:      lokiReq.Path,
-				StartTs:   start,
-				EndTs:     end,
+				Query:          lokiReq.Query,
+				Limit:          lokiReq.Limit,
+				Step:           lokiReq.Step,
+				Direction:      lokiReq.Direction,
+				Path:           lokiReq.Path,
+				StartTs:        start,
+				EndTs:          end,
+				IsMetricQuery:  lokiReq.IsMetricQuery,
+				CachingOptions: lokiReq.CachingOptions,
 			})
 		})
 
@@ -290,13 +473,15 @@ func splitMetricByTime(r queryrange.Request, interval time.Duration) []queryrang
 			end = lokiReq.EndTs
 		}
 		reqs = append(reqs, &LokiRequest{
-			Query:     lokiReq.Query,
-			Limit:     lokiReq.Limit,
-			Step:      lokiReq.Step,
-			Direction: lokiReq.Direction,
-			Path:      lokiReq.Path,
-			StartTs:   start,
-			EndTs:     end,
+			Query:          lokiReq.Query,
+			Limit:          lokiReq.Limit,
+			Step:           lokiReq.Step,
+			Direction:      lokiReq.Direction,
+			Path:           lokiReq.Path,
+			StartTs:        start,
+			EndTs:          end,
+			IsMetricQuery:  lokiReq.IsMetricQuery,
+			CachingOptions: lokiReq.CachingOptions,
 		})
 	}
 	return reqs
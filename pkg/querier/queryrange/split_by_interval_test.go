@@ -2,19 +2,25 @@ package queryrange
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"runtime"
 	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/cortexproject/cortex/pkg/cortexpb"
 	"github.com/cortexproject/cortex/pkg/querier/queryrange"
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/httpgrpc"
 	"github.com/weaveworks/common/user"
 
 	"github.com/grafana/loki/pkg/loghttp"
 	"github.com/grafana/loki/pkg/logproto"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/validation"
 )
 
 var nilMetrics = NewSplitByMetrics(nil)
@@ -369,10 +375,11 @@ func Test_splitByInterval_Do(t *testing.T) {
 				Path:      "/api/prom/query_range",
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.BACKWARD,
-				Limit:     1000,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.BACKWARD,
+				Limit:      1000,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 1}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -401,10 +408,11 @@ func Test_splitByInterval_Do(t *testing.T) {
 				Path:      "/api/prom/query_range",
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.FORWARD,
-				Limit:     1000,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.FORWARD,
+				Limit:      1000,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 1}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -433,10 +441,11 @@ func Test_splitByInterval_Do(t *testing.T) {
 				Path:      "/api/prom/query_range",
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.FORWARD,
-				Limit:     2,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.FORWARD,
+				Limit:      2,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 1}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -463,10 +472,11 @@ func Test_splitByInterval_Do(t *testing.T) {
 				Path:      "/api/prom/query_range",
 			},
 			&LokiResponse{
-				Status:    loghttp.QueryStatusSuccess,
-				Direction: logproto.BACKWARD,
-				Limit:     2,
-				Version:   1,
+				Status:     loghttp.QueryStatusSuccess,
+				Direction:  logproto.BACKWARD,
+				Limit:      2,
+				Version:    1,
+				Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 1}},
 				Data: LokiData{
 					ResultType: loghttp.ResultTypeStream,
 					Result: []logproto.Stream{
@@ -557,6 +567,297 @@ func Test_series_splitByInterval_Do(t *testing.T) {
 	}
 }
 
+func Test_series_splitByInterval_MaxQuerySeries(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	// each split returns 3 series of its own.
+	next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+		res := &LokiSeriesResponse{Status: "success", Version: uint32(loghttp.VersionV1)}
+		for i := 0; i < 3; i++ {
+			res.Data = append(res.Data, logproto.SeriesIdentifier{
+				Labels: map[string]string{"split": strconv.FormatInt(r.GetStart(), 10), "i": strconv.Itoa(i)},
+			})
+		}
+		return res, nil
+	})
+	req := &LokiSeriesRequest{
+		StartTs: time.Unix(0, 0),
+		EndTs:   time.Unix(0, (4 * time.Hour).Nanoseconds()),
+		Match:   []string{`{job="varlogs"}`},
+		Path:    "/loki/api/v1/series",
+	}
+
+	for _, tc := range []struct {
+		maxSeries int
+		err       error
+	}{
+		{maxSeries: 0},
+		{maxSeries: 12},
+		{maxSeries: 5, err: httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, 5)},
+	} {
+		t.Run(strconv.Itoa(tc.maxSeries), func(t *testing.T) {
+			l := WithDefaultLimits(fakeLimits{maxSeries: tc.maxSeries}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+			split := SplitByIntervalMiddleware(l, LokiCodec, splitByTime, nilMetrics).Wrap(next)
+
+			res, err := split.Do(ctx, req)
+			if tc.err != nil {
+				require.Equal(t, tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, res.(*LokiSeriesResponse).Data, 12)
+		})
+	}
+}
+
+func Test_splitByInterval_SeriesLimitCancelsSplits(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+	req := &LokiRequest{
+		StartTs: time.Unix(0, 0),
+		EndTs:   time.Unix(0, (3 * time.Hour).Nanoseconds()),
+		Query:   `rate({app="foo"}[1m])`,
+		Step:    60000,
+		Path:    "/loki/api/v1/query_range",
+	}
+	var (
+		started  = make(chan struct{}, 3)
+		canceled = make(chan error, 3)
+	)
+	next := queryrange.HandlerFunc(func(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+		started <- struct{}{}
+		if r.GetStart() < (2 * time.Hour).Milliseconds() {
+			// the first splits are still running when the last one reaches the limit.
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return nil, ctx.Err()
+		}
+		// wait for the siblings to be in flight.
+		for len(started) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		return &LokiPromResponse{
+			Response: &queryrange.PrometheusResponse{
+				Status: loghttp.QueryStatusSuccess,
+				Data: queryrange.PrometheusData{
+					ResultType: loghttp.ResultTypeMatrix,
+					Result: []queryrange.SampleStream{
+						{Labels: []cortexpb.LabelAdapter{{Name: "app", Value: "foo"}}},
+						{Labels: []cortexpb.LabelAdapter{{Name: "app", Value: "bar"}}},
+					},
+				},
+			},
+		}, nil
+	})
+
+	l := WithDefaultLimits(fakeLimits{maxSeries: 1, maxQueryParallelism: 3}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+	split := SplitByIntervalMiddleware(l, LokiCodec, splitMetricByTime, nilMetrics).Wrap(next)
+
+	done := make(chan error)
+	go func() {
+		_, err := split.Do(ctx, req)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.Equal(t, httpgrpc.Errorf(http.StatusBadRequest, limitErrTmpl, 1), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the in-flight splits weren't canceled")
+	}
+	for i := 0; i < 2; i++ {
+		require.Equal(t, context.Canceled, <-canceled)
+	}
+}
+
+func Test_splitByInterval_NonSplittable(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		calls int
+	}{
+		{
+			name:  "distributive",
+			query: `sum by (app) (rate({app="foo"} |= "foo" [1m]))`,
+			calls: 4,
+		},
+		{
+			name:  "non distributive",
+			query: `quantile_over_time(0.99, {app="foo"} | pattern "<_> <latency>" | unwrap latency [1m]) by (app)`,
+			calls: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var callCt int
+			var mtx sync.Mutex
+
+			next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				callCt++
+				return &LokiPromResponse{
+					Response: queryrange.NewEmptyPrometheusResponse(),
+				}, nil
+			})
+
+			l := WithDefaultLimits(fakeLimits{}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+			split := SplitByIntervalMiddleware(
+				l,
+				LokiCodec,
+				splitMetricByTime,
+				nilMetrics,
+			).Wrap(next)
+
+			_, err := split.Do(ctx, &LokiRequest{
+				StartTs:   time.Unix(0, 0),
+				EndTs:     time.Unix(0, (4 * time.Hour).Nanoseconds()),
+				Query:     tc.query,
+				Step:      15000,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.calls, callCt)
+		})
+	}
+}
+
+func Test_splitByInterval_MaxQuerySplits(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		name     string
+		mode     string
+		interval time.Duration
+		calls    int
+		err      bool
+	}{
+		{name: "reject", mode: validation.QuerySplitsModeReject, interval: time.Hour, err: true},
+		{name: "widen", mode: validation.QuerySplitsModeWiden, interval: time.Hour, calls: 2},
+		{name: "widen misaligned", mode: validation.QuerySplitsModeWiden, interval: 50 * time.Minute, calls: 2},
+		{name: "under the limit", mode: validation.QuerySplitsModeReject, interval: 2 * time.Hour, calls: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var callCt int
+			var mtx sync.Mutex
+
+			next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				mtx.Lock()
+				defer mtx.Unlock()
+				callCt++
+				return &LokiPromResponse{
+					Response: queryrange.NewEmptyPrometheusResponse(),
+				}, nil
+			})
+
+			l := WithDefaultLimits(fakeLimits{
+				maxQuerySplits:     2,
+				maxQuerySplitsMode: tc.mode,
+			}, queryrange.Config{SplitQueriesByInterval: tc.interval})
+			split := SplitByIntervalMiddleware(
+				l,
+				LokiCodec,
+				splitMetricByTime,
+				nilMetrics,
+			).Wrap(next)
+
+			_, err := split.Do(ctx, &LokiRequest{
+				StartTs:   time.Unix(0, 0),
+				EndTs:     time.Unix(0, (4 * time.Hour).Nanoseconds()),
+				Query:     `sum by (app) (rate({app="foo"} |= "foo" [1m]))`,
+				Step:      15000,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			})
+			if tc.err {
+				require.Error(t, err)
+				require.Equal(t, 0, callCt)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.calls, callCt)
+		})
+	}
+}
+
+func Test_splitByInterval_PartialResults(t *testing.T) {
+	ctx := user.InjectOrgID(context.Background(), "1")
+
+	for _, tc := range []struct {
+		name    string
+		allow   bool
+		failing map[int64]error // by start hour
+		err     bool
+		lines   int
+	}{
+		{name: "no failure", allow: true, lines: 4},
+		{name: "disabled", failing: map[int64]error{1: errors.New("querier crashed")}, err: true},
+		{name: "some failed", allow: true, failing: map[int64]error{1: errors.New("querier crashed"), 3: errors.New("timeout")}, lines: 2},
+		{name: "client error", allow: true, failing: map[int64]error{1: httpgrpc.Errorf(http.StatusBadRequest, "limit reached")}, err: true},
+		{
+			name:    "all failed",
+			allow:   true,
+			failing: map[int64]error{0: errors.New("down"), 1: errors.New("down"), 2: errors.New("down"), 3: errors.New("down")},
+			err:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			next := queryrange.HandlerFunc(func(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+				start := r.(*LokiRequest).StartTs
+				if err := tc.failing[start.Unix()/3600]; err != nil {
+					return nil, err
+				}
+				return &LokiResponse{
+					Status:    loghttp.QueryStatusSuccess,
+					Direction: logproto.FORWARD,
+					Limit:     100,
+					Version:   uint32(loghttp.VersionV1),
+					Data: LokiData{
+						ResultType: loghttp.ResultTypeStream,
+						Result: []logproto.Stream{{
+							Labels:  `{foo="bar"}`,
+							Entries: []logproto.Entry{{Timestamp: start, Line: start.String()}},
+						}},
+					},
+				}, nil
+			})
+
+			l := WithDefaultLimits(fakeLimits{allowPartialResults: tc.allow}, queryrange.Config{SplitQueriesByInterval: time.Hour})
+			split := SplitByIntervalMiddleware(
+				l,
+				LokiCodec,
+				splitByTime,
+				nilMetrics,
+			).Wrap(next)
+
+			res, err := split.Do(ctx, &LokiRequest{
+				StartTs:   time.Unix(0, 0),
+				EndTs:     time.Unix(0, (4 * time.Hour).Nanoseconds()),
+				Query:     `{foo="bar"}`,
+				Limit:     100,
+				Direction: logproto.FORWARD,
+				Path:      "/loki/api/v1/query_range",
+			})
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, int64(tc.lines), res.(*LokiResponse).Count())
+
+			httpRes, err := LokiCodec.EncodeResponse(ctx, res)
+			require.NoError(t, err)
+			if len(tc.failing) == 0 {
+				require.Equal(t, http.StatusOK, httpRes.StatusCode)
+				require.Empty(t, res.(*LokiResponse).Warnings)
+				return
+			}
+			require.Equal(t, http.StatusPartialContent, httpRes.StatusCode)
+			require.Equal(t, strconv.Itoa(len(tc.failing)), httpRes.Header.Get(partialResultsHeader))
+			require.Equal(t, []string{fmt.Sprintf(partialResultsWarningTmpl, len(tc.failing), 4)}, res.(*LokiResponse).Warnings)
+		})
+	}
+}
+
 func Test_ExitEarly(t *testing.T) {
 	ctx := user.InjectOrgID(context.Background(), "1")
 
@@ -612,10 +913,11 @@ func Test_ExitEarly(t *testing.T) {
 	}
 
 	expected := &LokiResponse{
-		Status:    loghttp.QueryStatusSuccess,
-		Direction: logproto.FORWARD,
-		Limit:     2,
-		Version:   1,
+		Status:     loghttp.QueryStatusSuccess,
+		Direction:  logproto.FORWARD,
+		Limit:      2,
+		Version:    1,
+		Statistics: stats.Result{Summary: stats.Summary{TotalStreamsReturned: 1}},
 		Data: LokiData{
 			ResultType: loghttp.ResultTypeStream,
 			Result: []logproto.Stream{
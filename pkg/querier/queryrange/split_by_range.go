@@ -0,0 +1,232 @@
+package queryrange
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/cortexpb"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/weaveworks/common/httpgrpc"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/pkg/tenant"
+	"github.com/grafana/loki/pkg/validation"
+)
+
+// rangeCombiners tells how to combine the results of a range aggregation evaluated on consecutive
+// sub-ranges, for the range aggregations which distribute over time.
+var rangeCombiners = map[string]func(a, b float64) float64{
+	logql.OpRangeTypeCount:     addValues,
+	logql.OpRangeTypeBytes:     addValues,
+	logql.OpRangeTypeSum:       addValues,
+	logql.OpRangeTypeRate:      addValues, // rates are weighted by the length of their sub-range.
+	logql.OpRangeTypeBytesRate: addValues,
+	logql.OpRangeTypeMax:       math.Max,
+	logql.OpRangeTypeMin:       math.Min,
+}
+
+// splittableVectorRanges tells which range aggregations each vector aggregation can be combined with.
+var splittableVectorRanges = map[string]map[string]bool{
+	logql.OpTypeSum: {
+		logql.OpRangeTypeCount:     true,
+		logql.OpRangeTypeBytes:     true,
+		logql.OpRangeTypeSum:       true,
+		logql.OpRangeTypeRate:      true,
+		logql.OpRangeTypeBytesRate: true,
+	},
+	logql.OpTypeMax: {logql.OpRangeTypeMax: true},
+	logql.OpTypeMin: {logql.OpRangeTypeMin: true},
+}
+
+func addValues(a, b float64) float64 { return a + b }
+
+// splittableRange returns the range aggregation of an instant query which can be evaluated on
+// consecutive sub-ranges and combined, or nil if the query doesn't distribute over time.
+func splittableRange(expr logql.SampleExpr) *logql.RangeAggregationExpr {
+	switch e := expr.(type) {
+	case *logql.RangeAggregationExpr:
+		if _, ok := rangeCombiners[e.Operation]; ok {
+			return e
+		}
+	case *logql.VectorAggregationExpr:
+		inner, ok := e.Left.(*logql.RangeAggregationExpr)
+		if ok && splittableVectorRanges[e.Operation][inner.Operation] {
+			return inner
+		}
+	}
+	return nil
+}
+
+// splitByRange splits instant metric queries with a long range selector into sub-queries over
+// consecutive sub-ranges of the split interval, whose results are then combined.
+type splitByRange struct {
+	logger  log.Logger
+	next    queryrange.Handler
+	limits  Limits
+	metrics *SplitByMetrics
+}
+
+// NewSplitByRangeMiddleware creates a middleware splitting the range of instant metric queries.
+func NewSplitByRangeMiddleware(logger log.Logger, limits Limits, metrics *SplitByMetrics) queryrange.Middleware {
+	return queryrange.MiddlewareFunc(func(next queryrange.Handler) queryrange.Handler {
+		return &splitByRange{
+			logger:  log.With(logger, "middleware", "InstantQuery.splitByRange"),
+			next:    next,
+			limits:  limits,
+			metrics: metrics,
+		}
+	})
+}
+
+func (s *splitByRange) Do(ctx context.Context, r queryrange.Request) (queryrange.Response, error) {
+	req, ok := r.(*LokiInstantRequest)
+	if !ok {
+		return s.next.Do(ctx, r)
+	}
+	userid, err := tenant.TenantID(ctx)
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	interval := s.limits.QuerySplitDuration(userid)
+	if interval == 0 {
+		return s.next.Do(ctx, r)
+	}
+
+	// the range of the expression is changed in place for each sub-query.
+	parsed, err := clonedExpr(req)
+	if err != nil {
+		return nil, httpgrpc.Errorf(http.StatusBadRequest, err.Error())
+	}
+	expr, ok := parsed.(logql.SampleExpr)
+	if !ok {
+		return s.next.Do(ctx, r)
+	}
+	rangeExpr := splittableRange(expr)
+	if rangeExpr == nil || rangeExpr.Left.Interval <= interval {
+		return s.next.Do(ctx, r)
+	}
+
+	totalRange, baseOffset := rangeExpr.Left.Interval, rangeExpr.Left.Offset
+	if maxSplits := s.limits.MaxQuerySplits(userid); maxSplits > 0 && splitCount(totalRange, interval) > maxSplits {
+		if s.limits.MaxQuerySplitsMode(userid) != validation.QuerySplitsModeWiden {
+			return nil, httpgrpc.Errorf(http.StatusBadRequest, maxQuerySplitsErrTmpl, splitCount(totalRange, interval), maxSplits)
+		}
+		interval = (totalRange + time.Duration(maxSplits) - 1) / time.Duration(maxSplits)
+	}
+
+	// sub-ranges go back in time from the original evaluation, the last one may be shorter.
+	var (
+		reqs    []queryrange.Request
+		weights = map[string]float64{}
+	)
+	for offset := time.Duration(0); offset < totalRange; offset += interval {
+		subRange := interval
+		if offset+subRange > totalRange {
+			subRange = totalRange - offset
+		}
+		rangeExpr.Left.Interval = subRange
+		rangeExpr.Left.Offset = baseOffset + offset
+		subReq := *req
+		subReq.Query = expr.String()
+		reqs = append(reqs, &subReq)
+		weights[subReq.Query] = 1
+		if rangeExpr.Operation == logql.OpRangeTypeRate || rangeExpr.Operation == logql.OpRangeTypeBytesRate {
+			weights[subReq.Query] = subRange.Seconds() / totalRange.Seconds()
+		}
+	}
+	s.metrics.splits.Observe(float64(len(reqs)))
+	level.Debug(util_log.WithContext(ctx, s.logger)).Log("msg", "splitting instant query range", "query", req.Query, "splits", len(reqs))
+
+	resps, err := queryrange.DoRequests(ctx, s.next, reqs, s.limits)
+	if err != nil {
+		return nil, err
+	}
+	return combineInstantResponses(resps, weights, rangeCombiners[rangeExpr.Operation])
+}
+
+func splitCount(totalRange, interval time.Duration) int {
+	return int((totalRange + interval - 1) / interval)
+}
+
+// combineInstantResponses combines the vectors of the sub-queries of a split instant query,
+// samples are weighted by their sub-query weight.
+func combineInstantResponses(resps []queryrange.RequestResponse, weights map[string]float64, combine func(a, b float64) float64) (queryrange.Response, error) {
+	vectors := make([]*LokiPromResponse, 0, len(resps))
+	vectorWeights := make([]float64, 0, len(resps))
+	for _, res := range resps {
+		promRes, ok := res.Response.(*LokiPromResponse)
+		if !ok {
+			return nil, fmt.Errorf("expected *LokiPromResponse, got (%T)", res.Response)
+		}
+		vectors = append(vectors, promRes)
+		vectorWeights = append(vectorWeights, weights[res.Request.GetQuery()])
+	}
+	return mergeVectors(vectors, vectorWeights, combine), nil
+}
+
+// mergeVectors merges vectors by combining the samples with the same labels, after multiplying
+// them by the weight of their vector if weights are given. The series are sorted by labels.
+func mergeVectors(vectors []*LokiPromResponse, weights []float64, combine func(a, b float64) float64) *LokiPromResponse {
+	var (
+		mergedStats stats.Result
+		warnings    = make(map[string]struct{})
+		series      = make(map[string]*queryrange.SampleStream)
+	)
+	for i, res := range vectors {
+		mergedStats.Merge(res.Statistics)
+		for _, w := range res.Warnings {
+			warnings[w] = struct{}{}
+		}
+		weight := 1.0
+		if weights != nil {
+			weight = weights[i]
+		}
+		for _, s := range res.Response.Data.Result {
+			if len(s.Samples) == 0 {
+				continue
+			}
+			value := s.Samples[0].Value * weight
+			key := cortexpb.FromLabelAdaptersToLabels(s.Labels).String()
+			existing, ok := series[key]
+			if !ok {
+				series[key] = &queryrange.SampleStream{
+					Labels:  s.Labels,
+					Samples: []cortexpb.Sample{{Value: value, TimestampMs: s.Samples[0].TimestampMs}},
+				}
+				continue
+			}
+			existing.Samples[0].Value = combine(existing.Samples[0].Value, value)
+		}
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]queryrange.SampleStream, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, *series[k])
+	}
+
+	return &LokiPromResponse{
+		Response: &queryrange.PrometheusResponse{
+			Status: loghttp.QueryStatusSuccess,
+			Data: queryrange.PrometheusData{
+				ResultType: loghttp.ResultTypeVector,
+				Result:     result,
+			},
+		},
+		Statistics: mergedStats,
+		Warnings:   sortedWarnings(warnings),
+	}
+}
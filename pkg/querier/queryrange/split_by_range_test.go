@@ -0,0 +1,183 @@
+package queryrange
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/cortexpb"
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/user"
+
+	"github.com/grafana/loki/pkg/loghttp"
+	"github.com/grafana/loki/pkg/logql"
+)
+
+// rangeVectorHandler answers instant queries with a vector holding one sample per app,
+// computed from the range and offset of the query.
+type rangeVectorHandler struct {
+	mtx     sync.Mutex
+	queries []string
+	value   func(app string, interval, offset time.Duration) float64
+}
+
+func (h *rangeVectorHandler) Do(_ context.Context, r queryrange.Request) (queryrange.Response, error) {
+	h.mtx.Lock()
+	h.queries = append(h.queries, r.GetQuery())
+	h.mtx.Unlock()
+
+	var interval, offset time.Duration
+	if expr, err := logql.ParseSampleExpr(r.GetQuery()); err == nil {
+		expr.Walk(func(e interface{}) {
+			if lr, ok := e.(*logql.LogRange); ok {
+				interval, offset = lr.Interval, lr.Offset
+			}
+		})
+	}
+	var result []queryrange.SampleStream
+	for _, app := range []string{"bar", "foo"} {
+		result = append(result, queryrange.SampleStream{
+			Labels:  []cortexpb.LabelAdapter{{Name: "app", Value: app}},
+			Samples: []cortexpb.Sample{{Value: h.value(app, interval, offset), TimestampMs: 1000}},
+		})
+	}
+	return &LokiPromResponse{
+		Response: &queryrange.PrometheusResponse{
+			Status: loghttp.QueryStatusSuccess,
+			Data: queryrange.PrometheusData{
+				ResultType: loghttp.ResultTypeVector,
+				Result:     result,
+			},
+		},
+	}, nil
+}
+
+func Test_splitByRange(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		query    string
+		value    func(app string, interval, offset time.Duration) float64
+		queries  []string
+		expected map[string]float64
+	}{
+		{
+			name:  "count is summed",
+			query: `sum by (app) (count_over_time({app=~".+"}[5h]))`,
+			value: func(app string, interval, _ time.Duration) float64 {
+				if app == "foo" {
+					return 10 * interval.Hours()
+				}
+				return interval.Hours()
+			},
+			queries: []string{
+				`sum by(app)(count_over_time({app=~".+"}[2h]))`,
+				`sum by(app)(count_over_time({app=~".+"}[2h] offset 2h0m0s))`,
+				`sum by(app)(count_over_time({app=~".+"}[1h] offset 4h0m0s))`,
+			},
+			expected: map[string]float64{"bar": 5, "foo": 50},
+		},
+		{
+			name:  "rates are weighted by their range",
+			query: `rate({app=~".+"}[5h] offset 1h0m0s)`,
+			value: func(_ string, _, offset time.Duration) float64 {
+				// 1 per second for the last 2h, 2 per second before.
+				if offset == time.Hour {
+					return 1
+				}
+				return 2
+			},
+			queries: []string{
+				`rate({app=~".+"}[2h] offset 1h0m0s)`,
+				`rate({app=~".+"}[2h] offset 3h0m0s)`,
+				`rate({app=~".+"}[1h] offset 5h0m0s)`,
+			},
+			expected: map[string]float64{"bar": 1.6, "foo": 1.6},
+		},
+		{
+			name:  "max of max",
+			query: `max by (app) (max_over_time({app=~".+"} | unwrap latency [5h]))`,
+			value: func(_ string, _, offset time.Duration) float64 {
+				return offset.Hours()
+			},
+			queries: []string{
+				`max by(app)(max_over_time({app=~".+"} | unwrap latency[2h]))`,
+				`max by(app)(max_over_time({app=~".+"} | unwrap latency[2h] offset 2h0m0s))`,
+				`max by(app)(max_over_time({app=~".+"} | unwrap latency[1h] offset 4h0m0s))`,
+			},
+			expected: map[string]float64{"bar": 4, "foo": 4},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &rangeVectorHandler{value: tc.value}
+			limits := fakeLimits{maxQueryParallelism: 2, splits: map[string]time.Duration{"1": 2 * time.Hour}}
+			split := NewSplitByRangeMiddleware(util_log.Logger, limits, nilMetrics).Wrap(h)
+
+			req := &LokiInstantRequest{
+				Query:  tc.query,
+				TimeTs: time.Unix(1, 0),
+				Path:   "/loki/api/v1/query",
+			}
+			ctx := withParsedExprs(user.InjectOrgID(context.Background(), "1"))
+			parsed, err := parsedExpr(ctx, req)
+			require.NoError(t, err)
+			expected := parsed.String()
+
+			res, err := split.Do(ctx, req)
+			require.NoError(t, err)
+			// the parsed query shared by the middlewares handling the request is left untouched.
+			parsed, err = parsedExpr(ctx, req)
+			require.NoError(t, err)
+			require.Equal(t, expected, parsed.String())
+
+			sort.Strings(h.queries)
+			sort.Strings(tc.queries)
+			require.Equal(t, tc.queries, h.queries)
+
+			result := res.(*LokiPromResponse).Response.Data
+			require.Equal(t, loghttp.ResultTypeVector, result.ResultType)
+			actual := map[string]float64{}
+			for _, s := range result.Result {
+				require.Len(t, s.Samples, 1)
+				require.Equal(t, int64(1000), s.Samples[0].TimestampMs)
+				actual[s.Labels[0].Value] = s.Samples[0].Value
+			}
+			require.Len(t, actual, len(tc.expected))
+			for app, v := range tc.expected {
+				require.InDelta(t, v, actual[app], 1e-9, app)
+			}
+		})
+	}
+}
+
+func Test_splitByRange_NotSplit(t *testing.T) {
+	for _, query := range []string{
+		// aggregations which don't distribute over time.
+		`avg_over_time({app="foo"} | unwrap latency [5h])`,
+		`count(count_over_time({app="foo"}[5h]))`,
+		`topk(2, rate({app="foo"}[5h]))`,
+		`max(rate({app="foo"}[5h]))`,
+		`sum(rate({app="foo"}[5h])) / sum(rate({app="bar"}[5h]))`,
+		// ranges within the split interval.
+		`sum(count_over_time({app="foo"}[2h]))`,
+		// log queries.
+		`{app="foo"}`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			h := &rangeVectorHandler{value: func(string, time.Duration, time.Duration) float64 { return 1 }}
+			limits := fakeLimits{maxQueryParallelism: 2, splits: map[string]time.Duration{"1": 2 * time.Hour}}
+			split := NewSplitByRangeMiddleware(util_log.Logger, limits, nilMetrics).Wrap(h)
+
+			_, err := split.Do(user.InjectOrgID(context.Background(), "1"), &LokiInstantRequest{
+				Query:  query,
+				TimeTs: time.Unix(1, 0),
+				Path:   "/loki/api/v1/query",
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{query}, h.queries)
+		})
+	}
+}
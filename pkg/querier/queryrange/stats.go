@@ -97,6 +97,8 @@ func StatsCollectorMiddleware() queryrange.Middleware {
 					res = logqlmodel.Streams(r.Data.Result)
 				case *LokiPromResponse:
 					statistics = &r.Statistics
+				case *ExplainResponse:
+					// the query isn't executed.
 				default:
 					level.Warn(logger).Log("msg", fmt.Sprintf("cannot compute stats, unexpected type: %T", resp))
 				}
@@ -143,6 +145,12 @@ func (i *interceptor) WriteHeader(code int) {
 	i.ResponseWriter.WriteHeader(code)
 }
 
+func (i *interceptor) Flush() {
+	if f, ok := i.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (i *interceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	hj, ok := i.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -0,0 +1,216 @@
+package queryrange
+
+import (
+	"time"
+
+	"github.com/cortexproject/cortex/pkg/querier/queryrange"
+	"github.com/go-kit/log"
+
+	"github.com/grafana/loki/pkg/logql"
+	"github.com/grafana/loki/pkg/storage/chunk"
+)
+
+// namedMiddleware is a middleware of the chain of a tripperware. It is only built when enabled, so that
+// TripperwaresStatus can list the chains without their dependencies.
+type namedMiddleware struct {
+	name    string
+	enabled bool
+	build   func() queryrange.Middleware
+}
+
+// chainDeps are the dependencies of the middlewares of the tripperware chains.
+type chainDeps struct {
+	log               log.Logger
+	limits            Limits
+	schema            chunk.SchemaConfig
+	codec             queryrange.Codec
+	instrumentMetrics *queryrange.InstrumentMiddlewareMetrics
+	retryMetrics      *queryrange.RetryMiddlewareMetrics
+	shardingMetrics   *logql.ShardingMetrics
+	splitByMetrics    *SplitByMetrics
+	durations         *QueryDurations
+	// resultsCache is the results cache middleware of the metric chain, nil when the results aren't cached.
+	resultsCache queryrange.Middleware
+}
+
+// buildChain returns the enabled middlewares of chain, in order.
+func buildChain(chain []namedMiddleware) []queryrange.Middleware {
+	middlewares := make([]queryrange.Middleware, 0, len(chain))
+	for _, m := range chain {
+		if m.enabled {
+			middlewares = append(middlewares, m.build())
+		}
+	}
+	return middlewares
+}
+
+// chainStatus returns the status of the middlewares of chain.
+func chainStatus(name string, chain []namedMiddleware) TripperwareStatus {
+	status := TripperwareStatus{Name: name, Middlewares: make([]MiddlewareStatus, 0, len(chain))}
+	for _, m := range chain {
+		status.Middlewares = append(status.Middlewares, MiddlewareStatus{Name: m.name, Enabled: m.enabled})
+	}
+	return status
+}
+
+// instrumented returns the named middleware built by build, instrumented under its name.
+func (d chainDeps) instrumented(name string, enabled bool, build func() queryrange.Middleware) namedMiddleware {
+	return namedMiddleware{name: name, enabled: enabled, build: func() queryrange.Middleware {
+		return queryrange.MergeMiddlewares(queryrange.InstrumentMiddleware(name, d.instrumentMetrics), build())
+	}}
+}
+
+func (d chainDeps) stats() namedMiddleware {
+	return namedMiddleware{"stats_collector", true, StatsCollectorMiddleware}
+}
+
+func (d chainDeps) queryDurations() namedMiddleware {
+	return namedMiddleware{"query_durations", true, func() queryrange.Middleware {
+		return NewQueryDurationsMiddleware(d.durations)
+	}}
+}
+
+func (d chainDeps) metadataConcurrency() namedMiddleware {
+	return namedMiddleware{"metadata_concurrency", true, func() queryrange.Middleware {
+		return NewMetadataConcurrencyMiddleware(d.limits)
+	}}
+}
+
+func (d chainDeps) limitsMiddleware() namedMiddleware {
+	return namedMiddleware{"limits", true, func() queryrange.Middleware {
+		return NewLimitsMiddleware(d.limits)
+	}}
+}
+
+// explain answers the explain requests with the status of chain, which must be the chain it belongs to.
+func (d chainDeps) explain(cfg Config, name string, chain *[]namedMiddleware, splitter Splitter) namedMiddleware {
+	return namedMiddleware{"explain", true, func() queryrange.Middleware {
+		return NewExplainMiddleware(chainStatus(name, *chain), d.limits, splitter, shardingConfigs(cfg, d.schema))
+	}}
+}
+
+func (d chainDeps) splitByInterval(limits Limits, splitter Splitter) namedMiddleware {
+	return d.instrumented("split_by_interval", true, func() queryrange.Middleware {
+		return SplitByIntervalMiddleware(limits, d.codec, splitter, d.splitByMetrics)
+	})
+}
+
+func (d chainDeps) sharding(cfg Config) namedMiddleware {
+	return namedMiddleware{"sharding", cfg.ShardedQueries, func() queryrange.Middleware {
+		return NewQueryShardMiddleware(
+			d.log,
+			d.schema.Configs,
+			d.instrumentMetrics, // instrumentation is included in the sharding middleware
+			d.shardingMetrics,
+			d.limits,
+		)
+	}}
+}
+
+func (d chainDeps) retry(cfg Config) namedMiddleware {
+	return d.instrumented("retry", cfg.MaxRetries > 0, func() queryrange.Middleware {
+		return queryrange.NewRetryMiddleware(d.log, cfg.MaxRetries, d.retryMetrics)
+	})
+}
+
+func (d chainDeps) faultInjection(cfg Config) namedMiddleware {
+	return namedMiddleware{"fault_injection", cfg.FaultInjection.Enabled && faultInjectionAllowed, func() queryrange.Middleware {
+		return NewFaultInjectionMiddleware(cfg.FaultInjection)
+	}}
+}
+
+// metricChain returns the middlewares of NewMetricTripperware.
+func metricChain(cfg Config, d chainDeps) []namedMiddleware {
+	_, splitter := splitters(cfg, d.schema)
+	var chain []namedMiddleware
+	chain = []namedMiddleware{
+		d.stats(),
+		d.queryDurations(),
+		d.limitsMiddleware(),
+		d.instrumented("step_align", cfg.AlignQueriesWithStep, func() queryrange.Middleware {
+			return queryrange.StepAlignMiddleware
+		}),
+		d.explain(cfg, "metric", &chain, splitter),
+		d.splitByInterval(d.limits, splitter),
+		{"results_cache_ttl", cfg.CacheResults, func() queryrange.Middleware {
+			return NewResultsCacheTTLMiddleware(d.limits)
+		}},
+		d.instrumented("results_cache", cfg.CacheResults, func() queryrange.Middleware {
+			return withCacheStats(d.resultsCache)
+		}),
+		d.sharding(cfg),
+		d.retry(cfg),
+		d.faultInjection(cfg),
+	}
+	return chain
+}
+
+// logFilterChain returns the middlewares of NewLogFilterTripperware.
+func logFilterChain(cfg Config, d chainDeps) []namedMiddleware {
+	splitter, _ := splitters(cfg, d.schema)
+	var chain []namedMiddleware
+	chain = []namedMiddleware{
+		d.stats(),
+		d.queryDurations(),
+		d.limitsMiddleware(),
+		d.explain(cfg, "log_filter", &chain, splitter),
+		d.splitByInterval(d.limits, splitter),
+		d.sharding(cfg),
+		d.retry(cfg),
+		d.faultInjection(cfg),
+	}
+	return chain
+}
+
+// seriesChain returns the middlewares of NewSeriesTripperware.
+func seriesChain(cfg Config, d chainDeps) []namedMiddleware {
+	return []namedMiddleware{
+		d.metadataConcurrency(),
+		d.limitsMiddleware(),
+		// The Series API needs to pull one chunk per series to extract the label set, which is much cheaper than iterating through all matching chunks.
+		// Force a 24 hours split by for series API, this will be more efficient with our static daily bucket storage.
+		// This would avoid queriers downloading chunks for same series over and over again for serving smaller queries.
+		d.splitByInterval(WithSplitByLimits(d.limits, 24*time.Hour), splitByTime),
+		d.retry(cfg),
+		{"sharding", cfg.ShardedQueries, func() queryrange.Middleware {
+			return NewSeriesQueryShardMiddleware(
+				d.log,
+				d.schema.Configs,
+				d.instrumentMetrics,
+				d.shardingMetrics,
+				d.limits,
+				d.codec,
+				cfg.FailOnMissingShards,
+			)
+		}},
+		d.faultInjection(cfg),
+	}
+}
+
+// labelsChain returns the middlewares of NewLabelsTripperware.
+func labelsChain(cfg Config, d chainDeps) []namedMiddleware {
+	return []namedMiddleware{
+		d.metadataConcurrency(),
+		d.limitsMiddleware(),
+		// Force a 24 hours split by for labels API, this will be more efficient with our static daily bucket storage.
+		// This is because the labels API is an index-only operation.
+		d.splitByInterval(WithSplitByLimits(d.limits, 24*time.Hour), splitByTime),
+		d.retry(cfg),
+		d.faultInjection(cfg),
+	}
+}
+
+// instantMetricChain returns the middlewares of NewInstantMetricTripperware.
+func instantMetricChain(cfg Config, d chainDeps) []namedMiddleware {
+	return []namedMiddleware{
+		d.stats(),
+		d.queryDurations(),
+		d.limitsMiddleware(),
+		d.instrumented("split_by_range", cfg.SplitInstantQueries, func() queryrange.Middleware {
+			return NewSplitByRangeMiddleware(d.log, d.limits, d.splitByMetrics)
+		}),
+		d.sharding(cfg),
+		d.retry(cfg),
+		d.faultInjection(cfg),
+	}
+}
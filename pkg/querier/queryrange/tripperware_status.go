@@ -0,0 +1,42 @@
+package queryrange
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// MiddlewareStatus is a middleware of a tripperware and whether the config enables it.
+type MiddlewareStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// TripperwareStatus is the ordered middleware chain of one of the tripperwares of NewTripperware.
+type TripperwareStatus struct {
+	Name        string             `json:"name"`
+	Middlewares []MiddlewareStatus `json:"middlewares"`
+}
+
+// TripperwaresStatus returns the middleware chains NewTripperware builds for the config, in the order
+// requests go through them.
+func TripperwaresStatus(cfg Config) []TripperwareStatus {
+	var d chainDeps
+	return []TripperwareStatus{
+		chainStatus("metric", metricChain(cfg, d)),
+		chainStatus("log_filter", logFilterChain(cfg, d)),
+		chainStatus("series", seriesChain(cfg, d)),
+		chainStatus("labels", labelsChain(cfg, d)),
+		chainStatus("instant_metric", instantMetricChain(cfg, d)),
+	}
+}
+
+// TripperwareStatusHandler serves the middleware chains of the tripperwares built for the config as JSON.
+func TripperwareStatusHandler(cfg Config) http.HandlerFunc {
+	status := TripperwaresStatus(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		// Errors can't be reported once the status code is sent.
+		_ = json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,53 @@
+package queryrange
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TripperwareStatusHandler(t *testing.T) {
+	cfg := testConfig
+	cfg.CacheResults = false
+	cfg.MaxRetries = 3
+	cfg.ShardedQueries = true
+
+	rec := httptest.NewRecorder()
+	TripperwareStatusHandler(cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/loki/api/v1/status/tripperware", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var status []TripperwareStatus
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+	require.Len(t, status, 5)
+	require.Equal(t, "metric", status[0].Name)
+
+	enabled := map[string]bool{}
+	var names []string
+	for _, m := range status[0].Middlewares {
+		names = append(names, m.Name)
+		enabled[m.Name] = m.Enabled
+	}
+	require.Equal(t, []string{
+		"stats_collector", "query_durations", "limits", "step_align", "explain", "split_by_interval",
+		"results_cache_ttl", "results_cache", "sharding", "retry", "fault_injection",
+	}, names)
+	require.True(t, enabled["limits"])
+	require.False(t, enabled["results_cache_ttl"])
+	require.False(t, enabled["results_cache"])
+	require.True(t, enabled["sharding"])
+	require.True(t, enabled["retry"])
+	require.False(t, enabled["fault_injection"])
+
+	require.Equal(t, "log_filter", status[1].Name)
+	names = names[:0]
+	for _, m := range status[1].Middlewares {
+		names = append(names, m.Name)
+	}
+	require.Equal(t, []string{
+		"stats_collector", "query_durations", "limits", "explain", "split_by_interval", "sharding", "retry", "fault_injection",
+	}, names)
+}
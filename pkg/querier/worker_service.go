@@ -1,6 +1,7 @@
 package querier
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -29,6 +30,10 @@ type WorkerServiceConfig struct {
 	QueryFrontendEnabled  bool
 	QuerySchedulerEnabled bool
 	SchedulerRing         ring.ReadRing
+
+	// SchedulerFallbackEnabled also connects the querier worker to the query frontend running in the same
+	// process, which hands it the queries while it is not connected to any scheduler.
+	SchedulerFallbackEnabled bool
 }
 
 // InitWorkerService takes a config object, a map of routes to handlers, an external http router and external
@@ -131,12 +136,52 @@ func InitWorkerService(
 
 	//Return a querier worker pointed to the internal querier HTTP handler so there is not a conflict in routes between the querier
 	//and the query frontend
-	return querier_worker.NewQuerierWorker(
+	worker, err := querier_worker.NewQuerierWorker(
 		*(cfg.QuerierWorkerConfig),
 		cfg.SchedulerRing,
 		httpgrpc_server.NewServer(internalHandler),
 		util_log.Logger,
 		prometheus.DefaultRegisterer)
+	if err != nil || !schedulerFallbackEnabled(cfg) {
+		return worker, err
+	}
+
+	// The query frontend hands the queries to the queriers connected to it directly while it is not connected to any
+	// scheduler, connect a second worker to it.
+	fallbackCfg := *(cfg.QuerierWorkerConfig)
+	fallbackCfg.FrontendAddress = fmt.Sprintf("127.0.0.1:%d", cfg.GrpcListenPort)
+	fallbackCfg.SchedulerAddress = ""
+	fallbackWorker, err := querier_worker.NewQuerierWorker(
+		fallbackCfg,
+		nil,
+		httpgrpc_server.NewServer(internalHandler),
+		util_log.Logger,
+		prometheus.DefaultRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	return newWorkersService(worker, fallbackWorker)
+}
+
+// schedulerFallbackEnabled tells if the querier worker also needs to connect to the query frontend running in the same
+// process, as the fallback of the scheduler it receives queries from.
+func schedulerFallbackEnabled(cfg WorkerServiceConfig) bool {
+	frontendEnabled := cfg.QueryFrontendEnabled || cfg.ReadEnabled || cfg.AllEnabled
+	usesScheduler := cfg.SchedulerRing != nil || (*cfg.QuerierWorkerConfig).SchedulerAddress != ""
+	return cfg.SchedulerFallbackEnabled && frontendEnabled && usesScheduler
+}
+
+// newWorkersService returns a service running all workers together.
+func newWorkersService(workers ...services.Service) (services.Service, error) {
+	manager, err := services.NewManager(workers...)
+	if err != nil {
+		return nil, err
+	}
+	return services.NewIdleService(func(ctx context.Context) error {
+		return services.StartManagerAndAwaitHealthy(ctx, manager)
+	}, func(_ error) error {
+		return services.StopManagerAndAwaitStopped(context.Background(), manager)
+	}), nil
 }
 
 func querierRunningStandalone(cfg WorkerServiceConfig) bool {
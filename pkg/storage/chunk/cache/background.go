@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"sync"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
@@ -38,6 +39,8 @@ type backgroundCache struct {
 type backgroundWrite struct {
 	keys []string
 	bufs [][]byte
+	// expiration is the expiration the entries are stored with, see WithExpiration.
+	expiration time.Duration
 }
 
 // NewBackground returns a new Cache that does stores on background goroutines.
@@ -89,8 +92,9 @@ func (c *backgroundCache) Store(ctx context.Context, keys []string, bufs [][]byt
 		}
 
 		bgWrite := backgroundWrite{
-			keys: keys[:num],
-			bufs: bufs[:num],
+			keys:       keys[:num],
+			bufs:       bufs[:num],
+			expiration: expiration(ctx, 0),
 		}
 		select {
 		case c.bgWrites <- bgWrite:
@@ -118,7 +122,7 @@ func (c *backgroundCache) writeBackLoop() {
 				return
 			}
 			c.queueLength.Sub(float64(len(bgWrite.keys)))
-			c.Cache.Store(context.Background(), bgWrite.keys, bgWrite.bufs)
+			c.Cache.Store(WithExpiration(context.Background(), bgWrite.expiration), bgWrite.keys, bgWrite.bufs)
 
 		case <-c.quit:
 			return
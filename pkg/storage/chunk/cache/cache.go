@@ -24,6 +24,22 @@ type Cache interface {
 	Stop()
 }
 
+type expirationCtxKey struct{}
+
+// WithExpiration returns a context for the fifo, memcached and redis caches to store entries with the
+// expiration rather than their configured one. Non positive expirations are ignored.
+func WithExpiration(ctx context.Context, expiration time.Duration) context.Context {
+	return context.WithValue(ctx, expirationCtxKey{}, expiration)
+}
+
+// expiration returns the expiration of the entries stored with ctx, or def if it doesn't set one.
+func expiration(ctx context.Context, def time.Duration) time.Duration {
+	if d, ok := ctx.Value(expirationCtxKey{}).(time.Duration); ok && d > 0 {
+		return d
+	}
+	return def
+}
+
 // Config for building Caches.
 type Config struct {
 	EnableFifoCache bool `yaml:"enable_fifocache"`
@@ -86,8 +86,10 @@ type FifoCache struct {
 
 type cacheEntry struct {
 	updated time.Time
-	key     string
-	value   []byte
+	// validity is the validity of the entry, the one of the cache unless it was stored with another expiration.
+	validity time.Duration
+	key      string
+	value    []byte
 }
 
 // NewFifoCache returns a new initialised FifoCache of size.
@@ -202,8 +204,9 @@ func (c *FifoCache) Store(ctx context.Context, keys []string, values [][]byte) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	validity := expiration(ctx, c.validity)
 	for i := range keys {
-		c.put(keys[i], values[i])
+		c.put(keys[i], values[i], validity)
 	}
 }
 
@@ -222,7 +225,7 @@ func (c *FifoCache) Stop() {
 	c.memoryBytes.Set(float64(0))
 }
 
-func (c *FifoCache) put(key string, value []byte) {
+func (c *FifoCache) put(key string, value []byte, validity time.Duration) {
 	// See if we already have the item in the cache.
 	element, ok := c.entries[key]
 	if ok {
@@ -234,9 +237,10 @@ func (c *FifoCache) put(key string, value []byte) {
 	}
 
 	entry := &cacheEntry{
-		updated: time.Now(),
-		key:     key,
-		value:   value,
+		updated:  time.Now(),
+		validity: validity,
+		key:      key,
+		value:    value,
 	}
 	entrySz := sizeOf(entry)
 
@@ -283,7 +287,7 @@ func (c *FifoCache) Get(ctx context.Context, key string) ([]byte, bool) {
 	element, ok := c.entries[key]
 	if ok {
 		entry := element.Value.(*cacheEntry)
-		if c.validity == 0 || time.Since(entry.updated) < c.validity {
+		if entry.validity == 0 || time.Since(entry.updated) < entry.validity {
 			return entry.value, true
 		}
 
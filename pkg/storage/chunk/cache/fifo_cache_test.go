@@ -231,6 +231,23 @@ func TestFifoCacheExpiry(t *testing.T) {
 	}
 }
 
+func TestFifoCacheExpiration(t *testing.T) {
+	c := NewFifoCache("test-expiration", FifoCacheConfig{MaxSizeItems: 2, Validity: 5 * time.Millisecond}, nil, log.NewNopLogger())
+	defer c.Stop()
+	ctx := context.Background()
+
+	c.Store(ctx, []string{"01"}, [][]byte{[]byte("data1")})
+	c.Store(WithExpiration(ctx, time.Hour), []string{"02"}, [][]byte{[]byte("data2")})
+
+	// only the entry stored with the validity of the cache expires.
+	time.Sleep(10 * time.Millisecond)
+	_, ok := c.Get(ctx, "01")
+	require.False(t, ok)
+	value, ok := c.Get(ctx, "02")
+	require.True(t, ok)
+	require.Equal(t, []byte("data2"), value)
+}
+
 func genBytes(n uint8) []byte {
 	arr := make([]byte, n)
 	for i := range arr {
@@ -209,7 +209,7 @@ func (c *Memcached) Store(ctx context.Context, keys []string, bufs [][]byte) {
 			item := memcache.Item{
 				Key:        keys[i],
 				Value:      bufs[i],
-				Expiration: int32(c.cfg.Expiration.Seconds()),
+				Expiration: int32(expiration(ctx, c.cfg.Expiration).Seconds()),
 			}
 			return c.memcache.Set(&item)
 		})
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/go-kit/log"
@@ -69,6 +70,36 @@ func testMemcache(t *testing.T, memcache *cache.Memcached) {
 	}
 }
 
+func TestMemcachedExpiration(t *testing.T) {
+	client := &mockMemcacheExpiration{mockMemcache: newMockMemcache(), expirations: map[string]int32{}}
+	// the expiration is kept by the background writes.
+	c := cache.NewBackground("test", cache.BackgroundConfig{WriteBackGoroutines: 1, WriteBackBuffer: 10},
+		cache.NewMemcached(cache.MemcachedConfig{Expiration: time.Minute}, client, "test", nil, log.NewNopLogger()), nil)
+	defer c.Stop()
+
+	ctx := context.Background()
+	c.Store(ctx, []string{"1"}, [][]byte{[]byte("1")})
+	c.Store(cache.WithExpiration(ctx, time.Hour), []string{"2"}, [][]byte{[]byte("2")})
+	cache.Flush(c)
+
+	client.Lock()
+	defer client.Unlock()
+	require.Equal(t, map[string]int32{"1": 60, "2": 3600}, client.expirations)
+}
+
+// mockMemcacheExpiration records the expiration of the items it stores.
+type mockMemcacheExpiration struct {
+	*mockMemcache
+	expirations map[string]int32
+}
+
+func (m *mockMemcacheExpiration) Set(item *memcache.Item) error {
+	m.Lock()
+	m.expirations[item.Key] = item.Expiration
+	m.Unlock()
+	return m.mockMemcache.Set(item)
+}
+
 // mockMemcache whose calls fail 1/3rd of the time.
 type mockMemcacheFailing struct {
 	*mockMemcache
@@ -50,6 +50,23 @@ func TestRedisCache(t *testing.T) {
 	}
 }
 
+func TestRedisCacheExpiration(t *testing.T) {
+	c, err := mockRedisCache()
+	require.Nil(t, err)
+	defer c.redis.Close()
+
+	ctx := context.Background()
+	c.Store(ctx, []string{"key1"}, [][]byte{[]byte("data1")})
+	c.Store(WithExpiration(ctx, time.Hour), []string{"key2"}, [][]byte{[]byte("data2")})
+
+	ttl, err := c.redis.rdb.TTL(ctx, "key1").Result()
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, ttl)
+	ttl, err = c.redis.rdb.TTL(ctx, "key2").Result()
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, ttl)
+}
+
 func mockRedisCache() (*RedisCache, error) {
 	redisServer, err := miniredis.Run()
 	if err != nil {
@@ -114,9 +114,10 @@ func (c *RedisClient) MSet(ctx context.Context, keys []string, values [][]byte)
 		defer cancel()
 	}
 
+	expiration := expiration(ctx, c.expiration)
 	pipe := c.rdb.TxPipeline()
 	for i := range keys {
-		pipe.Set(ctx, keys[i], values[i], c.expiration)
+		pipe.Set(ctx, keys[i], values[i], expiration)
 	}
 	_, err := pipe.Exec(ctx)
 	return err
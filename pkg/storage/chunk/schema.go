@@ -894,7 +894,8 @@ func (v10Entries) FilterReadQueries(queries []IndexQuery, shard *astmapper.Shard
 			)
 		}
 
-		if err == nil && n == shard.Shard {
+		// the query shards partition the index rows even when there are fewer of them than row shards.
+		if err == nil && (n == shard.Shard || shard.Of > 0 && n%shard.Of == shard.Shard) {
 			matches = append(matches, query)
 		}
 	}
@@ -444,6 +444,15 @@ func TestV10IndexQueries(t *testing.T) {
 			},
 			expected: []IndexQuery{fromShards(2)[1]},
 		},
+		{
+			name:    "fewer query shards than row shards",
+			queries: fromShards(4),
+			shard: &astmapper.ShardAnnotation{
+				Shard: 1,
+				Of:    2,
+			},
+			expected: []IndexQuery{fromShards(4)[1], fromShards(4)[3]},
+		},
 	}
 
 	for _, c := range testExprs {
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/storage/chunk/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper"
+)
+
+// StartupProbeTimeout bounds the time spent probing each object store on startup.
+const StartupProbeTimeout = 30 * time.Second
+
+// objectStoreTypes are the storage types backed by an object store.
+var objectStoreTypes = map[string]struct{}{
+	storage.StorageTypeAWS:        {},
+	storage.StorageTypeS3:         {},
+	storage.StorageTypeGCS:        {},
+	storage.StorageTypeAzure:      {},
+	storage.StorageTypeSwift:      {},
+	storage.StorageTypeFileSystem: {},
+	storage.StorageTypeInMemory:   {},
+}
+
+// probedObjectStores returns the object stores holding the chunks of the schema periods and the
+// boltdb-shipper index, in the order they are configured.
+func probedObjectStores(cfg Config, schemaCfg SchemaConfig) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	add := func(name string) {
+		if _, ok := objectStoreTypes[name]; !ok {
+			return
+		}
+		if _, ok := seen[name]; ok {
+			return
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	for _, period := range schemaCfg.Configs {
+		if period.ObjectType != "" {
+			add(period.ObjectType)
+		} else {
+			add(period.IndexType)
+		}
+		if period.IndexType == shipper.BoltDBShipperType {
+			add(cfg.BoltDBShipperConfig.SharedStoreType)
+		}
+	}
+	return names
+}
+
+// ProbeObjectStores lists the root of the object stores used by the schema periods, failing on the first
+// one which isn't reachable, so that a misconfigured store is reported on startup rather than on the first
+// query or flush.
+func ProbeObjectStores(ctx context.Context, cfg Config, schemaCfg SchemaConfig, newObjectClient func(string, storage.Config) (chunk.ObjectClient, error)) error {
+	for _, name := range probedObjectStores(cfg, schemaCfg) {
+		client, err := newObjectClient(name, cfg.Config)
+		if err != nil {
+			return fmt.Errorf("creating %s object store client: %w", name, err)
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, StartupProbeTimeout)
+		_, _, err = client.List(probeCtx, "", "/")
+		cancel()
+		client.Stop()
+		if err != nil {
+			return fmt.Errorf("%s object store is unreachable: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/chunk"
+	"github.com/grafana/loki/pkg/storage/chunk/storage"
+	"github.com/grafana/loki/pkg/storage/stores/shipper"
+)
+
+type probedObjectClient struct {
+	chunk.ObjectClient
+	err     error
+	stopped bool
+}
+
+func (c *probedObjectClient) List(_ context.Context, _, _ string) ([]chunk.StorageObject, []chunk.StorageCommonPrefix, error) {
+	return nil, nil, c.err
+}
+
+func (c *probedObjectClient) Stop() {
+	c.stopped = true
+}
+
+func Test_ProbeObjectStores(t *testing.T) {
+	cfg := Config{}
+	cfg.BoltDBShipperConfig.SharedStoreType = storage.StorageTypeS3
+	schemaCfg := SchemaConfig{chunk.SchemaConfig{Configs: []chunk.PeriodConfig{
+		{IndexType: "bigtable", ObjectType: storage.StorageTypeGCS},
+		{IndexType: shipper.BoltDBShipperType, ObjectType: storage.StorageTypeS3},
+		{IndexType: "cassandra"},
+	}}}
+	require.Equal(t, []string{storage.StorageTypeGCS, storage.StorageTypeS3}, probedObjectStores(cfg, schemaCfg))
+
+	clients := map[string]*probedObjectClient{
+		storage.StorageTypeGCS: {},
+		storage.StorageTypeS3:  {err: errors.New("access denied")},
+	}
+	newObjectClient := func(name string, _ storage.Config) (chunk.ObjectClient, error) {
+		return clients[name], nil
+	}
+
+	err := ProbeObjectStores(context.Background(), cfg, schemaCfg, newObjectClient)
+	require.EqualError(t, err, "s3 object store is unreachable: access denied")
+	require.True(t, clients[storage.StorageTypeGCS].stopped)
+	require.True(t, clients[storage.StorageTypeS3].stopped)
+
+	clients[storage.StorageTypeS3].err = nil
+	require.NoError(t, ProbeObjectStores(context.Background(), cfg, schemaCfg, newObjectClient))
+}
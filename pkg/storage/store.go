@@ -38,6 +38,7 @@ type Config struct {
 	storage.Config      `yaml:",inline"`
 	MaxChunkBatchSize   int            `yaml:"max_chunk_batch_size"`
 	BoltDBShipperConfig shipper.Config `yaml:"boltdb_shipper"`
+	StartupProbe        bool           `yaml:"startup_probe"`
 }
 
 // RegisterFlags adds the flags required to configure this flag set.
@@ -45,6 +46,7 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.Config.RegisterFlags(f)
 	cfg.BoltDBShipperConfig.RegisterFlags(f)
 	f.IntVar(&cfg.MaxChunkBatchSize, "store.max-chunk-batch-size", 50, "The maximum number of chunks to fetch per batch.")
+	f.BoolVar(&cfg.StartupProbe, "store.startup-probe", false, "List the object stores holding the chunks and the boltdb-shipper index when initializing the store, failing the startup if one of them is unreachable.")
 }
 
 // SchemaConfig contains the config for our chunk index schemas
@@ -41,6 +41,12 @@ const (
 	// ringNameForServer is the name of the ring used by the compactor server.
 	ringNameForServer = "compactor"
 
+	// deletionRingKey is the key under which we store the ring of the compactor-deletion instances in the KVStore.
+	deletionRingKey = "compactor-deletion"
+
+	// deletionRingName is the name of the ring used by the compactor-deletion instances.
+	deletionRingName = "compactor-deletion"
+
 	// ringKeyOfLeader is a somewhat arbitrary ID to pull from the ring to see who will be elected the leader
 	ringKeyOfLeader = 0
 
@@ -63,6 +69,8 @@ type Config struct {
 	RetentionDeleteWorkCount  int             `yaml:"retention_delete_worker_count"`
 	DeleteRequestCancelPeriod time.Duration   `yaml:"delete_request_cancel_period"`
 	MaxCompactionParallelism  int             `yaml:"max_compaction_parallelism"`
+	SeparateDeletion          bool            `yaml:"separate_deletion"`
+	DeletionMinTableAge       time.Duration   `yaml:"deletion_min_table_age"`
 	CompactorRing             util.RingConfig `yaml:"compactor_ring,omitempty"`
 }
 
@@ -78,6 +86,8 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.IntVar(&cfg.RetentionDeleteWorkCount, "boltdb.shipper.compactor.retention-delete-worker-count", 150, "The total amount of worker to use to delete chunks.")
 	f.DurationVar(&cfg.DeleteRequestCancelPeriod, "boltdb.shipper.compactor.delete-request-cancel-period", 24*time.Hour, "Allow cancellation of delete request until duration after they are created. Data would be deleted only after delete requests have been older than this duration. Ideally this should be set to at least 24h.")
 	f.IntVar(&cfg.MaxCompactionParallelism, "boltdb.shipper.compactor.max-compaction-parallelism", 1, "Maximum number of tables to compact in parallel. While increasing this value, please make sure compactor has enough disk space allocated to be able to store and compact as many tables.")
+	f.BoolVar(&cfg.SeparateDeletion, "boltdb.shipper.compactor.separate-deletion", false, "Apply retention and process the delete requests in the compactor-deletion target instead of the compactor target. The compactor then only compacts the tables which ended less than the deletion min table age ago, the compactor-deletion target compacts and applies retention to the older ones. Requires retention to be enabled.")
+	f.DurationVar(&cfg.DeletionMinTableAge, "boltdb.shipper.compactor.deletion-min-table-age", 48*time.Hour, "Time after the end of a table after which it is handed over from the compactor to the compactor-deletion target, when running the deletions separately. Retention and delete requests are only applied to the tables older than this.")
 	cfg.CompactorRing.RegisterFlagsWithPrefix("boltdb.shipper.compactor.", "collectors/", f)
 }
 
@@ -89,6 +99,12 @@ func (cfg *Config) Validate() error {
 	if cfg.RetentionEnabled && cfg.ApplyRetentionInterval != 0 && cfg.ApplyRetentionInterval%cfg.CompactionInterval != 0 {
 		return errors.New("interval for applying retention should either be set to a 0 or a multiple of compaction interval")
 	}
+	if cfg.SeparateDeletion && !cfg.RetentionEnabled {
+		return errors.New("retention must be enabled to run the deletions separately")
+	}
+	if cfg.SeparateDeletion && cfg.DeletionMinTableAge <= 0 {
+		return errors.New("deletion min table age must be > 0")
+	}
 
 	return shipper_util.ValidateSharedStoreKeyPrefix(cfg.SharedStoreKeyPrefix)
 }
@@ -108,6 +124,12 @@ type Compactor struct {
 	running               bool
 	wg                    sync.WaitGroup
 
+	// retentionEnabled is whether this instance applies retention and processes the delete requests.
+	retentionEnabled bool
+	// ownsTable returns whether this instance compacts the table: the tables are split by age between the
+	// compactor and the compactor-deletion instances, so that they never rewrite the same table concurrently.
+	ownsTable func(tableName string, now model.Time) bool
+
 	// Ring used for running a single compactor
 	ringLifecycler *ring.BasicLifecycler
 	ring           *ring.Ring
@@ -118,61 +140,100 @@ type Compactor struct {
 	subservicesWatcher *services.FailureWatcher
 }
 
+// NewCompactor returns the compactor of the compactor target. It compacts all the tables and applies retention to
+// them if enabled, or only compacts the recent tables if the deletions run separately.
 func NewCompactor(cfg Config, storageConfig storage.Config, schemaConfig loki_storage.SchemaConfig, limits retention.Limits, r prometheus.Registerer) (*Compactor, error) {
-	if cfg.SharedStoreType == "" {
-		return nil, errors.New("compactor shared_store_type must be specified")
+	compactor := &Compactor{
+		cfg:              cfg,
+		ringPollPeriod:   5 * time.Second,
+		retentionEnabled: cfg.RetentionEnabled && !cfg.SeparateDeletion,
+		ownsTable: func(tableName string, now model.Time) bool {
+			return !cfg.SeparateDeletion || !tableOlderThan(tableName, now, cfg.DeletionMinTableAge)
+		},
 	}
+	if err := compactor.setup(ringKey, ringNameForServer, storageConfig, schemaConfig, limits, r); err != nil {
+		return nil, err
+	}
+	return compactor, nil
+}
 
+// NewDeletionCompactor returns the compactor of the compactor-deletion target. It compacts and applies retention
+// to the tables the compactor target no longer compacts, one compaction interval after it hands them over.
+func NewDeletionCompactor(cfg Config, storageConfig storage.Config, schemaConfig loki_storage.SchemaConfig, limits retention.Limits, r prometheus.Registerer) (*Compactor, error) {
+	if !cfg.SeparateDeletion {
+		return nil, errors.New("the compactor-deletion target requires the deletions to run separately")
+	}
 	compactor := &Compactor{
-		cfg:            cfg,
-		ringPollPeriod: 5 * time.Second,
+		cfg:              cfg,
+		ringPollPeriod:   5 * time.Second,
+		retentionEnabled: true,
+		ownsTable: func(tableName string, now model.Time) bool {
+			return tableOlderThan(tableName, now, cfg.DeletionMinTableAge+cfg.CompactionInterval)
+		},
+	}
+	if err := compactor.setup(deletionRingKey, deletionRingName, storageConfig, schemaConfig, limits, r); err != nil {
+		return nil, err
+	}
+	return compactor, nil
+}
+
+// tableOlderThan returns whether the table ended more than age ago.
+func tableOlderThan(tableName string, now model.Time, age time.Duration) bool {
+	return retention.ExtractIntervalFromTableName(tableName).End.Before(now.Add(-age))
+}
+
+// setup creates the ring used to elect the instance running the compactions, under key and name.
+func (c *Compactor) setup(key, name string, storageConfig storage.Config, schemaConfig loki_storage.SchemaConfig, limits retention.Limits, r prometheus.Registerer) error {
+	cfg := c.cfg
+	if cfg.SharedStoreType == "" {
+		return errors.New("compactor shared_store_type must be specified")
 	}
 
 	ringStore, err := kv.NewClient(
 		cfg.CompactorRing.KVStore,
 		ring.GetCodec(),
-		kv.RegistererWithKVName(prometheus.WrapRegistererWithPrefix("loki_", r), "compactor"),
+		kv.RegistererWithKVName(prometheus.WrapRegistererWithPrefix("loki_", r), name),
 		util_log.Logger,
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "create KV store client")
+		return errors.Wrap(err, "create KV store client")
 	}
 	lifecyclerCfg, err := cfg.CompactorRing.ToLifecyclerConfig(ringNumTokens, util_log.Logger)
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid ring lifecycler config")
+		return errors.Wrap(err, "invalid ring lifecycler config")
 	}
 
 	// Define lifecycler delegates in reverse order (last to be called defined first because they're
 	// chained via "next delegate").
-	delegate := ring.BasicLifecyclerDelegate(compactor)
+	delegate := ring.BasicLifecyclerDelegate(c)
 	delegate = ring.NewLeaveOnStoppingDelegate(delegate, util_log.Logger)
 	delegate = ring.NewTokensPersistencyDelegate(cfg.CompactorRing.TokensFilePath, ring.JOINING, delegate, util_log.Logger)
 	delegate = ring.NewAutoForgetDelegate(ringAutoForgetUnhealthyPeriods*cfg.CompactorRing.HeartbeatTimeout, delegate, util_log.Logger)
 
-	compactor.ringLifecycler, err = ring.NewBasicLifecycler(lifecyclerCfg, ringNameForServer, ringKey, ringStore, delegate, util_log.Logger, r)
+	c.ringLifecycler, err = ring.NewBasicLifecycler(lifecyclerCfg, name, key, ringStore, delegate, util_log.Logger, r)
 	if err != nil {
-		return nil, errors.Wrap(err, "create ring lifecycler")
+		return errors.Wrap(err, "create ring lifecycler")
 	}
 
 	ringCfg := cfg.CompactorRing.ToRingConfig(ringReplicationFactor)
-	compactor.ring, err = ring.NewWithStoreClientAndStrategy(ringCfg, ringNameForServer, ringKey, ringStore, ring.NewIgnoreUnhealthyInstancesReplicationStrategy(), prometheus.WrapRegistererWithPrefix("cortex_", r), util_log.Logger)
+	c.ring, err = ring.NewWithStoreClientAndStrategy(ringCfg, name, key, ringStore, ring.NewIgnoreUnhealthyInstancesReplicationStrategy(), prometheus.WrapRegistererWithPrefix("cortex_", r), util_log.Logger)
 	if err != nil {
-		return nil, errors.Wrap(err, "create ring client")
+		return errors.Wrap(err, "create ring client")
 	}
 
-	compactor.subservices, err = services.NewManager(compactor.ringLifecycler, compactor.ring)
+	c.subservices, err = services.NewManager(c.ringLifecycler, c.ring)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	compactor.subservicesWatcher = services.NewFailureWatcher()
-	compactor.subservicesWatcher.WatchManager(compactor.subservices)
+	c.subservicesWatcher = services.NewFailureWatcher()
+	c.subservicesWatcher.WatchManager(c.subservices)
 
-	if err := compactor.init(storageConfig, schemaConfig, limits, r); err != nil {
-		return nil, err
+	if err := c.init(storageConfig, schemaConfig, limits, r); err != nil {
+		return err
 	}
 
-	compactor.Service = services.NewBasicService(compactor.starting, compactor.loop, compactor.stopping)
-	return compactor, nil
+	c.Service = services.NewBasicService(c.starting, c.loop, c.stopping)
+	return nil
 }
 
 func (c *Compactor) init(storageConfig storage.Config, schemaConfig loki_storage.SchemaConfig, limits retention.Limits, r prometheus.Registerer) error {
@@ -188,7 +249,7 @@ func (c *Compactor) init(storageConfig storage.Config, schemaConfig loki_storage
 	c.indexStorageClient = shipper_storage.NewIndexStorageClient(objectClient, c.cfg.SharedStoreKeyPrefix)
 	c.metrics = newMetrics(r)
 
-	if c.cfg.RetentionEnabled {
+	if c.retentionEnabled {
 		var encoder objectclient.KeyEncoder
 		if _, ok := objectClient.(*local.FSObjectClient); ok {
 			encoder = objectclient.Base64Encoder
@@ -272,7 +333,7 @@ func (c *Compactor) starting(ctx context.Context) (err error) {
 }
 
 func (c *Compactor) loop(ctx context.Context) error {
-	if c.cfg.RetentionEnabled {
+	if c.retentionEnabled {
 		defer c.deleteRequestsStore.Stop()
 		defer c.deleteRequestsManager.Stop()
 	}
@@ -347,7 +408,7 @@ func (c *Compactor) runCompactions(ctx context.Context) {
 	lastRetentionRunAt := time.Unix(0, 0)
 	runCompaction := func() {
 		applyRetention := false
-		if c.cfg.RetentionEnabled && time.Since(lastRetentionRunAt) >= c.cfg.ApplyRetentionInterval {
+		if c.retentionEnabled && time.Since(lastRetentionRunAt) >= c.cfg.ApplyRetentionInterval {
 			level.Info(util_log.Logger).Log("msg", "applying retention with compaction")
 			applyRetention = true
 		}
@@ -379,7 +440,7 @@ func (c *Compactor) runCompactions(ctx context.Context) {
 			}
 		}
 	}()
-	if c.cfg.RetentionEnabled {
+	if c.retentionEnabled {
 		c.wg.Add(1)
 		go func() {
 			// starts the chunk sweeper
@@ -408,7 +469,7 @@ func (c *Compactor) CompactTable(ctx context.Context, tableName string, applyRet
 
 	interval := retention.ExtractIntervalFromTableName(tableName)
 	intervalMayHaveExpiredChunks := false
-	if c.cfg.RetentionEnabled && applyRetention {
+	if c.retentionEnabled && applyRetention {
 		intervalMayHaveExpiredChunks = c.expirationChecker.IntervalMayHaveExpiredChunks(interval, "")
 	}
 
@@ -424,7 +485,7 @@ func (c *Compactor) RunCompaction(ctx context.Context, applyRetention bool) erro
 	status := statusSuccess
 	start := time.Now()
 
-	if c.cfg.RetentionEnabled {
+	if c.retentionEnabled {
 		c.expirationChecker.MarkPhaseStarted()
 	}
 
@@ -439,7 +500,7 @@ func (c *Compactor) RunCompaction(ctx context.Context, applyRetention bool) erro
 			}
 		}
 
-		if c.cfg.RetentionEnabled {
+		if c.retentionEnabled {
 			if status == statusSuccess {
 				c.expirationChecker.MarkPhaseFinished()
 			} else {
@@ -488,11 +549,15 @@ func (c *Compactor) RunCompaction(ctx context.Context, applyRetention bool) erro
 	}
 
 	go func() {
+		now := model.Now()
 		for _, tableName := range tables {
 			if tableName == deletion.DeleteRequestsTableName {
 				// we do not want to compact or apply retention on delete requests table
 				continue
 			}
+			if !c.ownsTable(tableName, now) {
+				continue
+			}
 
 			select {
 			case compactTablesChan <- tableName:
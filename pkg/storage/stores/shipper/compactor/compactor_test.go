@@ -7,8 +7,11 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 
 	loki_storage "github.com/grafana/loki/pkg/storage"
@@ -37,6 +40,52 @@ func setupTestCompactor(t *testing.T, tempDir string) *Compactor {
 	return c
 }
 
+func TestCompactor_SeparateDeletion(t *testing.T) {
+	tempDir := t.TempDir()
+
+	cfg := Config{}
+	flagext.DefaultValues(&cfg)
+	cfg.WorkingDirectory = filepath.Join(tempDir, workingDirName)
+	cfg.SharedStoreType = "filesystem"
+	cfg.RetentionEnabled = true
+	cfg.SeparateDeletion = true
+	cfg.DeletionMinTableAge = 48 * time.Hour
+	cfg.CompactionInterval = time.Hour
+	if loopbackIFace, err := loki_net.LoopbackInterfaceName(); err == nil {
+		cfg.CompactorRing.InstanceInterfaceNames = append(cfg.CompactorRing.InstanceInterfaceNames, loopbackIFace)
+	}
+	require.NoError(t, cfg.Validate())
+
+	storageCfg := storage.Config{FSConfig: local.FSConfig{Directory: tempDir}}
+	compactor, err := NewCompactor(cfg, storageCfg, loki_storage.SchemaConfig{}, nil, prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.False(t, compactor.retentionEnabled)
+	deletion, err := NewDeletionCompactor(cfg, storageCfg, loki_storage.SchemaConfig{}, nil, prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.True(t, deletion.retentionEnabled)
+
+	// half an hour into the day of the table index_19000.
+	now := model.TimeFromUnix(19000 * 86400).Add(30 * time.Minute)
+	for _, tc := range []struct {
+		table              string
+		compactor, deleter bool
+	}{
+		{table: "index_19000", compactor: true},
+		{table: "index_18998", compactor: true},
+		// ended more than 48h ago, but less than 48h plus a compaction interval ago.
+		{table: "index_18997"},
+		{table: "index_18996", deleter: true},
+		{table: "index_unknown", compactor: true},
+	} {
+		require.Equal(t, tc.compactor, compactor.ownsTable(tc.table, now), tc.table)
+		require.Equal(t, tc.deleter, deletion.ownsTable(tc.table, now), tc.table)
+	}
+
+	cfg.SeparateDeletion = false
+	_, err = NewDeletionCompactor(cfg, storageCfg, loki_storage.SchemaConfig{}, nil, prometheus.NewRegistry())
+	require.Error(t, err)
+}
+
 func TestCompactor_RunCompaction(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "compactor-run-compaction")
 	require.NoError(t, err)
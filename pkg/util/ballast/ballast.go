@@ -0,0 +1,62 @@
+package ballast
+
+import (
+	"fmt"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	// ModeHeap allocates the ballast as a byte slice on the Go heap.
+	ModeHeap = "heap"
+	// ModeMmap allocates the ballast as an anonymous memory mapping outside of the Go heap. The garbage
+	// collector doesn't account for it, so unlike ModeHeap it doesn't reduce the garbage collection frequency.
+	ModeMmap = "mmap"
+)
+
+// Modes lists the supported ballast allocation modes.
+var Modes = []string{ModeHeap, ModeMmap}
+
+// Ballast is a block of memory which is never read from nor written to.
+type Ballast struct {
+	data    []byte
+	release func() error
+}
+
+// New reserves a ballast of size bytes using the given mode.
+// The mmap mode falls back to a heap allocation, with a warning, when the memory mapping can't be created,
+// e.g. on platforms which don't support it.
+func New(size int, mode string, logger log.Logger) (*Ballast, error) {
+	if size <= 0 {
+		return &Ballast{}, nil
+	}
+	switch mode {
+	case ModeHeap, "":
+		return &Ballast{data: make([]byte, size)}, nil
+	case ModeMmap:
+		b, err := mmap(size)
+		if err != nil {
+			level.Warn(logger).Log("msg", "failed to map the ballast, allocating it on the heap instead", "err", err)
+			return &Ballast{data: make([]byte, size)}, nil
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unsupported ballast mode: %s", mode)
+	}
+}
+
+// Size returns the size of the ballast in bytes.
+func (b *Ballast) Size() int {
+	return len(b.data)
+}
+
+// Release frees the memory held by the ballast.
+func (b *Ballast) Release() error {
+	var err error
+	if b.release != nil {
+		err = b.release()
+	}
+	b.data, b.release = nil, nil
+	return err
+}
@@ -0,0 +1,28 @@
+package ballast
+
+import (
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	for _, mode := range append(Modes, "") {
+		t.Run(mode, func(t *testing.T) {
+			b, err := New(1<<20, mode, log.NewNopLogger())
+			require.NoError(t, err)
+			require.Equal(t, 1<<20, b.Size())
+			require.NoError(t, b.Release())
+			require.Equal(t, 0, b.Size())
+		})
+	}
+
+	b, err := New(0, ModeMmap, log.NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, 0, b.Size())
+	require.NoError(t, b.Release())
+
+	_, err = New(1<<20, "unknown", log.NewNopLogger())
+	require.Error(t, err)
+}
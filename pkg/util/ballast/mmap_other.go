@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package ballast
+
+import (
+	"errors"
+)
+
+// mmap fails on platforms without anonymous memory mappings.
+func mmap(size int) (*Ballast, error) {
+	return nil, errors.New("anonymous memory mappings aren't supported on this platform")
+}
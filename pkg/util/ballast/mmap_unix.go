@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package ballast
+
+import (
+	"syscall"
+)
+
+func mmap(size int) (*Ballast, error) {
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, err
+	}
+	return &Ballast{
+		data: data,
+		release: func() error {
+			return syscall.Munmap(data)
+		},
+	}, nil
+}
@@ -0,0 +1,35 @@
+// Package gctuning applies the garbage collector settings of the config, an alternative to the ballast to
+// control how often the Go runtime collects garbage.
+package gctuning
+
+import (
+	"errors"
+	"runtime/debug"
+)
+
+// Validate checks the GC percentage and the memory limit, 0 leaving either to the Go runtime.
+func Validate(gcPercent int, memoryLimitBytes int64) error {
+	if gcPercent < -1 {
+		return errors.New("the GC percentage must be positive, or -1 to disable the GC")
+	}
+	if memoryLimitBytes < 0 {
+		return errors.New("the memory limit must not be negative")
+	}
+	// without a memory limit, the heap would grow until the process is killed.
+	if gcPercent == -1 && memoryLimitBytes == 0 {
+		return errors.New("the GC can only be disabled with a memory limit")
+	}
+	return nil
+}
+
+// Apply sets the GC percentage and the soft memory limit of the Go runtime, like the GOGC and GOMEMLIMIT
+// environment variables. 0 leaves either untouched.
+func Apply(gcPercent int, memoryLimitBytes int64) error {
+	if gcPercent != 0 {
+		debug.SetGCPercent(gcPercent)
+	}
+	if memoryLimitBytes != 0 {
+		return setMemoryLimit(memoryLimitBytes)
+	}
+	return nil
+}
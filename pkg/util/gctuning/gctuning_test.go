@@ -0,0 +1,41 @@
+//go:build go1.19
+// +build go1.19
+
+package gctuning
+
+import (
+	"math"
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	gcPercent := debug.SetGCPercent(100)
+	memoryLimit := debug.SetMemoryLimit(math.MaxInt64)
+	defer func() {
+		debug.SetGCPercent(gcPercent)
+		debug.SetMemoryLimit(memoryLimit)
+	}()
+
+	// the zero values leave the runtime settings untouched.
+	require.NoError(t, Apply(0, 0))
+	require.Equal(t, 100, debug.SetGCPercent(100))
+	require.Equal(t, int64(math.MaxInt64), debug.SetMemoryLimit(-1))
+
+	require.NoError(t, Apply(50, 1<<30))
+	require.Equal(t, 50, debug.SetGCPercent(50))
+	// a negative limit reads it without changing it.
+	require.Equal(t, int64(1<<30), debug.SetMemoryLimit(-1))
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(0, 0))
+	require.NoError(t, Validate(200, 0))
+	require.NoError(t, Validate(0, 1<<30))
+	require.NoError(t, Validate(-1, 1<<30))
+	require.Error(t, Validate(-1, 0))
+	require.Error(t, Validate(-2, 1<<30))
+	require.Error(t, Validate(100, -1))
+}
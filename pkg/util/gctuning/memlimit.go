@@ -0,0 +1,11 @@
+//go:build go1.19
+// +build go1.19
+
+package gctuning
+
+import "runtime/debug"
+
+func setMemoryLimit(bytes int64) error {
+	debug.SetMemoryLimit(bytes)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !go1.19
+// +build !go1.19
+
+package gctuning
+
+import "errors"
+
+func setMemoryLimit(int64) error {
+	return errors.New("the memory limit requires Go 1.19 or later")
+}
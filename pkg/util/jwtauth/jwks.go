@@ -0,0 +1,216 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	util_log "github.com/cortexproject/cortex/pkg/util/log"
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+)
+
+// unknownKeyRefetchInterval is the minimum delay between two refetches of the JWKS triggered by tokens signed
+// with an unknown key, so that forged tokens can't flood the identity provider.
+const unknownKeyRefetchInterval = time.Minute
+
+// staleRefetchInterval is the minimum delay between two refetches of stale keys, so that an unreachable identity
+// provider isn't retried on every request.
+const staleRefetchInterval = 10 * time.Second
+
+// jwk is a JSON Web Key of a JWKS, only RSA and EC public keys are supported.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA public key
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC public key
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKey returns the RSA or ECDSA public key of the JWK.
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid RSA modulus")
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid RSA exponent")
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EC x coordinate")
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid EC y coordinate")
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC public key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keySet is the set of public keys of a JWKS, by key ID. It is fetched on first use, refetched in the background
+// once stale and refetched when a token is signed with an unknown key. The requests never wait for a fetch when
+// their key is known.
+type keySet struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	mtx       sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	// lastFetch is the time of the last fetch attempt, successful or not.
+	lastFetch time.Time
+	// fetching is closed once the fetch in flight completes, nil when there is none.
+	fetching chan struct{}
+}
+
+func newKeySet(url string, refreshInterval time.Duration, client *http.Client) *keySet {
+	return &keySet{
+		url:             url,
+		client:          client,
+		refreshInterval: refreshInterval,
+	}
+}
+
+// key returns the public key with the given ID. An empty ID matches the key of a JWKS with a single key.
+func (s *keySet) key(kid string) (interface{}, error) {
+	s.mtx.Lock()
+	now := time.Now()
+	key, ok := s.lookup(kid)
+	stale := now.Sub(s.fetchedAt) >= s.refreshInterval && now.Sub(s.lastFetch) >= staleRefetchInterval
+	if s.fetching == nil && (stale || (!ok && now.Sub(s.lastFetch) >= unknownKeyRefetchInterval)) {
+		s.startFetch(now)
+	}
+	fetching := s.fetching
+	s.mtx.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	// the unknown keys are looked up again once the fetch in flight, if any, completes.
+	if fetching != nil {
+		<-fetching
+		s.mtx.Lock()
+		key, ok = s.lookup(kid)
+		s.mtx.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// startFetch fetches the keys in the background. It must be called with the mutex held.
+func (s *keySet) startFetch(now time.Time) {
+	s.lastFetch = now
+	done := make(chan struct{})
+	s.fetching = done
+	go func() {
+		defer close(done)
+		keys, err := s.fetch()
+
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.fetching = nil
+		if err != nil {
+			// the keys fetched previously are kept until the identity provider is reachable again.
+			level.Warn(util_log.Logger).Log("msg", "failed to fetch the JWKS", "url", s.url, "err", err)
+			return
+		}
+		s.keys = keys
+		s.fetchedAt = now
+	}()
+}
+
+func (s *keySet) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// fetch returns the signing keys of the JWKS.
+func (s *keySet) fetch() (map[string]interface{}, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errors.Wrap(err, "invalid JWKS")
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			level.Warn(util_log.Logger).Log("msg", "ignoring JWK", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
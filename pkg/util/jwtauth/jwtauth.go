@@ -0,0 +1,132 @@
+// Package jwtauth provides an HTTP middleware authenticating requests with a JWT bearer token, whose tenant is
+// read from one of its claims, for deployments fronted by an OIDC proxy rather than setting X-Scope-OrgID.
+package jwtauth
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+const bearerPrefix = "Bearer "
+
+// signingMethods are the asymmetric algorithms of the keys of a JWKS, the symmetric and none ones are refused.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Config configures the JWT authentication of the HTTP requests.
+type Config struct {
+	Enabled             bool          `yaml:"enabled"`
+	JWKSURL             string        `yaml:"jwks_url"`
+	JWKSRefreshInterval time.Duration `yaml:"jwks_refresh_interval"`
+	TenantClaim         string        `yaml:"tenant_claim"`
+	Issuer              string        `yaml:"issuer"`
+	Audience            string        `yaml:"audience"`
+	AllowOrgIDHeader    bool          `yaml:"allow_org_id_header"`
+}
+
+// RegisterFlags registers flags.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "auth.jwt.enabled", false, "Authenticate the HTTP requests with the JWT bearer token of their Authorization header, reading their tenant from a claim of the token. Requires auth.enabled.")
+	f.StringVar(&cfg.JWKSURL, "auth.jwt.jwks-url", "", "URL of the JWKS holding the public keys the tokens are signed with.")
+	f.DurationVar(&cfg.JWKSRefreshInterval, "auth.jwt.jwks-refresh-interval", time.Hour, "How often the JWKS is fetched again, in the background while the previous keys keep being used. Failed fetches are retried at most every 10 seconds. It is also fetched again, at most once a minute, when a token is signed with an unknown key.")
+	f.StringVar(&cfg.TenantClaim, "auth.jwt.tenant-claim", "", "Name of the claim of the tokens holding the tenant ID.")
+	f.StringVar(&cfg.Issuer, "auth.jwt.issuer", "", "Issuer the tokens must be issued by, their iss claim. Empty to accept any issuer.")
+	f.StringVar(&cfg.Audience, "auth.jwt.audience", "", "Audience the tokens must be issued for, one of their aud claim. Empty to accept any audience.")
+	f.BoolVar(&cfg.AllowOrgIDHeader, "auth.jwt.allow-org-id-header", false, "Authenticate the requests without a bearer token with their X-Scope-OrgID header instead of rejecting them, e.g. for the clients which don't go through the OIDC proxy.")
+}
+
+// Validate validates the config.
+func (cfg *Config) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.JWKSURL == "" {
+		return errors.New("the JWKS URL is required")
+	}
+	if cfg.TenantClaim == "" {
+		return errors.New("the tenant claim is required")
+	}
+	if cfg.JWKSRefreshInterval <= 0 {
+		return errors.New("the JWKS refresh interval must be positive")
+	}
+	return nil
+}
+
+// NewMiddleware returns a middleware authenticating the requests with their bearer token, injecting the tenant
+// of its claim as their org ID. The requests without a bearer token go through headerAuth when the config
+// allows it, e.g. middleware.AuthenticateUser.
+func NewMiddleware(cfg Config, headerAuth middleware.Interface) middleware.Interface {
+	return newMiddleware(cfg, headerAuth, &http.Client{Timeout: 10 * time.Second})
+}
+
+func newMiddleware(cfg Config, headerAuth middleware.Interface, client *http.Client) middleware.Interface {
+	a := &authenticator{
+		cfg:    cfg,
+		keys:   newKeySet(cfg.JWKSURL, cfg.JWKSRefreshInterval, client),
+		parser: &jwt.Parser{ValidMethods: signingMethods},
+	}
+	return middleware.Func(func(next http.Handler) http.Handler {
+		headerNext := headerAuth.Wrap(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authorization, bearerPrefix) {
+				if cfg.AllowOrgIDHeader {
+					headerNext.ServeHTTP(w, r)
+					return
+				}
+				http.Error(w, "no bearer token", http.StatusUnauthorized)
+				return
+			}
+
+			tenantID, err := a.tenantID(strings.TrimPrefix(authorization, bearerPrefix))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			// the tenant of the token replaces any org ID header of the request, for the handlers forwarding it.
+			r.Header.Set(user.OrgIDHeaderName, tenantID)
+			next.ServeHTTP(w, r.WithContext(user.InjectOrgID(r.Context(), tenantID)))
+		})
+	})
+}
+
+type authenticator struct {
+	cfg    Config
+	keys   *keySet
+	parser *jwt.Parser
+}
+
+// tenantID verifies the token and returns the tenant of its claim.
+func (a *authenticator) tenantID(raw string) (string, error) {
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.keys.key(kid)
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %w", err)
+	}
+	// the parser only rejects the expired tokens, the tokens without expiry would be valid forever.
+	if _, ok := claims["exp"]; !ok {
+		return "", errors.New("invalid token: no exp claim")
+	}
+	if a.cfg.Issuer != "" && !claims.VerifyIssuer(a.cfg.Issuer, true) {
+		return "", errors.New("invalid token: unexpected issuer")
+	}
+	if a.cfg.Audience != "" && !claims.VerifyAudience(a.cfg.Audience, true) {
+		return "", errors.New("invalid token: unexpected audience")
+	}
+
+	tenantID, _ := claims[a.cfg.TenantClaim].(string)
+	if tenantID == "" {
+		return "", fmt.Errorf("invalid token: no %s claim", a.cfg.TenantClaim)
+	}
+	return tenantID, nil
+}
@@ -0,0 +1,229 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"go.uber.org/atomic"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// newJWKSServer serves a JWKS with the public keys of rsaKey, as "rsa", and ecKey, as "ec". It counts the fetches.
+func newJWKSServer(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) (*httptest.Server, *atomic.Int32) {
+	set := jwks{Keys: []jwk{
+		{Kty: "RSA", Kid: "rsa", Use: "sig", N: encodeBigInt(rsaKey.N), E: encodeBigInt(big.NewInt(int64(rsaKey.E)))},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encodeBigInt(ecKey.X), Y: encodeBigInt(ecKey.Y)},
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: encodeBigInt(rsaKey.N), E: encodeBigInt(big.NewInt(int64(rsaKey.E)))},
+	}}
+	fetches := atomic.NewInt32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Inc()
+		require.NoError(t, json.NewEncoder(w).Encode(set))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, fetches
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	require.NoError(t, err)
+	return raw
+}
+
+func Test_Middleware(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv, _ := newJWKSServer(t, rsaKey, ecKey)
+
+	cfg := Config{
+		Enabled:             true,
+		JWKSURL:             srv.URL,
+		JWKSRefreshInterval: time.Hour,
+		TenantClaim:         "tenant",
+		Issuer:              "https://idp.example.com",
+		Audience:            "loki",
+	}
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"tenant": "team-a",
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"grafana", "loki"},
+			"exp":    time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name        string
+		allowHeader bool
+		token       string
+		orgID       string
+		status      int
+		tenant      string
+	}{
+		{name: "valid RSA token", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), status: http.StatusOK, tenant: "team-a"},
+		{name: "valid EC token", token: sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil)), status: http.StatusOK, tenant: "team-a"},
+		{name: "token overrides org ID header", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), orgID: "team-b", status: http.StatusOK, tenant: "team-a"},
+		{name: "no expiry", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": nil})), status: http.StatusUnauthorized},
+		{name: "expired", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), status: http.StatusUnauthorized},
+		{name: "signed by another key", token: sign(t, jwt.SigningMethodRS256, "rsa", otherKey, claims(nil)), status: http.StatusUnauthorized},
+		{name: "unknown key", token: sign(t, jwt.SigningMethodRS256, "other", otherKey, claims(nil)), status: http.StatusUnauthorized},
+		{name: "encryption key", token: sign(t, jwt.SigningMethodRS256, "enc", rsaKey, claims(nil)), status: http.StatusUnauthorized},
+		{name: "symmetric algorithm", token: sign(t, jwt.SigningMethodHS256, "rsa", []byte("secret"), claims(nil)), status: http.StatusUnauthorized},
+		{name: "unexpected issuer", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"})), status: http.StatusUnauthorized},
+		{name: "unexpected audience", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"aud": "grafana"})), status: http.StatusUnauthorized},
+		{name: "no tenant claim", token: sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(jwt.MapClaims{"tenant": nil})), status: http.StatusUnauthorized},
+		{name: "malformed", token: "not.a.token", status: http.StatusUnauthorized},
+		{name: "no token", orgID: "team-b", status: http.StatusUnauthorized},
+		{name: "no token with header allowed", allowHeader: true, orgID: "team-b", status: http.StatusOK, tenant: "team-b"},
+		{name: "no token nor header", allowHeader: true, status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := cfg
+			cfg.AllowOrgIDHeader = tc.allowHeader
+			var tenant string
+			h := NewMiddleware(cfg, middleware.AuthenticateUser).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var err error
+				tenant, err = user.ExtractOrgID(r.Context())
+				require.NoError(t, err)
+				require.Equal(t, tenant, r.Header.Get(user.OrgIDHeaderName))
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if tc.orgID != "" {
+				req.Header.Set(user.OrgIDHeaderName, tc.orgID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			require.Equal(t, tc.tenant, tenant)
+		})
+	}
+}
+
+func Test_keySet_Refetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv, fetches := newJWKSServer(t, rsaKey, ecKey)
+
+	keys := newKeySet(srv.URL, time.Hour, srv.Client())
+	_, err = keys.key("rsa")
+	require.NoError(t, err)
+	_, err = keys.key("ec")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fetches.Load())
+
+	// unknown keys trigger a single refetch per unknownKeyRefetchInterval.
+	keys.lastFetch = time.Now().Add(-unknownKeyRefetchInterval)
+	_, err = keys.key("other")
+	require.Error(t, err)
+	_, err = keys.key("other")
+	require.Error(t, err)
+	require.Equal(t, int32(2), fetches.Load())
+
+	// stale keys are refetched in the background.
+	keys.fetchedAt = time.Now().Add(-time.Hour)
+	keys.lastFetch = time.Now().Add(-staleRefetchInterval)
+	_, err = keys.key("rsa")
+	require.NoError(t, err)
+	waitFetch(keys)
+	require.Equal(t, int32(3), fetches.Load())
+
+	// the previous keys are kept when the JWKS can't be fetched.
+	srv.Close()
+	keys.fetchedAt = time.Now().Add(-time.Hour)
+	keys.lastFetch = time.Now().Add(-staleRefetchInterval)
+	_, err = keys.key("rsa")
+	require.NoError(t, err)
+	waitFetch(keys)
+	_, err = keys.key("rsa")
+	require.NoError(t, err)
+}
+
+// waitFetch waits for the fetch in flight of the key set to complete, if any.
+func waitFetch(keys *keySet) {
+	keys.mtx.Lock()
+	fetching := keys.fetching
+	keys.mtx.Unlock()
+	if fetching != nil {
+		<-fetching
+	}
+}
+
+func Test_keySet_Unreachable(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv, fetches := newJWKSServer(t, rsaKey, ecKey)
+
+	keys := newKeySet(srv.URL, time.Hour, srv.Client())
+	_, err = keys.key("rsa")
+	require.NoError(t, err)
+
+	// the identity provider hangs until released.
+	release := make(chan struct{})
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Inc()
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	defer close(release)
+	keys.url = down.URL
+
+	// the stale keys are served while they are refetched, which only happens once per staleRefetchInterval.
+	keys.mtx.Lock()
+	keys.fetchedAt = time.Now().Add(-time.Hour)
+	keys.lastFetch = time.Now().Add(-staleRefetchInterval)
+	keys.mtx.Unlock()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		_, err = keys.key("rsa")
+		require.NoError(t, err)
+	}
+	require.Less(t, time.Since(start).Milliseconds(), int64(time.Second/time.Millisecond))
+	require.Eventually(t, func() bool { return fetches.Load() == 2 }, time.Second, time.Millisecond)
+}
+
+func Test_Config_Validate(t *testing.T) {
+	require.NoError(t, (&Config{}).Validate())
+	require.Error(t, (&Config{Enabled: true, TenantClaim: "tenant", JWKSRefreshInterval: time.Hour}).Validate())
+	require.Error(t, (&Config{Enabled: true, JWKSURL: "https://idp.example.com/jwks", JWKSRefreshInterval: time.Hour}).Validate())
+	require.Error(t, (&Config{Enabled: true, JWKSURL: "https://idp.example.com/jwks", TenantClaim: "tenant"}).Validate())
+	require.NoError(t, (&Config{Enabled: true, JWKSURL: "https://idp.example.com/jwks", TenantClaim: "tenant", JWKSRefreshInterval: time.Hour}).Validate())
+}
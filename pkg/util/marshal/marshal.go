@@ -3,7 +3,10 @@
 package marshal
 
 import (
+	"bufio"
 	"io"
+	"sort"
+	"strconv"
 
 	"github.com/grafana/loki/pkg/logqlmodel"
 
@@ -30,6 +33,7 @@ func WriteQueryResponseJSON(v logqlmodel.Result, w io.Writer) error {
 			Result:     value,
 			Statistics: v.Statistics,
 		},
+		Warnings: v.Warnings,
 	}
 
 	return jsoniter.NewEncoder(w).Encode(q)
@@ -46,6 +50,17 @@ func WriteLabelResponseJSON(l logproto.LabelResponse, w io.Writer) error {
 	return jsoniter.NewEncoder(w).Encode(v1Response)
 }
 
+// WriteLabelCountsResponseJSON marshals the counts of the values of a label to v1 loghttp JSON
+// and then writes it to the provided io.Writer.
+func WriteLabelCountsResponseJSON(counts []loghttp.LabelValueCount, w io.Writer) error {
+	v1Response := loghttp.LabelCountsResponse{
+		Status: "success",
+		Data:   counts,
+	}
+
+	return jsoniter.NewEncoder(w).Encode(v1Response)
+}
+
 // WebsocketWriter knows how to write message to a websocket connection.
 type WebsocketWriter interface {
 	WriteMessage(int, []byte) error
@@ -80,6 +95,78 @@ func WriteSeriesResponseJSON(r logproto.SeriesResponse, w io.Writer) error {
 	return jsoniter.NewEncoder(w).Encode(adapter)
 }
 
+// ndjsonFlushLines is the number of lines after which WriteStreamsNDJSON flushes its buffer.
+const ndjsonFlushLines = 100
+
+// ndjsonEntry is a single line of a NDJSON streams response.
+type ndjsonEntry struct {
+	Stream    loghttp.LabelSet `json:"stream"`
+	Timestamp string           `json:"ts"`
+	Line      string           `json:"line"`
+}
+
+// WriteStreamsNDJSON writes the entries of streams to the provided io.Writer as newline delimited JSON,
+// one entry per line ordered by timestamp in the given direction. The output is flushed every
+// ndjsonFlushLines lines so that readers can process it while it is written.
+func WriteStreamsNDJSON(streams []logproto.Stream, direction logproto.Direction, w io.Writer) error {
+	type streamEntry struct {
+		labels loghttp.LabelSet
+		entry  logproto.Entry
+	}
+	var entries []streamEntry
+	for _, s := range streams {
+		labels, err := NewLabelSet(s.Labels)
+		if err != nil {
+			return err
+		}
+		for _, e := range s.Entries {
+			entries = append(entries, streamEntry{labels: labels, entry: e})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if direction == logproto.BACKWARD {
+			return entries[i].entry.Timestamp.After(entries[j].entry.Timestamp)
+		}
+		return entries[i].entry.Timestamp.Before(entries[j].entry.Timestamp)
+	})
+
+	buf := bufio.NewWriter(w)
+	enc := jsoniter.NewEncoder(buf)
+	for i, e := range entries {
+		if err := enc.Encode(ndjsonEntry{
+			Stream:    e.labels,
+			Timestamp: strconv.FormatInt(e.entry.Timestamp.UnixNano(), 10),
+			Line:      e.entry.Line,
+		}); err != nil {
+			return err
+		}
+		if (i+1)%ndjsonFlushLines == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return buf.Flush()
+}
+
+// WriteSeriesCountResponseJSON writes the number of series matched by a series request as v1 loghttp JSON
+// to the provided io.Writer, for clients which don't need the label sets themselves.
+func WriteSeriesCountResponseJSON(count int, w io.Writer) error {
+	return jsoniter.NewEncoder(w).Encode(seriesCountResponseAdapter{
+		Status: "success",
+		Data:   seriesCount{Count: count},
+	})
+}
+
+type seriesCountResponseAdapter struct {
+	Status string      `json:"status"`
+	Data   seriesCount `json:"data"`
+}
+
+type seriesCount struct {
+	Count int `json:"count"`
+}
+
 // This struct exists primarily because we can't specify a repeated map in proto v3.
 // Otherwise, we'd use that + gogoproto.jsontag to avoid this layer of indirection
 type seriesResponseAdapter struct {
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+type flusherCtxKey struct{}
+
+// NewFlusherMiddleware creates a middleware which keeps the flusher of the response writer in the request context,
+// so that the handlers streaming their responses can flush them. It must wrap the default middlewares of the
+// server, as some of their response writers don't implement http.Flusher, e.g. the logging one.
+func NewFlusherMiddleware() middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if flusher, ok := w.(http.Flusher); ok {
+				req = req.WithContext(context.WithValue(req.Context(), flusherCtxKey{}, flusher))
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+}
+
+// Flush sends what was written to w to the client: it flushes w when it implements http.Flusher, e.g. to flush
+// the compressed data, then the response writer of the server kept by the flusher middleware.
+func Flush(w http.ResponseWriter, req *http.Request) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := req.Context().Value(flusherCtxKey{}).(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	dskit_flagext "github.com/grafana/dskit/flagext"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
@@ -34,6 +35,12 @@ const (
 	// is used to keep track of the current number of healthy distributor replicas.
 	GlobalIngestionRateStrategy = "global"
 
+	// QuerySplitsModeReject fails queries which would be split into more than the maximum number of sub-queries.
+	QuerySplitsModeReject = "reject"
+	// QuerySplitsModeWiden widens the split interval of queries which would be split into more than the
+	// maximum number of sub-queries, until the limit is met.
+	QuerySplitsModeWiden = "widen"
+
 	bytesInMB = 1048576
 
 	defaultPerStreamRateLimit  = 3 << 20 // 3MB
@@ -69,6 +76,7 @@ type Limits struct {
 	// Querier enforced limits.
 	MaxChunksPerQuery          int            `yaml:"max_chunks_per_query" json:"max_chunks_per_query"`
 	MaxQuerySeries             int            `yaml:"max_query_series" json:"max_query_series"`
+	MaxStreamsMatchedPerQuery  int            `yaml:"max_streams_matched_per_query" json:"max_streams_matched_per_query"`
 	MaxQueryLookback           model.Duration `yaml:"max_query_lookback" json:"max_query_lookback"`
 	MaxQueryLength             model.Duration `yaml:"max_query_length" json:"max_query_length"`
 	MaxQueryParallelism        int            `yaml:"max_query_parallelism" json:"max_query_parallelism"`
@@ -80,8 +88,23 @@ type Limits struct {
 	MaxQueriersPerTenant       int            `yaml:"max_queriers_per_tenant" json:"max_queriers_per_tenant"`
 
 	// Query frontend enforced limits. The default is actually parameterized by the queryrange config.
-	QuerySplitDuration  model.Duration `yaml:"split_queries_by_interval" json:"split_queries_by_interval"`
-	MinShardingLookback model.Duration `yaml:"min_sharding_lookback" json:"min_sharding_lookback"`
+	QuerySplitDuration    model.Duration `yaml:"split_queries_by_interval" json:"split_queries_by_interval"`
+	MinShardingLookback   model.Duration `yaml:"min_sharding_lookback" json:"min_sharding_lookback"`
+	QueryCacheKeyJitter   bool           `yaml:"query_cache_key_jitter" json:"query_cache_key_jitter"`
+	MaxQuerySplits        int            `yaml:"max_query_splits" json:"max_query_splits"`
+	MaxQuerySplitsMode    string         `yaml:"max_query_splits_mode" json:"max_query_splits_mode"`
+	BlockedQueryLabels    []string       `yaml:"blocked_query_labels,omitempty" json:"blocked_query_labels,omitempty"`
+	BlockedQueryFunctions []string       `yaml:"blocked_query_functions,omitempty" json:"blocked_query_functions,omitempty"`
+	AllowPartialResults   bool           `yaml:"allow_partial_results" json:"allow_partial_results"`
+
+	MaxConcurrentMetadataQueries int              `yaml:"max_concurrent_metadata_queries" json:"max_concurrent_metadata_queries"`
+	MaxQueryBytes                flagext.ByteSize `yaml:"max_query_bytes" json:"max_query_bytes"`
+	ResultsCacheTTL              model.Duration   `yaml:"results_cache_ttl" json:"results_cache_ttl"`
+	AutoStep                     bool             `yaml:"auto_step" json:"auto_step"`
+	ExposeLimitsHeaders          bool             `yaml:"expose_limits_headers" json:"expose_limits_headers"`
+
+	MaxConcurrentQueriesPerDashboard int  `yaml:"max_concurrent_queries_per_dashboard" json:"max_concurrent_queries_per_dashboard"`
+	ShardingEnabled                  bool `yaml:"sharding_enabled" json:"sharding_enabled"`
 
 	// Ruler defaults and limits.
 	RulerEvaluationDelay        model.Duration `yaml:"ruler_evaluation_delay_duration" json:"ruler_evaluation_delay_duration"`
@@ -155,7 +178,8 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 
 	_ = l.MaxQueryLength.Set("721h")
 	f.Var(&l.MaxQueryLength, "store.max-query-length", "Limit to length of chunk store queries, 0 to disable.")
-	f.IntVar(&l.MaxQuerySeries, "querier.max-query-series", 500, "Limit the maximum of unique series returned by a metric query. When the limit is reached an error is returned.")
+	f.IntVar(&l.MaxQuerySeries, "querier.max-query-series", 500, "Limit the maximum of unique series returned by a metric query, and by a series query once the responses of its splits are merged. When the limit is reached an error is returned.")
+	f.IntVar(&l.MaxStreamsMatchedPerQuery, "querier.max-streams-matched-per-query", 0, "Limit the maximum of unique streams returned by a log or series query. When the limit is reached an error is returned. 0 to disable.")
 
 	_ = l.MaxQueryLookback.Set("0s")
 	f.Var(&l.MaxQueryLookback, "querier.max-query-lookback", "Limit how long back data (series and metadata) can be queried, up until <lookback> duration ago. This limit is enforced in the query-frontend, querier and ruler. If the requested time range is outside the allowed range, the request will not fail but will be manipulated to only query data within the allowed time range. 0 to disable.")
@@ -167,6 +191,21 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	_ = l.MinShardingLookback.Set("0s")
 	f.Var(&l.MinShardingLookback, "frontend.min-sharding-lookback", "Limit the sharding time range.Queries with time range that fall between now and now minus the sharding lookback are not sharded. 0 to disable.")
 
+	f.BoolVar(&l.QueryCacheKeyJitter, "frontend.query-cache-key-jitter", false, "Offset the split boundaries and results cache key time buckets by a per-tenant amount, so that the latest bucket of every tenant isn't recomputed at the same time. Ignored with the index_tables split alignment.")
+
+	f.IntVar(&l.MaxQuerySplits, "frontend.max-query-splits", 0, "Maximum number of sub-queries a single query can be split into by time. 0 to disable.")
+	f.StringVar(&l.MaxQuerySplitsMode, "frontend.max-query-splits-mode", QuerySplitsModeReject, fmt.Sprintf("What to do with queries exceeding the maximum number of splits: %q fails the query, %q widens the split interval until the limit is met.", QuerySplitsModeReject, QuerySplitsModeWiden))
+	f.Var((*dskit_flagext.StringSliceCSV)(&l.BlockedQueryLabels), "frontend.blocked-query-labels", "Comma separated list of label names which can't be used in series matchers, whose values can't be queried and which are removed from label names responses.")
+	f.Var((*dskit_flagext.StringSliceCSV)(&l.BlockedQueryFunctions), "frontend.blocked-query-functions", "Comma separated list of LogQL functions which can't be used in queries, e.g. ip,quantile_over_time,label_replace. Range and vector aggregations, label_replace, the ip filters and the unwrap conversion functions can be blocked.")
+	f.BoolVar(&l.AllowPartialResults, "frontend.allow-partial-results", false, "Return the merged results of the sub-queries which succeeded with a 206 status code when only some of the sub-queries of a split query fail, instead of failing the query.")
+	f.IntVar(&l.MaxConcurrentMetadataQueries, "frontend.max-concurrent-metadata-queries", 0, "Maximum number of series and of labels queries a tenant can run concurrently in a query frontend, each kind is capped separately. Queries above the limit are rejected with a 429. 0 to disable.")
+	f.Var(&l.MaxQueryBytes, "frontend.max-query-bytes", "Maximum number of bytes a split query can process across its sub-queries, i.e. 100gb. The remaining sub-queries are aborted and the query fails once it is exceeded. Default (0) means unlimited.")
+	f.Var(&l.ResultsCacheTTL, "frontend.results-cache-ttl", "Time to live of the results cache entries of the tenant's queries, used as their expiration by the fifo cache, memcached and redis. 0 to use the expiration of the results cache.")
+	f.BoolVar(&l.AutoStep, "frontend.auto-step", false, "Increase the step of metric range queries exceeding 11,000 points per series to the smallest one within it, with a warning on the response, instead of rejecting them.")
+	f.BoolVar(&l.ExposeLimitsHeaders, "frontend.expose-limits-headers", false, "Set the effective split interval, max entries, max query lookback and max query parallelism of the tenant's queries as X-Loki-Limit-* headers on their responses, to debug them.")
+	f.IntVar(&l.MaxConcurrentQueriesPerDashboard, "frontend.max-concurrent-queries-per-dashboard", 0, "Maximum number of queries with the same dashboard query tag, e.g. X-Query-Tags: dashboard=<uid>, a tenant can run concurrently in a query frontend. Queries above the limit are rejected with a 429. 0 to disable.")
+	f.BoolVar(&l.ShardingEnabled, "frontend.sharding-enabled", true, "Shard the tenant's metric and log queries when query sharding is enabled by -querier.parallelise-shardable-queries. Set to false to send them unsharded, e.g. when sharded aggregations differ too much from unsharded ones in floating point precision.")
+
 	_ = l.MaxCacheFreshness.Set("1m")
 	f.Var(&l.MaxCacheFreshness, "frontend.max-cache-freshness", "Most recent allowed cacheable result per-tenant, to prevent caching very recent results that might still be in flux.")
 
@@ -221,6 +260,11 @@ func (l *Limits) Validate() error {
 			l.StreamRetention[i].Matchers = matchers
 		}
 	}
+	switch l.MaxQuerySplitsMode {
+	case "", QuerySplitsModeReject, QuerySplitsModeWiden:
+	default:
+		return fmt.Errorf("invalid max query splits mode %q, supported values are %q and %q", l.MaxQuerySplitsMode, QuerySplitsModeReject, QuerySplitsModeWiden)
+	}
 	return nil
 }
 
@@ -349,6 +393,11 @@ func (o *Overrides) MaxQuerySeries(userID string) int {
 	return o.getOverridesForUser(userID).MaxQuerySeries
 }
 
+// MaxStreamsMatchedPerQuery returns the limit of unique streams returned by log and series queries.
+func (o *Overrides) MaxStreamsMatchedPerQuery(userID string) int {
+	return o.getOverridesForUser(userID).MaxStreamsMatchedPerQuery
+}
+
 // MaxQueriersPerUser returns the maximum number of queriers that can handle requests for this user.
 func (o *Overrides) MaxQueriersPerUser(userID string) int {
 	return o.getOverridesForUser(userID).MaxQueriersPerTenant
@@ -380,6 +429,71 @@ func (o *Overrides) MinShardingLookback(userID string) time.Duration {
 	return time.Duration(o.getOverridesForUser(userID).MinShardingLookback)
 }
 
+// QueryCacheKeyJitter returns whether the results cache key time buckets are offset per tenant.
+func (o *Overrides) QueryCacheKeyJitter(userID string) bool {
+	return o.getOverridesForUser(userID).QueryCacheKeyJitter
+}
+
+// MaxQuerySplits returns the maximum number of sub-queries a query can be split into by time.
+func (o *Overrides) MaxQuerySplits(userID string) int {
+	return o.getOverridesForUser(userID).MaxQuerySplits
+}
+
+// MaxQuerySplitsMode returns how queries exceeding MaxQuerySplits are handled.
+func (o *Overrides) MaxQuerySplitsMode(userID string) string {
+	return o.getOverridesForUser(userID).MaxQuerySplitsMode
+}
+
+// BlockedQueryLabels returns the label names the tenant is not allowed to query.
+func (o *Overrides) BlockedQueryLabels(userID string) []string {
+	return o.getOverridesForUser(userID).BlockedQueryLabels
+}
+
+// BlockedQueryFunctions returns the LogQL functions the tenant is not allowed to use in queries.
+func (o *Overrides) BlockedQueryFunctions(userID string) []string {
+	return o.getOverridesForUser(userID).BlockedQueryFunctions
+}
+
+// AllowPartialResults returns whether split queries return partial results when some of their sub-queries fail.
+func (o *Overrides) AllowPartialResults(userID string) bool {
+	return o.getOverridesForUser(userID).AllowPartialResults
+}
+
+// MaxConcurrentMetadataQueries returns the maximum number of series and of labels queries a tenant can run concurrently.
+func (o *Overrides) MaxConcurrentMetadataQueries(userID string) int {
+	return o.getOverridesForUser(userID).MaxConcurrentMetadataQueries
+}
+
+// MaxQueryBytes returns the maximum number of bytes a split query can process across its sub-queries.
+func (o *Overrides) MaxQueryBytes(userID string) int {
+	return o.getOverridesForUser(userID).MaxQueryBytes.Val()
+}
+
+// ResultsCacheTTL returns the time to live of the results cache entries of the tenant, or 0 for the global one.
+func (o *Overrides) ResultsCacheTTL(userID string) time.Duration {
+	return time.Duration(o.getOverridesForUser(userID).ResultsCacheTTL)
+}
+
+// AutoStep returns whether the step of range queries exceeding the maximum number of points is increased instead of rejecting them.
+func (o *Overrides) AutoStep(userID string) bool {
+	return o.getOverridesForUser(userID).AutoStep
+}
+
+// ExposeLimitsHeaders returns whether the effective limits of the tenant's queries are set as headers on their responses.
+func (o *Overrides) ExposeLimitsHeaders(userID string) bool {
+	return o.getOverridesForUser(userID).ExposeLimitsHeaders
+}
+
+// MaxConcurrentQueriesPerDashboard returns the maximum number of queries of a dashboard the tenant can run concurrently.
+func (o *Overrides) MaxConcurrentQueriesPerDashboard(userID string) int {
+	return o.getOverridesForUser(userID).MaxConcurrentQueriesPerDashboard
+}
+
+// ShardingEnabled returns whether the tenant's queries are sharded when query sharding is enabled.
+func (o *Overrides) ShardingEnabled(userID string) bool {
+	return o.getOverridesForUser(userID).ShardingEnabled
+}
+
 // QuerySplitDuration returns the tenant specific splitby interval applied in the query frontend.
 func (o *Overrides) QuerySplitDuration(userID string) time.Duration {
 	return time.Duration(o.getOverridesForUser(userID).QuerySplitDuration)